@@ -0,0 +1,689 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: api/conversion/v1/conversion.proto
+
+package conversion
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Job_State int32
+
+const (
+	Job_UNKNOWN   Job_State = 0
+	Job_RUNNING   Job_State = 1
+	Job_SUCCEEDED Job_State = 2
+	Job_FAILED    Job_State = 3
+	Job_CANCELED  Job_State = 4
+)
+
+// Enum value maps for Job_State.
+var (
+	Job_State_name = map[int32]string{
+		0: "UNKNOWN",
+		1: "RUNNING",
+		2: "SUCCEEDED",
+		3: "FAILED",
+		4: "CANCELED",
+	}
+	Job_State_value = map[string]int32{
+		"UNKNOWN":   0,
+		"RUNNING":   1,
+		"SUCCEEDED": 2,
+		"FAILED":    3,
+		"CANCELED":  4,
+	}
+)
+
+func (x Job_State) Enum() *Job_State {
+	p := new(Job_State)
+	*p = x
+	return p
+}
+
+func (x Job_State) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Job_State) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_conversion_v1_conversion_proto_enumTypes[0].Descriptor()
+}
+
+func (Job_State) Type() protoreflect.EnumType {
+	return &file_api_conversion_v1_conversion_proto_enumTypes[0]
+}
+
+func (x Job_State) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Job_State.Descriptor instead.
+func (Job_State) EnumDescriptor() ([]byte, []int) {
+	return file_api_conversion_v1_conversion_proto_rawDescGZIP(), []int{4, 0}
+}
+
+type ConvertImageRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Source is the name of the image to convert, which must exist.
+	Source string `protobuf:"bytes,1,opt,name=source,proto3" json:"source,omitempty"`
+	// Target is the name of the converted image.
+	Target string `protobuf:"bytes,2,opt,name=target,proto3" json:"target,omitempty"`
+	// Platforms are the platforms to convert, the default platform if empty.
+	Platforms []string `protobuf:"bytes,3,rep,name=platforms,proto3" json:"platforms,omitempty"`
+	// AllPlatforms converts all the platforms of the source.
+	AllPlatforms bool `protobuf:"varint,4,opt,name=all_platforms,json=allPlatforms,proto3" json:"all_platforms,omitempty"`
+	// Compressors are the compressors of mkfs.erofs, e.g. "lz4hc,12".
+	Compressors string `protobuf:"bytes,5,opt,name=compressors,proto3" json:"compressors,omitempty"`
+	// Features are the EROFS features, as ctr-erofs --erofs-features.
+	Features string `protobuf:"bytes,6,opt,name=features,proto3" json:"features,omitempty"`
+	// MkfsOptions are extra compression and chunk options of mkfs.erofs.
+	MkfsOptions string `protobuf:"bytes,7,opt,name=mkfs_options,json=mkfsOptions,proto3" json:"mkfs_options,omitempty"`
+	// Verity annotates the layers with their fs-verity digests.
+	Verity        bool `protobuf:"varint,8,opt,name=verity,proto3" json:"verity,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConvertImageRequest) Reset() {
+	*x = ConvertImageRequest{}
+	mi := &file_api_conversion_v1_conversion_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConvertImageRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConvertImageRequest) ProtoMessage() {}
+
+func (x *ConvertImageRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_conversion_v1_conversion_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConvertImageRequest.ProtoReflect.Descriptor instead.
+func (*ConvertImageRequest) Descriptor() ([]byte, []int) {
+	return file_api_conversion_v1_conversion_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ConvertImageRequest) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *ConvertImageRequest) GetTarget() string {
+	if x != nil {
+		return x.Target
+	}
+	return ""
+}
+
+func (x *ConvertImageRequest) GetPlatforms() []string {
+	if x != nil {
+		return x.Platforms
+	}
+	return nil
+}
+
+func (x *ConvertImageRequest) GetAllPlatforms() bool {
+	if x != nil {
+		return x.AllPlatforms
+	}
+	return false
+}
+
+func (x *ConvertImageRequest) GetCompressors() string {
+	if x != nil {
+		return x.Compressors
+	}
+	return ""
+}
+
+func (x *ConvertImageRequest) GetFeatures() string {
+	if x != nil {
+		return x.Features
+	}
+	return ""
+}
+
+func (x *ConvertImageRequest) GetMkfsOptions() string {
+	if x != nil {
+		return x.MkfsOptions
+	}
+	return ""
+}
+
+func (x *ConvertImageRequest) GetVerity() bool {
+	if x != nil {
+		return x.Verity
+	}
+	return false
+}
+
+type ConvertImageResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// ID identifies the conversion.
+	Id            string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConvertImageResponse) Reset() {
+	*x = ConvertImageResponse{}
+	mi := &file_api_conversion_v1_conversion_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConvertImageResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConvertImageResponse) ProtoMessage() {}
+
+func (x *ConvertImageResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_conversion_v1_conversion_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConvertImageResponse.ProtoReflect.Descriptor instead.
+func (*ConvertImageResponse) Descriptor() ([]byte, []int) {
+	return file_api_conversion_v1_conversion_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ConvertImageResponse) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+type StatusRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// ID is the conversion to return, all if empty.
+	Id            string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatusRequest) Reset() {
+	*x = StatusRequest{}
+	mi := &file_api_conversion_v1_conversion_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatusRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatusRequest) ProtoMessage() {}
+
+func (x *StatusRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_conversion_v1_conversion_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatusRequest.ProtoReflect.Descriptor instead.
+func (*StatusRequest) Descriptor() ([]byte, []int) {
+	return file_api_conversion_v1_conversion_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *StatusRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+type StatusResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Jobs          []*Job                 `protobuf:"bytes,1,rep,name=jobs,proto3" json:"jobs,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatusResponse) Reset() {
+	*x = StatusResponse{}
+	mi := &file_api_conversion_v1_conversion_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatusResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatusResponse) ProtoMessage() {}
+
+func (x *StatusResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_conversion_v1_conversion_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatusResponse.ProtoReflect.Descriptor instead.
+func (*StatusResponse) Descriptor() ([]byte, []int) {
+	return file_api_conversion_v1_conversion_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *StatusResponse) GetJobs() []*Job {
+	if x != nil {
+		return x.Jobs
+	}
+	return nil
+}
+
+type Job struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Id     string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Source string                 `protobuf:"bytes,2,opt,name=source,proto3" json:"source,omitempty"`
+	Target string                 `protobuf:"bytes,3,opt,name=target,proto3" json:"target,omitempty"`
+	State  Job_State              `protobuf:"varint,4,opt,name=state,proto3,enum=erofs.v1.Job_State" json:"state,omitempty"`
+	// Error is the error of a failed conversion.
+	Error      string                 `protobuf:"bytes,5,opt,name=error,proto3" json:"error,omitempty"`
+	StartedAt  *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=started_at,json=startedAt,proto3" json:"started_at,omitempty"`
+	FinishedAt *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=finished_at,json=finishedAt,proto3" json:"finished_at,omitempty"`
+	// Digest is the digest of the converted image, once succeeded.
+	Digest string `protobuf:"bytes,8,opt,name=digest,proto3" json:"digest,omitempty"`
+	// Layers are the layer conversions, in the order they started.
+	Layers        []*Layer `protobuf:"bytes,9,rep,name=layers,proto3" json:"layers,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Job) Reset() {
+	*x = Job{}
+	mi := &file_api_conversion_v1_conversion_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Job) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Job) ProtoMessage() {}
+
+func (x *Job) ProtoReflect() protoreflect.Message {
+	mi := &file_api_conversion_v1_conversion_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Job.ProtoReflect.Descriptor instead.
+func (*Job) Descriptor() ([]byte, []int) {
+	return file_api_conversion_v1_conversion_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Job) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Job) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *Job) GetTarget() string {
+	if x != nil {
+		return x.Target
+	}
+	return ""
+}
+
+func (x *Job) GetState() Job_State {
+	if x != nil {
+		return x.State
+	}
+	return Job_UNKNOWN
+}
+
+func (x *Job) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *Job) GetStartedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.StartedAt
+	}
+	return nil
+}
+
+func (x *Job) GetFinishedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.FinishedAt
+	}
+	return nil
+}
+
+func (x *Job) GetDigest() string {
+	if x != nil {
+		return x.Digest
+	}
+	return ""
+}
+
+func (x *Job) GetLayers() []*Layer {
+	if x != nil {
+		return x.Layers
+	}
+	return nil
+}
+
+type Layer struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Source is the digest of the source layer.
+	Source string `protobuf:"bytes,1,opt,name=source,proto3" json:"source,omitempty"`
+	// Status is the progress status, e.g. "converting" or "done".
+	Status string `protobuf:"bytes,2,opt,name=status,proto3" json:"status,omitempty"`
+	// Offset and Total are the bytes of the uncompressed tar stream read so
+	// far, and in total.
+	Offset int64 `protobuf:"varint,3,opt,name=offset,proto3" json:"offset,omitempty"`
+	Total  int64 `protobuf:"varint,4,opt,name=total,proto3" json:"total,omitempty"`
+	// Digest is the digest of the EROFS layer, once done.
+	Digest        string `protobuf:"bytes,5,opt,name=digest,proto3" json:"digest,omitempty"`
+	Error         string `protobuf:"bytes,6,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Layer) Reset() {
+	*x = Layer{}
+	mi := &file_api_conversion_v1_conversion_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Layer) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Layer) ProtoMessage() {}
+
+func (x *Layer) ProtoReflect() protoreflect.Message {
+	mi := &file_api_conversion_v1_conversion_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Layer.ProtoReflect.Descriptor instead.
+func (*Layer) Descriptor() ([]byte, []int) {
+	return file_api_conversion_v1_conversion_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Layer) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *Layer) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *Layer) GetOffset() int64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *Layer) GetTotal() int64 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *Layer) GetDigest() string {
+	if x != nil {
+		return x.Digest
+	}
+	return ""
+}
+
+func (x *Layer) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type CancelRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CancelRequest) Reset() {
+	*x = CancelRequest{}
+	mi := &file_api_conversion_v1_conversion_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CancelRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CancelRequest) ProtoMessage() {}
+
+func (x *CancelRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_conversion_v1_conversion_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CancelRequest.ProtoReflect.Descriptor instead.
+func (*CancelRequest) Descriptor() ([]byte, []int) {
+	return file_api_conversion_v1_conversion_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *CancelRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+var File_api_conversion_v1_conversion_proto protoreflect.FileDescriptor
+
+const file_api_conversion_v1_conversion_proto_rawDesc = "" +
+	"\n" +
+	"\"api/conversion/v1/conversion.proto\x12\berofs.v1\x1a\x1bgoogle/protobuf/empty.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"\x81\x02\n" +
+	"\x13ConvertImageRequest\x12\x16\n" +
+	"\x06source\x18\x01 \x01(\tR\x06source\x12\x16\n" +
+	"\x06target\x18\x02 \x01(\tR\x06target\x12\x1c\n" +
+	"\tplatforms\x18\x03 \x03(\tR\tplatforms\x12#\n" +
+	"\rall_platforms\x18\x04 \x01(\bR\fallPlatforms\x12 \n" +
+	"\vcompressors\x18\x05 \x01(\tR\vcompressors\x12\x1a\n" +
+	"\bfeatures\x18\x06 \x01(\tR\bfeatures\x12!\n" +
+	"\fmkfs_options\x18\a \x01(\tR\vmkfsOptions\x12\x16\n" +
+	"\x06verity\x18\b \x01(\bR\x06verity\"&\n" +
+	"\x14ConvertImageResponse\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\"\x1f\n" +
+	"\rStatusRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\"3\n" +
+	"\x0eStatusResponse\x12!\n" +
+	"\x04jobs\x18\x01 \x03(\v2\r.erofs.v1.JobR\x04jobs\"\x8b\x03\n" +
+	"\x03Job\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x16\n" +
+	"\x06source\x18\x02 \x01(\tR\x06source\x12\x16\n" +
+	"\x06target\x18\x03 \x01(\tR\x06target\x12)\n" +
+	"\x05state\x18\x04 \x01(\x0e2\x13.erofs.v1.Job.StateR\x05state\x12\x14\n" +
+	"\x05error\x18\x05 \x01(\tR\x05error\x129\n" +
+	"\n" +
+	"started_at\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\tstartedAt\x12;\n" +
+	"\vfinished_at\x18\a \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"finishedAt\x12\x16\n" +
+	"\x06digest\x18\b \x01(\tR\x06digest\x12'\n" +
+	"\x06layers\x18\t \x03(\v2\x0f.erofs.v1.LayerR\x06layers\"J\n" +
+	"\x05State\x12\v\n" +
+	"\aUNKNOWN\x10\x00\x12\v\n" +
+	"\aRUNNING\x10\x01\x12\r\n" +
+	"\tSUCCEEDED\x10\x02\x12\n" +
+	"\n" +
+	"\x06FAILED\x10\x03\x12\f\n" +
+	"\bCANCELED\x10\x04\"\x93\x01\n" +
+	"\x05Layer\x12\x16\n" +
+	"\x06source\x18\x01 \x01(\tR\x06source\x12\x16\n" +
+	"\x06status\x18\x02 \x01(\tR\x06status\x12\x16\n" +
+	"\x06offset\x18\x03 \x01(\x03R\x06offset\x12\x14\n" +
+	"\x05total\x18\x04 \x01(\x03R\x05total\x12\x16\n" +
+	"\x06digest\x18\x05 \x01(\tR\x06digest\x12\x14\n" +
+	"\x05error\x18\x06 \x01(\tR\x05error\"\x1f\n" +
+	"\rCancelRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id2\xd3\x01\n" +
+	"\n" +
+	"Conversion\x12M\n" +
+	"\fConvertImage\x12\x1d.erofs.v1.ConvertImageRequest\x1a\x1e.erofs.v1.ConvertImageResponse\x12;\n" +
+	"\x06Status\x12\x17.erofs.v1.StatusRequest\x1a\x18.erofs.v1.StatusResponse\x129\n" +
+	"\x06Cancel\x12\x17.erofs.v1.CancelRequest\x1a\x16.google.protobuf.EmptyBGZEgithub.com/erofs/erofs-container-toolkit/api/conversion/v1;conversionb\x06proto3"
+
+var (
+	file_api_conversion_v1_conversion_proto_rawDescOnce sync.Once
+	file_api_conversion_v1_conversion_proto_rawDescData []byte
+)
+
+func file_api_conversion_v1_conversion_proto_rawDescGZIP() []byte {
+	file_api_conversion_v1_conversion_proto_rawDescOnce.Do(func() {
+		file_api_conversion_v1_conversion_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_api_conversion_v1_conversion_proto_rawDesc), len(file_api_conversion_v1_conversion_proto_rawDesc)))
+	})
+	return file_api_conversion_v1_conversion_proto_rawDescData
+}
+
+var file_api_conversion_v1_conversion_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_api_conversion_v1_conversion_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_api_conversion_v1_conversion_proto_goTypes = []any{
+	(Job_State)(0),                // 0: erofs.v1.Job.State
+	(*ConvertImageRequest)(nil),   // 1: erofs.v1.ConvertImageRequest
+	(*ConvertImageResponse)(nil),  // 2: erofs.v1.ConvertImageResponse
+	(*StatusRequest)(nil),         // 3: erofs.v1.StatusRequest
+	(*StatusResponse)(nil),        // 4: erofs.v1.StatusResponse
+	(*Job)(nil),                   // 5: erofs.v1.Job
+	(*Layer)(nil),                 // 6: erofs.v1.Layer
+	(*CancelRequest)(nil),         // 7: erofs.v1.CancelRequest
+	(*timestamppb.Timestamp)(nil), // 8: google.protobuf.Timestamp
+	(*emptypb.Empty)(nil),         // 9: google.protobuf.Empty
+}
+var file_api_conversion_v1_conversion_proto_depIdxs = []int32{
+	5, // 0: erofs.v1.StatusResponse.jobs:type_name -> erofs.v1.Job
+	0, // 1: erofs.v1.Job.state:type_name -> erofs.v1.Job.State
+	8, // 2: erofs.v1.Job.started_at:type_name -> google.protobuf.Timestamp
+	8, // 3: erofs.v1.Job.finished_at:type_name -> google.protobuf.Timestamp
+	6, // 4: erofs.v1.Job.layers:type_name -> erofs.v1.Layer
+	1, // 5: erofs.v1.Conversion.ConvertImage:input_type -> erofs.v1.ConvertImageRequest
+	3, // 6: erofs.v1.Conversion.Status:input_type -> erofs.v1.StatusRequest
+	7, // 7: erofs.v1.Conversion.Cancel:input_type -> erofs.v1.CancelRequest
+	2, // 8: erofs.v1.Conversion.ConvertImage:output_type -> erofs.v1.ConvertImageResponse
+	4, // 9: erofs.v1.Conversion.Status:output_type -> erofs.v1.StatusResponse
+	9, // 10: erofs.v1.Conversion.Cancel:output_type -> google.protobuf.Empty
+	8, // [8:11] is the sub-list for method output_type
+	5, // [5:8] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
+}
+
+func init() { file_api_conversion_v1_conversion_proto_init() }
+func file_api_conversion_v1_conversion_proto_init() {
+	if File_api_conversion_v1_conversion_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_api_conversion_v1_conversion_proto_rawDesc), len(file_api_conversion_v1_conversion_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   7,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_api_conversion_v1_conversion_proto_goTypes,
+		DependencyIndexes: file_api_conversion_v1_conversion_proto_depIdxs,
+		EnumInfos:         file_api_conversion_v1_conversion_proto_enumTypes,
+		MessageInfos:      file_api_conversion_v1_conversion_proto_msgTypes,
+	}.Build()
+	File_api_conversion_v1_conversion_proto = out.File
+	file_api_conversion_v1_conversion_proto_goTypes = nil
+	file_api_conversion_v1_conversion_proto_depIdxs = nil
+}
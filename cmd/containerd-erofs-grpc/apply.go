@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/v2/core/diff"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// upperDiffer unpacks the tar layers applied on top of the changes of an active
+// snapshot into its upper directory, which the EROFS snapshotter converts when
+// committed, instead of converting them to a layer.erofs which would replace
+// the changes.  The layers applied to an empty snapshot, as when pulling, are
+// still converted.
+type upperDiffer struct {
+	differ
+	upper diff.Applier
+}
+
+func (d upperDiffer) Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount, opts ...diff.ApplyOpt) (ocispec.Descriptor, error) {
+	layer := layerPath(mounts)
+	if layer == "" || !images.IsLayerType(desc.MediaType) {
+		return d.differ.Apply(ctx, desc, mounts, opts...)
+	}
+	if _, err := os.Stat(layer); err == nil {
+		return ocispec.Descriptor{}, fmt.Errorf("a layer was already applied to %s, apply %s to a new snapshot: %w", filepath.Dir(layer), desc.Digest, errdefs.ErrFailedPrecondition)
+	}
+	entries, err := os.ReadDir(filepath.Join(filepath.Dir(layer), "fs"))
+	if err != nil || len(entries) == 0 {
+		return d.differ.Apply(ctx, desc, mounts, opts...)
+	}
+	return d.upper.Apply(ctx, desc, mounts, opts...)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/v2/core/events"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/containerd/typeurl/v2"
+	"github.com/distribution/reference"
+	conversionapi "github.com/erofs/erofs-container-toolkit/api/conversion/v1"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	"github.com/opencontainers/go-digest"
+)
+
+const defaultAutoConversionSuffix = "-erofs"
+
+type autoConversionConfig struct {
+	// Enable converts the images created or updated in containerd, e.g.
+	// pulled, to EROFS
+	Enable bool `toml:"enable"`
+	// Namespaces are the namespaces of the images converted, all if empty
+	Namespaces []string `toml:"namespaces"`
+	// Labels are the labels the images converted must have, with any value
+	// if empty
+	Labels map[string]string `toml:"labels"`
+	// Suffix is appended to the tag of the converted images,
+	// defaultAutoConversionSuffix if empty
+	Suffix string `toml:"suffix"`
+
+	Compressors  string   `toml:"compressors"`
+	Features     string   `toml:"features"`
+	MkfsOptions  string   `toml:"mkfs_options"`
+	Verity       bool     `toml:"verity"`
+	Platforms    []string `toml:"platforms"`
+	AllPlatforms bool     `toml:"all_platforms"`
+}
+
+// autoConverter converts the images created or updated in containerd, as
+// told by its events, with the conversion service.  The events sent while
+// containerd isn't reachable are missed.  Its configuration is replaced on
+// reload.
+type autoConverter struct {
+	clients    *clientManager
+	conversion *conversionService
+	config     atomic.Pointer[autoConversionConfig]
+}
+
+func newAutoConverter(clients *clientManager, conversion *conversionService, c autoConversionConfig) *autoConverter {
+	a := &autoConverter{clients: clients, conversion: conversion}
+	a.set(c)
+	return a
+}
+
+func (a *autoConverter) set(c autoConversionConfig) {
+	if c.Suffix == "" {
+		c.Suffix = defaultAutoConversionSuffix
+	}
+	a.config.Store(&c)
+}
+
+// run converts the images until ctx is done, subscribing to the events of
+// containerd again after it's re-dialed.
+func (a *autoConverter) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		client, err := a.clients.get(ctx)
+		if err != nil {
+			continue
+		}
+		subCtx, cancel := context.WithCancel(ctx)
+		envelopes, errs := client.Subscribe(subCtx, `topic=="/images/create"`, `topic=="/images/update"`)
+	loop:
+		for {
+			select {
+			case e := <-envelopes:
+				a.handle(ctx, e)
+			case err := <-errs:
+				if err != nil && ctx.Err() == nil {
+					log.G(ctx).WithError(err).Warn("image events subscription closed, subscribing again")
+				}
+				break loop
+			}
+		}
+		cancel()
+		select {
+		case <-ctx.Done():
+		case <-time.After(maxDialBackoff):
+		}
+	}
+}
+
+func (a *autoConverter) handle(ctx context.Context, e *events.Envelope) {
+	v, err := typeurl.UnmarshalAny(e.Event)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to decode %s event", e.Topic)
+		return
+	}
+	var name string
+	var labels map[string]string
+	switch ev := v.(type) {
+	case *eventstypes.ImageCreate:
+		name, labels = ev.Name, ev.Labels
+	case *eventstypes.ImageUpdate:
+		name, labels = ev.Name, ev.Labels
+	default:
+		return
+	}
+	ctx = log.WithLogger(namespaces.WithNamespace(ctx, e.Namespace), log.G(ctx).WithField("image", name))
+	if !a.selected(e.Namespace, labels) {
+		return
+	}
+	target := a.target(name)
+	if target == "" {
+		return
+	}
+	if err := a.convert(ctx, name, target); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to start the automatic conversion")
+	}
+}
+
+// selected reports whether the images of namespace ns with labels are
+// converted.  The converted images aren't converted again.
+func (a *autoConverter) selected(ns string, labels map[string]string) bool {
+	c := a.config.Load()
+	if len(c.Namespaces) > 0 && !slices.Contains(c.Namespaces, ns) {
+		return false
+	}
+	if _, ok := labels[convert.LabelConversion]; ok {
+		return false
+	}
+	for k, v := range c.Labels {
+		if l, ok := labels[k]; !ok || (v != "" && l != v) {
+			return false
+		}
+	}
+	return true
+}
+
+// target returns the name of the converted image of name, with the suffix
+// appended to its tag, or "" if name has no tag, e.g. the image IDs and repo
+// digests of the CRI plugin, or is itself a converted image.
+func (a *autoConverter) target(name string) string {
+	suffix := a.config.Load().Suffix
+	if _, err := digest.Parse(name); err == nil {
+		return ""
+	}
+	ref, err := reference.Parse(name)
+	if err != nil {
+		return ""
+	}
+	tagged, ok := ref.(reference.NamedTagged)
+	if !ok {
+		return ""
+	}
+	if _, ok := ref.(reference.Digested); ok || strings.HasSuffix(tagged.Tag(), suffix) {
+		return ""
+	}
+	return name + suffix
+}
+
+// convert converts the image name to target, unless target was already
+// converted from its current content or is being converted.
+func (a *autoConverter) convert(ctx context.Context, name, target string) error {
+	client, err := a.clients.get(ctx)
+	if err != nil {
+		return err
+	}
+	is := client.ImageService()
+	src, err := is.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	switch dst, err := is.Get(ctx, target); {
+	case err == nil:
+		if c, err := convert.ParseConversion(dst.Labels); err == nil && c.SourceDigest == src.Target.Digest {
+			return nil
+		}
+	case !errdefs.IsNotFound(err):
+		return err
+	}
+	ns, _ := namespaces.Namespace(ctx)
+	if a.conversion.running(ns, target) {
+		return nil
+	}
+	c := a.config.Load()
+	id, err := a.conversion.start(ns, &conversionapi.ConvertImageRequest{
+		Source:       name,
+		Target:       target,
+		Compressors:  c.Compressors,
+		Features:     c.Features,
+		MkfsOptions:  c.MkfsOptions,
+		Verity:       c.Verity,
+		Platforms:    c.Platforms,
+		AllPlatforms: c.AllPlatforms,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to convert to %s: %w", target, err)
+	}
+	log.G(ctx).WithField("id", id).Infof("converting to %s", target)
+	return nil
+}
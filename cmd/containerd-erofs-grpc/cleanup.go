@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/loop"
+	"github.com/erofs/erofs-container-toolkit/pkg/snapshotgc"
+)
+
+type cleanupConfig struct {
+	// Interval is the period of the cleanups, or the snapshotter is only
+	// cleaned up on Cleanup calls if 0
+	Interval duration `toml:"interval"`
+	// MinAge is the age of the snapshot directories without metadata
+	// removed, snapshotgc.DefaultMinAge if 0
+	MinAge duration `toml:"min_age"`
+}
+
+// cleanupSnapshotter reclaims the resources of the removed snapshots on
+// Cleanup, which containerd calls after its garbage collection when its
+// cleanup reaches the proxy snapshotter, or periodically: the snapshot
+// directories without metadata, e.g. left by a crash, and the loop devices
+// of the deleted layers.  The snapshots aren't created nor removed during a
+// cleanup, which reads their ids from the metadata store of the snapshotter.
+type cleanupSnapshotter struct {
+	snapshots.Snapshotter
+	root   string
+	minAge time.Duration
+	// pool are the loop devices of the layers, an empty pool if not managed
+	pool *loop.Pool
+	ms   metaStore
+	mu   *sync.RWMutex
+}
+
+// metaStore is the metadata store of the snapshotters of containerd.
+type metaStore interface {
+	WithTransaction(ctx context.Context, writable bool, fn storage.TransactionCallback) error
+}
+
+// snapshotterMetaStore returns the metadata store of the EROFS snapshotter
+// sn, or of the overlayfs snapshotter of the erofsfuse one, which they don't
+// expose.
+func snapshotterMetaStore(sn snapshots.Snapshotter) (metaStore, error) {
+	if f, ok := sn.(fuseSnapshotter); ok {
+		sn = f.Snapshotter
+	}
+	v := reflect.ValueOf(sn)
+	if v.Kind() == reflect.Pointer && v.Elem().Kind() == reflect.Struct {
+		if f := v.Elem().FieldByName("ms"); f.IsValid() {
+			if ms, ok := reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem().Interface().(metaStore); ok {
+				return ms, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no metadata store in %T", sn)
+}
+
+// withCleanup returns sn of root cleaned up as c, reading the snapshot ids
+// from ms, with the loop devices of pool if not nil.
+func withCleanup(sn snapshots.Snapshotter, root string, c cleanupConfig, ms metaStore, pool *loop.Pool) snapshots.Snapshotter {
+	minAge := time.Duration(c.MinAge)
+	if minAge == 0 {
+		minAge = snapshotgc.DefaultMinAge
+	}
+	if pool == nil {
+		pool = loop.NewPool()
+	}
+	s := cleanupSnapshotter{sn, root, minAge, pool, ms, &sync.RWMutex{}}
+	if c.Interval > 0 {
+		go func() {
+			ctx := log.WithLogger(context.Background(), log.L.WithField("root", root))
+			t := time.NewTicker(time.Duration(c.Interval))
+			defer t.Stop()
+			for range t.C {
+				if err := s.Cleanup(ctx); err != nil {
+					log.G(ctx).WithError(err).Warn("failed to clean up the snapshots")
+				}
+			}
+		}()
+	}
+	return s
+}
+
+func (s cleanupSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Snapshotter.Prepare(ctx, key, parent, opts...)
+}
+
+func (s cleanupSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Snapshotter.View(ctx, key, parent, opts...)
+}
+
+func (s cleanupSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Snapshotter.Commit(ctx, name, key, opts...)
+}
+
+func (s cleanupSnapshotter) Remove(ctx context.Context, key string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Snapshotter.Remove(ctx, key)
+}
+
+func (s cleanupSnapshotter) Cleanup(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := func(ctx context.Context) (ids map[string]string, err error) {
+		err = s.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+			ids, err = storage.IDMap(ctx)
+			return err
+		})
+		return ids, err
+	}
+	// The snapshots are all known: containerd removes those it doesn't
+	// reference
+	orphans, err := snapshotgc.ScanIDs(ctx, s.root, ids, func(string) bool { return true }, s.minAge)
+	if errors.Is(err, os.ErrNotExist) || errdefs.IsNotFound(err) {
+		// No snapshot was created yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var (
+		errs    []error
+		removed int
+	)
+	for _, o := range orphans {
+		if err := snapshotgc.Remove(ctx, o); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove %s: %w", o.Path, err))
+			continue
+		}
+		removed++
+	}
+	detached, err := s.pool.Prune(filepath.Join(s.root, "snapshots"))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to detach the loop devices of the removed layers: %w", err))
+	}
+	if removed > 0 || detached > 0 {
+		log.G(ctx).WithField("root", s.root).Infof("removed %d snapshot directories, detached %d loop devices", removed, detached)
+	}
+	return errors.Join(errs...)
+}
+
+// cleanup cleans up sn, if it can.
+func cleanup(ctx context.Context, sn snapshots.Snapshotter) error {
+	c, ok := sn.(snapshots.Cleaner)
+	if !ok {
+		return fmt.Errorf("snapshotter does not implement Cleanup method: %w", errdefs.ErrNotImplemented)
+	}
+	return c.Cleanup(ctx)
+}
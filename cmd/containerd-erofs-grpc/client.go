@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+)
+
+const (
+	dialTimeout    = 5 * time.Second
+	minDialBackoff = 100 * time.Millisecond
+	maxDialBackoff = 5 * time.Second
+)
+
+// clientManager keeps a client of containerd, which is dialed on first use
+// and re-dialed after containerd is found not serving, e.g. restarted.
+type clientManager struct {
+	address string
+
+	mu     sync.Mutex
+	client *containerd.Client
+}
+
+func newClientManager(address string) *clientManager {
+	return &clientManager{address: address}
+}
+
+// get returns the client of containerd, dialing it with exponential backoff
+// until containerd is serving or ctx is done.
+func (m *clientManager) get(ctx context.Context) (*containerd.Client, error) {
+	backoff := minDialBackoff
+	for {
+		client, err := m.connect(ctx)
+		if err == nil {
+			return client, nil
+		}
+		log.G(ctx).WithError(err).Debugf("failed to connect to containerd, retrying in %s", backoff)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to connect to containerd at %s: %w: %w", m.address, err, errdefs.ErrUnavailable)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxDialBackoff)
+	}
+}
+
+// connect returns the client of containerd, dialing it once if needed.
+func (m *clientManager) connect(ctx context.Context) (*containerd.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client != nil {
+		return m.client, nil
+	}
+	client, err := containerd.New(m.address, containerd.WithTimeout(dialTimeout))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkServing(ctx, client); err != nil {
+		client.Close()
+		return nil, err
+	}
+	m.client = client
+	return client, nil
+}
+
+// check checks that containerd is serving, for the health service.  The
+// client is dropped if it isn't, to be re-dialed on next use, but not closed
+// as the calls in progress may still use it, e.g. with the differ of the diff
+// service.
+func (m *clientManager) check(ctx context.Context) error {
+	m.mu.Lock()
+	client := m.client
+	m.mu.Unlock()
+	if client == nil {
+		_, err := m.connect(ctx)
+		return err
+	}
+
+	err := checkServing(ctx, client)
+	if err != nil {
+		m.mu.Lock()
+		if m.client == client {
+			m.client = nil
+		}
+		m.mu.Unlock()
+	}
+	return err
+}
+
+// checkServing checks that containerd is serving.
+func checkServing(ctx context.Context, client *containerd.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	serving, err := client.IsServing(ctx)
+	if err != nil {
+		return err
+	}
+	if !serving {
+		return fmt.Errorf("containerd is not serving")
+	}
+	return nil
+}
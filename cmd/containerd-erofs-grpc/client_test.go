@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// fakeContainerd serves the health service of containerd on a unix socket.
+func fakeContainerd(t *testing.T) (string, *health.Server) {
+	address := filepath.Join(t.TempDir(), "containerd.sock")
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return address, hs
+}
+
+// TestClientCheckKeepsClient checks that a failed health check doesn't close
+// the client the calls in progress got before.
+func TestClientCheckKeepsClient(t *testing.T) {
+	ctx := context.Background()
+	address, hs := fakeContainerd(t)
+	m := newClientManager(address)
+
+	inFlight, err := m.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inFlight.Close()
+
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	if err := m.check(ctx); err == nil {
+		t.Fatal("expected the check to fail while containerd isn't serving")
+	}
+	m.mu.Lock()
+	dropped := m.client == nil
+	m.mu.Unlock()
+	if !dropped {
+		t.Fatal("expected the client to be dropped")
+	}
+
+	// The call in progress still has a usable client
+	if _, err := inFlight.IsServing(ctx); err != nil {
+		t.Fatalf("client of the call in progress was closed: %v", err)
+	}
+
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	client, err := m.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client == inFlight {
+		t.Fatal("expected a new client to be dialed")
+	}
+	defer client.Close()
+	if err := m.check(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
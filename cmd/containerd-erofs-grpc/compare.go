@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/diff"
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// tarDiffer computes the tar diffs the EROFS differ can't: those of the
+// committed EROFS layers, e.g. of views, which it would read from their empty
+// upper directory, and those of other snapshots.  It walks the mounted
+// snapshots instead, so that the images built on EROFS nodes can still be
+// pushed as OCI tar layers.
+type tarDiffer struct {
+	differ
+	walking diff.Comparer
+}
+
+func (d tarDiffer) Compare(ctx context.Context, lower, upper []mount.Mount, opts ...diff.Opt) (ocispec.Descriptor, error) {
+	if !readOnlyMounts(upper) {
+		desc, err := d.differ.Compare(ctx, lower, upper, opts...)
+		if !errdefs.IsNotImplemented(err) {
+			return desc, err
+		}
+	}
+	return d.walking.Compare(ctx, lower, upper, opts...)
+}
+
+// readOnlyMounts reports whether mounts are those of committed layers, without
+// upper directory.
+func readOnlyMounts(mounts []mount.Mount) bool {
+	if len(mounts) != 1 {
+		return false
+	}
+	switch m := mounts[0]; m.Type {
+	case "erofs":
+		return true
+	case "overlay":
+		for _, o := range m.Options {
+			if strings.HasPrefix(o, "upperdir=") {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/composefs"
+	"github.com/erofs/go-erofs"
+	"golang.org/x/sys/unix"
+)
+
+// composefsDir holds the metadata images of the chains of layers of the root
+const composefsDir = "composefs"
+
+// composefsSnapshotter mounts the chains of committed layers the way
+// composefs does: an EROFS metadata image of their merged tree, built when
+// the top layer is committed, as the only lower directory of the overlay,
+// with the layers as its data-only lower layers that its files redirect to,
+// so that overlayfs looks the files up once.  The chains which can't be,
+// e.g. with layers mounted lazily, are mounted as usual.
+type composefsSnapshotter struct {
+	snapshots.Snapshotter
+	root string
+	mu   *sync.Mutex
+}
+
+func (s composefsSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.Prepare(ctx, key, parent, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s.composefsMounts(ctx, mounts), nil
+}
+
+func (s composefsSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.View(ctx, key, parent, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s.composefsMounts(ctx, mounts), nil
+}
+
+func (s composefsSnapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.Mounts(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.composefsMounts(ctx, mounts), nil
+}
+
+func (s composefsSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	if err := s.Snapshotter.Commit(ctx, name, key, opts...); err != nil {
+		return err
+	}
+	lowerdirs, err := committedLowerdirs(ctx, s.Snapshotter, s.root, name)
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("the layers of %s can't be mounted with composefs", name)
+		return nil
+	}
+	// The layer is committed already: its children are mounted as usual
+	if err := s.build(lowerdirs); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to build the composefs image of the %d layers of %s", len(lowerdirs), name)
+	}
+	return nil
+}
+
+func (s composefsSnapshotter) Remove(ctx context.Context, key string) error {
+	if err := s.Snapshotter.Remove(ctx, key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pruneChains(ctx, s.root, filepath.Join(s.root, composefsDir))
+	return nil
+}
+
+// composefsMounts replaces the lower directories of the overlay of mounts
+// with the metadata image of their layers, if built, and the layers as its
+// data-only layers.
+func (s composefsSnapshotter) composefsMounts(ctx context.Context, mounts []mount.Mount) []mount.Mount {
+	if len(mounts) != 1 || mounts[0].Type != "overlay" {
+		return mounts
+	}
+	m := mounts[0]
+	i := slices.IndexFunc(m.Options, func(o string) bool { return strings.HasPrefix(o, "lowerdir=") })
+	if i < 0 {
+		return mounts
+	}
+	lowerdirs := strings.Split(strings.TrimPrefix(m.Options[i], "lowerdir="), ":")
+	mountpoint, err := s.mount(lowerdirs)
+	if errors.Is(err, os.ErrNotExist) {
+		// Committed before the layout was set, or failed to build
+		return mounts
+	} else if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to mount %d layers with composefs", len(lowerdirs))
+		return mounts
+	}
+	options := slices.Delete(slices.Clone(m.Options), i, i+1)
+	for _, o := range composefs.MountOptions(mountpoint, lowerdirs) {
+		key, _, _ := strings.Cut(o, "=")
+		if !slices.ContainsFunc(options, func(o string) bool { return strings.HasPrefix(o, key+"=") }) {
+			options = append(options, o)
+		}
+	}
+	m.Options = options
+	return []mount.Mount{m}
+}
+
+// build builds the metadata image of the layers of the lower directories,
+// from the top one, unless built already.
+func (s composefsSnapshotter) build(lowerdirs []string) error {
+	ids, layers, err := chainLayers(s.root, lowerdirs)
+	if err != nil {
+		return err
+	}
+	dir := chainDir(filepath.Join(s.root, composefsDir), ids)
+	meta := filepath.Join(dir, "meta.erofs")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(meta); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "fs"), 0755); err != nil {
+		return err
+	}
+	// The layers are listed first, for pruneChains
+	if err := os.WriteFile(filepath.Join(dir, chainLayersFile), []byte(strings.Join(ids, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	var fss []fs.FS
+	for _, l := range layers {
+		f, err := os.Open(l)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fsys, err := erofs.Open(f)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", l, err)
+		}
+		fss = append(fss, fsys)
+	}
+	if err := composefs.Build(meta+".tmp", fss); err != nil {
+		os.Remove(meta + ".tmp")
+		return err
+	}
+	return os.Rename(meta+".tmp", meta)
+}
+
+// mount returns the mountpoint of the metadata image of the layers of the
+// lower directories, from the top one, mounting it if needed.  It fails with
+// os.ErrNotExist if the image isn't built.
+func (s composefsSnapshotter) mount(lowerdirs []string) (string, error) {
+	ids, _, err := chainLayers(s.root, lowerdirs)
+	if err != nil {
+		return "", err
+	}
+	dir := chainDir(filepath.Join(s.root, composefsDir), ids)
+	mountpoint := filepath.Join(dir, "fs")
+	meta := filepath.Join(dir, "meta.erofs")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var st unix.Statfs_t
+	if err := unix.Statfs(mountpoint, &st); err == nil && uint32(st.Type) == erofsSuperMagic {
+		return mountpoint, nil
+	}
+	if _, err := os.Stat(meta); err != nil {
+		return "", err
+	}
+	if err := unix.Mount(meta, mountpoint, "erofs", unix.MS_RDONLY, ""); err != nil {
+		return "", fmt.Errorf("failed to mount %s on %s: %w", meta, mountpoint, err)
+	}
+	return mountpoint, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+const (
+	defaultConfigPath      = "/etc/containerd-erofs/config.toml"
+	defaultShutdownTimeout = 30 * time.Second
+
+	// sandboxDir holds the mkfs.erofs shim of the sandbox
+	sandboxDir = "/run/containerd-erofs-grpc/sandbox"
+)
+
+// config is the configuration file of containerd-erofs-grpc.  Flags given on
+// the command line override its values.
+type config struct {
+	Root              string   `toml:"root"`
+	Address           string   `toml:"address"`
+	ContainerdAddress string   `toml:"containerd_address"`
+	ReapInterval      duration `toml:"reap_interval"`
+	ReapAge           duration `toml:"reap_age"`
+	// ShutdownTimeout bounds the wait for the running calls on SIGTERM
+	ShutdownTimeout duration `toml:"shutdown_timeout"`
+
+	// Listeners serve the services on more sockets than Address
+	Listeners []listenerConfig `toml:"listeners"`
+	// Snapshotters are more snapshotters, by name, each served on its own
+	// socket
+	Snapshotters map[string]namedSnapshotterConfig `toml:"snapshotters"`
+
+	Snapshotter snapshotterConfig `toml:"snapshotter"`
+	Differ      differConfig      `toml:"differ"`
+	Fscache     fscacheConfig     `toml:"fscache"`
+	Limits      limitsConfig      `toml:"limits"`
+	Namespaces  namespacesConfig  `toml:"namespaces"`
+	Events      eventsConfig      `toml:"events"`
+	Conversion  conversionConfig  `toml:"conversion"`
+	Log         logConfig         `toml:"log"`
+	Metrics     metricsConfig     `toml:"metrics"`
+	Tracing     tracingConfig     `toml:"tracing"`
+	Debug       debugConfig       `toml:"debug"`
+}
+
+type listenerConfig struct {
+	// Address is the path of a unix socket, or "tcp://host:port"
+	Address string `toml:"address"`
+	// Protocol is "grpc" (the default) or "ttrpc"
+	Protocol string `toml:"protocol"`
+	// TLS is required on TCP
+	TLS *tlsConfig `toml:"tls"`
+}
+
+type snapshotterConfig struct {
+	// OvlOptions are added to the overlayfs mounts
+	OvlOptions     []string `toml:"ovl_mount_options"`
+	EnableFsverity bool     `toml:"enable_fsverity"`
+	// ViewMountOptions are added to the mounts of views, e.g. "nodev"
+	ViewMountOptions []string `toml:"view_mount_options"`
+	// Labels are set on new snapshots, unless set by the client
+	Labels map[string]string `toml:"labels"`
+	// Mount is "kernel" (the default) to mount the EROFS layers with the
+	// kernel, "fuse" to mount them with erofsfuse, or "auto" to use
+	// erofsfuse if the kernel can't mount them
+	Mount string `toml:"mount"`
+	// Erofsfuse is the erofsfuse binary, looked up in PATH if empty
+	Erofsfuse string `toml:"erofsfuse"`
+	// DmVerity mounts the layers with a dm-verity root hash annotation
+	// from a dm-verity device, and refuses to mount them on mismatch
+	DmVerity bool `toml:"dm_verity"`
+	// Fsverity verifies the layers with an fs-verity digest annotation
+	// before mounting them
+	Fsverity fsverityConfig `toml:"fsverity"`
+	// Loop manages the loop devices of the layers
+	Loop loopConfig `toml:"loop"`
+	// FileBacked is "auto" (the default) to mount the layers from their file
+	// if the kernel can, "always" to require it, or "never" to mount them
+	// from loop devices
+	FileBacked string `toml:"file_backed"`
+	// Dedup stores the identical layers once, as "hardlink" or "reflink"
+	// copies, or not if empty
+	Dedup string `toml:"dedup"`
+	// PageCache shares the page cache of the identical files of the layers
+	PageCache pageCacheConfig `toml:"page_cache"`
+	// Quota limits the size of the upper directories of the containers
+	Quota quotaConfig `toml:"quota"`
+	// Retention removes or demotes the layers idle for long
+	Retention retentionConfig `toml:"retention"`
+	// SELinux are the SELinux mount options of the snapshots
+	SELinux selinuxConfig `toml:"selinux"`
+	// Overlay are the overlayfs features of the snapshots
+	Overlay overlayConfig `toml:"overlay"`
+	// Layout is "layers" (the default) to mount the layers as the lower
+	// directories of the snapshots, or "composefs" to mount the metadata of
+	// their merged tree, with the layers as its data-only layers
+	Layout string `toml:"layout"`
+	// Merge mounts the deep chains of layers as a single lower directory
+	Merge mergeConfig `toml:"merge"`
+	// Cleanup removes the directories and loop devices of the removed
+	// snapshots periodically
+	Cleanup cleanupConfig `toml:"cleanup"`
+}
+
+type namedSnapshotterConfig struct {
+	Root     string     `toml:"root"`
+	Address  string     `toml:"address"`
+	Protocol string     `toml:"protocol"`
+	TLS      *tlsConfig `toml:"tls"`
+	snapshotterConfig
+}
+
+type differConfig struct {
+	// MkfsOptions are passed to mkfs.erofs when applying layers
+	MkfsOptions []string `toml:"mkfs_options"`
+	// ContentDir is a local content store to read and write the layers,
+	// instead of the content store of containerd
+	ContentDir string `toml:"content_dir"`
+	// Sandbox runs mkfs.erofs in a sandbox, as it parses untrusted layers
+	Sandbox sandboxConfig `toml:"sandbox"`
+	// StreamProcessors process the layers when applied, by ID; the tar
+	// layers processed into EROFS are applied as such
+	StreamProcessors map[string]streamProcessorConfig `toml:"stream_processors"`
+}
+
+type sandboxConfig struct {
+	Enable bool `toml:"enable"`
+	// User runs mkfs.erofs as this user, a name or "uid[:gid]"
+	User string `toml:"user"`
+	// UserNamespace runs mkfs.erofs as root of a user namespace mapped to
+	// User
+	UserNamespace bool `toml:"user_namespace"`
+	NoNewPrivs    bool `toml:"no_new_privs"`
+	Seccomp       bool `toml:"seccomp"`
+	// Rlimits are the resource limits of mkfs.erofs by name, e.g. "as" or
+	// "cpu"
+	Rlimits map[string]uint64 `toml:"rlimits"`
+}
+
+type logConfig struct {
+	Level string `toml:"level"`
+	// Format is "text" (the default) or "json"
+	Format string `toml:"format"`
+	// Output is "stderr" (the default), "journald", or the path of a file
+	Output string `toml:"output"`
+}
+
+type metricsConfig struct {
+	// Address is the TCP address to serve the metrics on, none if empty
+	Address string `toml:"address"`
+}
+
+// duration is a time.Duration written as a string, e.g. "1h30m".
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// loadConfig reads the configuration file at path over the flag defaults,
+// then applies the flags set on the command line.  A missing file is only an
+// error if it was given explicitly.
+func loadConfig(path string, explicit bool) (*config, error) {
+	c := config{ShutdownTimeout: duration(defaultShutdownTimeout)}
+	c.setFlags(flag.VisitAll)
+
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && !explicit:
+	case err != nil:
+		return nil, err
+	default:
+		if err := toml.Unmarshal(b, &c); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+
+	c.setFlags(flag.Visit)
+	return &c, nil
+}
+
+// setFlags sets the values of the flags visited by visit.
+func (c *config) setFlags(visit func(func(*flag.Flag))) {
+	visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "root":
+			c.Root = *rootDir
+		case "addr":
+			c.Address = *sockAddr
+		case "containerd-addr":
+			c.ContainerdAddress = *containerdAddr
+		case "reap-interval":
+			c.ReapInterval = duration(*reapInterval)
+		case "reap-age":
+			c.ReapAge = duration(*reapAge)
+		}
+	})
+}
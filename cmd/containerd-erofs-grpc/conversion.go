@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/images/converter"
+	"github.com/containerd/containerd/v2/core/leases"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/errdefs/pkg/errgrpc"
+	"github.com/containerd/log"
+	"github.com/containerd/platforms"
+	conversionapi "github.com/erofs/erofs-container-toolkit/api/conversion/v1"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// conversionRetention is how long the finished conversions are kept for
+	// Status
+	conversionRetention = time.Hour
+	// conversionLeaseTTL bounds the lease protecting the content of a
+	// conversion, in case the daemon dies before deleting it
+	conversionLeaseTTL = 24 * time.Hour
+)
+
+type conversionConfig struct {
+	// Enable serves the conversion API, to convert the images of containerd
+	// on request
+	Enable bool `toml:"enable"`
+	// Auto converts the images created in containerd
+	Auto autoConversionConfig `toml:"auto"`
+}
+
+// conversionJob is a conversion running in the background.
+type conversionJob struct {
+	namespace string
+	cancel    context.CancelFunc
+
+	mu  sync.Mutex
+	job *conversionapi.Job
+}
+
+// progress records the progress of the layer conversions.
+func (j *conversionJob) progress(e convert.ProgressEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	i := slices.IndexFunc(j.job.Layers, func(l *conversionapi.Layer) bool { return l.Source == e.Source.String() })
+	if i < 0 {
+		i = len(j.job.Layers)
+		j.job.Layers = append(j.job.Layers, &conversionapi.Layer{Source: e.Source.String()})
+	}
+	l := j.job.Layers[i]
+	l.Status = string(e.Status)
+	if e.Total > 0 {
+		l.Offset, l.Total = e.Offset, e.Total
+	}
+	if e.Digest != "" {
+		l.Digest = e.Digest.String()
+	}
+	l.Error = e.Error
+}
+
+func (j *conversionJob) finish(img *images.Image, err error, canceled bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.job.FinishedAt = timestamppb.Now()
+	switch {
+	case err == nil:
+		j.job.State = conversionapi.Job_SUCCEEDED
+		j.job.Digest = img.Target.Digest.String()
+	case canceled:
+		j.job.State = conversionapi.Job_CANCELED
+	default:
+		j.job.State = conversionapi.Job_FAILED
+		j.job.Error = err.Error()
+	}
+}
+
+func (j *conversionJob) status() *conversionapi.Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return proto.Clone(j.job).(*conversionapi.Job)
+}
+
+// conversionService converts the images of containerd to EROFS, as
+// "ctr-erofs images convert --erofs", in the background.  The conversions are
+// only visible to their namespace.
+type conversionService struct {
+	clients *clientManager
+	limit   *limiter
+
+	mu   sync.Mutex
+	jobs map[string]*conversionJob
+
+	conversionapi.UnimplementedConversionServer
+}
+
+func newConversionService(clients *clientManager, limit *limiter) *conversionService {
+	return &conversionService{clients: clients, limit: limit, jobs: map[string]*conversionJob{}}
+}
+
+func (s *conversionService) ConvertImage(ctx context.Context, req *conversionapi.ConvertImageRequest) (*conversionapi.ConvertImageResponse, error) {
+	ns, err := namespaces.NamespaceRequired(ctx)
+	if err != nil {
+		return nil, errgrpc.ToGRPC(err)
+	}
+	id, err := s.start(ns, req)
+	if err != nil {
+		return nil, errgrpc.ToGRPC(err)
+	}
+	return &conversionapi.ConvertImageResponse{Id: id}, nil
+}
+
+// allowedMkfsOptions are the mkfs.erofs options the clients may set, with
+// their value: the compression and chunk options, which neither read nor
+// write other files than the layer.
+var allowedMkfsOptions = []string{"-z", "-C", "-E", "--chunksize=", "--max-extent-bytes="}
+
+// checkMkfsOptions fails if the extra mkfs.erofs options of a request aren't
+// all allowed, as mkfs.erofs runs as root.
+func checkMkfsOptions(opts string) error {
+	for _, o := range strings.Fields(opts) {
+		if !slices.ContainsFunc(allowedMkfsOptions, func(prefix string) bool {
+			return len(o) > len(prefix) && strings.HasPrefix(o, prefix)
+		}) {
+			return fmt.Errorf("mkfs.erofs option %q not allowed: %w", o, errdefs.ErrInvalidArgument)
+		}
+	}
+	return nil
+}
+
+// start starts converting the image of req in the namespace ns, and returns
+// the conversion id.
+func (s *conversionService) start(ns string, req *conversionapi.ConvertImageRequest) (string, error) {
+	if req.Source == "" || req.Target == "" {
+		return "", fmt.Errorf("source and target are required: %w", errdefs.ErrInvalidArgument)
+	}
+	platformMC, err := conversionPlatforms(req)
+	if err != nil {
+		return "", err
+	}
+	features, err := convert.ParseFeatures(req.Features)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", err, errdefs.ErrInvalidArgument)
+	}
+	if err := checkMkfsOptions(req.MkfsOptions); err != nil {
+		return "", err
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	jobCtx, cancel := context.WithCancel(namespaces.WithNamespace(context.Background(), ns))
+	j := &conversionJob{namespace: ns, cancel: cancel, job: &conversionapi.Job{
+		Id:        id,
+		Source:    req.Source,
+		Target:    req.Target,
+		State:     conversionapi.Job_RUNNING,
+		StartedAt: timestamppb.Now(),
+	}}
+	opts := []convert.Option{
+		convert.WithCompressors(req.Compressors),
+		convert.WithFeatures(features...),
+		convert.WithExtraMkfsOption(req.MkfsOptions),
+		convert.WithProgress(j.progress),
+	}
+	if req.Verity {
+		opts = append(opts, convert.WithVerityAnnotations())
+	}
+
+	s.mu.Lock()
+	s.prune()
+	s.jobs[id] = j
+	s.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		img, err := s.run(jobCtx, req, platformMC, opts)
+		if err != nil {
+			log.G(jobCtx).WithError(err).WithField("target", req.Target).Warnf("failed to convert %s", req.Source)
+		}
+		j.finish(img, err, jobCtx.Err() != nil)
+	}()
+	return id, nil
+}
+
+// run converts the image of req once admitted by the limit, with its content
+// protected by a lease until the target image references it.
+func (s *conversionService) run(ctx context.Context, req *conversionapi.ConvertImageRequest, platformMC platforms.MatchComparer, opts []convert.Option) (*images.Image, error) {
+	if err := s.limit.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.limit.release()
+
+	client, err := s.clients.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ls := client.LeasesService()
+	l, err := ls.Create(ctx, leases.WithRandomID(), leases.WithExpiration(conversionLeaseTTL))
+	if err != nil {
+		return nil, err
+	}
+	ctx = leases.WithLease(ctx, l.ID)
+	defer func() {
+		if err := ls.Delete(context.WithoutCancel(ctx), l); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to delete lease %s", l.ID)
+		}
+	}()
+
+	src, err := client.ImageService().Get(ctx, req.Source)
+	if err != nil {
+		return nil, err
+	}
+	indexConvertFunc, err := convert.IndexConvertFunc(true, platformMC, opts...)
+	if err != nil {
+		return nil, err
+	}
+	conversion := convert.NewConversion(req.Source, src.Target.Digest, conversionOptions(req))
+	img, err := converter.Convert(ctx, client, req.Target, req.Source,
+		converter.WithPlatform(platformMC),
+		converter.WithIndexConvertFunc(indexConvertFunc),
+		converter.WithDockerToOCI(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := recordConversion(ctx, client, img, conversion); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to record the conversion of %s", req.Target)
+	}
+	return img, nil
+}
+
+// recordConversion labels the converted image with conversion, for
+// "ctr-erofs images attest".
+func recordConversion(ctx context.Context, client *containerd.Client, img *images.Image, conversion *convert.Conversion) error {
+	conversion.FinishedOn = time.Now().UTC()
+	label, err := conversion.Label()
+	if err != nil {
+		return err
+	}
+	if img.Labels == nil {
+		img.Labels = map[string]string{}
+	}
+	img.Labels[convert.LabelConversion] = label
+	updated, err := client.ImageService().Update(ctx, *img, "labels."+convert.LabelConversion)
+	if err != nil {
+		return err
+	}
+	*img = updated
+	return nil
+}
+
+func (s *conversionService) Status(ctx context.Context, req *conversionapi.StatusRequest) (*conversionapi.StatusResponse, error) {
+	ns, err := namespaces.NamespaceRequired(ctx)
+	if err != nil {
+		return nil, errgrpc.ToGRPC(err)
+	}
+	s.mu.Lock()
+	s.prune()
+	var jobs []*conversionJob
+	if req.Id != "" {
+		j, err := s.get(ns, req.Id)
+		if err != nil {
+			s.mu.Unlock()
+			return nil, errgrpc.ToGRPC(err)
+		}
+		jobs = append(jobs, j)
+	} else {
+		for _, j := range s.jobs {
+			if j.namespace == ns {
+				jobs = append(jobs, j)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	resp := &conversionapi.StatusResponse{}
+	for _, j := range jobs {
+		resp.Jobs = append(resp.Jobs, j.status())
+	}
+	slices.SortFunc(resp.Jobs, func(a, b *conversionapi.Job) int {
+		return a.StartedAt.AsTime().Compare(b.StartedAt.AsTime())
+	})
+	return resp, nil
+}
+
+func (s *conversionService) Cancel(ctx context.Context, req *conversionapi.CancelRequest) (*emptypb.Empty, error) {
+	ns, err := namespaces.NamespaceRequired(ctx)
+	if err != nil {
+		return nil, errgrpc.ToGRPC(err)
+	}
+	s.mu.Lock()
+	j, err := s.get(ns, req.Id)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, errgrpc.ToGRPC(err)
+	}
+	if j.status().State != conversionapi.Job_RUNNING {
+		return nil, errgrpc.ToGRPC(fmt.Errorf("conversion %s is not running: %w", req.Id, errdefs.ErrFailedPrecondition))
+	}
+	j.cancel()
+	return &emptypb.Empty{}, nil
+}
+
+// running reports whether a conversion to target of the namespace ns is
+// running.
+func (s *conversionService) running(ns, target string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if st := j.status(); j.namespace == ns && st.Target == target && st.State == conversionapi.Job_RUNNING {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the conversion id of the namespace ns.  s.mu must be held.
+func (s *conversionService) get(ns, id string) (*conversionJob, error) {
+	j, ok := s.jobs[id]
+	if !ok || j.namespace != ns {
+		return nil, fmt.Errorf("conversion %s: %w", id, errdefs.ErrNotFound)
+	}
+	return j, nil
+}
+
+// prune forgets the conversions finished for longer than
+// conversionRetention.  s.mu must be held.
+func (s *conversionService) prune() {
+	for id, j := range s.jobs {
+		st := j.status()
+		if st.FinishedAt != nil && time.Since(st.FinishedAt.AsTime()) > conversionRetention {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// conversionPlatforms returns the platforms to convert, the default platform
+// if none.
+func conversionPlatforms(req *conversionapi.ConvertImageRequest) (platforms.MatchComparer, error) {
+	if req.AllPlatforms {
+		return platforms.All, nil
+	}
+	if len(req.Platforms) == 0 {
+		return platforms.DefaultStrict(), nil
+	}
+	var all []ocispec.Platform
+	for _, ps := range req.Platforms {
+		p, err := platforms.Parse(ps)
+		if err != nil {
+			return nil, fmt.Errorf("invalid platform %q: %w: %w", ps, err, errdefs.ErrInvalidArgument)
+		}
+		all = append(all, p)
+	}
+	return platforms.Ordered(all...), nil
+}
+
+// conversionOptions returns the options recorded in the provenance of the
+// converted image, as the flags of "ctr-erofs images convert".
+func conversionOptions(req *conversionapi.ConvertImageRequest) map[string]string {
+	opts := map[string]string{"erofs": "true", "oci": "true"}
+	if req.Verity {
+		opts["erofs-verity"] = "true"
+	}
+	if req.AllPlatforms {
+		opts["all-platforms"] = "true"
+	}
+	for name, v := range map[string]string{
+		"erofs-compressors":  req.Compressors,
+		"erofs-features":     req.Features,
+		"erofs-mkfs-options": req.MkfsOptions,
+		"platform":           strings.Join(req.Platforms, ","),
+	} {
+		if v != "" {
+			opts[name] = v
+		}
+	}
+	return opts
+}
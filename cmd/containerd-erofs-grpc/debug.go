@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/moby/sys/mountinfo"
+)
+
+type debugConfig struct {
+	// Address is the unix socket to serve pprof and the state dump on, none
+	// if empty
+	Address string `toml:"address"`
+}
+
+// running are the snapshot and diff operations in progress.
+var running = &callTracker{calls: map[uint64]runningCall{}}
+
+type runningCall struct {
+	Op        string `json:"op"`
+	Namespace string `json:"namespace,omitempty"`
+	// Key is the snapshot key, or the layer digest for diff operations
+	Key       string    `json:"key,omitempty"`
+	MediaType string    `json:"mediaType,omitempty"`
+	Started   time.Time `json:"started"`
+}
+
+type callTracker struct {
+	mu    sync.Mutex
+	next  uint64
+	calls map[uint64]runningCall
+}
+
+// track records c as running until the returned function is called.
+func (t *callTracker) track(ctx context.Context, c runningCall) func() {
+	c.Namespace, _ = namespaces.Namespace(ctx)
+	c.Started = time.Now()
+	t.mu.Lock()
+	id := t.next
+	t.next++
+	t.calls[id] = c
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		delete(t.calls, id)
+		t.mu.Unlock()
+	}
+}
+
+// list returns the running calls, oldest first.
+func (t *callTracker) list() []runningCall {
+	t.mu.Lock()
+	calls := make([]runningCall, 0, len(t.calls))
+	for _, c := range t.calls {
+		calls = append(calls, c)
+	}
+	t.mu.Unlock()
+	slices.SortFunc(calls, func(a, b runningCall) int { return a.Started.Compare(b.Started) })
+	return calls
+}
+
+// debugTarget is a snapshotter to dump the state of.
+type debugTarget struct {
+	root string
+	sn   snapshots.Snapshotter
+}
+
+type debugState struct {
+	Calls []runningCall `json:"calls"`
+	// Conversions are the layers being converted by mkfs.erofs
+	Conversions  []runningCall      `json:"conversions"`
+	Snapshotters []snapshotterState `json:"snapshotters"`
+}
+
+type snapshotterState struct {
+	Root string `json:"root"`
+	// Active are the snapshots not committed yet, i.e. being prepared or
+	// viewed
+	Active      []activeSnapshot `json:"active"`
+	LoopDevices []loopDevice     `json:"loopDevices"`
+	Mounts      []mountState     `json:"mounts"`
+	Error       string           `json:"error,omitempty"`
+}
+
+type activeSnapshot struct {
+	Key     string            `json:"key"`
+	Parent  string            `json:"parent,omitempty"`
+	Kind    string            `json:"kind"`
+	Created time.Time         `json:"created"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+type mountState struct {
+	Mountpoint string `json:"mountpoint"`
+	FSType     string `json:"fstype"`
+	Source     string `json:"source"`
+}
+
+// serveDebug serves the pprof profiles under /debug/pprof/ and the state of
+// targets on /debug/state, on the unix socket address in the background.
+func serveDebug(address string, targets []debugTarget) error {
+	l, err := listenUnix(address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(dumpState(r.Context(), targets)); err != nil {
+			log.G(r.Context()).WithError(err).Warn("failed to write the state dump")
+		}
+	})
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.L.WithError(err).Error("debug server stopped")
+		}
+	}()
+	return nil
+}
+
+func dumpState(ctx context.Context, targets []debugTarget) debugState {
+	state := debugState{Calls: running.list(), Conversions: []runningCall{}}
+	for _, c := range state.Calls {
+		if c.Op == "apply" && !strings.HasSuffix(c.MediaType, ".erofs") {
+			state.Conversions = append(state.Conversions, c)
+		}
+	}
+	for _, t := range targets {
+		s := snapshotterState{Root: t.root, Active: []activeSnapshot{}, Mounts: []mountState{}, LoopDevices: loopDevices([]string{t.root})}
+		err := t.sn.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+			if info.Kind != snapshots.KindCommitted {
+				s.Active = append(s.Active, activeSnapshot{info.Name, info.Parent, info.Kind.String(), info.Created, info.Labels})
+			}
+			return nil
+		})
+		if errdefs.IsNotFound(err) {
+			// No snapshot yet
+			err = nil
+		}
+		slices.SortFunc(s.Active, func(a, b activeSnapshot) int { return a.Created.Compare(b.Created) })
+		mounts, merr := mountinfo.GetMounts(mountinfo.PrefixFilter(t.root))
+		for _, m := range mounts {
+			s.Mounts = append(s.Mounts, mountState{m.Mountpoint, m.FSType, m.Source})
+		}
+		slices.SortFunc(s.Mounts, func(a, b mountState) int { return cmp.Compare(a.Mountpoint, b.Mountpoint) })
+		if err = cmp.Or(err, merr); err != nil {
+			s.Error = err.Error()
+		}
+		state.Snapshotters = append(state.Snapshotters, s)
+	}
+	return state
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+// fsImmutableFl is the immutable inode flag the EROFS snapshotter sets on the
+// layers
+const fsImmutableFl = 0x10
+
+// dedupSnapshotter stores the identical layer.erofs of the layers labeled by
+// idSnapshotter once, in the blobs directory of the root by digest, and
+// replaces them with hardlinks or reflink copies of it when committed.  The
+// layers referencing a blob are the symlinks to it named after their
+// snapshot id in blobs/refs, and the blob is removed with the last one.
+type dedupSnapshotter struct {
+	snapshots.Snapshotter
+	root string
+	// reflink clones the blobs instead of hardlinking them
+	reflink bool
+	mu      *sync.Mutex
+}
+
+// newDedupSnapshotter returns sn of root storing its layers once, with
+// mode "hardlink" or "reflink".  The blobs of the layers removed meanwhile
+// are removed.
+func newDedupSnapshotter(ctx context.Context, sn snapshots.Snapshotter, root, mode string) (snapshots.Snapshotter, error) {
+	if mode != "hardlink" && mode != "reflink" {
+		return nil, fmt.Errorf("unknown dedup %q", mode)
+	}
+	s := dedupSnapshotter{sn, root, mode == "reflink", &sync.Mutex{}}
+	for _, dir := range []string{s.blobsDir(), s.refsDir()} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.gc(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s dedupSnapshotter) blobsDir() string {
+	return filepath.Join(s.root, "blobs", string(digest.Canonical))
+}
+
+func (s dedupSnapshotter) refsDir() string {
+	return filepath.Join(s.root, "blobs", "refs")
+}
+
+func (s dedupSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if id, ok := info.Labels[labelSnapshotID]; ok {
+		if err := s.dedup(ctx, id); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to deduplicate the layer of %s", key)
+		}
+	}
+	if err := s.Snapshotter.Commit(ctx, name, key, opts...); err != nil {
+		if id, ok := info.Labels[labelSnapshotID]; ok {
+			s.release(ctx, id)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s dedupSnapshotter) Remove(ctx context.Context, key string) error {
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := s.Snapshotter.Remove(ctx, key); err != nil {
+		return err
+	}
+	if id, ok := info.Labels[labelSnapshotID]; ok && info.Kind == snapshots.KindCommitted {
+		s.release(ctx, id)
+	}
+	return nil
+}
+
+// dedup replaces the layer.erofs of the snapshot id with a copy of the blob
+// with the same digest, or stores it as the blob, and references the blob.
+func (s dedupSnapshotter) dedup(ctx context.Context, id string) error {
+	layer := filepath.Join(s.root, "snapshots", id, "layer.erofs")
+	fi, err := os.Stat(layer)
+	if err != nil || fi.Size() == 0 {
+		// Not applied, or mounted lazily
+		return nil
+	}
+	dgst, err := layerDigest(layer)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blob := filepath.Join(s.blobsDir(), dgst.Encoded())
+	if _, err := os.Stat(blob); err == nil {
+		tmp := layer + ".tmp"
+		if err := s.copy(blob, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, layer); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	} else if err := s.copy(layer, blob); err != nil {
+		return err
+	}
+	ref := filepath.Join(s.refsDir(), id)
+	os.Remove(ref)
+	if err := os.Symlink(filepath.Join("..", string(digest.Canonical), dgst.Encoded()), ref); err != nil {
+		return err
+	}
+	log.G(ctx).WithField("digest", dgst).Debugf("deduplicated the layer of snapshot %s", id)
+	return nil
+}
+
+// copy hardlinks or clones src to dst.
+func (s dedupSnapshotter) copy(src, dst string) error {
+	if !s.reflink {
+		// The snapshotter sets the immutable flag of the layers again.  The
+		// filesystems without the flag fail, and can always link.
+		setImmutable(src, false)
+		return os.Link(src, dst)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	err = unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("failed to clone %s: %w", src, err)
+	}
+	return nil
+}
+
+// release drops the reference of the snapshot id, and removes its blob if it
+// was the last one.
+func (s dedupSnapshotter) release(ctx context.Context, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref := filepath.Join(s.refsDir(), id)
+	target, err := os.Readlink(ref)
+	if err != nil {
+		return
+	}
+	if err := os.Remove(ref); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to remove %s", ref)
+		return
+	}
+	blob := filepath.Join(s.refsDir(), target)
+	refs, err := s.refs()
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to list the blob references")
+		return
+	}
+	if refs[target] > 0 {
+		if !s.reflink {
+			// Cleared by the snapshotter when removing the layer
+			if err := setImmutable(blob, true); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to set the immutable flag of %s", blob)
+			}
+		}
+		return
+	}
+	if err := removeBlob(blob); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to remove %s", blob)
+	}
+}
+
+// refs returns the numbers of references of the blobs by link target.
+// s.mu must be held.
+func (s dedupSnapshotter) refs() (map[string]int, error) {
+	entries, err := os.ReadDir(s.refsDir())
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]int{}
+	for _, e := range entries {
+		if target, err := os.Readlink(filepath.Join(s.refsDir(), e.Name())); err == nil {
+			refs[target]++
+		}
+	}
+	return refs, nil
+}
+
+// gc removes the references of the snapshots which don't exist anymore, and
+// the blobs without reference.
+func (s dedupSnapshotter) gc(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(s.refsDir())
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(s.root, "snapshots", e.Name())); errors.Is(err, os.ErrNotExist) {
+			os.Remove(filepath.Join(s.refsDir(), e.Name()))
+		}
+	}
+	refs, err := s.refs()
+	if err != nil {
+		return err
+	}
+	blobs, err := os.ReadDir(s.blobsDir())
+	if err != nil {
+		return err
+	}
+	for _, b := range blobs {
+		if refs[filepath.Join("..", string(digest.Canonical), b.Name())] > 0 {
+			continue
+		}
+		blob := filepath.Join(s.blobsDir(), b.Name())
+		if err := removeBlob(blob); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to remove %s", blob)
+		}
+	}
+	return nil
+}
+
+func removeBlob(path string) error {
+	setImmutable(path, false)
+	return os.Remove(path)
+}
+
+// setImmutable sets or clears the immutable flag of the file at path, as the
+// EROFS snapshotter.
+func setImmutable(path string, enable bool) error {
+	_, err := updateImmutable(path, enable)
+	return err
+}
+
+// updateImmutable sets or clears the immutable flag of the file at path, and
+// reports whether it was set before.
+func updateImmutable(path string, enable bool) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	flags, err := unix.IoctlGetInt(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return false, err
+	}
+	was := flags&fsImmutableFl != 0
+	updated := flags &^ fsImmutableFl
+	if enable {
+		updated |= fsImmutableFl
+	}
+	if updated == flags {
+		return was, nil
+	}
+	return was, unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, updated)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/diff"
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/erofs"
+	"github.com/erofs/erofs-container-toolkit/pkg/verity"
+	"github.com/moby/sys/mountinfo"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// rootHashFile records the dm-verity root hash annotation of an applied
+	// layer, next to its layer.erofs, for the snapshotter
+	rootHashFile = "layer.erofs.roothash"
+	// hashTreeFile is the dm-verity hash tree of a layer
+	hashTreeFile = "layer.erofs.verity"
+
+	// labelRootHash is the dm-verity root hash of a committed layer
+	labelRootHash = "containerd.io/snapshot/erofs.dm-verity.root-hash"
+)
+
+// verityDiffer records the dm-verity root hash and fs-verity digest
+// annotations of the native EROFS layers it applies.
+type verityDiffer struct {
+	differ
+}
+
+func (d verityDiffer) Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount, opts ...diff.ApplyOpt) (ocispec.Descriptor, error) {
+	applied, err := d.differ.Apply(ctx, desc, mounts, opts...)
+	if err != nil || !strings.HasSuffix(desc.MediaType, ".erofs") {
+		return applied, err
+	}
+	layer := layerPath(mounts)
+	if layer == "" {
+		return applied, nil
+	}
+	for file, annotation := range map[string]string{
+		rootHashFile:       verity.AnnotationDmVerityRootHash,
+		fsverityDigestFile: verity.AnnotationFsverityDigest,
+	} {
+		if v, ok := desc.Annotations[annotation]; ok {
+			if err := os.WriteFile(filepath.Join(filepath.Dir(layer), file), []byte(v), 0600); err != nil {
+				return ocispec.Descriptor{}, err
+			}
+		}
+	}
+	return applied, nil
+}
+
+// veritySnapshotter mounts the layers labeled by idSnapshotter with a dm-verity root hash annotation
+// from a dm-verity device, on their fs directory once committed, so that the
+// EROFS snapshotter uses it instead of a loop device.  The layers are checked
+// again before mounting their children, and not mounted if their data doesn't
+// match the root hash.
+type veritySnapshotter struct {
+	snapshots.Snapshotter
+	root string
+	// options are the EROFS mount options of the layers
+	options string
+}
+
+// newVeritySnapshotter returns sn of root with dm-verity, mounting the layers
+// with options.  The verified layers of sn are set up again.
+func newVeritySnapshotter(ctx context.Context, sn snapshots.Snapshotter, root, options string) (snapshots.Snapshotter, error) {
+	s := veritySnapshotter{sn, root, options}
+	err := sn.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if err := s.setup(ctx, info.Labels); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to set up dm-verity for %s", info.Name)
+		}
+		return nil
+	}, fmt.Sprintf(`kind==committed,labels."%s"`, labelRootHash))
+	// No snapshot yet
+	if err != nil && !errdefs.IsNotFound(err) {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s veritySnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	if err := s.check(ctx, parent); err != nil {
+		return nil, err
+	}
+	return s.Snapshotter.Prepare(ctx, key, parent, opts...)
+}
+
+func (s veritySnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	if err := s.check(ctx, parent); err != nil {
+		return nil, err
+	}
+	mounts, err := s.Snapshotter.View(ctx, key, parent, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s.verityMounts(mounts), nil
+}
+
+func (s veritySnapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.Mounts(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.verityMounts(mounts), nil
+}
+
+func (s veritySnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	id, ok := info.Labels[labelSnapshotID]
+	if !ok {
+		return s.Snapshotter.Commit(ctx, name, key, opts...)
+	}
+	rootHash, err := os.ReadFile(filepath.Join(s.root, "snapshots", id, rootHashFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return s.Snapshotter.Commit(ctx, name, key, opts...)
+	} else if err != nil {
+		return err
+	}
+	labels := map[string]string{labelRootHash: string(rootHash), labelSnapshotID: id}
+	if err := s.setup(ctx, labels); err != nil {
+		return fmt.Errorf("layer %s: %w", name, err)
+	}
+	if err := s.Snapshotter.Commit(ctx, name, key, append(opts, snapshots.WithLabels(labels))...); err != nil {
+		if err := s.teardown(ctx, labels); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to tear down dm-verity for %s", key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s veritySnapshotter) Remove(ctx context.Context, key string) error {
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if _, ok := info.Labels[labelRootHash]; !ok {
+		return s.Snapshotter.Remove(ctx, key)
+	}
+	if err := s.Snapshotter.Remove(ctx, key); err != nil {
+		return err
+	}
+	// The snapshot is gone already: the snapshotter unmounted the layer, and
+	// the device keeps its removed files until closed
+	if err := s.teardown(ctx, info.Labels); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to tear down dm-verity for %s", key)
+	}
+	return nil
+}
+
+// check sets up the verified layers of the chain of parent, and fails if
+// one doesn't match its root hash.
+func (s veritySnapshotter) check(ctx context.Context, parent string) error {
+	for parent != "" {
+		info, err := s.Snapshotter.Stat(ctx, parent)
+		if err != nil {
+			return err
+		}
+		if _, ok := info.Labels[labelRootHash]; ok {
+			if err := s.setup(ctx, info.Labels); err != nil {
+				return fmt.Errorf("layer %s: %w", parent, err)
+			}
+		}
+		parent = info.Parent
+	}
+	return nil
+}
+
+// setup mounts the layer of labels from its dm-verity device, unless already
+// mounted.  The hash tree is written once, from the layer: it can only match
+// the root hash if the layer does.
+func (s veritySnapshotter) setup(ctx context.Context, labels map[string]string) error {
+	dir := filepath.Join(s.root, "snapshots", labels[labelSnapshotID])
+	mountpoint := filepath.Join(dir, "fs")
+	name := s.deviceName(labels[labelSnapshotID])
+	dev := erofs.VerityDevice(name)
+	if mounts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter(mountpoint)); err == nil && len(mounts) == 1 && mounts[0].Source == dev {
+		return nil
+	}
+
+	layer, hashTree := filepath.Join(dir, "layer.erofs"), filepath.Join(dir, hashTreeFile)
+	if _, err := os.Stat(dev); errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(hashTree); errors.Is(err, os.ErrNotExist) {
+			rootHash, err := erofs.FormatVerity(ctx, layer, hashTree)
+			if err != nil {
+				return err
+			}
+			if rootHash != labels[labelRootHash] {
+				os.Remove(hashTree)
+				return fmt.Errorf("dm-verity root hash %s, expected %s: %w", rootHash, labels[labelRootHash], errdefs.ErrFailedPrecondition)
+			}
+		}
+		if _, err := erofs.OpenVerity(ctx, name, layer, hashTree, labels[labelRootHash]); err != nil {
+			return err
+		}
+	}
+	// The EROFS snapshotter may have mounted the layer from a loop device
+	if err := unix.Unmount(mountpoint, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+		return fmt.Errorf("failed to unmount %s: %w", mountpoint, err)
+	}
+	if err := unix.Mount(dev, mountpoint, "erofs", unix.MS_RDONLY, s.options); err != nil {
+		return fmt.Errorf("failed to mount %s on %s: %w", dev, mountpoint, err)
+	}
+	return nil
+}
+
+// teardown unmounts the layer of labels and closes its dm-verity device.
+func (s veritySnapshotter) teardown(ctx context.Context, labels map[string]string) error {
+	mountpoint := filepath.Join(s.root, "snapshots", labels[labelSnapshotID], "fs")
+	if err := unix.Unmount(mountpoint, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+		return fmt.Errorf("failed to unmount %s: %w", mountpoint, err)
+	}
+	name := s.deviceName(labels[labelSnapshotID])
+	if _, err := os.Stat(erofs.VerityDevice(name)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return erofs.CloseVerity(ctx, name)
+}
+
+// deviceName returns the dm-verity device of the snapshot id, unique to the
+// root.
+func (s veritySnapshotter) deviceName(id string) string {
+	sum := sha256.Sum256([]byte(s.root))
+	return fmt.Sprintf("erofs-%s-%s", hex.EncodeToString(sum[:4]), id)
+}
+
+// verityMounts replaces the loop mount of the layer.erofs of a verified layer,
+// which the snapshotter returns for the views of a single layer, with a mount
+// of its dm-verity device.
+func (s veritySnapshotter) verityMounts(mounts []mount.Mount) []mount.Mount {
+	if len(mounts) != 1 || mounts[0].Type != "erofs" {
+		return mounts
+	}
+	dev := erofs.VerityDevice(s.deviceName(filepath.Base(filepath.Dir(mounts[0].Source))))
+	if _, err := os.Stat(dev); err != nil {
+		return mounts
+	}
+	return []mount.Mount{{Type: "erofs", Source: dev, Options: []string{"ro"}}}
+}
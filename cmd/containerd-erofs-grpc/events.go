@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/diff"
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/log"
+	"github.com/containerd/typeurl/v2"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// eventQueueSize bounds the events waiting to be published, beyond which
+	// they're dropped
+	eventQueueSize = 1024
+	eventTimeout   = 10 * time.Second
+)
+
+type eventsConfig struct {
+	// Enable publishes the snapshot and layer events to containerd
+	Enable bool `toml:"enable"`
+}
+
+// The events are encoded in JSON, e.g. for "ctr events".
+type snapshotPrepareEvent struct {
+	Root   string `json:"root"`
+	Key    string `json:"key"`
+	Parent string `json:"parent,omitempty"`
+	Kind   string `json:"kind"`
+}
+
+type snapshotCommitEvent struct {
+	Root string `json:"root"`
+	Key  string `json:"key"`
+	Name string `json:"name"`
+}
+
+type snapshotRemoveEvent struct {
+	Root string `json:"root"`
+	Key  string `json:"key"`
+}
+
+type layerConvertEvent struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"mediaType"`
+	// Size is the size of the EROFS layer
+	Size int64 `json:"size"`
+}
+
+type layerVerityEvent struct {
+	Root string `json:"root"`
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+func init() {
+	typeurl.Register(&snapshotPrepareEvent{}, "io.github.erofs.events", "SnapshotPrepare")
+	typeurl.Register(&snapshotCommitEvent{}, "io.github.erofs.events", "SnapshotCommit")
+	typeurl.Register(&snapshotRemoveEvent{}, "io.github.erofs.events", "SnapshotRemove")
+	typeurl.Register(&layerConvertEvent{}, "io.github.erofs.events", "LayerConvert")
+	typeurl.Register(&layerVerityEvent{}, "io.github.erofs.events", "LayerVerity")
+}
+
+type event struct {
+	namespace string
+	topic     string
+	payload   any
+}
+
+// publisher publishes events to containerd in the background, in order.
+type publisher struct {
+	clients *clientManager
+	queue   chan event
+}
+
+func newPublisher(clients *clientManager) *publisher {
+	p := &publisher{clients: clients, queue: make(chan event, eventQueueSize)}
+	go p.run()
+	return p
+}
+
+// publish queues the event payload on topic, in the namespace of ctx.  The
+// events of calls without namespace, e.g. the removals of snapshots garbage
+// collected by containerd, aren't published.
+func (p *publisher) publish(ctx context.Context, topic string, payload any) {
+	ns, ok := namespaces.Namespace(ctx)
+	if !ok {
+		return
+	}
+	select {
+	case p.queue <- event{ns, topic, payload}:
+	default:
+		log.G(ctx).Warnf("dropping %s event, too many pending", topic)
+	}
+}
+
+func (p *publisher) run() {
+	for e := range p.queue {
+		ctx, cancel := context.WithTimeout(namespaces.WithNamespace(context.Background(), e.namespace), eventTimeout)
+		client, err := p.clients.get(ctx)
+		if err == nil {
+			err = client.EventService().Publish(ctx, e.topic, e.payload)
+		}
+		cancel()
+		if err != nil {
+			log.L.WithError(err).Warnf("failed to publish %s event", e.topic)
+		}
+	}
+}
+
+// snapshotter returns sn publishing its events, if p isn't nil.  The
+// committed layers are checked to be protected by fs-verity if verity.
+func (p *publisher) snapshotter(sn snapshots.Snapshotter, root string, verity bool) snapshots.Snapshotter {
+	if p == nil {
+		return sn
+	}
+	return eventsSnapshotter{sn, p, root, verity}
+}
+
+// eventsSnapshotter publishes the events of a snapshotter.
+type eventsSnapshotter struct {
+	snapshots.Snapshotter
+	events *publisher
+	root   string
+	verity bool
+}
+
+func (s eventsSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.Prepare(ctx, key, parent, opts...)
+	if err == nil {
+		s.events.publish(ctx, "/erofs/snapshot/prepare", &snapshotPrepareEvent{s.root, key, parent, snapshots.KindActive.String()})
+	}
+	return mounts, err
+}
+
+func (s eventsSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.View(ctx, key, parent, opts...)
+	if err == nil {
+		s.events.publish(ctx, "/erofs/snapshot/prepare", &snapshotPrepareEvent{s.root, key, parent, snapshots.KindView.String()})
+	}
+	return mounts, err
+}
+
+func (s eventsSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	var layer string
+	if s.verity {
+		if mounts, err := s.Snapshotter.Mounts(ctx, key); err == nil {
+			layer = layerPath(mounts)
+		}
+	}
+	if err := s.Snapshotter.Commit(ctx, name, key, opts...); err != nil {
+		return err
+	}
+	s.events.publish(ctx, "/erofs/snapshot/commit", &snapshotCommitEvent{s.root, key, name})
+
+	// The snapshotter enabled fs-verity on the EROFS layer when committing
+	if layer == "" {
+		return nil
+	}
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, layer, 0, unix.STATX_BASIC_STATS, &stx); err != nil {
+		if !os.IsNotExist(err) {
+			log.G(ctx).WithError(err).Warnf("failed to check fs-verity of %s", layer)
+		}
+		return nil
+	}
+	if stx.Attributes&unix.STATX_ATTR_VERITY == 0 {
+		log.G(ctx).Warnf("fs-verity is not enabled on %s", layer)
+		return nil
+	}
+	s.events.publish(ctx, "/erofs/layer/verity", &layerVerityEvent{s.root, name, layer})
+	return nil
+}
+
+func (s eventsSnapshotter) Remove(ctx context.Context, key string) error {
+	if err := s.Snapshotter.Remove(ctx, key); err != nil {
+		return err
+	}
+	s.events.publish(ctx, "/erofs/snapshot/remove", &snapshotRemoveEvent{s.root, key})
+	return nil
+}
+
+func (s eventsSnapshotter) Cleanup(ctx context.Context) error {
+	return cleanup(ctx, s.Snapshotter)
+}
+
+// layerPath returns the path of the EROFS layer of the active snapshot with
+// mounts, next to its upper directory.
+func layerPath(mounts []mount.Mount) string {
+	if len(mounts) != 1 {
+		return ""
+	}
+	switch m := mounts[0]; m.Type {
+	case "bind":
+		return filepath.Join(filepath.Dir(m.Source), "layer.erofs")
+	case "overlay":
+		for _, o := range m.Options {
+			if upper, ok := strings.CutPrefix(o, "upperdir="); ok {
+				return filepath.Join(filepath.Dir(upper), "layer.erofs")
+			}
+		}
+	}
+	return ""
+}
+
+// eventsDiffer publishes the events of a differ.
+type eventsDiffer struct {
+	differ
+	events *publisher
+}
+
+func (d eventsDiffer) Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount, opts ...diff.ApplyOpt) (ocispec.Descriptor, error) {
+	applied, err := d.differ.Apply(ctx, desc, mounts, opts...)
+	// Native EROFS layers are copied as they are
+	if err == nil && !strings.HasSuffix(desc.MediaType, ".erofs") {
+		d.events.publish(ctx, "/erofs/layer/convert", &layerConvertEvent{desc.Digest.String(), desc.MediaType, applied.Size})
+	}
+	return applied, err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+	"golang.org/x/sys/unix"
+)
+
+// fileBacked reports whether the layers of root are mounted from their file
+// with mode "auto" (the default), "always" or "never".
+func fileBacked(root, mode string) (bool, error) {
+	switch mode {
+	case "", "auto":
+		return findFileBacked(root) == nil, nil
+	case "always":
+		if err := findFileBacked(root); err != nil {
+			return false, fmt.Errorf("file-backed mounts: %w", err)
+		}
+		return true, nil
+	case "never":
+		return false, nil
+	default:
+		return false, fmt.Errorf("unknown file_backed %q", mode)
+	}
+}
+
+// findFileBacked checks that the kernel mounts EROFS from regular files, as
+// Linux 6.12 or later with CONFIG_EROFS_FS_BACKED_BY_FILE, by mounting an
+// empty file in dir: the kernels without them fail with ENOTBLK.
+func findFileBacked(dir string) error {
+	f, err := os.CreateTemp(dir, "file-backed-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	target, err := os.MkdirTemp(dir, "file-backed-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(target)
+
+	err = unix.Mount(f.Name(), target, "erofs", unix.MS_RDONLY, "")
+	switch {
+	case err == nil:
+		unix.Unmount(target, unix.MNT_DETACH)
+		return nil
+	case errors.Is(err, unix.EINVAL), errors.Is(err, unix.EIO):
+		// The empty file was read
+		return nil
+	case errors.Is(err, unix.ENOTBLK):
+		return fmt.Errorf("the kernel lacks EROFS file-backed mounts: %w", errdefs.ErrNotImplemented)
+	default:
+		return err
+	}
+}
+
+// fileBackedSnapshotter returns the views of a single layer mounted from its
+// layer.erofs, instead of a loop device.
+type fileBackedSnapshotter struct {
+	snapshots.Snapshotter
+}
+
+func (s fileBackedSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.View(ctx, key, parent, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return fileBackedMounts(mounts), nil
+}
+
+func (s fileBackedSnapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.Mounts(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return fileBackedMounts(mounts), nil
+}
+
+// fileBackedMounts removes the loop option of the mount of the layer.erofs of
+// a layer, which the snapshotter returns for the views of a single layer.
+func fileBackedMounts(mounts []mount.Mount) []mount.Mount {
+	if len(mounts) != 1 || mounts[0].Type != "erofs" {
+		return mounts
+	}
+	mounts[0].Options = slices.DeleteFunc(slices.Clone(mounts[0].Options), func(o string) bool { return o == "loop" })
+	return mounts
+}
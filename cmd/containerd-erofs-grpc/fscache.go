@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+	dockerconfig "github.com/containerd/containerd/v2/core/remotes/docker/config"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/fscache"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultFscacheDir = "/var/cache/containerd-erofs-grpc/fscache"
+	defaultHostsDir   = "/etc/containerd/certs.d"
+
+	// labelSnapshotRef is the target snapshot of a Prepare, which remote
+	// snapshotters create instead
+	labelSnapshotRef = "containerd.io/snapshot.ref"
+	// labelFsid is the fscache blob of a lazily mounted layer
+	labelFsid = "containerd.io/snapshot/erofs.fsid"
+)
+
+type fscacheConfig struct {
+	// Enable mounts the EROFS layers labeled with their registry lazily,
+	// with erofs-over-fscache, instead of unpacking them
+	Enable bool `toml:"enable"`
+	// CacheDir stores the fetched blobs, defaultFscacheDir if empty
+	CacheDir string `toml:"cache_dir"`
+	// Tag names the cachefiles cache, "erofs" if empty
+	Tag string `toml:"tag"`
+	// HostsDir configures the registries as containerd, defaultHostsDir if
+	// empty
+	HostsDir string `toml:"hosts_dir"`
+	// Prefetch fetches the whole blobs in the background once mounted,
+	// and not only the ranges read
+	Prefetch bool `toml:"prefetch"`
+	// DomainID mounts the layers in a shared domain, so that their device
+	// blobs with the same tag are cached once across images
+	DomainID string `toml:"domain_id"`
+}
+
+// fscacheMounter mounts the EROFS layers lazily, fetching their blobs from
+// their registry on demand.
+type fscacheMounter struct {
+	daemon   *fscache.Daemon
+	resolver remotes.Resolver
+	domain   string
+	// spool holds the blobs being fetched, next to the cache
+	spool string
+}
+
+func newFscacheMounter(ctx context.Context, c fscacheConfig) (*fscacheMounter, error) {
+	dir, tag, hostsDir := c.CacheDir, c.Tag, c.HostsDir
+	if dir == "" {
+		dir = defaultFscacheDir
+	}
+	if tag == "" {
+		tag = fscache.DefaultTag
+	}
+	if hostsDir == "" {
+		hostsDir = defaultHostsDir
+	}
+	var opts []fscache.Opt
+	if c.Prefetch {
+		opts = append(opts, fscache.WithPrefetch())
+	}
+	spool := filepath.Join(filepath.Dir(dir), "spool")
+	if err := os.MkdirAll(spool, 0700); err != nil {
+		return nil, err
+	}
+	d, err := fscache.Open(dir, tag, opts...)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := d.Serve(ctx); err != nil {
+			log.G(ctx).WithError(err).Error("fscache daemon stopped")
+		}
+	}()
+	return &fscacheMounter{
+		daemon: d,
+		domain: c.DomainID,
+		spool:  spool,
+		resolver: docker.NewResolver(docker.ResolverOptions{
+			Hosts: dockerconfig.ConfigureHosts(ctx, dockerconfig.HostOptions{HostDir: dockerconfig.HostDirFromRoot(hostsDir)}),
+		}),
+	}, nil
+}
+
+// register serves the blob of the layer of labels as fsid, and its device
+// blobs from the image ref by their tags.
+func (m *fscacheMounter) register(ctx context.Context, fsid string, blob fscache.Blob, ref string, labels map[string]string) error {
+	devices, err := fscache.DevicesFromLabels(labels)
+	if err != nil {
+		return err
+	}
+	if len(devices) > 0 && m.domain == "" {
+		return fmt.Errorf("the device blobs of %s require a domain_id: %w", fsid, errdefs.ErrNotImplemented)
+	}
+	blobs := []fscache.Blob{}
+	for _, desc := range devices {
+		b, err := fscache.NewRemoteBlob(context.WithoutCancel(ctx), m.resolver, ref, desc, m.spool)
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, b)
+	}
+	m.daemon.Register(fsid, blob)
+	for i, desc := range devices {
+		m.daemon.Register(desc.Digest.Encoded(), blobs[i])
+	}
+	return nil
+}
+
+// unregister stops serving the blob fsid of the layer of labels, and its
+// device blobs unless shared with other layers.
+func (m *fscacheMounter) unregister(fsid string, labels map[string]string) {
+	m.daemon.Unregister(fsid)
+	devices, _ := fscache.DevicesFromLabels(labels)
+	for _, desc := range devices {
+		m.daemon.Unregister(desc.Digest.Encoded())
+	}
+}
+
+// snapshotter returns sn of root mounting the labeled layers lazily, if m
+// isn't nil.  The lazy layers of sn are mounted again.
+func (m *fscacheMounter) snapshotter(ctx context.Context, sn snapshots.Snapshotter, root string) (snapshots.Snapshotter, error) {
+	if m == nil {
+		return sn, nil
+	}
+	s := lazySnapshotter{sn, m, root}
+	if err := s.restore(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// lazySnapshotter creates the committed snapshots of the EROFS layers
+// labeled with their registry, when they're prepared, mounted with
+// erofs-over-fscache, as a remote snapshotter.  The layers have an empty
+// layer.erofs so that the snapshotter uses their mount.
+type lazySnapshotter struct {
+	snapshots.Snapshotter
+	fscache *fscacheMounter
+	root    string
+}
+
+func (s lazySnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	var base snapshots.Info
+	for _, o := range opts {
+		if err := o(&base); err != nil {
+			return nil, err
+		}
+	}
+	target, ok := base.Labels[labelSnapshotRef]
+	if !ok {
+		return s.Snapshotter.Prepare(ctx, key, parent, opts...)
+	}
+	if _, _, lazy := fscache.BlobFromLabels(base.Labels); !lazy {
+		return s.Snapshotter.Prepare(ctx, key, parent, opts...)
+	}
+	if _, err := s.Snapshotter.Stat(ctx, target); err == nil {
+		return nil, fmt.Errorf("target snapshot %q: %w", target, errdefs.ErrAlreadyExists)
+	}
+	if err := s.createLazy(ctx, key, parent, target, base.Labels, opts); err != nil {
+		// Unpack the layer instead
+		log.G(ctx).WithError(err).Warnf("failed to mount %s lazily", target)
+		return s.Snapshotter.Prepare(ctx, key, parent, opts...)
+	}
+	return nil, fmt.Errorf("target snapshot %q: %w", target, errdefs.ErrAlreadyExists)
+}
+
+// createLazy creates the target snapshot of the layer of labels, mounted
+// lazily, by committing the active snapshot key.
+func (s lazySnapshotter) createLazy(ctx context.Context, key, parent, target string, labels map[string]string, opts []snapshots.Opt) (retErr error) {
+	ref, desc, _ := fscache.BlobFromLabels(labels)
+	mounts, err := s.Snapshotter.Prepare(ctx, key, parent, opts...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			if err := s.Snapshotter.Remove(ctx, key); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to remove %s", key)
+			}
+		}
+	}()
+	layer := layerPath(mounts)
+	if layer == "" {
+		return fmt.Errorf("unexpected mounts of %s", key)
+	}
+	fsid := s.fsid(layer, desc.Digest.Encoded())
+	blob, err := fscache.NewRemoteBlob(context.WithoutCancel(ctx), s.fscache.resolver, ref, desc, s.fscache.spool)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(layer, nil, 0644); err != nil {
+		return err
+	}
+	if err := s.fscache.register(ctx, fsid, blob, ref, labels); err != nil {
+		return err
+	}
+	mountpoint := filepath.Join(filepath.Dir(layer), "fs")
+	if err := s.fscache.daemon.Mount(fsid, s.fscache.domain, mountpoint); err != nil {
+		s.fscache.unregister(fsid, labels)
+		return err
+	}
+
+	labels = maps.Clone(labels)
+	labels[labelFsid] = fsid
+	if err := s.Snapshotter.Commit(ctx, target, key, snapshots.WithLabels(labels)); err != nil {
+		if err := unix.Unmount(mountpoint, unix.MNT_DETACH); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to unmount %s", mountpoint)
+		}
+		s.fscache.unregister(fsid, labels)
+		return err
+	}
+	log.G(ctx).WithField("ref", ref).Infof("mounted %s lazily", desc.Digest)
+	return nil
+}
+
+// fsid returns the fscache blob of the layer whose digest is encoded and
+// layer.erofs is at layer.  It's unique to the snapshot, since the blob can't be mounted
+// twice.
+func (s lazySnapshotter) fsid(layer, encoded string) string {
+	sum := sha256.Sum256([]byte(s.root))
+	id := filepath.Base(filepath.Dir(layer))
+	return fmt.Sprintf("%.16s-%s-%s", encoded, hex.EncodeToString(sum[:4]), id)
+}
+
+func (s lazySnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.View(ctx, key, parent, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return lazyMounts(mounts), nil
+}
+
+func (s lazySnapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.Mounts(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return lazyMounts(mounts), nil
+}
+
+func (s lazySnapshotter) Remove(ctx context.Context, key string) error {
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	// The snapshotter unmounts the layer
+	if err := s.Snapshotter.Remove(ctx, key); err != nil {
+		return err
+	}
+	if fsid, ok := info.Labels[labelFsid]; ok {
+		s.fscache.unregister(fsid, info.Labels)
+	}
+	return nil
+}
+
+// restore mounts the lazy layers again, e.g. after a restart.
+func (s lazySnapshotter) restore(ctx context.Context) error {
+	err := s.Snapshotter.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		fsid := info.Labels[labelFsid]
+		ref, desc, ok := fscache.BlobFromLabels(info.Labels)
+		if fsid == "" || !ok {
+			return nil
+		}
+		id := fsid[strings.LastIndexByte(fsid, '-')+1:]
+		mountpoint := filepath.Join(s.root, "snapshots", id, "fs")
+		blob, err := fscache.NewRemoteBlob(ctx, s.fscache.resolver, ref, desc, s.fscache.spool)
+		if err != nil {
+			return err
+		}
+		if err := s.fscache.register(ctx, fsid, blob, ref, info.Labels); err != nil {
+			return err
+		}
+		// The mount of the previous daemon can't fetch anymore
+		if err := unix.Unmount(mountpoint, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+			log.G(ctx).WithError(err).Warnf("failed to unmount %s", mountpoint)
+		}
+		if err := s.fscache.daemon.Mount(fsid, s.fscache.domain, mountpoint); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to mount %s lazily", info.Name)
+		}
+		return nil
+	}, fmt.Sprintf(`kind==committed,labels."%s"`, labelFsid))
+	// No snapshot yet
+	if errdefs.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// lazyMounts replaces the loop mount of the empty layer.erofs of a lazy
+// layer, which the snapshotter returns for the views of a single layer, with
+// a bind mount of the layer.
+func lazyMounts(mounts []mount.Mount) []mount.Mount {
+	if len(mounts) != 1 || mounts[0].Type != "erofs" {
+		return mounts
+	}
+	if st, err := os.Stat(mounts[0].Source); err != nil || st.Size() > 0 {
+		return mounts
+	}
+	return []mount.Mount{{
+		Type:    "bind",
+		Source:  filepath.Join(filepath.Dir(mounts[0].Source), "fs"),
+		Options: []string{"ro", "rbind"},
+	}}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/verity"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// fsverityDigestFile records the fs-verity digest annotation of an
+	// applied layer, next to its layer.erofs, for the snapshotter
+	fsverityDigestFile = "layer.erofs.fsverity"
+
+	// labelFsverityDigest is the fs-verity digest of a committed layer
+	labelFsverityDigest = "containerd.io/snapshot/erofs.fsverity.digest"
+)
+
+type fsverityConfig struct {
+	// Policy is "off" (the default) to mount the layers unverified, "log"
+	// to log the layers which don't match their fs-verity digest
+	// annotation, or "enforce" to refuse to mount them
+	Policy string `toml:"policy"`
+}
+
+func (c fsverityConfig) check() error {
+	switch c.Policy {
+	case "", "off", "log", "enforce":
+		return nil
+	default:
+		return fmt.Errorf("unknown fsverity policy %q", c.Policy)
+	}
+}
+
+// enabled reports whether the layers are verified.
+func (c fsverityConfig) enabled() bool {
+	return c.Policy == "log" || c.Policy == "enforce"
+}
+
+// fsveritySnapshotter verifies the layers labeled by idSnapshotter with an
+// fs-verity digest annotation before the snapshots of their children are
+// mounted.  fs-verity is enabled on their layer.erofs if the filesystem
+// supports it, so that the kernel measures them and fails the reads of
+// modified blocks, or their digest is computed.  The layers verified are
+// cached until their layer.erofs changes.
+type fsveritySnapshotter struct {
+	snapshots.Snapshotter
+	root string
+	// enforce refuses to mount the layers which don't match, instead of
+	// logging them
+	enforce  bool
+	verified *verifiedLayers
+}
+
+// verifiedLayers are the layer.erofs verified, by path.
+type verifiedLayers struct {
+	mu     sync.Mutex
+	layers map[string]verifiedLayer
+}
+
+// verifiedLayer is a layer.erofs verified, as it was then.
+type verifiedLayer struct {
+	digest digest.Digest
+	ino    uint64
+	size   int64
+	ctime  unix.Timespec
+}
+
+func newFsveritySnapshotter(sn snapshots.Snapshotter, root string, c fsverityConfig) fsveritySnapshotter {
+	return fsveritySnapshotter{sn, root, c.Policy == "enforce", &verifiedLayers{layers: map[string]verifiedLayer{}}}
+}
+
+func (s fsveritySnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	if err := s.check(ctx, parent); err != nil {
+		return nil, err
+	}
+	return s.Snapshotter.Prepare(ctx, key, parent, opts...)
+}
+
+func (s fsveritySnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	if err := s.check(ctx, parent); err != nil {
+		return nil, err
+	}
+	return s.Snapshotter.View(ctx, key, parent, opts...)
+}
+
+func (s fsveritySnapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.check(ctx, info.Parent); err != nil {
+		return nil, err
+	}
+	return s.Snapshotter.Mounts(ctx, key)
+}
+
+func (s fsveritySnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	id, ok := info.Labels[labelSnapshotID]
+	if !ok {
+		return s.Snapshotter.Commit(ctx, name, key, opts...)
+	}
+	dgst, err := os.ReadFile(filepath.Join(s.root, "snapshots", id, fsverityDigestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return s.Snapshotter.Commit(ctx, name, key, opts...)
+	} else if err != nil {
+		return err
+	}
+	return s.Snapshotter.Commit(ctx, name, key, append(opts, snapshots.WithLabels(map[string]string{labelFsverityDigest: string(dgst), labelSnapshotID: id}))...)
+}
+
+func (s fsveritySnapshotter) Remove(ctx context.Context, key string) error {
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := s.Snapshotter.Remove(ctx, key); err != nil {
+		return err
+	}
+	if id, ok := info.Labels[labelSnapshotID]; ok {
+		s.verified.mu.Lock()
+		delete(s.verified.layers, filepath.Join(s.root, "snapshots", id, "layer.erofs"))
+		s.verified.mu.Unlock()
+	}
+	return nil
+}
+
+// check verifies the layers of the chain of parent, and fails if one
+// doesn't match its fs-verity digest and the policy is enforced.
+func (s fsveritySnapshotter) check(ctx context.Context, parent string) error {
+	for parent != "" {
+		info, err := s.Snapshotter.Stat(ctx, parent)
+		if err != nil {
+			return err
+		}
+		if expected, ok := info.Labels[labelFsverityDigest]; ok {
+			layer := filepath.Join(s.root, "snapshots", info.Labels[labelSnapshotID], "layer.erofs")
+			if err := s.verify(ctx, layer, digest.Digest(expected)); err != nil {
+				if s.enforce {
+					return fmt.Errorf("layer %s: %w", parent, err)
+				}
+				log.G(ctx).WithError(err).Warnf("layer %s failed the fs-verity check", parent)
+			}
+		}
+		parent = info.Parent
+	}
+	return nil
+}
+
+// verify checks that the layer.erofs at path has the fs-verity digest
+// expected, unless already verified as it is.
+func (s fsveritySnapshotter) verify(ctx context.Context, path string, expected digest.Digest) error {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return err
+	}
+	s.verified.mu.Lock()
+	v, ok := s.verified.layers[path]
+	s.verified.mu.Unlock()
+	if ok && v.digest == expected && v.ino == st.Ino && v.size == st.Size && v.ctime == st.Ctim {
+		return nil
+	}
+
+	dgst, err := measureFsverity(path)
+	if errors.Is(err, unix.ENODATA) {
+		// Not enabled yet
+		if err = enableFsverity(path); err == nil {
+			dgst, err = measureFsverity(path)
+		} else {
+			log.G(ctx).WithError(err).Debugf("failed to enable fs-verity on %s", path)
+		}
+	}
+	// fs-verity may also be enabled with other parameters than the
+	// annotation, e.g. by the EROFS snapshotter
+	if err != nil || dgst != expected {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if dgst, err = verity.FsverityDigest(f); err != nil {
+			return err
+		}
+	}
+	if dgst != expected {
+		return fmt.Errorf("fs-verity digest %s, expected %s: %w", dgst, expected, errdefs.ErrFailedPrecondition)
+	}
+
+	// Enabling fs-verity changes the ctime
+	if err := unix.Stat(path, &st); err != nil {
+		return err
+	}
+	s.verified.mu.Lock()
+	s.verified.layers[path] = verifiedLayer{expected, st.Ino, st.Size, st.Ctim}
+	s.verified.mu.Unlock()
+	return nil
+}
+
+// measureFsverity returns the fs-verity digest of the file at path, as
+// measured by the kernel.  It fails with ENODATA if fs-verity isn't enabled
+// on the file.
+func measureFsverity(path string) (digest.Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// struct fsverity_digest, followed by the digest
+	var buf struct {
+		unix.FsverityDigest
+		digest [64]byte
+	}
+	buf.Size = uint16(len(buf.digest))
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_MEASURE_VERITY, uintptr(unsafe.Pointer(&buf))); errno != 0 {
+		return "", errno
+	}
+	if buf.Algorithm != unix.FS_VERITY_HASH_ALG_SHA256 {
+		return "", fmt.Errorf("fs-verity hash algorithm %d: %w", buf.Algorithm, errdefs.ErrNotImplemented)
+	}
+	return digest.NewDigestFromBytes(digest.SHA256, buf.digest[:buf.Size]), nil
+}
+
+// enableFsverity enables fs-verity on the file at path, with the parameters
+// of the digest annotations.  The immutable flag the EROFS snapshotter sets
+// on the layers is cleared meanwhile, as fs-verity requires write access, and
+// set again if it was set.
+func enableFsverity(path string) (retErr error) {
+	immutable, err := updateImmutable(path, false)
+	if err != nil {
+		return fmt.Errorf("failed to clear the immutable flag: %w", err)
+	}
+	if immutable {
+		defer func() {
+			if err := setImmutable(path, true); err != nil && retErr == nil {
+				retErr = fmt.Errorf("failed to set the immutable flag again: %w", err)
+			}
+		}()
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	arg := unix.FsverityEnableArg{Version: 1, Hash_algorithm: unix.FS_VERITY_HASH_ALG_SHA256, Block_size: verity.BlockSize}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_ENABLE_VERITY, uintptr(unsafe.Pointer(&arg))); errno != 0 && errno != unix.EEXIST {
+		return errno
+	}
+	return nil
+}
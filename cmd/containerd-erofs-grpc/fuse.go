@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/plugins/snapshots/overlay"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultErofsfuse = "erofsfuse"
+
+	// labelFuse is the id of the snapshot of a layer mounted with erofsfuse
+	labelFuse = "containerd.io/snapshot/erofs.fuse"
+)
+
+// newFuseSnapshotter returns the snapshotter of root mounting the EROFS
+// layers with erofsfuse instead of the kernel, e.g. for rootless containerd or
+// kernels without EROFS.  It's the overlayfs snapshotter, with the layout of
+// the EROFS snapshotter so that the EROFS differ writes the layer.erofs of the
+// layers, which are mounted on their fs directory once committed.  The layers
+// are mounted again if their erofsfuse is gone, e.g. after a reboot.
+func newFuseSnapshotter(ctx context.Context, root string, c snapshotterConfig) (snapshots.Snapshotter, error) {
+	if c.EnableFsverity {
+		return nil, fmt.Errorf("fs-verity requires the kernel mounts: %w", errdefs.ErrNotImplemented)
+	}
+	erofsfuse := c.Erofsfuse
+	if erofsfuse == "" {
+		erofsfuse = defaultErofsfuse
+	}
+	erofsfuse, err := exec.LookPath(erofsfuse)
+	if err != nil {
+		return nil, err
+	}
+	var opts []overlay.Opt
+	if len(c.OvlOptions) > 0 {
+		opts = append(opts, overlay.WithMountOptions(c.OvlOptions))
+	}
+	sn, err := overlay.NewSnapshotter(root, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s := fuseSnapshotter{sn, root, erofsfuse}
+	if err := s.restore(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type fuseSnapshotter struct {
+	snapshots.Snapshotter
+	root      string
+	erofsfuse string
+}
+
+func (s fuseSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.Prepare(ctx, key, parent, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// Let the EROFS differ write the layer.erofs of the snapshot, as for the
+	// EROFS snapshotter
+	if layer := layerPath(mounts); layer != "" {
+		if err := os.WriteFile(filepath.Join(filepath.Dir(layer), ".erofslayer"), nil, 0644); err != nil {
+			if err := s.Snapshotter.Remove(ctx, key); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to remove %s", key)
+			}
+			return nil, err
+		}
+	}
+	return mounts, nil
+}
+
+func (s fuseSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	mounts, err := s.Snapshotter.Mounts(ctx, key)
+	if err != nil {
+		return err
+	}
+	layer := layerPath(mounts)
+	if st, err := os.Stat(layer); layer == "" || err != nil || st.Size() == 0 {
+		// Not an applied layer, e.g. the rootfs of a container
+		return s.Snapshotter.Commit(ctx, name, key, opts...)
+	}
+	mountpoint := filepath.Join(filepath.Dir(layer), "fs")
+	if err := s.mount(ctx, layer, mountpoint); err != nil {
+		return err
+	}
+	id := filepath.Base(filepath.Dir(layer))
+	opts = append(opts, snapshots.WithLabels(map[string]string{labelFuse: id}))
+	if err := s.Snapshotter.Commit(ctx, name, key, opts...); err != nil {
+		if err := unmountFuse(mountpoint); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to unmount %s", mountpoint)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s fuseSnapshotter) Remove(ctx context.Context, key string) error {
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	id, ok := info.Labels[labelFuse]
+	if !ok {
+		return s.Snapshotter.Remove(ctx, key)
+	}
+	// The overlayfs snapshotter removes the directory of the snapshot, which
+	// must not be mounted anymore
+	dir := filepath.Join(s.root, "snapshots", id)
+	if err := unmountFuse(filepath.Join(dir, "fs")); err != nil {
+		return err
+	}
+	if err := s.Snapshotter.Remove(ctx, key); err != nil {
+		// Still used, e.g. by a child
+		if err := s.mount(ctx, filepath.Join(dir, "layer.erofs"), filepath.Join(dir, "fs")); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to mount %s again", key)
+		}
+		return err
+	}
+	return nil
+}
+
+// restore mounts the layers whose erofsfuse is gone.
+func (s fuseSnapshotter) restore(ctx context.Context) error {
+	err := s.Snapshotter.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		dir := filepath.Join(s.root, "snapshots", info.Labels[labelFuse])
+		mountpoint := filepath.Join(dir, "fs")
+		var st unix.Statfs_t
+		if err := unix.Statfs(mountpoint, &st); err == nil && st.Type == unix.FUSE_SUPER_MAGIC {
+			return nil
+		}
+		// The mount of a dead erofsfuse fails with ENOTCONN
+		if err := unmountFuse(mountpoint); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to unmount %s", mountpoint)
+		}
+		if err := s.mount(ctx, filepath.Join(dir, "layer.erofs"), mountpoint); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to mount %s", info.Name)
+		}
+		return nil
+	}, fmt.Sprintf(`kind==committed,labels."%s"`, labelFuse))
+	// No snapshot yet
+	if errdefs.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// mount mounts layer on mountpoint with erofsfuse, which runs in the
+// background once mounted.
+func (s fuseSnapshotter) mount(ctx context.Context, layer, mountpoint string) error {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.erofsfuse, layer, mountpoint)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	// Don't wait for the output of the daemonized erofsfuse
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil && !errors.Is(err, exec.ErrWaitDelay) {
+		return fmt.Errorf("erofsfuse %s: %w: %s", layer, err, bytes.TrimSpace(out.Bytes()))
+	}
+	return nil
+}
+
+// unmountFuse unmounts the erofsfuse mount at mountpoint, if any, with
+// fusermount3 if not allowed to, e.g. outside of the user namespace of the
+// mount.
+func unmountFuse(mountpoint string) error {
+	err := unix.Unmount(mountpoint, unix.MNT_DETACH)
+	switch {
+	case err == nil, errors.Is(err, unix.EINVAL), errors.Is(err, unix.ENOENT):
+		return nil
+	case errors.Is(err, unix.EPERM):
+		if out, err := exec.Command("fusermount3", "-u", "-z", mountpoint).CombinedOutput(); err != nil {
+			return fmt.Errorf("fusermount3 -u %s: %w: %s", mountpoint, err, bytes.TrimSpace(out))
+		}
+		return nil
+	default:
+		return fmt.Errorf("failed to unmount %s: %w", mountpoint, err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/containerd/log"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	healthInterval = 10 * time.Second
+	healthTimeout  = 5 * time.Second
+)
+
+// checkHealth sets the serving status of the services in hs from their health
+// checks every healthInterval until ctx is done.  The status of the whole
+// server is serving if all of them are.
+func checkHealth(ctx context.Context, hs *health.Server, checks map[string]func(context.Context) error) {
+	check := func() {
+		var errs []error
+		for _, service := range slices.Sorted(maps.Keys(checks)) {
+			err := checks[service](ctx)
+			setHealth(ctx, hs, service, err)
+			errs = append(errs, err)
+		}
+		setHealth(ctx, hs, "", errors.Join(errs...))
+	}
+
+	check()
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
+
+// setHealth sets the serving status of service from the error of its health
+// check, logging the changes.
+func setHealth(ctx context.Context, hs *health.Server, service string, err error) {
+	status := healthpb.HealthCheckResponse_SERVING
+	if err != nil {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	if service != "" {
+		prev, _ := hs.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		switch {
+		case err != nil && prev.GetStatus() != status:
+			log.G(ctx).WithError(err).Warnf("%s unhealthy", service)
+		case err == nil && prev.GetStatus() == healthpb.HealthCheckResponse_NOT_SERVING:
+			log.G(ctx).Infof("%s healthy again", service)
+		}
+	}
+	hs.SetServingStatus(service, status)
+}
+
+// rootHealth returns the health check of a snapshotter root, which must be
+// writable.
+func rootHealth(root string) func(context.Context) error {
+	return func(context.Context) error {
+		return checkRoot(root)
+	}
+}
+
+func checkRoot(root string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(root, &st); err != nil {
+		return err
+	}
+	if st.Flags&unix.ST_RDONLY != 0 {
+		return fmt.Errorf("%s is read-only", root)
+	}
+	return unix.Access(root, unix.W_OK)
+}
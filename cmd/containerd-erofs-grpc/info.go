@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	infoapi "github.com/erofs/erofs-container-toolkit/api/info/v1"
+	"golang.org/x/sys/unix"
+)
+
+// decompressors are the kernel options of the EROFS decompressors.
+var decompressors = []struct {
+	option string
+	name   string
+}{
+	{"CONFIG_EROFS_FS_ZIP", "lz4"},
+	{"CONFIG_EROFS_FS_ZIP_LZMA", "lzma"},
+	{"CONFIG_EROFS_FS_ZIP_DEFLATE", "deflate"},
+	{"CONFIG_EROFS_FS_ZIP_ZSTD", "zstd"},
+}
+
+// infoService reports the EROFS capabilities of the node, probing the kernel
+// in the snapshotter root on every call, so that modules loaded since are
+// seen.
+type infoService struct {
+	root string
+
+	infoapi.UnimplementedInfoServer
+}
+
+func (s *infoService) Info(ctx context.Context, _ *infoapi.InfoRequest) (*infoapi.InfoResponse, error) {
+	resp := &infoapi.InfoResponse{
+		Kernel:        kernelRelease(),
+		Erofs:         hasFilesystem("erofs"),
+		Decompressors: kernelDecompressors(),
+		Loop:          hasLoop(),
+		FileBacked:    findFileBacked(s.root) == nil,
+		Fsverity:      hasFsverity(s.root),
+	}
+	if entries, err := os.ReadDir("/sys/fs/erofs/features"); err == nil {
+		for _, e := range entries {
+			resp.Features = append(resp.Features, e.Name())
+		}
+	}
+	if out, err := exec.CommandContext(ctx, "mkfs.erofs", "-V").Output(); err == nil {
+		resp.ErofsUtils = strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	}
+	return resp, nil
+}
+
+func kernelRelease() string {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(uts.Release[:])
+}
+
+// hasFilesystem checks if the kernel lists fs in /proc/filesystems.
+func hasFilesystem(fs string) bool {
+	b, err := os.ReadFile("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[len(fields)-1] == fs {
+			return true
+		}
+	}
+	return false
+}
+
+// kernelDecompressors returns the EROFS decompressors enabled in the kernel
+// configuration, from /proc/config.gz or /boot.
+func kernelDecompressors() []string {
+	var r io.Reader
+	if f, err := os.Open("/proc/config.gz"); err == nil {
+		defer f.Close()
+		if r, err = gzip.NewReader(f); err != nil {
+			return nil
+		}
+	} else if f, err := os.Open(filepath.Join("/boot", "config-"+kernelRelease())); err == nil {
+		defer f.Close()
+		r = f
+	} else {
+		return nil
+	}
+	enabled := map[string]bool{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if k, v, ok := strings.Cut(s.Text(), "="); ok && (v == "y" || v == "m") {
+			enabled[k] = true
+		}
+	}
+	var names []string
+	for _, d := range decompressors {
+		if enabled[d.option] {
+			names = append(names, d.name)
+		}
+	}
+	return names
+}
+
+// hasLoop checks if a loop device can be allocated.
+func hasLoop() bool {
+	f, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = unix.IoctlRetInt(int(f.Fd()), unix.LOOP_CTL_GET_FREE)
+	return err == nil
+}
+
+// hasFsverity checks if the filesystem of dir supports fs-verity, by enabling
+// it on a temporary file.
+func hasFsverity(dir string) bool {
+	f, err := os.CreateTemp(dir, "fsverity-")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte{0})
+	// fs-verity can't be enabled on a file open for writing
+	if cerr := f.Close(); err != nil || cerr != nil {
+		return false
+	}
+	ro, err := os.Open(f.Name())
+	if err != nil {
+		return false
+	}
+	defer ro.Close()
+	arg := unix.FsverityEnableArg{Version: 1, Hash_algorithm: unix.FS_VERITY_HASH_ALG_SHA256, Block_size: 4096}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, ro.Fd(), unix.FS_IOC_ENABLE_VERITY, uintptr(unsafe.Pointer(&arg)))
+	return errno == 0 || errors.Is(errno, unix.EEXIST)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/containerd/containerd/v2/core/diff"
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type limitsConfig struct {
+	// MaxApplies, MaxCompares and MaxPrepares bound the concurrent diff
+	// Apply, diff Compare and snapshot Prepare calls, unbounded if 0
+	MaxApplies  int `toml:"max_applies"`
+	MaxCompares int `toml:"max_compares"`
+	MaxPrepares int `toml:"max_prepares"`
+	// MaxConversions bounds the concurrent image conversions of the
+	// conversion API, unbounded if 0
+	MaxConversions int `toml:"max_conversions"`
+	// MaxQueued bounds the calls waiting for each limit, beyond which they
+	// fail as exhausted, unbounded if 0
+	MaxQueued int `toml:"max_queued"`
+}
+
+// limiter bounds the concurrent operations op, unless its limit is 0.  The
+// operations over the limit are queued by namespace, and admitted from each
+// namespace in turn so that a namespace unpacking a large image doesn't starve
+// the others.
+type limiter struct {
+	op        string
+	max       int
+	maxQueued int
+
+	mu      sync.Mutex
+	running int
+	queued  int
+	queues  map[string][]chan struct{}
+	// order are the namespaces with queued operations, next first
+	order []string
+}
+
+func newLimiter(op string, max, maxQueued int) *limiter {
+	return &limiter{op: op, max: max, maxQueued: maxQueued, queues: map[string][]chan struct{}{}}
+}
+
+// set changes the limits, admitting the queued operations now under them.
+// The operations queued over a lower maxQueued stay queued.
+func (l *limiter) set(max, maxQueued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max, l.maxQueued = max, maxQueued
+	l.admit()
+}
+
+func (l *limiter) full() bool {
+	return l.max > 0 && l.running >= l.max
+}
+
+// acquire waits for the operation of ctx to be admitted, until ctx is done.
+// It must be released after.
+func (l *limiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if !l.full() && l.queued == 0 {
+		l.running++
+		l.mu.Unlock()
+		return nil
+	}
+	if l.maxQueued > 0 && l.queued >= l.maxQueued {
+		l.mu.Unlock()
+		return fmt.Errorf("too many queued %s operations: %w", l.op, errdefs.ErrResourceExhausted)
+	}
+	ns, _ := namespaces.Namespace(ctx)
+	ch := make(chan struct{})
+	if len(l.queues[ns]) == 0 {
+		l.order = append(l.order, ns)
+	}
+	l.queues[ns] = append(l.queues[ns], ch)
+	l.setQueued(l.queued + 1)
+	l.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-ch:
+		// Admitted meanwhile
+		l.running--
+		l.admit()
+	default:
+		l.queues[ns] = slices.DeleteFunc(l.queues[ns], func(c chan struct{}) bool { return c == ch })
+		if len(l.queues[ns]) == 0 {
+			delete(l.queues, ns)
+			l.order = slices.DeleteFunc(l.order, func(n string) bool { return n == ns })
+		}
+		l.setQueued(l.queued - 1)
+	}
+	return fmt.Errorf("waiting to %s: %w", l.op, ctx.Err())
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	l.admit()
+}
+
+// admit admits the queued operations up to the limit, one namespace after the
+// other.
+func (l *limiter) admit() {
+	for !l.full() && len(l.order) > 0 {
+		ns := l.order[0]
+		l.order = l.order[1:]
+		ch := l.queues[ns][0]
+		if l.queues[ns] = l.queues[ns][1:]; len(l.queues[ns]) > 0 {
+			l.order = append(l.order, ns)
+		} else {
+			delete(l.queues, ns)
+		}
+		l.setQueued(l.queued - 1)
+		l.running++
+		close(ch)
+	}
+}
+
+func (l *limiter) setQueued(n int) {
+	l.queued = n
+	queuedGauge.WithValues(l.op).Set(float64(n))
+}
+
+// limitedSnapshotter limits the concurrent Prepare calls of a snapshotter.
+type limitedSnapshotter struct {
+	snapshots.Snapshotter
+	prepare *limiter
+}
+
+func (s limitedSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	if err := s.prepare.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.prepare.release()
+	return s.Snapshotter.Prepare(ctx, key, parent, opts...)
+}
+
+func (s limitedSnapshotter) Cleanup(ctx context.Context) error {
+	return cleanup(ctx, s.Snapshotter)
+}
+
+// limitedDiffer limits the concurrent operations of a differ.
+type limitedDiffer struct {
+	differ
+	apply, compare *limiter
+}
+
+func (d limitedDiffer) Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount, opts ...diff.ApplyOpt) (ocispec.Descriptor, error) {
+	if err := d.apply.acquire(ctx); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer d.apply.release()
+	return d.differ.Apply(ctx, desc, mounts, opts...)
+}
+
+func (d limitedDiffer) Compare(ctx context.Context, lower, upper []mount.Mount, opts ...diff.Opt) (ocispec.Descriptor, error) {
+	if err := d.compare.acquire(ctx); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer d.compare.release()
+	return d.differ.Compare(ctx, lower, upper, opts...)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/log"
+	"github.com/coreos/go-systemd/v22/journal"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/grpclog"
+)
+
+// setupLog applies the log configuration.  The logs of gRPC are routed to the
+// same logger as the ones of the snapshotter and differ.
+func setupLog(c logConfig) error {
+	if c.Level != "" {
+		if err := log.SetLevel(c.Level); err != nil {
+			return err
+		}
+	}
+	if c.Format != "" {
+		if err := log.SetFormat(log.OutputFormat(c.Format)); err != nil {
+			return err
+		}
+	}
+
+	switch c.Output {
+	case "", "stderr":
+	case "journald":
+		if !journal.Enabled() {
+			return fmt.Errorf("journald is not available")
+		}
+		log.L.Logger.SetOutput(io.Discard)
+		log.L.Logger.AddHook(journalHook{})
+	default:
+		if !filepath.IsAbs(c.Output) {
+			return fmt.Errorf("invalid log output %q: must be stderr, journald or an absolute path", c.Output)
+		}
+		f, err := os.OpenFile(c.Output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		log.L.Logger.SetOutput(f)
+	}
+
+	grpclog.SetLoggerV2(grpclog.NewLoggerV2(io.Discard, log.L.WriterLevel(logrus.WarnLevel), log.L.WriterLevel(logrus.ErrorLevel)))
+	return nil
+}
+
+// journalHook sends the log entries to journald, with their fields.
+type journalHook struct{}
+
+func (journalHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (journalHook) Fire(entry *logrus.Entry) error {
+	vars := make(map[string]string, len(entry.Data))
+	for k, v := range entry.Data {
+		if f := journalField(k); f != "" {
+			vars[f] = fmt.Sprint(v)
+		}
+	}
+	return journal.Send(entry.Message, journalPriority(entry.Level), vars)
+}
+
+// journalField returns the journal field name of a log field: uppercase
+// letters, digits and underscores, not starting with an underscore.
+func journalField(k string) string {
+	k = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, k)
+	return strings.TrimLeft(k, "_")
+}
+
+func journalPriority(l logrus.Level) journal.Priority {
+	switch l {
+	case logrus.PanicLevel:
+		return journal.PriEmerg
+	case logrus.FatalLevel:
+		return journal.PriCrit
+	case logrus.ErrorLevel:
+		return journal.PriErr
+	case logrus.WarnLevel:
+		return journal.PriWarning
+	case logrus.InfoLevel:
+		return journal.PriInfo
+	default:
+		return journal.PriDebug
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/loop"
+	"github.com/moby/sys/mountinfo"
+	"golang.org/x/sys/unix"
+)
+
+// erofsSuperMagic is the filesystem type of the EROFS mounts
+const erofsSuperMagic = 0xE0F5E1E2
+
+type loopConfig struct {
+	// Enable mounts the layers from a pool of loop devices managed by
+	// containerd-erofs-grpc
+	Enable bool `toml:"enable"`
+	// MaxDevices bounds the loop devices attached, unbounded if 0
+	MaxDevices int `toml:"max_devices"`
+	// MaxFree is the number of detached loop devices kept for reuse
+	MaxFree int `toml:"max_free"`
+	// DirectIO reads the layers with direct I/O, without caching them twice
+	DirectIO bool `toml:"direct_io"`
+}
+
+// loopSnapshotter mounts the layers labeled by idSnapshotter on their fs
+// directory from the loop devices of its pool, or from their file, before
+// mounting their children, so that the EROFS snapshotter uses them instead of
+// attaching its own.  The devices are released when the layers are removed.
+type loopSnapshotter struct {
+	snapshots.Snapshotter
+	root string
+	pool *loop.Pool
+	// options are the EROFS mount options of the layers
+	options string
+	// fileBacked mounts the layers from their file instead of the pool
+	fileBacked bool
+}
+
+// newLoopSnapshotter returns sn of root with a pool of loop devices
+// configured with c, mounting the layers with options, from their file if
+// fileBacked.  The devices of the mounted layers of sn are adopted by
+// the pool, and the others detached.
+func newLoopSnapshotter(ctx context.Context, sn snapshots.Snapshotter, root string, c loopConfig, options string, fileBacked bool) (loopSnapshotter, error) {
+	opts := []loop.Opt{loop.WithMaxDevices(c.MaxDevices), loop.WithMaxFree(c.MaxFree)}
+	if c.DirectIO {
+		opts = append(opts, loop.WithDirectIO())
+	}
+	s := loopSnapshotter{sn, root, loop.NewPool(opts...), options, fileBacked}
+	adopted, detached, err := s.pool.Reclaim(filepath.Join(root, "snapshots"), func(path, dev string) bool {
+		mounts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter(filepath.Join(filepath.Dir(path), "fs")))
+		return err == nil && len(mounts) == 1 && mounts[0].Source == dev
+	})
+	if err != nil {
+		return loopSnapshotter{}, fmt.Errorf("failed to reclaim the loop devices of %s: %w", root, err)
+	}
+	if adopted > 0 || detached > 0 {
+		log.G(ctx).WithField("root", root).Infof("adopted %d loop devices, detached %d", adopted, detached)
+	}
+	return s, nil
+}
+
+func (s loopSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	if err := s.mountParents(ctx, parent); err != nil {
+		return nil, err
+	}
+	return s.Snapshotter.Prepare(ctx, key, parent, opts...)
+}
+
+func (s loopSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	if err := s.mountParents(ctx, parent); err != nil {
+		return nil, err
+	}
+	mounts, err := s.Snapshotter.View(ctx, key, parent, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return loopMounts(mounts), nil
+}
+
+func (s loopSnapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.Mounts(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return loopMounts(mounts), nil
+}
+
+func (s loopSnapshotter) Remove(ctx context.Context, key string) error {
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	// The snapshotter unmounts the layer
+	if err := s.Snapshotter.Remove(ctx, key); err != nil {
+		return err
+	}
+	if id, ok := info.Labels[labelSnapshotID]; ok && info.Kind == snapshots.KindCommitted {
+		if err := s.pool.Release(filepath.Join(s.root, "snapshots", id, "layer.erofs")); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to release the loop device of %s", key)
+		}
+	}
+	return nil
+}
+
+// mountParents mounts the layers of the chain of parent which aren't mounted
+// yet.
+func (s loopSnapshotter) mountParents(ctx context.Context, parent string) error {
+	for parent != "" {
+		info, err := s.Snapshotter.Stat(ctx, parent)
+		if err != nil {
+			return err
+		}
+		if id, ok := info.Labels[labelSnapshotID]; ok {
+			if err := s.mount(filepath.Join(s.root, "snapshots", id)); err != nil {
+				return fmt.Errorf("layer %s: %w", parent, err)
+			}
+		}
+		parent = info.Parent
+	}
+	return nil
+}
+
+// mount mounts the layer.erofs of the snapshot directory dir on its fs
+// directory, unless already mounted, e.g. lazily or from dm-verity.
+func (s loopSnapshotter) mount(dir string) error {
+	mountpoint := filepath.Join(dir, "fs")
+	var st unix.Statfs_t
+	if err := unix.Statfs(mountpoint, &st); err != nil {
+		return err
+	}
+	if uint32(st.Type) == erofsSuperMagic {
+		return nil
+	}
+	layer := filepath.Join(dir, "layer.erofs")
+	if fi, err := os.Stat(layer); err != nil || fi.Size() == 0 {
+		return err
+	}
+	if s.fileBacked {
+		if err := unix.Mount(layer, mountpoint, "erofs", unix.MS_RDONLY, s.options); err != nil {
+			return fmt.Errorf("failed to mount %s on %s: %w", layer, mountpoint, err)
+		}
+		return nil
+	}
+	dev, err := s.pool.Attach(layer)
+	if err != nil {
+		return err
+	}
+	if err := unix.Mount(dev, mountpoint, "erofs", unix.MS_RDONLY, s.options); err != nil {
+		s.pool.Release(layer)
+		return fmt.Errorf("failed to mount %s on %s: %w", dev, mountpoint, err)
+	}
+	return nil
+}
+
+// loopMounts replaces the loop mount of the layer.erofs of a layer, which the
+// snapshotter returns for the views of a single layer, with a bind mount of
+// the layer once mounted from the pool.
+func loopMounts(mounts []mount.Mount) []mount.Mount {
+	if len(mounts) != 1 || mounts[0].Type != "erofs" {
+		return mounts
+	}
+	mountpoint := filepath.Join(filepath.Dir(mounts[0].Source), "fs")
+	var st unix.Statfs_t
+	if err := unix.Statfs(mountpoint, &st); err != nil || uint32(st.Type) != erofsSuperMagic {
+		return mounts
+	}
+	return []mount.Mount{{Type: "bind", Source: mountpoint, Options: []string{"ro", "rbind"}}}
+}
@@ -2,90 +2,388 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
-	"sync/atomic"
+	"time"
 
 	diffapi "github.com/containerd/containerd/api/services/diff/v1"
 	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
 	containerd "github.com/containerd/containerd/v2/client"
 	"github.com/containerd/containerd/v2/contrib/diffservice"
-	"github.com/containerd/containerd/v2/contrib/snapshotservice"
+	"github.com/containerd/containerd/v2/core/content"
 	"github.com/containerd/containerd/v2/core/diff"
+	"github.com/containerd/containerd/v2/core/diff/apply"
 	"github.com/containerd/containerd/v2/core/mount"
 	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/containerd/v2/plugins/content/local"
 	erofsdiff "github.com/containerd/containerd/v2/plugins/diff/erofs"
-	snapshot "github.com/containerd/containerd/v2/plugins/snapshots/erofs"
-	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"github.com/containerd/containerd/v2/plugins/diff/walking"
+	"github.com/containerd/log"
+	"github.com/coreos/go-systemd/v22/daemon"
+	conversionapi "github.com/erofs/erofs-container-toolkit/api/conversion/v1"
+	"github.com/erofs/erofs-container-toolkit/pkg/reaper"
+	"github.com/erofs/erofs-container-toolkit/pkg/sandbox"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
 )
 
 var (
+	configPath     = flag.String("config", defaultConfigPath, "Path to the configuration file")
 	rootDir        = flag.String("root", "/var/lib/containerd-erofs/snapshotter", "EROFS snapshotter root directory")
 	sockAddr       = flag.String("addr", "/run/containerd-erofs-grpc/containerd-erofs-grpc.sock", "Socket path to listen on")
 	containerdAddr = flag.String("containerd-addr", "/run/containerd/containerd.sock", "Address for containerd's GRPC server")
+	reapInterval   = flag.Duration("reap-interval", time.Hour, "Interval for reaping stale conversion leftovers (0 to disable)")
+	reapAge        = flag.Duration("reap-age", reaper.DefaultMaxAge, "Age after which conversion leftovers are considered stale")
 )
 
 func main() {
+	// The mkfs.erofs sandbox runs this executable
+	sandbox.Main()
 	flag.Parse()
 
-	if err := serve(*containerdAddr, *sockAddr, *rootDir); err != nil {
-		fmt.Printf("error: %v\n", err)
-		os.Exit(1)
+	explicit := false
+	flag.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "config" })
+	cfg, err := loadConfig(*configPath, explicit)
+	if err == nil {
+		err = setupLog(cfg.Log)
+	}
+	if err == nil {
+		err = serve(cfg, func() (*config, error) { return loadConfig(*configPath, explicit) })
+	}
+	if err != nil {
+		log.L.WithError(err).Fatal("containerd-erofs-grpc failed")
 	}
 }
 
-func serve(containerdAddress, address, root string) error {
-	// Prepare the address directory
-	if err := os.MkdirAll(filepath.Dir(address), 0700); err != nil {
+// serve serves cfg until SIGTERM, and applies the configuration loaded again
+// by reload on SIGHUP.
+func serve(cfg *config, reload func() (*config, error)) error {
+	shutdownTracing, err := setupTracing(context.Background(), cfg.Tracing)
+	if err != nil {
 		return err
 	}
-	// Remove the socket if exist to avoid EADDRINUSE
-	if err := os.RemoveAll(address); err != nil {
-		return err
+	defer shutdownTracing(context.Background())
+
+	roots := []string{cfg.Root}
+	for name, c := range cfg.Snapshotters {
+		if c.Root == "" || c.Address == "" {
+			return fmt.Errorf("snapshotter %s: root and address are required", name)
+		}
+		if slices.Contains(roots, c.Root) {
+			return fmt.Errorf("snapshotter %s: root %s is already used", name, c.Root)
+		}
+		roots = append(roots, c.Root)
+	}
+
+	if cfg.Metrics.Address != "" {
+		if err := serveMetrics(cfg.Metrics.Address, roots); err != nil {
+			return err
+		}
+	}
+
+	if c := cfg.Differ.Sandbox; c.Enable {
+		err := sandbox.Install(sandboxDir, sandbox.Config{
+			User:          c.User,
+			UserNamespace: c.UserNamespace,
+			NoNewPrivs:    c.NoNewPrivs,
+			Seccomp:       c.Seccomp,
+			Rlimits:       c.Rlimits,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set up the mkfs.erofs sandbox: %w", err)
+		}
+	}
+
+	// The differ uses the content store of containerd, unless local
+	var (
+		clients *clientManager
+		store   content.Store
+	)
+	if cfg.Differ.ContentDir != "" {
+		if err := os.MkdirAll(cfg.Differ.ContentDir, 0700); err != nil {
+			return err
+		}
+		if store, err = local.NewStore(cfg.Differ.ContentDir); err != nil {
+			return err
+		}
+	} else {
+		clients = newClientManager(cfg.ContainerdAddress)
+	}
+	// The events, the conversions and the retention of the idle layers use
+	// containerd even with a local store
+	containerdClients := clients
+	if containerdClients == nil && (cfg.Events.Enable || cfg.Conversion.Enable || cfg.Conversion.Auto.Enable || cfg.removesIdleLayers()) {
+		containerdClients = newClientManager(cfg.ContainerdAddress)
+	}
+	var events *publisher
+	if cfg.Events.Enable {
+		events = newPublisher(containerdClients)
+	}
+	if cfg.ReapInterval > 0 {
+		go reaper.Run(context.Background(), time.Duration(cfg.ReapInterval), func(ctx context.Context) error {
+			return reap(ctx, clients, store, time.Duration(cfg.ReapAge))
+		})
 	}
 
-	serverOpts := []grpc.ServerOption{
-		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
-			streamNamespaceInterceptor,
-		)),
-		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
-			unaryNamespaceInterceptor,
-		)),
+	nsFilter := newNamespaceFilter(cfg.Namespaces)
+	rpc, err := newServer(nsFilter)
+	if err != nil {
+		return err
 	}
 
-	rpc := grpc.NewServer(serverOpts...)
+	processors, err := registerProcessors(cfg.Differ.StreamProcessors)
+	if err != nil {
+		return err
+	}
 
 	// Instantiate the EROFS differ
-	d := &diffService{address: containerdAddress}
-	service := diffservice.FromApplierAndComparer(d, d)
-	diffapi.RegisterDiffServer(rpc, service)
+	d := &diffService{
+		clients:     clients,
+		store:       store,
+		processors:  processors,
+		mkfsOptions: cfg.Differ.MkfsOptions,
+		apply:       newLimiter("apply", cfg.Limits.MaxApplies, cfg.Limits.MaxQueued),
+		compare:     newLimiter("compare", cfg.Limits.MaxCompares, cfg.Limits.MaxQueued),
+		events:      events,
+	}
+	diffHealth := clients.check
+	if store != nil {
+		diffHealth = rootHealth(cfg.Differ.ContentDir)
+	}
+	rpc.registerDiff(diffservice.FromApplierAndComparer(d, d))
+
+	var fsc *fscacheMounter
+	if cfg.Fscache.Enable {
+		if fsc, err = newFscacheMounter(context.Background(), cfg.Fscache); err != nil {
+			return fmt.Errorf("failed to set up fscache: %w", err)
+		}
+	}
 
-	var opts []snapshot.Opt
 	// Instantiate the EROFS snapshotter
-	sn, err := snapshot.NewSnapshotter(root, opts...)
+	sn, err := newSnapshotter(cfg.Root, cfg.Snapshotter, fsc, containerdClients)
+	if err != nil {
+		return err
+	}
+	// The snapshotters share the limit of Prepare calls
+	prepare := newLimiter("prepare", cfg.Limits.MaxPrepares, cfg.Limits.MaxQueued)
+	rpc.registerSnapshotter(events.snapshotter(sn, cfg.Root, cfg.Snapshotter.EnableFsverity), prepare)
+	rpc.registerInfo(&infoService{root: cfg.Root})
+	targets := []debugTarget{{cfg.Root, sn}}
+
+	health := map[string]func(context.Context) error{
+		snapshotsapi.Snapshots_ServiceDesc.ServiceName: rootHealth(cfg.Root),
+		diffapi.Diff_ServiceDesc.ServiceName:           diffHealth,
+	}
+
+	var (
+		convertLimit *limiter
+		auto         *autoConverter
+	)
+	if cfg.Conversion.Enable || cfg.Conversion.Auto.Enable {
+		convertLimit = newLimiter("convert", cfg.Limits.MaxConversions, cfg.Limits.MaxQueued)
+		conversion := newConversionService(containerdClients, convertLimit)
+		if cfg.Conversion.Enable {
+			rpc.registerConversion(conversion)
+			health[conversionapi.Conversion_ServiceDesc.ServiceName] = containerdClients.check
+		}
+		if cfg.Conversion.Auto.Enable {
+			auto = newAutoConverter(containerdClients, conversion, cfg.Conversion.Auto)
+			go auto.run(context.Background())
+		}
+	}
+	go checkHealth(context.Background(), rpc.health, health)
+
+	type binding struct {
+		listenerConfig
+		server *server
+		tls    *tls.Config
+	}
+	var bindings []binding
+	if cfg.Address != "" {
+		bindings = append(bindings, binding{listenerConfig: listenerConfig{Address: cfg.Address}, server: rpc})
+	}
+	for _, lc := range cfg.Listeners {
+		bindings = append(bindings, binding{listenerConfig: lc, server: rpc})
+	}
+	servers := []*server{rpc}
+
+	// The other snapshotters have their own server, without differ
+	for name, c := range cfg.Snapshotters {
+		sn, err := newSnapshotter(c.Root, c.snapshotterConfig, fsc, containerdClients)
+		if err != nil {
+			return fmt.Errorf("snapshotter %s: %w", name, err)
+		}
+		srv, err := newServer(nsFilter)
+		if err != nil {
+			return err
+		}
+		srv.registerSnapshotter(events.snapshotter(sn, c.Root, c.EnableFsverity), prepare)
+		targets = append(targets, debugTarget{c.Root, sn})
+		go checkHealth(context.Background(), srv.health, map[string]func(context.Context) error{
+			snapshotsapi.Snapshots_ServiceDesc.ServiceName: rootHealth(c.Root),
+		})
+		bindings = append(bindings, binding{listenerConfig: listenerConfig{c.Address, c.Protocol, c.TLS}, server: srv})
+		servers = append(servers, srv)
+	}
+	for i, b := range bindings {
+		if b.Protocol != "" && b.Protocol != "grpc" && b.Protocol != "ttrpc" {
+			return fmt.Errorf("unknown protocol %q for %s", b.Protocol, b.Address)
+		}
+		if b.TLS == nil {
+			if strings.HasPrefix(b.Address, "tcp://") {
+				return fmt.Errorf("%s: tcp requires tls", b.Address)
+			}
+			continue
+		}
+		if bindings[i].tls, err = b.TLS.server(b.Protocol); err != nil {
+			return fmt.Errorf("%s: %w", b.Address, err)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, unix.SIGTERM, unix.SIGINT)
+	r := &reloader{reload, d, d.apply, d.compare, prepare, convertLimit, nsFilter, cfg.Conversion, auto}
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, unix.SIGHUP)
+	go func() {
+		for range hups {
+			if err := r.reload(); err != nil {
+				log.L.WithError(err).Error("failed to reload the configuration")
+				continue
+			}
+			log.L.Info("configuration reloaded")
+		}
+	}()
+
+	// Listen and serve, on the sockets passed by systemd if any
+	activated, err := activationListeners()
 	if err != nil {
 		return err
 	}
+	var created []string
+	if cfg.Debug.Address != "" {
+		if err := serveDebug(cfg.Debug.Address, targets); err != nil {
+			return err
+		}
+		created = append(created, cfg.Debug.Address)
+	}
+	errCh := make(chan error, len(bindings)+len(activated))
+	for _, b := range bindings {
+		address, tcp := strings.CutPrefix(b.Address, "tcp://")
+		l, ok := activated[address]
+		switch {
+		case ok:
+			delete(activated, address)
+		case tcp:
+			if l, err = net.Listen("tcp", address); err != nil {
+				return err
+			}
+		default:
+			if l, err = listenUnix(address); err != nil {
+				return err
+			}
+			created = append(created, address)
+		}
+		if b.tls != nil {
+			l = tls.NewListener(l, b.tls)
+		}
+		go func() { errCh <- b.server.serve(l, b.Protocol) }()
+	}
+	for address, l := range activated {
+		log.L.Infof("serving gRPC on socket-activated %s", address)
+		go func() { errCh <- rpc.serve(l, "grpc") }()
+	}
+	notify(daemon.SdNotifyReady)
 
-	// Convert the snapshotter to a gRPC service,
-	// example in github.com/containerd/containerd/contrib/snapshotservice
-	ss := snapshotservice.FromSnapshotter(sn)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return err
+		}
+	case sig := <-signals:
+		log.L.Infof("received %s, shutting down", sig)
+	}
+
+	// Wait for the running calls, unless signaled again
+	notify(daemon.SdNotifyStopping)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-signals:
+			log.L.Warnf("received %s, aborting the running calls", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var wg sync.WaitGroup
+	errs := make([]error, len(servers))
+	for i, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = srv.shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	for _, address := range created {
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// listenUnix listens on the unix socket address.
+func listenUnix(address string) (net.Listener, error) {
+	// Prepare the address directory
+	if err := os.MkdirAll(filepath.Dir(address), 0700); err != nil {
+		return nil, err
+	}
+	// Remove the socket if exist to avoid EADDRINUSE
+	if err := os.RemoveAll(address); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", address)
+}
 
-	// Register the service with the gRPC server
-	snapshotsapi.RegisterSnapshotsServer(rpc, ss)
+// reap removes stale temporary files and the stale converter ingests of the
+// local content store if any, or else of all containerd namespaces.
+func reap(ctx context.Context, clients *clientManager, store content.Store, maxAge time.Duration) error {
+	if _, err := reaper.ReapTempFiles(ctx, reaper.WithMaxAge(maxAge)); err != nil {
+		return err
+	}
+	if store != nil {
+		_, err := reaper.ReapIngests(ctx, store, reaper.WithMaxAge(maxAge))
+		return err
+	}
+	client, err := clients.get(ctx)
+	if err != nil {
+		return err
+	}
 
-	// Listen and serve
-	l, err := net.Listen("unix", address)
+	nss, err := client.NamespaceService().List(ctx)
 	if err != nil {
 		return err
 	}
-	return rpc.Serve(l)
+	var errs []error
+	for _, ns := range nss {
+		nctx := namespaces.WithNamespace(ctx, ns)
+		if _, err := reaper.ReapIngests(nctx, client.ContentStore(), reaper.WithMaxAge(maxAge)); err != nil {
+			errs = append(errs, fmt.Errorf("namespace %s: %w", ns, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
 func unaryNamespaceInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
@@ -122,37 +420,69 @@ type differ interface {
 }
 
 type diffService struct {
-	address string
+	// clients are nil with a local content store
+	clients        *clientManager
+	store          content.Store
+	apply, compare *limiter
+	events         *publisher
+	// processors is the media type returned by the stream processors by
+	// accepted media type
+	processors map[string]string
 
-	differ differ
-	loaded uint32
-	loadM  sync.Mutex
+	mu           sync.Mutex
+	mkfsOptions  []string
+	differ       differ
+	differClient *containerd.Client
 
 	diffapi.UnimplementedDiffServer
 }
 
-func (a *diffService) getDiffer() (differ, error) {
-	if atomic.LoadUint32(&a.loaded) == 1 {
-		return a.differ, nil
+// getDiffer returns the differ using the local content store, or the content
+// store of the current containerd client, which is re-created after re-dialing
+// containerd.
+func (a *diffService) getDiffer(ctx context.Context) (differ, error) {
+	var client *containerd.Client
+	if a.clients != nil {
+		var err error
+		if client, err = a.clients.get(ctx); err != nil {
+			return nil, err
+		}
 	}
-	a.loadM.Lock()
-	defer a.loadM.Unlock()
-	if a.loaded == 1 {
-		return a.differ, nil
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.differ == nil || a.differClient != client {
+		cs := a.store
+		if client != nil {
+			cs = client.ContentStore()
+		}
+		a.differ = a.newDiffer(cs)
+		a.differClient = client
 	}
+	return a.differ, nil
+}
 
-	client, err := containerd.New(a.address)
-	if err != nil {
-		return nil, nil
-	}
+// setMkfsOptions changes the mkfs.erofs options of the next Apply calls.
+func (a *diffService) setMkfsOptions(opts []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.mkfsOptions = opts
+	a.differ = nil
+}
 
-	defer atomic.StoreUint32(&a.loaded, 1)
-	a.differ = erofsdiff.NewErofsDiffer(client.ContentStore(), []string{})
-	return a.differ, nil
+func (a *diffService) newDiffer(cs content.Store) differ {
+	var d differ = tarDiffer{mkfsDiffer{erofsdiff.NewErofsDiffer(cs, a.mkfsOptions)}, walking.NewWalkingDiff(cs)}
+	if len(a.processors) > 0 {
+		d = processorDiffer{d, cs, a.processors}
+	}
+	d = upperDiffer{verityDiffer{d}, apply.NewFileSystemApplier(cs)}
+	if a.events != nil {
+		d = eventsDiffer{d, a.events}
+	}
+	return tracingDiffer{limitedDiffer{metricsDiffer{d}, a.apply, a.compare}}
 }
 
 func (s *diffService) Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount, opts ...diff.ApplyOpt) (d ocispec.Descriptor, err error) {
-	differ, err := s.getDiffer()
+	differ, err := s.getDiffer(ctx)
 	if err != nil {
 		return d, err
 	}
@@ -160,7 +490,7 @@ func (s *diffService) Apply(ctx context.Context, desc ocispec.Descriptor, mounts
 }
 
 func (s *diffService) Compare(ctx context.Context, lower, upper []mount.Mount, opts ...diff.Opt) (d ocispec.Descriptor, err error) {
-	differ, err := s.getDiffer()
+	differ, err := s.getDiffer(ctx)
 	if err != nil {
 		return d, err
 	}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/erofs"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// mergedDir holds the merged images of the chains of layers of the root
+	mergedDir = "merged"
+	// chainLayersFile lists the ids of the layers of the directory of a chain
+	chainLayersFile = "layers"
+)
+
+type mergeConfig struct {
+	// Threshold is the number of layers from which the chains are mounted
+	// as a single lower directory, or they're not merged if 0
+	Threshold int `toml:"threshold"`
+}
+
+// mergeSnapshotter mounts the chains of at least threshold committed layers
+// as a single lower directory: an EROFS metadata image merging the layers,
+// built when the top layer is committed and mounted with their layer.erofs
+// as its devices, so that overlayfs doesn't look files up through all the
+// layers, nor reaches its limit of lower directories.  The chains which
+// can't be merged, e.g. with layers mounted lazily or without mkfs.erofs 1.8,
+// are mounted as usual.
+type mergeSnapshotter struct {
+	snapshots.Snapshotter
+	root      string
+	threshold int
+	// options are the EROFS mount options of the layers
+	options string
+	mu      *sync.Mutex
+}
+
+func (s mergeSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.Prepare(ctx, key, parent, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s.mergedMounts(ctx, mounts), nil
+}
+
+func (s mergeSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.View(ctx, key, parent, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s.mergedMounts(ctx, mounts), nil
+}
+
+func (s mergeSnapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.Mounts(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.mergedMounts(ctx, mounts), nil
+}
+
+func (s mergeSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	if err := s.Snapshotter.Commit(ctx, name, key, opts...); err != nil {
+		return err
+	}
+	lowerdirs, err := committedLowerdirs(ctx, s.Snapshotter, s.root, name)
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("the layers of %s can't be merged", name)
+		return nil
+	}
+	if len(lowerdirs) < s.threshold {
+		return nil
+	}
+	// The layer is committed already: its children are mounted as usual
+	if err := s.build(ctx, lowerdirs); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to merge the %d layers of %s", len(lowerdirs), name)
+	}
+	return nil
+}
+
+func (s mergeSnapshotter) Remove(ctx context.Context, key string) error {
+	if err := s.Snapshotter.Remove(ctx, key); err != nil {
+		return err
+	}
+	s.prune(ctx)
+	return nil
+}
+
+// mergedMounts replaces the lower directories of the overlay of mounts with
+// their merged image, if at least threshold and built.  The views, without
+// upper directory, are an overlay of the merged image over an empty
+// directory, so that its whiteouts still hide the files of the lower layers.
+func (s mergeSnapshotter) mergedMounts(ctx context.Context, mounts []mount.Mount) []mount.Mount {
+	if len(mounts) != 1 || mounts[0].Type != "overlay" {
+		return mounts
+	}
+	m := mounts[0]
+	i := slices.IndexFunc(m.Options, func(o string) bool { return strings.HasPrefix(o, "lowerdir=") })
+	if i < 0 {
+		return mounts
+	}
+	lowerdirs := strings.Split(strings.TrimPrefix(m.Options[i], "lowerdir="), ":")
+	if len(lowerdirs) < s.threshold {
+		return mounts
+	}
+	mountpoint, err := s.mount(lowerdirs)
+	if errors.Is(err, os.ErrNotExist) {
+		// Committed before the merges were enabled, or failed to merge
+		return mounts
+	} else if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to mount the %d merged layers", len(lowerdirs))
+		return mounts
+	}
+	lowerdir := mountpoint
+	if !slices.ContainsFunc(m.Options, func(o string) bool { return strings.HasPrefix(o, "upperdir=") }) {
+		lowerdir += ":" + filepath.Join(filepath.Dir(mountpoint), "empty")
+	}
+	m.Options = slices.Clone(m.Options)
+	m.Options[i] = "lowerdir=" + lowerdir
+	return []mount.Mount{m}
+}
+
+// build builds the merged image of the layers of the lower directories, from
+// the top one, unless built already.
+func (s mergeSnapshotter) build(ctx context.Context, lowerdirs []string) error {
+	ids, layers, err := chainLayers(s.root, lowerdirs)
+	if err != nil {
+		return err
+	}
+	dir := chainDir(filepath.Join(s.root, mergedDir), ids)
+	meta := filepath.Join(dir, "meta.erofs")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(meta); err == nil {
+		return nil
+	}
+	for _, d := range []string{"fs", "empty"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return err
+		}
+	}
+	// The layers are listed first, for pruneChains
+	if err := os.WriteFile(filepath.Join(dir, chainLayersFile), []byte(strings.Join(ids, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := erofs.MkfsMerge(ctx, meta+".tmp", layers...); err != nil {
+		os.Remove(meta + ".tmp")
+		return err
+	}
+	return os.Rename(meta+".tmp", meta)
+}
+
+// mount returns the mountpoint of the merged image of the layers of the
+// lower directories, from the top one, mounting it if needed.  It fails with
+// os.ErrNotExist if the image isn't built.
+func (s mergeSnapshotter) mount(lowerdirs []string) (string, error) {
+	ids, layers, err := chainLayers(s.root, lowerdirs)
+	if err != nil {
+		return "", err
+	}
+	dir := chainDir(filepath.Join(s.root, mergedDir), ids)
+	mountpoint := filepath.Join(dir, "fs")
+	meta := filepath.Join(dir, "meta.erofs")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var st unix.Statfs_t
+	if err := unix.Statfs(mountpoint, &st); err == nil && uint32(st.Type) == erofsSuperMagic {
+		return mountpoint, nil
+	}
+	if _, err := os.Stat(meta); err != nil {
+		return "", err
+	}
+	if err := mountMerged(meta, mountpoint, layers, s.options); err != nil {
+		return "", fmt.Errorf("failed to mount %s on %s: %w", meta, mountpoint, err)
+	}
+	return mountpoint, nil
+}
+
+// mountMerged mounts the merged image meta of layers on mountpoint with the
+// EROFS options.  The mount API is used as the device options of deep chains
+// exceed the page of mount(2).
+func mountMerged(meta, mountpoint string, layers []string, options string) error {
+	fd, err := unix.Fsopen("erofs", unix.FSOPEN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.FsconfigSetString(fd, "source", meta); err != nil {
+		return err
+	}
+	for _, l := range layers {
+		if err := unix.FsconfigSetString(fd, "device", l); err != nil {
+			return fmt.Errorf("device %s: %w", l, err)
+		}
+	}
+	for _, o := range strings.Split(options, ",") {
+		k, v, ok := strings.Cut(o, "=")
+		switch {
+		case o == "":
+		case ok:
+			err = unix.FsconfigSetString(fd, k, v)
+		default:
+			err = unix.FsconfigSetFlag(fd, k)
+		}
+		if err != nil {
+			return fmt.Errorf("option %s: %w", o, err)
+		}
+	}
+	if err := unix.FsconfigSetFlag(fd, "ro"); err != nil {
+		return err
+	}
+	if err := unix.FsconfigCreate(fd); err != nil {
+		return err
+	}
+	mfd, err := unix.Fsmount(fd, unix.FSMOUNT_CLOEXEC, unix.MOUNT_ATTR_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(mfd)
+	return unix.MoveMount(mfd, "", unix.AT_FDCWD, mountpoint, unix.MOVE_MOUNT_F_EMPTY_PATH)
+}
+
+// prune removes the merged images of the removed layers.
+func (s mergeSnapshotter) prune(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pruneChains(ctx, s.root, filepath.Join(s.root, mergedDir))
+}
+
+// committedLowerdirs returns the lower directories of the overlays of the
+// children of the committed snapshot name: the mountpoints of the layers of
+// its chain, from name.
+func committedLowerdirs(ctx context.Context, sn snapshots.Snapshotter, root, name string) ([]string, error) {
+	var lowerdirs []string
+	for name != "" {
+		info, err := sn.Stat(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		id, ok := info.Labels[labelSnapshotID]
+		if !ok {
+			return nil, fmt.Errorf("layer %s not unpacked", name)
+		}
+		lowerdirs = append(lowerdirs, filepath.Join(root, "snapshots", id, "fs"))
+		name = info.Parent
+	}
+	return lowerdirs, nil
+}
+
+// chainLayers returns the ids and the layer.erofs of the snapshots of the
+// lower directories of an overlay, from the lowest one.
+func chainLayers(root string, lowerdirs []string) ([]string, []string, error) {
+	snapshotDir := filepath.Join(root, "snapshots")
+	var ids, layers []string
+	for _, d := range slices.Backward(lowerdirs) {
+		if filepath.Base(d) != "fs" || filepath.Dir(filepath.Dir(d)) != snapshotDir {
+			return nil, nil, fmt.Errorf("unexpected lower directory %s", d)
+		}
+		layer := filepath.Join(filepath.Dir(d), "layer.erofs")
+		if fi, err := os.Stat(layer); err != nil || fi.Size() == 0 {
+			return nil, nil, fmt.Errorf("no EROFS layer in %s", filepath.Dir(d))
+		}
+		ids = append(ids, filepath.Base(filepath.Dir(d)))
+		layers = append(layers, layer)
+	}
+	return ids, layers, nil
+}
+
+// chainDir returns the directory in dir of the chain of layers ids.
+func chainDir(dir string, ids []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(ids, ",")))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8]))
+}
+
+// pruneChains unmounts and removes the directories in dir of the chains with
+// removed layers of root, lazily as they may still be the lower directory of
+// containers.  It returns the number of directories removed.
+func pruneChains(ctx context.Context, root, dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var removed int
+	for _, e := range entries {
+		d := filepath.Join(dir, e.Name())
+		b, err := os.ReadFile(filepath.Join(d, chainLayersFile))
+		if err == nil && !slices.ContainsFunc(strings.Fields(string(b)), func(id string) bool {
+			_, err := os.Stat(filepath.Join(root, "snapshots", id))
+			return err != nil
+		}) {
+			continue
+		}
+		if err := unix.Unmount(filepath.Join(d, "fs"), unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+			log.G(ctx).WithError(err).Warnf("failed to unmount the layers of %s", d)
+			continue
+		}
+		if err := os.RemoveAll(d); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to remove %s", d)
+			continue
+		}
+		removed++
+	}
+	return removed
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/diff"
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/log"
+	metrics "github.com/docker/go-metrics"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricsNamespace = metrics.NewNamespace("containerd_erofs", "", nil)
+
+	snapshotTimer  = metricsNamespace.NewLabeledTimer("snapshot_operations", "Duration of the snapshot operations", "op")
+	diffTimer      = metricsNamespace.NewLabeledTimer("diff_operations", "Duration of the diff Apply and Compare operations", "op")
+	errorCounter   = metricsNamespace.NewLabeledCounter("errors", "Number of failed snapshot and diff operations", "op")
+	mkfsCounter    = metricsNamespace.NewCounter("mkfs_invocations", "Number of non-EROFS layers converted by mkfs.erofs when applied")
+	convertedBytes = metricsNamespace.NewCounter("converted_bytes", "Uncompressed bytes of the layers converted by mkfs.erofs")
+	queuedGauge    = metricsNamespace.NewLabeledGauge("queued_operations", "Number of operations waiting for their concurrency limit", metrics.Unit(""), "op")
+)
+
+// serveMetrics serves the Prometheus metrics on the TCP address in the
+// background.  The loop devices in use are those backed by files under roots.
+func serveMetrics(address string, roots []string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	metricsNamespace.Add(&loopCollector{
+		roots: roots,
+		desc:  metricsNamespace.NewDesc("loop_devices", "Number of loop devices backed by snapshot layers", metrics.Unit("")),
+	})
+	metrics.Register(metricsNamespace)
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1/metrics", metrics.Handler())
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.L.WithError(err).Error("metrics server stopped")
+		}
+	}()
+	return nil
+}
+
+// observe records the duration of the operation op started at start in
+// timer, and its error if any.
+func observe(timer metrics.LabeledTimer, op string, start time.Time, err error) {
+	timer.WithValues(op).UpdateSince(start)
+	if err != nil {
+		errorCounter.WithValues(op).Inc()
+	}
+}
+
+// loopCollector counts the loop devices backed by files under roots when
+// collected.
+type loopCollector struct {
+	roots []string
+	desc  *prometheus.Desc
+}
+
+func (c *loopCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *loopCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(len(loopDevices(c.roots))))
+}
+
+type loopDevice struct {
+	Device      string `json:"device"`
+	BackingFile string `json:"backingFile"`
+}
+
+// loopDevices returns the loop devices backed by files under roots.
+func loopDevices(roots []string) []loopDevice {
+	files, _ := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	devices := []loopDevice{}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		backing := strings.TrimSpace(string(b))
+		for _, root := range roots {
+			if strings.HasPrefix(backing, root+"/") {
+				name := filepath.Base(filepath.Dir(filepath.Dir(f)))
+				devices = append(devices, loopDevice{"/dev/" + name, backing})
+				break
+			}
+		}
+	}
+	return devices
+}
+
+// metricsSnapshotter records the metrics of the operations of a snapshotter.
+type metricsSnapshotter struct {
+	snapshots.Snapshotter
+}
+
+func (s metricsSnapshotter) Stat(ctx context.Context, key string) (_ snapshots.Info, err error) {
+	defer func(start time.Time) { observe(snapshotTimer, "stat", start, err) }(time.Now())
+	return s.Snapshotter.Stat(ctx, key)
+}
+
+func (s metricsSnapshotter) Update(ctx context.Context, info snapshots.Info, fieldpaths ...string) (_ snapshots.Info, err error) {
+	defer func(start time.Time) { observe(snapshotTimer, "update", start, err) }(time.Now())
+	return s.Snapshotter.Update(ctx, info, fieldpaths...)
+}
+
+func (s metricsSnapshotter) Usage(ctx context.Context, key string) (_ snapshots.Usage, err error) {
+	defer func(start time.Time) { observe(snapshotTimer, "usage", start, err) }(time.Now())
+	return s.Snapshotter.Usage(ctx, key)
+}
+
+func (s metricsSnapshotter) Mounts(ctx context.Context, key string) (_ []mount.Mount, err error) {
+	defer func(start time.Time) { observe(snapshotTimer, "mounts", start, err) }(time.Now())
+	defer running.track(ctx, runningCall{Op: "mounts", Key: key})()
+	return s.Snapshotter.Mounts(ctx, key)
+}
+
+func (s metricsSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) (_ []mount.Mount, err error) {
+	defer func(start time.Time) { observe(snapshotTimer, "prepare", start, err) }(time.Now())
+	defer running.track(ctx, runningCall{Op: "prepare", Key: key})()
+	return s.Snapshotter.Prepare(ctx, key, parent, opts...)
+}
+
+func (s metricsSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) (_ []mount.Mount, err error) {
+	defer func(start time.Time) { observe(snapshotTimer, "view", start, err) }(time.Now())
+	defer running.track(ctx, runningCall{Op: "view", Key: key})()
+	return s.Snapshotter.View(ctx, key, parent, opts...)
+}
+
+func (s metricsSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) (err error) {
+	defer func(start time.Time) { observe(snapshotTimer, "commit", start, err) }(time.Now())
+	defer running.track(ctx, runningCall{Op: "commit", Key: key})()
+	return s.Snapshotter.Commit(ctx, name, key, opts...)
+}
+
+func (s metricsSnapshotter) Remove(ctx context.Context, key string) (err error) {
+	defer func(start time.Time) { observe(snapshotTimer, "remove", start, err) }(time.Now())
+	defer running.track(ctx, runningCall{Op: "remove", Key: key})()
+	return s.Snapshotter.Remove(ctx, key)
+}
+
+func (s metricsSnapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, filters ...string) (err error) {
+	defer func(start time.Time) { observe(snapshotTimer, "walk", start, err) }(time.Now())
+	return s.Snapshotter.Walk(ctx, fn, filters...)
+}
+
+func (s metricsSnapshotter) Cleanup(ctx context.Context) (err error) {
+	defer func(start time.Time) { observe(snapshotTimer, "cleanup", start, err) }(time.Now())
+	return cleanup(ctx, s.Snapshotter)
+}
+
+// metricsDiffer records the metrics of the operations of a differ.
+type metricsDiffer struct {
+	differ
+}
+
+func (d metricsDiffer) Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount, opts ...diff.ApplyOpt) (_ ocispec.Descriptor, err error) {
+	defer func(start time.Time) { observe(diffTimer, "apply", start, err) }(time.Now())
+	defer running.track(ctx, runningCall{Op: "apply", Key: desc.Digest.String(), MediaType: desc.MediaType})()
+	return d.differ.Apply(ctx, desc, mounts, opts...)
+}
+
+func (d metricsDiffer) Compare(ctx context.Context, lower, upper []mount.Mount, opts ...diff.Opt) (_ ocispec.Descriptor, err error) {
+	defer func(start time.Time) { observe(diffTimer, "compare", start, err) }(time.Now())
+	defer running.track(ctx, runningCall{Op: "compare"})()
+	return d.differ.Compare(ctx, lower, upper, opts...)
+}
+
+// mkfsDiffer counts the layers converted with mkfs.erofs by the EROFS differ,
+// the native EROFS layers being copied as they are.
+type mkfsDiffer struct {
+	differ
+}
+
+func (d mkfsDiffer) Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount, opts ...diff.ApplyOpt) (ocispec.Descriptor, error) {
+	applied, err := d.differ.Apply(ctx, desc, mounts, opts...)
+	if err == nil && !strings.HasSuffix(desc.MediaType, ".erofs") {
+		mkfsCounter.Inc()
+		convertedBytes.Inc(float64(applied.Size))
+	}
+	return applied, err
+}
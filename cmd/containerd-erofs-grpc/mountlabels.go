@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+)
+
+const (
+	// labelNoatime mounts a snapshot with noatime, e.g. "true"
+	labelNoatime = "containerd.io/snapshot/erofs.noatime"
+	// labelVolatile mounts the upper directory of an active snapshot with the
+	// volatile option of overlayfs, which doesn't sync it, e.g. "true"
+	labelVolatile = "containerd.io/snapshot/erofs.volatile"
+	// labelCacheStrategy is the EROFS cache_strategy of a snapshot mounted
+	// from a single layer: "disabled", "readahead" or "readaround"
+	labelCacheStrategy = "containerd.io/snapshot/erofs.cache-strategy"
+	// labelSELinuxContext is the SELinux context= mount option of a
+	// snapshot, e.g. "system_u:object_r:container_file_t:s0:c1,c2"
+	labelSELinuxContext = "containerd.io/snapshot/erofs.selinux-context"
+	// labelSELinuxDefContext is the SELinux defcontext= mount option of a
+	// snapshot, the context of its files without label
+	labelSELinuxDefContext = "containerd.io/snapshot/erofs.selinux-defcontext"
+)
+
+type selinuxConfig struct {
+	// Context is the context= mount option of the snapshots without SELinux
+	// label, or none if empty
+	Context string `toml:"context"`
+	// DefContext is the defcontext= mount option of the snapshots without
+	// SELinux label, or none if empty
+	DefContext string `toml:"defcontext"`
+}
+
+// check checks the SELinux mount options of c.
+func (c selinuxConfig) check() error {
+	return checkSELinux(c.Context, c.DefContext)
+}
+
+// checkSELinux checks the SELinux context and defcontext mount options, which
+// can't be combined.
+func checkSELinux(label, deflabel string) error {
+	if label != "" && deflabel != "" {
+		return fmt.Errorf("the SELinux context and defcontext can't be combined: %w", errdefs.ErrInvalidArgument)
+	}
+	if strings.Contains(label+deflabel, `"`) {
+		return fmt.Errorf("invalid SELinux context %q: %w", label+deflabel, errdefs.ErrInvalidArgument)
+	}
+	return nil
+}
+
+// mountLabelSnapshotter adds the mount options of the labels of the
+// snapshots to their mounts, so that the I/O of each container can be tuned,
+// and idmaps the mounts of the snapshots with the uid and gid mapping labels
+// of containerd, so that containers in user namespaces share the layers
+// instead of chowned copies.  The snapshots without SELinux label get the
+// SELinux mount options of the configuration.
+type mountLabelSnapshotter struct {
+	snapshots.Snapshotter
+	selinux selinuxConfig
+}
+
+func (s mountLabelSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	labels, err := mountLabels(opts)
+	if err != nil {
+		return nil, err
+	}
+	labels = s.withDefaults(labels)
+	mounts, err := s.Snapshotter.Prepare(ctx, key, parent, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// The upper directory belongs to the root of the user namespace, as with
+	// the overlayfs snapshotter
+	if uid, gid, ok := rootPair(labels); ok {
+		if layer := layerPath(mounts); layer != "" {
+			if err := os.Lchown(filepath.Join(filepath.Dir(layer), "fs"), int(uid), int(gid)); err != nil {
+				if err := s.Snapshotter.Remove(ctx, key); err != nil {
+					log.G(ctx).WithError(err).Warnf("failed to remove %s", key)
+				}
+				return nil, fmt.Errorf("failed to chown the upper directory of %s: %w", key, err)
+			}
+		}
+	}
+	return labeledMounts(mounts, labels), nil
+}
+
+func (s mountLabelSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	labels, err := mountLabels(opts)
+	if err != nil {
+		return nil, err
+	}
+	labels = s.withDefaults(labels)
+	mounts, err := s.Snapshotter.View(ctx, key, parent, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return labeledMounts(mounts, labels), nil
+}
+
+func (s mountLabelSnapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.Mounts(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return labeledMounts(mounts, s.withDefaults(info.Labels)), nil
+}
+
+// withDefaults returns labels with the SELinux mount options of the
+// configuration, unless they have SELinux labels.
+func (s mountLabelSnapshotter) withDefaults(labels map[string]string) map[string]string {
+	_, label := labels[labelSELinuxContext]
+	_, deflabel := labels[labelSELinuxDefContext]
+	if label || deflabel || s.selinux == (selinuxConfig{}) {
+		return labels
+	}
+	labels = maps.Clone(labels)
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	if s.selinux.Context != "" {
+		labels[labelSELinuxContext] = s.selinux.Context
+	}
+	if s.selinux.DefContext != "" {
+		labels[labelSELinuxDefContext] = s.selinux.DefContext
+	}
+	return labels
+}
+
+// mountLabels returns the labels of opts, checking their mount labels.
+func mountLabels(opts []snapshots.Opt) (map[string]string, error) {
+	var base snapshots.Info
+	for _, o := range opts {
+		if err := o(&base); err != nil {
+			return nil, err
+		}
+	}
+	for _, l := range []string{labelNoatime, labelVolatile} {
+		if v, ok := base.Labels[l]; ok {
+			if _, err := strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("invalid %s label %q: %w", l, v, errdefs.ErrInvalidArgument)
+			}
+		}
+	}
+	switch v, ok := base.Labels[labelCacheStrategy]; {
+	case !ok, v == "disabled", v == "readahead", v == "readaround":
+	default:
+		return nil, fmt.Errorf("invalid %s label %q: %w", labelCacheStrategy, v, errdefs.ErrInvalidArgument)
+	}
+	if err := checkSELinux(base.Labels[labelSELinuxContext], base.Labels[labelSELinuxDefContext]); err != nil {
+		return nil, err
+	}
+	uidmap, uok := base.Labels[snapshots.LabelSnapshotUIDMapping]
+	gidmap, gok := base.Labels[snapshots.LabelSnapshotGIDMapping]
+	if uok || gok {
+		if !uok || !gok {
+			return nil, fmt.Errorf("both %s and %s labels are required: %w", snapshots.LabelSnapshotUIDMapping, snapshots.LabelSnapshotGIDMapping, errdefs.ErrInvalidArgument)
+		}
+		for _, m := range []string{uidmap, gidmap} {
+			if _, err := rootID(m); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return base.Labels, nil
+}
+
+// rootID returns the host id of the root of the user namespace of mapping,
+// comma-separated "<container id>:<host id>:<size>" ranges.
+func rootID(mapping string) (uint32, error) {
+	for _, r := range strings.Split(mapping, ",") {
+		var container, host, size uint32
+		if n, err := fmt.Sscanf(r, "%d:%d:%d", &container, &host, &size); err != nil || n != 3 || size == 0 {
+			return 0, fmt.Errorf("invalid id mapping %q: %w", r, errdefs.ErrInvalidArgument)
+		}
+		if container == 0 {
+			return host, nil
+		}
+	}
+	return 0, fmt.Errorf("id mapping %q has no root: %w", mapping, errdefs.ErrInvalidArgument)
+}
+
+// rootPair returns the host uid and gid of the root of the user namespace of
+// the mapping labels, if any.
+func rootPair(labels map[string]string) (uint32, uint32, bool) {
+	uid, err := rootID(labels[snapshots.LabelSnapshotUIDMapping])
+	if err != nil {
+		return 0, 0, false
+	}
+	gid, err := rootID(labels[snapshots.LabelSnapshotGIDMapping])
+	if err != nil {
+		return 0, 0, false
+	}
+	return uid, gid, true
+}
+
+// labeledMounts adds the mount options of labels to mounts.  The layers below
+// an overlay are shared by the snapshots, and keep their options, but for the
+// id mappings, which containerd applies to idmapped mounts of them.
+func labeledMounts(mounts []mount.Mount, labels map[string]string) []mount.Mount {
+	noatime, _ := strconv.ParseBool(labels[labelNoatime])
+	volatile, _ := strconv.ParseBool(labels[labelVolatile])
+	strategy := labels[labelCacheStrategy]
+	_, _, idmapped := rootPair(labels)
+	var selinux []string
+	if v := labels[labelSELinuxContext]; v != "" {
+		selinux = append(selinux, `context="`+v+`"`)
+	}
+	if v := labels[labelSELinuxDefContext]; v != "" {
+		selinux = append(selinux, `defcontext="`+v+`"`)
+	}
+	if !noatime && !volatile && strategy == "" && !idmapped && len(selinux) == 0 {
+		return mounts
+	}
+	for i, m := range mounts {
+		var options []string
+		if noatime {
+			options = append(options, "noatime")
+		}
+		// The bind mounts of the snapshots without parent keep the context
+		// of their directory
+		if m.Type == "overlay" || m.Type == "erofs" {
+			options = append(options, selinux...)
+		}
+		if idmapped {
+			options = append(options,
+				"uidmap="+labels[snapshots.LabelSnapshotUIDMapping],
+				"gidmap="+labels[snapshots.LabelSnapshotGIDMapping])
+		}
+		switch m.Type {
+		case "overlay":
+			upper := slices.ContainsFunc(m.Options, func(o string) bool { return strings.HasPrefix(o, "upperdir=") })
+			if volatile && upper {
+				options = append(options, "volatile")
+			}
+		case "erofs":
+			if strategy != "" {
+				options = append(options, "cache_strategy="+strategy)
+			}
+		}
+		for _, o := range options {
+			if !slices.Contains(m.Options, o) {
+				mounts[i].Options = append(slices.Clip(mounts[i].Options), o)
+			}
+		}
+	}
+	return mounts
+}
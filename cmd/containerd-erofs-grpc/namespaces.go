@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/ttrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// namespacesConfig restricts the containerd namespaces which may use the
+// services.  The health service and the calls without namespace, such as the
+// Walk and Remove of the garbage collector of containerd, aren't restricted.
+type namespacesConfig struct {
+	// Allow are the only namespaces allowed, all if empty
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
+}
+
+// namespaceFilter restricts the namespaces as its configuration, which is
+// replaced on reload.
+type namespaceFilter struct {
+	config atomic.Pointer[namespacesConfig]
+}
+
+func newNamespaceFilter(c namespacesConfig) *namespaceFilter {
+	f := &namespaceFilter{}
+	f.set(c)
+	return f
+}
+
+func (f *namespaceFilter) set(c namespacesConfig) {
+	f.config.Store(&c)
+}
+
+// check returns a PermissionDenied error if the namespace of ctx isn't
+// allowed.  The calls without namespace are allowed.
+func (f *namespaceFilter) check(ctx context.Context) error {
+	ns, ok := namespaces.Namespace(ctx)
+	if !ok {
+		return nil
+	}
+	c := f.config.Load()
+	if slices.Contains(c.Deny, ns) || len(c.Allow) > 0 && !slices.Contains(c.Allow, ns) {
+		return status.Errorf(codes.PermissionDenied, "namespace %q is not allowed to use the EROFS services", ns)
+	}
+	return nil
+}
+
+func (f *namespaceFilter) checkMethod(ctx context.Context, method string) error {
+	if strings.HasPrefix(method, "/"+healthpb.Health_ServiceDesc.ServiceName+"/") {
+		return nil
+	}
+	return f.check(ctx)
+}
+
+func (f *namespaceFilter) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := f.checkMethod(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (f *namespaceFilter) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := f.checkMethod(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// ttrpcInterceptor checks the unary TTRPC calls, ttrpcSnapshots checks the
+// List streams.
+func (f *namespaceFilter) ttrpcInterceptor(ctx context.Context, unmarshal ttrpc.Unmarshaler, info *ttrpc.UnaryServerInfo, method ttrpc.Method) (interface{}, error) {
+	if err := f.checkMethod(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return method(ctx, unmarshal)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNamespaceFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		config  namespacesConfig
+		ns      string
+		method  string
+		allowed bool
+	}{
+		{name: "no restriction", ns: "default", allowed: true},
+		{name: "allowed", config: namespacesConfig{Allow: []string{"k8s.io"}}, ns: "k8s.io", allowed: true},
+		{name: "not allowed", config: namespacesConfig{Allow: []string{"k8s.io"}}, ns: "default"},
+		{name: "denied", config: namespacesConfig{Deny: []string{"ci"}}, ns: "ci"},
+		{name: "denied and allowed", config: namespacesConfig{Allow: []string{"ci"}, Deny: []string{"ci"}}, ns: "ci"},
+		// The garbage collector of containerd and the TTRPC streams
+		{name: "unnamespaced with allow", config: namespacesConfig{Allow: []string{"k8s.io"}}, allowed: true},
+		{name: "unnamespaced with deny", config: namespacesConfig{Deny: []string{"default"}}, allowed: true},
+		{name: "health", config: namespacesConfig{Allow: []string{"k8s.io"}}, ns: "default", method: "/grpc.health.v1.Health/Check", allowed: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newNamespaceFilter(tc.config)
+			ctx := context.Background()
+			if tc.ns != "" {
+				ctx = namespaces.WithNamespace(ctx, tc.ns)
+			}
+			method := tc.method
+			if method == "" {
+				method = "/containerd.services.snapshots.v1.Snapshots/Remove"
+			}
+			err := f.checkMethod(ctx, method)
+			if tc.allowed {
+				if err != nil {
+					t.Fatalf("expected the call to be allowed, got %v", err)
+				}
+			} else if status.Code(err) != codes.PermissionDenied {
+				t.Fatalf("expected PermissionDenied, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNamespaceFilterReload(t *testing.T) {
+	f := newNamespaceFilter(namespacesConfig{})
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+	if err := f.check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	f.set(namespacesConfig{Allow: []string{"k8s.io"}})
+	if err := f.check(ctx); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied after reload, got %v", err)
+	}
+	if err := f.check(context.Background()); err != nil {
+		t.Fatalf("expected the call without namespace to be allowed, got %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+)
+
+type overlayConfig struct {
+	overlayFeatures
+	// Namespaces are the features of the snapshots of the namespaces, instead
+	// of the above
+	Namespaces map[string]overlayFeatures `toml:"namespaces"`
+}
+
+// overlayFeatures are the overlayfs features of the snapshots, left to the
+// kernel defaults if empty.
+type overlayFeatures struct {
+	// Volatile doesn't sync the upper directories, which are lost on a crash
+	Volatile bool `toml:"volatile"`
+	// Metacopy copies up the metadata only, "on" or "off"
+	Metacopy string `toml:"metacopy"`
+	// RedirectDir is "on", "follow", "nofollow" or "off"
+	RedirectDir string `toml:"redirect_dir"`
+	// Index is "on" or "off"
+	Index string `toml:"index"`
+	// Xino is "on", "off" or "auto"
+	Xino string `toml:"xino"`
+}
+
+func (c overlayConfig) check() error {
+	if err := c.overlayFeatures.check(); err != nil {
+		return err
+	}
+	for ns, f := range c.Namespaces {
+		if err := f.check(); err != nil {
+			return fmt.Errorf("namespace %s: %w", ns, err)
+		}
+	}
+	return nil
+}
+
+func (f overlayFeatures) check() error {
+	for _, o := range []struct {
+		name, value string
+		values      []string
+	}{
+		{"metacopy", f.Metacopy, []string{"on", "off"}},
+		{"redirect_dir", f.RedirectDir, []string{"on", "follow", "nofollow", "off"}},
+		{"index", f.Index, []string{"on", "off"}},
+		{"xino", f.Xino, []string{"on", "off", "auto"}},
+	} {
+		if o.value != "" && !slices.Contains(o.values, o.value) {
+			return fmt.Errorf("invalid overlay %s %q", o.name, o.value)
+		}
+	}
+	return nil
+}
+
+// options returns the overlayfs mount options of f, with volatile if upper.
+func (f overlayFeatures) options(upper bool) []string {
+	var options []string
+	if f.Volatile && upper {
+		options = append(options, "volatile")
+	}
+	for _, o := range []struct{ name, value string }{
+		{"metacopy", f.Metacopy},
+		{"redirect_dir", f.RedirectDir},
+		{"index", f.Index},
+		{"xino", f.Xino},
+	} {
+		if o.value != "" {
+			options = append(options, o.name+"="+o.value)
+		}
+	}
+	return options
+}
+
+// withOverlay returns sn mounting the overlays with the features of c, if any.
+func withOverlay(sn snapshots.Snapshotter, c overlayConfig) snapshots.Snapshotter {
+	if c.overlayFeatures == (overlayFeatures{}) && len(c.Namespaces) == 0 {
+		return sn
+	}
+	return overlaySnapshotter{sn, c}
+}
+
+// overlaySnapshotter adds the overlayfs features of the namespace of the
+// calls to the overlay mounts.  The options already set, e.g. by
+// ovl_mount_options, are kept.
+type overlaySnapshotter struct {
+	snapshots.Snapshotter
+	config overlayConfig
+}
+
+func (s overlaySnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.Prepare(ctx, key, parent, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s.mounts(ctx, mounts), nil
+}
+
+func (s overlaySnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.View(ctx, key, parent, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s.mounts(ctx, mounts), nil
+}
+
+func (s overlaySnapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.Mounts(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.mounts(ctx, mounts), nil
+}
+
+func (s overlaySnapshotter) mounts(ctx context.Context, mounts []mount.Mount) []mount.Mount {
+	features := s.config.overlayFeatures
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		if f, ok := s.config.Namespaces[ns]; ok {
+			features = f
+		}
+	}
+	for i, m := range mounts {
+		if m.Type != "overlay" {
+			continue
+		}
+		upper := slices.ContainsFunc(m.Options, func(o string) bool { return strings.HasPrefix(o, "upperdir=") })
+		for _, o := range features.options(upper) {
+			name, _, _ := strings.Cut(o, "=")
+			set := slices.ContainsFunc(m.Options, func(mo string) bool { return mo == name || strings.HasPrefix(mo, name+"=") })
+			if !set {
+				mounts[i].Options = append(slices.Clip(mounts[i].Options), o)
+			}
+		}
+	}
+	return mounts
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// labelLayerDigest is the digest of the layer.erofs of a committed layer
+	labelLayerDigest = "containerd.io/snapshot/erofs.layer-digest"
+	// labelPageCacheDomain is the page cache domain a committed layer is
+	// mounted in
+	labelPageCacheDomain = "containerd.io/snapshot/erofs.page-cache-domain"
+)
+
+type pageCacheConfig struct {
+	// DomainID mounts the layers in a page cache domain, so that their
+	// identical files are cached once, or not if empty
+	DomainID string `toml:"domain_id"`
+}
+
+// mountOptions returns the EROFS mount options of the layers.
+func (c pageCacheConfig) mountOptions() string {
+	if c.DomainID == "" {
+		return ""
+	}
+	return "domain_id=" + c.DomainID + ",inode_share"
+}
+
+// pageCacheSnapshotter labels the layers labeled by idSnapshotter with the
+// digest of their layer.erofs and their page cache domain when committed, so
+// that the clients can tell the identical layers sharing their page cache.
+type pageCacheSnapshotter struct {
+	snapshots.Snapshotter
+	root   string
+	domain string
+}
+
+func (s pageCacheSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if id, ok := info.Labels[labelSnapshotID]; ok {
+		layer := filepath.Join(s.root, "snapshots", id, "layer.erofs")
+		// Not applied, or mounted lazily
+		if fi, err := os.Stat(layer); err == nil && fi.Size() > 0 {
+			dgst, err := layerDigest(layer)
+			if err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to hash the layer of %s", key)
+			} else {
+				opts = append(opts, snapshots.WithLabels(map[string]string{
+					labelLayerDigest:     dgst.String(),
+					labelPageCacheDomain: s.domain,
+				}))
+			}
+		}
+	}
+	return s.Snapshotter.Commit(ctx, name, key, opts...)
+}
+
+// layerDigest returns the digest of the layer.erofs at path.
+func layerDigest(path string) (digest.Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return digest.Canonical.FromReader(f)
+}
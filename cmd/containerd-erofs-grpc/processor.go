@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/diff"
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// streamProcessorConfig is a stream processor binary, configured like those
+// of containerd.
+type streamProcessorConfig struct {
+	// Accepts are the media types of the streams it processes
+	Accepts []string `toml:"accepts"`
+	// Returns is the media type of its output
+	Returns string   `toml:"returns"`
+	Path    string   `toml:"path"`
+	Args    []string `toml:"args"`
+	Env     []string `toml:"env"`
+}
+
+// registerProcessors registers the stream processors of the differ, and
+// returns the media type each of them returns by accepted media type.
+func registerProcessors(processors map[string]streamProcessorConfig) (map[string]string, error) {
+	returns := map[string]string{}
+	for id, p := range processors {
+		if p.Path == "" || p.Returns == "" || len(p.Accepts) == 0 {
+			return nil, fmt.Errorf("stream processor %s needs accepts, returns and path", id)
+		}
+		diff.RegisterProcessor(diff.BinaryHandler(id, p.Returns, p.Accepts, p.Path, p.Args, p.Env))
+		for _, t := range p.Accepts {
+			returns[t] = p.Returns
+		}
+	}
+	return returns, nil
+}
+
+// processorDiffer applies the layers that stream processors turn into EROFS,
+// e.g. erofs-stream-processor, with their output instead of mkfs.erofs.
+type processorDiffer struct {
+	differ
+	store content.Store
+	// returns is the media type returned by the stream processors by
+	// accepted media type
+	returns map[string]string
+}
+
+// erofsProcessed reports whether the stream processors turn the layers of
+// mediaType into EROFS.
+func (d processorDiffer) erofsProcessed(mediaType string) bool {
+	// Bounded in case of cycles
+	for range len(d.returns) {
+		mt, ok := d.returns[mediaType]
+		if !ok {
+			return false
+		}
+		if strings.HasSuffix(mt, ".erofs") {
+			return true
+		}
+		mediaType = mt
+	}
+	return false
+}
+
+func (d processorDiffer) Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount, opts ...diff.ApplyOpt) (ocispec.Descriptor, error) {
+	layer := layerPath(mounts)
+	if strings.HasSuffix(desc.MediaType, ".erofs") || layer == "" || !d.erofsProcessed(desc.MediaType) {
+		return d.differ.Apply(ctx, desc, mounts, opts...)
+	}
+	var config diff.ApplyConfig
+	for _, o := range opts {
+		if err := o(ctx, desc, &config); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to apply config opt: %w", err)
+		}
+	}
+	ra, err := d.store.ReaderAt(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to get reader from content store: %w", err)
+	}
+	defer ra.Close()
+
+	// The applied layer is described by the digest of its uncompressed tar,
+	// which the stream processors don't output
+	pr, pw := io.Pipe()
+	diffID := make(chan diffIDResult, 1)
+	go func() {
+		diffID <- tarDiffID(pr)
+	}()
+	defer pw.Close()
+
+	var processor diff.StreamProcessor = diff.NewProcessorChain(desc.MediaType, io.TeeReader(content.NewReader(ra), pw))
+	for !strings.HasSuffix(processor.MediaType(), ".erofs") {
+		if processor, err = diff.GetProcessor(ctx, processor, config.ProcessorPayloads); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to get stream processor for %s: %w", desc.MediaType, err)
+		}
+	}
+	defer processor.Close()
+
+	f, err := os.Create(layer)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	_, err = io.Copy(f, processor)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if w, ok := processor.(interface{ Wait(context.Context) error }); ok && err == nil {
+		err = w.Wait(ctx)
+	}
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to process %s: %w", desc.Digest, err)
+	}
+	pw.Close()
+	r := <-diffID
+	if r.err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to read %s: %w", desc.Digest, r.err)
+	}
+	return ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Size:      r.size,
+		Digest:    r.digest,
+	}, nil
+}
+
+type diffIDResult struct {
+	digest digest.Digest
+	size   int64
+	err    error
+}
+
+// tarDiffID returns the digest and size of the uncompressed tar read from pr.
+func tarDiffID(pr *io.PipeReader) (r diffIDResult) {
+	defer func() {
+		// Don't block the writer on trailing data or errors
+		io.Copy(io.Discard, pr)
+		pr.CloseWithError(r.err)
+	}()
+	ds, err := compression.DecompressStream(pr)
+	if err != nil {
+		return diffIDResult{err: err}
+	}
+	defer ds.Close()
+	digester := digest.Canonical.Digester()
+	r.size, r.err = io.Copy(digester.Hash(), ds)
+	r.digest = digester.Digest()
+	return r
+}
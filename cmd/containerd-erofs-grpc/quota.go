@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/docker/go-units"
+	"github.com/erofs/erofs-container-toolkit/pkg/quota"
+)
+
+const (
+	defaultFirstProjectID = 1 << 16
+
+	// labelQuota is the size limit of the upper directory of an active
+	// snapshot, e.g. "10GiB"
+	labelQuota = "containerd.io/snapshot/erofs.quota"
+	// labelQuotaProject is the project of the upper directory of an active
+	// snapshot with a quota
+	labelQuotaProject = "containerd.io/snapshot/erofs.quota-project"
+)
+
+type quotaConfig struct {
+	// Enable limits the size of the upper directories of the active
+	// snapshots with project quotas
+	Enable bool `toml:"enable"`
+	// DefaultSize is the limit of the snapshots without quota label, e.g.
+	// "10GiB", or none if empty
+	DefaultSize string `toml:"default_size"`
+	// FirstProjectID is the project of the snapshot 0 of the root, the
+	// others following, defaultFirstProjectID if 0
+	FirstProjectID uint32 `toml:"first_project_id"`
+}
+
+// quotaSnapshotter accounts the upper and work directories of the active
+// snapshots with a quota label, or the default size, to a project of their
+// own limited to the size.  The layers being unpacked have no quota.
+type quotaSnapshotter struct {
+	snapshots.Snapshotter
+	quota       *quota.Control
+	first       uint32
+	defaultSize uint64
+}
+
+// withQuota returns sn of root with the quotas of c, if enabled.
+func withQuota(sn snapshots.Snapshotter, root string, c quotaConfig) (snapshots.Snapshotter, error) {
+	if !c.Enable {
+		return sn, nil
+	}
+	var size int64
+	if c.DefaultSize != "" {
+		var err error
+		if size, err = units.RAMInBytes(c.DefaultSize); err != nil {
+			return nil, fmt.Errorf("invalid quota default_size: %w", err)
+		}
+	}
+	first := c.FirstProjectID
+	if first == 0 {
+		first = defaultFirstProjectID
+	}
+	ctl, err := quota.New(root)
+	if err != nil {
+		return nil, err
+	}
+	return quotaSnapshotter{sn, ctl, first, uint64(size)}, nil
+}
+
+func (s quotaSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	var base snapshots.Info
+	for _, o := range opts {
+		if err := o(&base); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := base.Labels[labelSnapshotRef]; ok {
+		return s.Snapshotter.Prepare(ctx, key, parent, opts...)
+	}
+	size := s.defaultSize
+	if l, ok := base.Labels[labelQuota]; ok {
+		v, err := units.RAMInBytes(l)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid %s label %q: %w", labelQuota, l, errdefs.ErrInvalidArgument)
+		}
+		size = uint64(v)
+	}
+	mounts, err := s.Snapshotter.Prepare(ctx, key, parent, opts...)
+	if err != nil || size == 0 {
+		return mounts, err
+	}
+	if err := s.limit(ctx, key, mounts, size); err != nil {
+		if err := s.Snapshotter.Remove(ctx, key); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to remove %s", key)
+		}
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// limit limits the size of the directories of the active snapshot key with
+// mounts to size.
+func (s quotaSnapshotter) limit(ctx context.Context, key string, mounts []mount.Mount, size uint64) error {
+	layer := layerPath(mounts)
+	if layer == "" {
+		return fmt.Errorf("unexpected mounts of %s", key)
+	}
+	dir := filepath.Dir(layer)
+	id, err := strconv.ParseUint(filepath.Base(dir), 10, 64)
+	if err != nil || id > math.MaxUint32-uint64(s.first) {
+		return fmt.Errorf("no project for snapshot %s: %w", filepath.Base(dir), errdefs.ErrResourceExhausted)
+	}
+	project := s.first + uint32(id)
+	for _, d := range []string{"fs", "work"} {
+		if err := s.quota.SetProject(filepath.Join(dir, d), project); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := s.quota.SetLimit(project, size); err != nil {
+		return err
+	}
+	info := snapshots.Info{Name: key, Labels: map[string]string{labelQuotaProject: strconv.FormatUint(uint64(project), 10)}}
+	_, err = s.Snapshotter.Update(ctx, info, "labels."+labelQuotaProject)
+	return err
+}
+
+func (s quotaSnapshotter) Remove(ctx context.Context, key string) error {
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := s.Snapshotter.Remove(ctx, key); err != nil {
+		return err
+	}
+	if p, ok := info.Labels[labelQuotaProject]; ok {
+		// The projects aren't reused, but their limits are kept in the
+		// quota files
+		if project, err := strconv.ParseUint(p, 10, 32); err == nil {
+			if err := s.quota.SetLimit(uint32(project), 0); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to remove the quota of %s", key)
+			}
+		}
+	}
+	return nil
+}
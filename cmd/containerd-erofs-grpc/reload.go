@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containerd/log"
+)
+
+// reloader applies the configuration which can be reloaded without
+// restarting: the log level and format, the mkfs.erofs options, the
+// concurrency limits, the namespace filter and the automatic conversions.
+type reloader struct {
+	load                    func() (*config, error)
+	diff                    *diffService
+	apply, compare, prepare *limiter
+	// convert is nil without the conversion API
+	convert    *limiter
+	namespaces *namespaceFilter
+	// conversion is the configuration of the conversions started with, and
+	// auto the automatic conversions, nil if not enabled
+	conversion conversionConfig
+	auto       *autoConverter
+}
+
+// reload loads the configuration again and applies it.  The running calls
+// keep the previous one.
+func (r *reloader) reload() error {
+	cfg, err := r.load()
+	if err != nil {
+		return err
+	}
+	if cfg.Conversion.Enable != r.conversion.Enable || cfg.Conversion.Auto.Enable != r.conversion.Auto.Enable {
+		return fmt.Errorf("enabling or disabling the conversions requires a restart")
+	}
+	level := cfg.Log.Level
+	if level == "" {
+		level = log.InfoLevel.String()
+	}
+	if err := log.SetLevel(level); err != nil {
+		return err
+	}
+	if cfg.Log.Format != "" {
+		if err := log.SetFormat(log.OutputFormat(cfg.Log.Format)); err != nil {
+			return err
+		}
+	}
+
+	r.diff.setMkfsOptions(cfg.Differ.MkfsOptions)
+	r.apply.set(cfg.Limits.MaxApplies, cfg.Limits.MaxQueued)
+	r.compare.set(cfg.Limits.MaxCompares, cfg.Limits.MaxQueued)
+	r.prepare.set(cfg.Limits.MaxPrepares, cfg.Limits.MaxQueued)
+	if r.convert != nil {
+		r.convert.set(cfg.Limits.MaxConversions, cfg.Limits.MaxQueued)
+	}
+	r.namespaces.set(cfg.Namespaces)
+	if r.auto != nil {
+		r.auto.set(cfg.Conversion.Auto)
+	}
+	return nil
+}
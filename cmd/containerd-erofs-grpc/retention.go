@@ -0,0 +1,403 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultRetentionInterval = time.Hour
+	defaultSnapshotterName   = "erofs"
+
+	// usedResolution is the resolution of the last use of the layers, to
+	// update their label at most once per period
+	usedResolution = time.Hour
+
+	// labelLastUsed is the last time a committed layer was used by a
+	// snapshot prepared or viewed on top of it, in RFC 3339
+	labelLastUsed = "containerd.io/snapshot/erofs.last-used"
+	// labelCold is the file a demoted layer was moved to
+	labelCold = "containerd.io/snapshot/erofs.cold"
+)
+
+type retentionConfig struct {
+	// MaxIdle is the time after which a layer not used by any snapshot is
+	// idle, or the layers are kept if 0
+	MaxIdle duration `toml:"max_idle"`
+	// Interval is the period of the checks, defaultRetentionInterval if 0
+	Interval duration `toml:"interval"`
+	// HighWatermark is the usage of the filesystem of the root, in percent,
+	// above which the idle layers are removed, always if 0
+	HighWatermark int `toml:"high_watermark"`
+	// LowWatermark is the usage below which no more idle layers are removed
+	LowWatermark int `toml:"low_watermark"`
+	// Action is "remove" (the default) to remove the idle layers through
+	// containerd, or "demote" to move them to ColdDir until used again
+	Action string `toml:"action"`
+	// ColdDir stores the demoted layers
+	ColdDir string `toml:"cold_dir"`
+	// Snapshotter is the name of the snapshotter in containerd,
+	// defaultSnapshotterName if empty
+	Snapshotter string `toml:"snapshotter"`
+}
+
+// removesIdleLayers reports whether a snapshotter of c removes its idle layers
+// through containerd.
+func (c *config) removesIdleLayers() bool {
+	removes := func(r retentionConfig) bool {
+		return r.MaxIdle > 0 && (r.Action == "" || r.Action == "remove")
+	}
+	if removes(c.Snapshotter.Retention) {
+		return true
+	}
+	for _, s := range c.Snapshotters {
+		if removes(s.Retention) {
+			return true
+		}
+	}
+	return false
+}
+
+// check checks c, with the EROFS snapshotter configured with enableFsverity.
+func (c retentionConfig) check(enableFsverity bool) error {
+	switch {
+	case c.MaxIdle < 0 || c.Interval < 0:
+		return fmt.Errorf("negative retention max_idle or interval")
+	case c.HighWatermark < 0 || c.HighWatermark > 100 || c.LowWatermark < 0 || c.LowWatermark > c.HighWatermark:
+		return fmt.Errorf("retention watermarks %d and %d aren't percentages with low_watermark <= high_watermark", c.LowWatermark, c.HighWatermark)
+	}
+	switch c.Action {
+	case "", "remove":
+	case "demote":
+		if c.ColdDir == "" {
+			return fmt.Errorf("retention action demote requires a cold_dir")
+		}
+		if enableFsverity {
+			return fmt.Errorf("fs-verity can't be kept on the demoted layers: %w", errdefs.ErrNotImplemented)
+		}
+	default:
+		return fmt.Errorf("unknown retention action %q", c.Action)
+	}
+	return nil
+}
+
+// retentionSnapshotter records the last use of the committed layers, and
+// promotes the demoted layers back to the root before mounting them.  The
+// demoted layers are symlinks to their cold file meanwhile.
+type retentionSnapshotter struct {
+	snapshots.Snapshotter
+	root string
+}
+
+func (s retentionSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	if err := s.use(ctx, parent); err != nil {
+		return nil, err
+	}
+	return s.Snapshotter.Prepare(ctx, key, parent, opts...)
+}
+
+func (s retentionSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	if err := s.use(ctx, parent); err != nil {
+		return nil, err
+	}
+	return s.Snapshotter.View(ctx, key, parent, opts...)
+}
+
+func (s retentionSnapshotter) Remove(ctx context.Context, key string) error {
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := s.Snapshotter.Remove(ctx, key); err != nil {
+		return err
+	}
+	if cold, ok := info.Labels[labelCold]; ok {
+		if err := os.Remove(cold); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.G(ctx).WithError(err).Warnf("failed to remove the demoted layer of %s", key)
+		}
+	}
+	return nil
+}
+
+// use records the use of the layers of the chain of parent, and promotes
+// them if demoted.  A layer which can't be promoted is used from its cold
+// file.
+func (s retentionSnapshotter) use(ctx context.Context, parent string) error {
+	now := time.Now().UTC()
+	for parent != "" {
+		info, err := s.Snapshotter.Stat(ctx, parent)
+		if err != nil {
+			return err
+		}
+		if _, ok := info.Labels[labelCold]; ok {
+			if err := s.promote(ctx, info); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to promote the demoted layer %s", parent)
+			}
+		}
+		if now.Sub(lastUsed(info)) >= usedResolution {
+			info := snapshots.Info{Name: parent, Labels: map[string]string{labelLastUsed: now.Format(time.RFC3339)}}
+			if _, err := s.Snapshotter.Update(ctx, info, "labels."+labelLastUsed); err != nil {
+				return err
+			}
+		}
+		parent = info.Parent
+	}
+	return nil
+}
+
+// promote moves the demoted layer of info back to the root.
+func (s retentionSnapshotter) promote(ctx context.Context, info snapshots.Info) error {
+	cold := info.Labels[labelCold]
+	layer := filepath.Join(s.root, "snapshots", info.Labels[labelSnapshotID], "layer.erofs")
+	if err := copyLayer(cold, layer); err != nil {
+		return err
+	}
+	if err := setImmutable(layer, true); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to set the immutable flag of %s", layer)
+	}
+	// Removes the label
+	if _, err := s.Snapshotter.Update(ctx, snapshots.Info{Name: info.Name}, "labels."+labelCold); err != nil {
+		return err
+	}
+	if err := os.Remove(cold); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to remove %s", cold)
+	}
+	log.G(ctx).WithField("layer", info.Name).Info("promoted the demoted layer")
+	return nil
+}
+
+// startRetention removes or demotes the idle layers of sn of root with c
+// in the background, if enabled, removing them through containerd with
+// clients.
+func startRetention(sn snapshots.Snapshotter, root string, c retentionConfig, clients *clientManager) {
+	if c.MaxIdle == 0 {
+		return
+	}
+	interval := time.Duration(c.Interval)
+	if interval == 0 {
+		interval = defaultRetentionInterval
+	}
+	r := retention{sn, root, c, clients}
+	go func() {
+		ctx := log.WithLogger(context.Background(), log.L.WithField("root", root))
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			if err := r.run(ctx); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to apply the retention of the idle layers")
+			}
+			<-t.C
+		}
+	}()
+}
+
+// retention removes or demotes the idle layers of a snapshotter.
+type retention struct {
+	sn      snapshots.Snapshotter
+	root    string
+	config  retentionConfig
+	clients *clientManager
+}
+
+// run removes or demotes the idle layers, least recently used first, until
+// the usage of the filesystem of the root is below the low watermark.
+func (r retention) run(ctx context.Context) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(r.root, &st); err != nil {
+		return err
+	}
+	total, used := st.Blocks*uint64(st.Bsize), (st.Blocks-st.Bfree)*uint64(st.Bsize)
+	if r.config.HighWatermark > 0 && used*100 < total*uint64(r.config.HighWatermark) {
+		return nil
+	}
+
+	var infos []snapshots.Info
+	byName := map[string]snapshots.Info{}
+	if err := r.sn.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		infos = append(infos, info)
+		byName[info.Name] = info
+		return nil
+	}); err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	// The layers below the active snapshots and views are in use
+	inUse := map[string]bool{}
+	children := map[string]int{}
+	for _, info := range infos {
+		children[info.Parent]++
+		if info.Kind == snapshots.KindCommitted {
+			continue
+		}
+		for p := info.Parent; p != "" && !inUse[p]; p = byName[p].Parent {
+			inUse[p] = true
+		}
+	}
+	var idle []snapshots.Info
+	for _, info := range infos {
+		_, cold := info.Labels[labelCold]
+		if info.Kind == snapshots.KindCommitted && !inUse[info.Name] && !cold && time.Since(lastUsed(info)) >= time.Duration(r.config.MaxIdle) {
+			idle = append(idle, info)
+		}
+	}
+	slices.SortFunc(idle, func(a, b snapshots.Info) int { return lastUsed(a).Compare(lastUsed(b)) })
+
+	// The layers are removed from the top of their chain, their parents
+	// being idle as long as them
+	done := map[string]bool{}
+	for progress := true; progress; {
+		progress = false
+		for _, info := range idle {
+			if r.config.HighWatermark > 0 && used*100 <= total*uint64(r.config.LowWatermark) {
+				return nil
+			}
+			if done[info.Name] || (r.config.Action != "demote" && children[info.Name] > 0) {
+				continue
+			}
+			done[info.Name] = true
+			freed, err := r.apply(ctx, info)
+			if err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to %s the idle layer %s", cmp.Or(r.config.Action, "remove"), info.Name)
+				continue
+			}
+			used -= min(used, uint64(freed))
+			children[info.Parent]--
+			progress = true
+		}
+	}
+	return nil
+}
+
+// apply removes or demotes the idle layer of info, and returns the bytes
+// freed.
+func (r retention) apply(ctx context.Context, info snapshots.Info) (int64, error) {
+	if r.config.Action == "demote" {
+		return r.demote(ctx, info)
+	}
+	u, err := r.sn.Usage(ctx, info.Name)
+	if err != nil {
+		return 0, err
+	}
+	// The snapshots of containerd are named "<namespace>/<id>/<key>"
+	parts := strings.SplitN(info.Name, "/", 3)
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("snapshot %s not created by containerd: %w", info.Name, errdefs.ErrNotImplemented)
+	}
+	client, err := r.clients.get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	name := cmp.Or(r.config.Snapshotter, defaultSnapshotterName)
+	if err := client.SnapshotService(name).Remove(namespaces.WithNamespace(ctx, parts[0]), parts[2]); err != nil {
+		return 0, err
+	}
+	log.G(ctx).WithField("layer", info.Name).Infof("removed the layer idle since %s", lastUsed(info).Format(time.RFC3339))
+	// Freed once containerd collects it
+	return u.Size, nil
+}
+
+// demote moves the layer.erofs of the idle layer of info to the cold
+// directory, and replaces it with a symlink.  The layers which would still
+// use their space are skipped: mounted from the pool of loop devices,
+// deduplicated, or verified with dm-verity.
+func (r retention) demote(ctx context.Context, info snapshots.Info) (int64, error) {
+	id, ok := info.Labels[labelSnapshotID]
+	if _, verity := info.Labels[labelRootHash]; !ok || verity {
+		return 0, nil
+	}
+	dir := filepath.Join(r.root, "snapshots", id)
+	layer := filepath.Join(dir, "layer.erofs")
+	var st unix.Stat_t
+	if err := unix.Lstat(layer, &st); err != nil {
+		return 0, err
+	}
+	// Not a regular file, lazy or deduplicated
+	if st.Mode&unix.S_IFMT != unix.S_IFREG || st.Size == 0 || st.Nlink > 1 {
+		return 0, nil
+	}
+	mountpoint := filepath.Join(dir, "fs")
+	if err := unix.Unmount(mountpoint, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+		return 0, fmt.Errorf("failed to unmount %s: %w", mountpoint, err)
+	}
+	if len(loopDevices([]string{dir})) > 0 {
+		return 0, nil
+	}
+
+	if err := os.MkdirAll(r.config.ColdDir, 0700); err != nil {
+		return 0, err
+	}
+	sum := sha256.Sum256([]byte(r.root))
+	cold := filepath.Join(r.config.ColdDir, fmt.Sprintf("%s-%s.erofs", hex.EncodeToString(sum[:4]), id))
+	if err := copyLayer(layer, cold); err != nil {
+		return 0, err
+	}
+	labels := map[string]string{labelCold: cold}
+	if _, err := r.sn.Update(ctx, snapshots.Info{Name: info.Name, Labels: labels}, "labels."+labelCold); err != nil {
+		os.Remove(cold)
+		return 0, err
+	}
+	tmp := layer + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(cold, tmp); err != nil {
+		return 0, err
+	}
+	setImmutable(layer, false)
+	if err := os.Rename(tmp, layer); err != nil {
+		os.Remove(tmp)
+		setImmutable(layer, true)
+		return 0, err
+	}
+	log.G(ctx).WithField("layer", info.Name).Infof("demoted the layer idle since %s to %s", lastUsed(info).Format(time.RFC3339), cold)
+	return st.Size, nil
+}
+
+// lastUsed returns the last use of the layer of info, or its creation.
+func lastUsed(info snapshots.Info) time.Time {
+	t, err := time.Parse(time.RFC3339, info.Labels[labelLastUsed])
+	if err != nil || t.Before(info.Created) {
+		return info.Created
+	}
+	return t
+}
+
+// copyLayer copies the layer at src to dst, replacing it at once.
+func copyLayer(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
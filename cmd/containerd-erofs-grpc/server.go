@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	diffapi "github.com/containerd/containerd/api/services/diff/v1"
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/containerd/containerd/v2/contrib/snapshotservice"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/ttrpc"
+	conversionapi "github.com/erofs/erofs-container-toolkit/api/conversion/v1"
+	infoapi "github.com/erofs/erofs-container-toolkit/api/info/v1"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// server serves the same services over gRPC and TTRPC.
+type server struct {
+	grpc   *grpc.Server
+	ttrpc  *ttrpc.Server
+	health *health.Server
+
+	snapshotters []snapshots.Snapshotter
+	namespaces   *namespaceFilter
+}
+
+// newServer returns a server restricted to the namespaces of ns.
+func newServer(ns *namespaceFilter) (*server, error) {
+	serverOpts := []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
+			streamNamespaceInterceptor,
+			ns.streamInterceptor,
+		)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
+			unaryNamespaceInterceptor,
+			ns.unaryInterceptor,
+		)),
+	}
+	trpc, err := ttrpc.NewServer(ttrpc.WithChainUnaryServerInterceptor(ttrpcNamespaceInterceptor, ns.ttrpcInterceptor))
+	if err != nil {
+		return nil, err
+	}
+	s := &server{
+		grpc:   grpc.NewServer(serverOpts...),
+		ttrpc:  trpc,
+		health: health.NewServer(),
+
+		namespaces: ns,
+	}
+	healthpb.RegisterHealthServer(s.grpc, s.health)
+	return s, nil
+}
+
+// registerSnapshotter registers sn, with its Prepare calls limited by
+// prepare.
+func (s *server) registerSnapshotter(sn snapshots.Snapshotter, prepare *limiter) {
+	// Convert the snapshotter to a gRPC service,
+	// example in github.com/containerd/containerd/contrib/snapshotservice
+	ss := snapshotservice.FromSnapshotter(tracingSnapshotter{limitedSnapshotter{metricsSnapshotter{sn}, prepare}})
+	snapshotsapi.RegisterSnapshotsServer(s.grpc, ss)
+	snapshotsapi.RegisterTTRPCSnapshotsService(s.ttrpc, ttrpcSnapshots{ss, s.namespaces})
+	s.snapshotters = append(s.snapshotters, sn)
+}
+
+func (s *server) registerDiff(ds diffapi.DiffServer) {
+	diffapi.RegisterDiffServer(s.grpc, ds)
+	diffapi.RegisterTTRPCDiffService(s.ttrpc, ds)
+}
+
+func (s *server) registerConversion(cs *conversionService) {
+	conversionapi.RegisterConversionServer(s.grpc, cs)
+	conversionapi.RegisterTTRPCConversionService(s.ttrpc, cs)
+}
+
+func (s *server) registerInfo(is *infoService) {
+	infoapi.RegisterInfoServer(s.grpc, is)
+	infoapi.RegisterTTRPCInfoService(s.ttrpc, is)
+}
+
+// serve serves l with protocol, "grpc" if empty, until the server stops.
+func (s *server) serve(l net.Listener, protocol string) error {
+	switch protocol {
+	case "", "grpc":
+		return s.grpc.Serve(l)
+	case "ttrpc":
+		return s.ttrpc.Serve(context.Background(), l)
+	default:
+		return fmt.Errorf("unknown protocol %q", protocol)
+	}
+}
+
+// shutdown stops accepting calls and waits for the running ones to complete,
+// until ctx is done when they're aborted.  The snapshotters are closed last.
+func (s *server) shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		s.grpc.GracefulStop()
+		close(stopped)
+	}()
+
+	var errs []error
+	if err := s.ttrpc.Shutdown(ctx); err != nil {
+		errs = append(errs, err, s.ttrpc.Close())
+	}
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.grpc.Stop()
+		<-stopped
+		errs = append(errs, ctx.Err())
+	}
+	for _, sn := range s.snapshotters {
+		errs = append(errs, sn.Close())
+	}
+	return errors.Join(errs...)
+}
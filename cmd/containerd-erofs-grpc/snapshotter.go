@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	snapshot "github.com/containerd/containerd/v2/plugins/snapshots/erofs"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/loop"
+	"github.com/moby/sys/userns"
+)
+
+// newSnapshotter returns the EROFS snapshotter of root configured with c,
+// mounting the labeled layers lazily with fsc if not nil, and removing its
+// idle layers through containerd with clients.
+func newSnapshotter(root string, c snapshotterConfig, fsc *fscacheMounter, clients *clientManager) (snapshots.Snapshotter, error) {
+	fuse := c.Mount == "fuse"
+	switch c.Mount {
+	case "", "kernel", "fuse":
+	case "auto":
+		// Rootless containerd can't mount EROFS
+		fuse = !findErofs() || userns.RunningInUserNS()
+	default:
+		return nil, fmt.Errorf("unknown mount %q", c.Mount)
+	}
+	if err := c.Retention.check(c.EnableFsverity); err != nil {
+		return nil, err
+	}
+	if err := c.SELinux.check(); err != nil {
+		return nil, err
+	}
+	if err := c.Overlay.check(); err != nil {
+		return nil, err
+	}
+	if err := c.Fsverity.check(); err != nil {
+		return nil, err
+	}
+	demote := c.Retention.MaxIdle > 0 && c.Retention.Action == "demote"
+	switch c.Layout {
+	case "", "layers":
+	case "composefs":
+		if c.Merge.Threshold > 0 {
+			return nil, fmt.Errorf("the composefs layout merges the layers already")
+		}
+	default:
+		return nil, fmt.Errorf("unknown layout %q", c.Layout)
+	}
+	composefs := c.Layout == "composefs"
+	if fuse {
+		if fsc != nil || c.DmVerity || c.Fsverity.enabled() || c.Loop.Enable || c.Dedup != "" || c.PageCache.DomainID != "" || demote || c.Merge.Threshold > 0 || composefs {
+			return nil, fmt.Errorf("fscache, dm-verity, fs-verity checks, loop devices, dedup, page cache sharing, demoting and merging layers, and the composefs layout require the kernel mounts: %w", errdefs.ErrNotImplemented)
+		}
+		log.L.WithField("root", root).Info("mounting the EROFS layers with erofsfuse")
+		sn, err := newFuseSnapshotter(context.Background(), root, c)
+		if err != nil {
+			return nil, err
+		}
+		ms, err := snapshotterMetaStore(sn)
+		if err != nil {
+			return nil, err
+		}
+		if c.Retention.MaxIdle > 0 {
+			sn = retentionSnapshotter{sn, root}
+		}
+		if sn, err = withQuota(sn, root, c.Quota); err != nil {
+			return nil, err
+		}
+		startRetention(sn, root, c.Retention, clients)
+		sn = readOnlySnapshotter{withOptions(mountLabelSnapshotter{withOverlay(sn, c.Overlay), c.SELinux}, c)}
+		return withCleanup(sn, root, c.Cleanup, ms, nil), nil
+	}
+
+	if c.Dedup == "hardlink" && c.EnableFsverity {
+		return nil, fmt.Errorf("fs-verity requires reflink dedup: %w", errdefs.ErrNotImplemented)
+	}
+	if strings.ContainsAny(c.PageCache.DomainID, ",=") {
+		return nil, fmt.Errorf("invalid page cache domain_id %q", c.PageCache.DomainID)
+	}
+	var opts []snapshot.Opt
+	if len(c.OvlOptions) > 0 {
+		opts = append(opts, snapshot.WithOvlOptions(c.OvlOptions))
+	}
+	if c.EnableFsverity {
+		opts = append(opts, snapshot.WithFsverity())
+	}
+	sn, err := snapshot.NewSnapshotter(root, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ms, err := snapshotterMetaStore(sn)
+	if err != nil {
+		return nil, err
+	}
+	files, err := fileBacked(root, c.FileBacked)
+	if err != nil {
+		return nil, err
+	}
+	log.L.WithField("root", root).Debugf("file-backed mounts: %t", files)
+	if c.Merge.Threshold > 0 && (!files || c.DmVerity) {
+		return nil, fmt.Errorf("merging layers requires file-backed mounts, without dm-verity: %w", errdefs.ErrNotImplemented)
+	}
+	if composefs && (!files || c.DmVerity || c.EnableFsverity) {
+		return nil, fmt.Errorf("the composefs layout requires file-backed mounts, without dm-verity nor fs-verity: %w", errdefs.ErrNotImplemented)
+	}
+	if files {
+		sn = fileBackedSnapshotter{sn}
+	}
+	// The layers shared in a page cache domain are mounted by the loop
+	// snapshotter, with the options of the domain, as the layers which must
+	// not be mounted from their file
+	sharePageCache := c.PageCache.DomainID != ""
+	mountLayers := c.Loop.Enable || sharePageCache || c.FileBacked == "never"
+	if c.DmVerity || c.Fsverity.enabled() || mountLayers || c.Dedup != "" || demote {
+		sn = idSnapshotter{sn}
+	}
+	if c.Dedup != "" {
+		if sn, err = newDedupSnapshotter(context.Background(), sn, root, c.Dedup); err != nil {
+			return nil, err
+		}
+	}
+	if sharePageCache {
+		sn = pageCacheSnapshotter{sn, root, c.PageCache.DomainID}
+	}
+	if sn, err = fsc.snapshotter(context.Background(), sn, root); err != nil {
+		return nil, err
+	}
+	var pool *loop.Pool
+	if mountLayers {
+		l, err := newLoopSnapshotter(context.Background(), sn, root, c.Loop, c.PageCache.mountOptions(), files)
+		if err != nil {
+			return nil, err
+		}
+		sn, pool = l, l.pool
+	}
+	if c.DmVerity {
+		if sn, err = newVeritySnapshotter(context.Background(), sn, root, c.PageCache.mountOptions()); err != nil {
+			return nil, err
+		}
+	}
+	if c.Fsverity.enabled() {
+		sn = newFsveritySnapshotter(sn, root, c.Fsverity)
+	}
+	if c.Merge.Threshold > 0 {
+		sn = mergeSnapshotter{sn, root, c.Merge.Threshold, c.PageCache.mountOptions(), &sync.Mutex{}}
+	}
+	if composefs {
+		sn = composefsSnapshotter{sn, root, &sync.Mutex{}}
+	}
+	// The demoted layers are promoted before they're mounted
+	if c.Retention.MaxIdle > 0 {
+		sn = retentionSnapshotter{sn, root}
+	}
+	if sn, err = withQuota(sn, root, c.Quota); err != nil {
+		return nil, err
+	}
+	startRetention(sn, root, c.Retention, clients)
+	sn = readOnlySnapshotter{withOptions(mountLabelSnapshotter{withOverlay(sn, c.Overlay), c.SELinux}, c)}
+	return withCleanup(sn, root, c.Cleanup, ms, pool), nil
+}
+
+// findErofs reports whether the kernel supports EROFS.
+func findErofs() bool {
+	b, err := os.ReadFile("/proc/filesystems")
+	return err == nil && bytes.Contains(b, []byte("\terofs\n"))
+}
+
+// withOptions returns sn applying the options of c it has no options for.
+func withOptions(sn snapshots.Snapshotter, c snapshotterConfig) snapshots.Snapshotter {
+	if len(c.ViewMountOptions) == 0 && len(c.Labels) == 0 {
+		return sn
+	}
+	return optionsSnapshotter{Snapshotter: sn, config: c}
+}
+
+// optionsSnapshotter applies the configuration the EROFS snapshotter has no
+// options for: the default labels of new snapshots and the mount options of
+// views.
+type optionsSnapshotter struct {
+	snapshots.Snapshotter
+	config snapshotterConfig
+}
+
+func (s optionsSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	return s.Snapshotter.Prepare(ctx, key, parent, s.withLabels(opts)...)
+}
+
+func (s optionsSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.View(ctx, key, parent, s.withLabels(opts)...)
+	if err != nil {
+		return nil, err
+	}
+	return s.viewMounts(mounts), nil
+}
+
+func (s optionsSnapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.Mounts(ctx, key)
+	if err != nil || len(s.config.ViewMountOptions) == 0 {
+		return mounts, err
+	}
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if info.Kind == snapshots.KindView {
+		mounts = s.viewMounts(mounts)
+	}
+	return mounts, nil
+}
+
+// withLabels prepends the default labels to opts, so that the labels given
+// by the client override them.
+func (s optionsSnapshotter) withLabels(opts []snapshots.Opt) []snapshots.Opt {
+	if len(s.config.Labels) == 0 {
+		return opts
+	}
+	return append([]snapshots.Opt{snapshots.WithLabels(s.config.Labels)}, opts...)
+}
+
+func (s optionsSnapshotter) viewMounts(mounts []mount.Mount) []mount.Mount {
+	for i := range mounts {
+		for _, o := range s.config.ViewMountOptions {
+			if !slices.Contains(mounts[i].Options, o) {
+				mounts[i].Options = append(mounts[i].Options, o)
+			}
+		}
+	}
+	return mounts
+}
+
+// labelReadOnly prepares the snapshot of a read-only container as a view,
+// without a writable upper directory
+const labelReadOnly = "containerd.io/snapshot/erofs.read-only"
+
+// readOnlySnapshotter creates the active snapshots labeled read-only as views:
+// their mounts are the EROFS layer, or an overlay of the layers without upper
+// directory, and can't be committed.
+type readOnlySnapshotter struct {
+	snapshots.Snapshotter
+}
+
+func (s readOnlySnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	var base snapshots.Info
+	for _, o := range opts {
+		if err := o(&base); err != nil {
+			return nil, err
+		}
+	}
+	if ro, _ := strconv.ParseBool(base.Labels[labelReadOnly]); ro {
+		return s.Snapshotter.View(ctx, key, parent, opts...)
+	}
+	return s.Snapshotter.Prepare(ctx, key, parent, opts...)
+}
+
+// labelSnapshotID is the id of the directory of the snapshot of an unpacked
+// layer
+const labelSnapshotID = "containerd.io/snapshot/erofs.id"
+
+// idSnapshotter labels the snapshots of the layers unpacked with the id of
+// their directory, which the EROFS snapshotter doesn't tell, to mount them.
+type idSnapshotter struct {
+	snapshots.Snapshotter
+}
+
+func (s idSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	mounts, err := s.Snapshotter.Prepare(ctx, key, parent, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var base snapshots.Info
+	for _, o := range opts {
+		if err := o(&base); err != nil {
+			return nil, err
+		}
+	}
+	// The snapshotter has no mounts for the layers without parent once
+	// applied
+	if _, ok := base.Labels[labelSnapshotRef]; ok {
+		if layer := layerPath(mounts); layer != "" {
+			info := snapshots.Info{Name: key, Labels: map[string]string{labelSnapshotID: filepath.Base(filepath.Dir(layer))}}
+			if _, err := s.Snapshotter.Update(ctx, info, "labels."+labelSnapshotID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return mounts, nil
+}
+
+func (s idSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if id, ok := info.Labels[labelSnapshotID]; ok {
+		opts = append(opts, snapshots.WithLabels(map[string]string{labelSnapshotID: id}))
+	}
+	return s.Snapshotter.Commit(ctx, name, key, opts...)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+
+	"github.com/containerd/log"
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// activationListeners returns the sockets passed by systemd socket
+// activation, by address.
+func activationListeners() (map[string]net.Listener, error) {
+	ls, err := activation.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	listeners := make(map[string]net.Listener, len(ls))
+	for _, l := range ls {
+		// Passed file descriptors which aren't sockets are nil
+		if l != nil {
+			listeners[l.Addr().String()] = l
+		}
+	}
+	return listeners, nil
+}
+
+// notify sends state to systemd, if started by systemd with Type=notify.
+func notify(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		log.L.WithError(err).Warnf("failed to notify systemd of %s", state)
+	}
+}
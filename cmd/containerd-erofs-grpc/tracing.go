@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/diff"
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/tracing"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const defaultServiceName = "containerd-erofs-grpc"
+
+type tracingConfig struct {
+	// Endpoint is the OTLP collector to export the spans to, none if empty
+	Endpoint string `toml:"endpoint"`
+	// Protocol is "http/protobuf" (the default) or "grpc"
+	Protocol      string  `toml:"protocol"`
+	Insecure      bool    `toml:"insecure"`
+	SamplingRatio float64 `toml:"sampling_ratio"`
+	ServiceName   string  `toml:"service_name"`
+}
+
+// setupTracing exports the spans to the OTLP collector of c, if any.  It
+// returns a function to flush the pending spans and stop exporting.
+func setupTracing(ctx context.Context, c tracingConfig) (func(context.Context) error, error) {
+	if c.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var client otlptrace.Client
+	switch c.Protocol {
+	case "", "http/protobuf":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(c.Endpoint)}
+		if strings.Contains(c.Endpoint, "://") {
+			opts = []otlptracehttp.Option{otlptracehttp.WithEndpointURL(c.Endpoint)}
+		}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		client = otlptracehttp.NewClient(opts...)
+	case "grpc":
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(c.Endpoint)}
+		if strings.Contains(c.Endpoint, "://") {
+			opts = []otlptracegrpc.Option{otlptracegrpc.WithEndpointURL(c.Endpoint)}
+		}
+		if c.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		client = otlptracegrpc.NewClient(opts...)
+	default:
+		return nil, fmt.Errorf("unsupported tracing protocol %q", c.Protocol)
+	}
+	exporter, err := otlptrace.New(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	name := c.ServiceName
+	if name == "" {
+		name = defaultServiceName
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(name)))
+	if err != nil {
+		return nil, err
+	}
+	sampler := sdktrace.AlwaysSample()
+	if c.SamplingRatio > 0 {
+		sampler = sdktrace.TraceIDRatioBased(c.SamplingRatio)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// tracingSnapshotter records spans for the operations of a snapshotter.
+type tracingSnapshotter struct {
+	snapshots.Snapshotter
+}
+
+func (s tracingSnapshotter) Mounts(ctx context.Context, key string) (_ []mount.Mount, err error) {
+	ctx, span := tracing.StartSpan(ctx, tracing.Name("erofs", "snapshotter", "Mounts"),
+		tracing.WithAttribute("snapshot.key", key))
+	defer func() { span.SetStatus(err); span.End() }()
+	return s.Snapshotter.Mounts(ctx, key)
+}
+
+func (s tracingSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) (_ []mount.Mount, err error) {
+	ctx, span := tracing.StartSpan(ctx, tracing.Name("erofs", "snapshotter", "Prepare"),
+		tracing.WithAttribute("snapshot.key", key), tracing.WithAttribute("snapshot.parent", parent))
+	defer func() { span.SetStatus(err); span.End() }()
+	return s.Snapshotter.Prepare(ctx, key, parent, opts...)
+}
+
+func (s tracingSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) (_ []mount.Mount, err error) {
+	ctx, span := tracing.StartSpan(ctx, tracing.Name("erofs", "snapshotter", "View"),
+		tracing.WithAttribute("snapshot.key", key), tracing.WithAttribute("snapshot.parent", parent))
+	defer func() { span.SetStatus(err); span.End() }()
+	return s.Snapshotter.View(ctx, key, parent, opts...)
+}
+
+func (s tracingSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) (err error) {
+	ctx, span := tracing.StartSpan(ctx, tracing.Name("erofs", "snapshotter", "Commit"),
+		tracing.WithAttribute("snapshot.name", name), tracing.WithAttribute("snapshot.key", key))
+	defer func() { span.SetStatus(err); span.End() }()
+	return s.Snapshotter.Commit(ctx, name, key, opts...)
+}
+
+func (s tracingSnapshotter) Remove(ctx context.Context, key string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, tracing.Name("erofs", "snapshotter", "Remove"),
+		tracing.WithAttribute("snapshot.key", key))
+	defer func() { span.SetStatus(err); span.End() }()
+	return s.Snapshotter.Remove(ctx, key)
+}
+
+func (s tracingSnapshotter) Cleanup(ctx context.Context) (err error) {
+	ctx, span := tracing.StartSpan(ctx, tracing.Name("erofs", "snapshotter", "Cleanup"))
+	defer func() { span.SetStatus(err); span.End() }()
+	return cleanup(ctx, s.Snapshotter)
+}
+
+// tracingDiffer records spans for the operations of a differ.
+type tracingDiffer struct {
+	differ
+}
+
+func (d tracingDiffer) Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount, opts ...diff.ApplyOpt) (_ ocispec.Descriptor, err error) {
+	ctx, span := tracing.StartSpan(ctx, tracing.Name("erofs", "differ", "Apply"),
+		tracing.WithAttribute("layer.digest", desc.Digest.String()),
+		tracing.WithAttribute("layer.mediatype", desc.MediaType),
+		tracing.WithAttribute("layer.size", desc.Size))
+	defer func() { span.SetStatus(err); span.End() }()
+	// Native EROFS layers are copied as they are, mkfs.erofs converts others
+	if !strings.HasSuffix(desc.MediaType, ".erofs") {
+		var mkfs *tracing.Span
+		ctx, mkfs = tracing.StartSpan(ctx, tracing.Name("erofs", "mkfs"))
+		defer func() { mkfs.SetStatus(err); mkfs.End() }()
+	}
+	return d.differ.Apply(ctx, desc, mounts, opts...)
+}
+
+func (d tracingDiffer) Compare(ctx context.Context, lower, upper []mount.Mount, opts ...diff.Opt) (_ ocispec.Descriptor, err error) {
+	ctx, span := tracing.StartSpan(ctx, tracing.Name("erofs", "differ", "Compare"))
+	defer func() { span.SetStatus(err); span.End() }()
+	return d.differ.Compare(ctx, lower, upper, opts...)
+}
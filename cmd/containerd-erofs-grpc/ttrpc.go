@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/ttrpc"
+	"google.golang.org/grpc"
+)
+
+// ttrpcSnapshots serves a gRPC snapshots service over TTRPC.
+type ttrpcSnapshots struct {
+	snapshotsapi.SnapshotsServer
+	namespaces *namespaceFilter
+}
+
+func (s ttrpcSnapshots) List(ctx context.Context, req *snapshotsapi.ListSnapshotsRequest, ss snapshotsapi.TTRPCSnapshots_ListServer) error {
+	if err := s.namespaces.check(ctx); err != nil {
+		return err
+	}
+	return s.SnapshotsServer.List(req, &ttrpcListServer{ctx: ctx, ss: ss})
+}
+
+// ttrpcListServer adapts a TTRPC List stream to the gRPC one, on which the
+// snapshots service only sends responses.
+type ttrpcListServer struct {
+	grpc.ServerStream
+	ctx context.Context
+	ss  snapshotsapi.TTRPCSnapshots_ListServer
+}
+
+func (s *ttrpcListServer) Context() context.Context {
+	return s.ctx
+}
+
+func (s *ttrpcListServer) Send(m *snapshotsapi.ListSnapshotsResponse) error {
+	return s.ss.Send(m)
+}
+
+func ttrpcNamespaceInterceptor(ctx context.Context, unmarshal ttrpc.Unmarshaler, _ *ttrpc.UnaryServerInfo, method ttrpc.Method) (interface{}, error) {
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		// The above call checks the *incoming* metadata, this makes sure the outgoing metadata is also set
+		ctx = namespaces.WithNamespace(ctx, ns)
+	}
+	return method(ctx, unmarshal)
+}
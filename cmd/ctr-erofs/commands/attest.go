@@ -0,0 +1,180 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+// AttestCommand attaches the SLSA provenance of a conversion to an image
+var AttestCommand = &cli.Command{
+	Name:      "attest",
+	Usage:     "attach the SLSA provenance of a conversion to an image",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Generate an in-toto SLSA provenance statement describing the conversion of
+an image by 'ctr-erofs images convert' (source digest, tool version, options
+and environment), and attach it to the image as an OCI referrer, in an
+unsigned DSSE envelope.
+
+The referrer is stored in the referrers index of the image, tagged
+'<repository>:sha256-<digest>', which is pushed with '--push', merged with the
+referrers already pushed.  Registries supporting the OCI referrers API index
+it by its subject as well.
+`,
+	Flags: append([]cli.Flag{
+		&cli.BoolFlag{
+			Name:  "push",
+			Usage: "Push the referrers index to the registry of the image",
+		},
+		&cli.BoolFlag{
+			Name:  "print",
+			Usage: "Print the provenance statement",
+		},
+	}, commands.RegistryFlags...),
+	Action: func(context *cli.Context) error {
+		ref := context.Args().First()
+		if ref == "" {
+			return errors.New("image ref needs to be specified")
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+
+		is := client.ImageService()
+		img, err := is.Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		conversion, err := convert.ParseConversion(img.Labels)
+		if err != nil {
+			return fmt.Errorf("%s wasn't converted by ctr-erofs: %w", ref, err)
+		}
+		spec, err := reference.Parse(img.Name)
+		if err != nil {
+			return err
+		}
+
+		st := conversion.Statement(img.Name, img.Target)
+		if context.Bool("print") {
+			enc := json.NewEncoder(context.App.Writer)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(st); err != nil {
+				return err
+			}
+		}
+		cs := client.ContentStore()
+		referrer, err := convert.WriteReferrer(ctx, cs, img.Target, st)
+		if err != nil {
+			return err
+		}
+
+		index := images.Image{Name: spec.Locator + ":" + convert.ReferrersTag(img.Target.Digest)}
+		var indexes []ocispec.Descriptor
+		old, err := is.Get(ctx, index.Name)
+		if err == nil {
+			indexes = append(indexes, old.Target)
+		} else if !errdefs.IsNotFound(err) {
+			return err
+		}
+		if context.Bool("push") {
+			// The pushed index replaces the one of the registry
+			remote, err := fetchReferrers(ctx, context, cs, index.Name)
+			if err != nil {
+				return fmt.Errorf("failed to fetch the referrers of %s: %w", ref, err)
+			}
+			if remote != nil {
+				indexes = append(indexes, *remote)
+			}
+		}
+		if index.Target, err = convert.AddReferrer(ctx, cs, referrer, indexes...); err != nil {
+			return err
+		}
+		if old.Name != "" {
+			index, err = is.Update(ctx, index, "target")
+		} else {
+			index, err = is.Create(ctx, index)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(context.App.Writer, "attached provenance %s to %s as %s\n", referrer.Digest, ref, index.Name)
+
+		if context.Bool("push") {
+			return pushTarget(ctx, context, client, &index, platforms.All)
+		}
+		return nil
+	},
+}
+
+// fetchReferrers fetches the referrers index ref from its registry, and its
+// manifests for it to be pushed again.  It returns nil if there's none.
+func fetchReferrers(ctx gocontext.Context, context *cli.Context, cs content.Store, ref string) (*ocispec.Descriptor, error) {
+	resolver, err := commands.GetResolver(ctx, context)
+	if err != nil {
+		return nil, err
+	}
+	_, desc, err := resolver.Resolve(ctx, ref)
+	if errdefs.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	fetch := remotes.FetchHandler(cs, fetcher)
+	if _, err := fetch(ctx, desc); err != nil {
+		return nil, err
+	}
+	b, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		return nil, err
+	}
+	var idx ocispec.Index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, err
+	}
+	for _, m := range idx.Manifests {
+		if _, err := fetch(ctx, m); err != nil {
+			return nil, err
+		}
+	}
+	return &desc, nil
+}
@@ -0,0 +1,320 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/pkg/cio"
+	"github.com/containerd/containerd/v2/pkg/oci"
+	"github.com/containerd/log"
+	"github.com/containerd/platforms"
+	"github.com/moby/sys/symlink"
+	"github.com/opencontainers/image-spec/identity"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
+)
+
+// BenchmarkCommand compares the startup costs of an image with different
+// snapshotters
+var BenchmarkCommand = &cli.Command{
+	Name:      "benchmark",
+	Usage:     "compare snapshot, mount and container cold-start times across snapshotters",
+	ArgsUsage: "[flags] <ref> [<ref for the other snapshotters>]",
+	Description: `Measure, for each snapshotter, the time to unpack the image, prepare a
+snapshot, mount it, read a file for the first time and start a container.
+
+EROFS-native images can only be unpacked by the erofs snapshotter, so the
+source image can be given as a second reference for the other snapshotters:
+
+  ctr-erofs images benchmark example.com/foo:erofs example.com/foo:orig
+
+Requires root privileges.
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+		formatFlag,
+		&cli.StringSliceFlag{
+			Name:  "snapshotter",
+			Usage: "Snapshotters to compare",
+			Value: cli.NewStringSlice("erofs", "overlayfs"),
+		},
+		&cli.IntFlag{
+			Name:  "count",
+			Usage: "Number of runs averaged for each snapshotter",
+			Value: 3,
+		},
+		&cli.StringFlag{
+			Name:  "read-path",
+			Usage: "File read in the mounted snapshot to measure the first-read latency",
+			Value: "/bin/sh",
+		},
+		&cli.StringFlag{
+			Name:  "cmd",
+			Usage: "Command run in the container to measure the cold start, empty to skip it",
+			Value: "true",
+		},
+		&cli.BoolFlag{
+			Name:  "drop-caches",
+			Usage: "Drop the page cache before each run",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		ref := context.Args().Get(0)
+		if ref == "" {
+			return errors.New("image ref needs to be specified")
+		}
+		format, err := outputFormat(context)
+		if err != nil {
+			return err
+		}
+		otherRef := context.Args().Get(1)
+		if otherRef == "" {
+			otherRef = ref
+		}
+		p, err := platforms.Parse(context.String("platform"))
+		if err != nil {
+			return fmt.Errorf("invalid platform %q: %w", context.String("platform"), err)
+		}
+		count := max(context.Int("count"), 1)
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		var results []benchmarkResult
+		for _, sn := range context.StringSlice("snapshotter") {
+			r := benchmarkResult{Snapshotter: sn, Image: ref}
+			if sn != "erofs" {
+				r.Image = otherRef
+			}
+			b := &benchmark{
+				client:      client,
+				platform:    platforms.OnlyStrict(p),
+				snapshotter: sn,
+				ref:         r.Image,
+				readPath:    context.String("read-path"),
+				cmd:         strings.Fields(context.String("cmd")),
+				dropCaches:  context.Bool("drop-caches"),
+			}
+			if err := b.run(ctx, count, &r); err != nil {
+				r.Error = err.Error()
+				log.G(ctx).WithError(err).Warnf("benchmark with %s failed", sn)
+			}
+			results = append(results, r)
+		}
+
+		if format != "table" {
+			return writeOutput(context.App.Writer, format, results)
+		}
+		tw := tabwriter.NewWriter(context.App.Writer, 1, 8, 1, ' ', 0)
+		fmt.Fprintln(tw, "SNAPSHOTTER\tIMAGE\tUNPACK\tPREPARE\tMOUNT\tFIRST READ\tCOLD START")
+		for _, r := range results {
+			if r.Error != "" {
+				fmt.Fprintf(tw, "%s\t%s\tfailed: %s\n", r.Snapshotter, r.Image, r.Error)
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Snapshotter, r.Image,
+				formatDuration(r.Unpack), formatDuration(r.Prepare), formatDuration(r.Mount),
+				formatDuration(r.FirstRead), formatDuration(r.ColdStart))
+		}
+		return tw.Flush()
+	},
+}
+
+// benchmarkResult holds the average durations measured for a snapshotter.
+type benchmarkResult struct {
+	Snapshotter string        `json:"snapshotter"`
+	Image       string        `json:"image"`
+	Unpack      time.Duration `json:"unpack,omitempty"`
+	Prepare     time.Duration `json:"prepare,omitempty"`
+	Mount       time.Duration `json:"mount,omitempty"`
+	FirstRead   time.Duration `json:"firstRead,omitempty"`
+	ColdStart   time.Duration `json:"coldStart,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(10 * time.Microsecond).String()
+}
+
+type benchmark struct {
+	client      *containerd.Client
+	platform    platforms.MatchComparer
+	snapshotter string
+	ref         string
+	readPath    string
+	cmd         []string
+	dropCaches  bool
+}
+
+func (b *benchmark) run(ctx gocontext.Context, count int, r *benchmarkResult) error {
+	i, err := b.client.ImageService().Get(ctx, b.ref)
+	if err != nil {
+		return err
+	}
+	img := containerd.NewImageWithPlatform(b.client, i, b.platform)
+
+	start := time.Now()
+	if err := img.Unpack(ctx, b.snapshotter); err != nil {
+		return fmt.Errorf("failed to unpack %s: %w", b.ref, err)
+	}
+	r.Unpack = time.Since(start)
+
+	diffIDs, err := img.RootFS(ctx)
+	if err != nil {
+		return err
+	}
+	parent := identity.ChainID(diffIDs).String()
+	sn := b.client.SnapshotService(b.snapshotter)
+
+	var prepare, mnt, read, coldStart time.Duration
+	for n := 0; n < count; n++ {
+		if err := b.dropPageCache(); err != nil {
+			return err
+		}
+		key := fmt.Sprintf("erofs-benchmark-%d-%d", time.Now().UnixNano(), n)
+		start := time.Now()
+		mounts, err := sn.Prepare(ctx, key, parent)
+		if err != nil {
+			return fmt.Errorf("failed to prepare snapshot: %w", err)
+		}
+		prepare += time.Since(start)
+
+		d, rd, err := b.mountAndRead(mounts)
+		if rerr := sn.Remove(ctx, key); rerr != nil {
+			log.G(ctx).WithError(rerr).Warnf("failed to remove snapshot %s", key)
+		}
+		if err != nil {
+			return err
+		}
+		mnt += d
+		read += rd
+
+		if len(b.cmd) > 0 {
+			if err := b.dropPageCache(); err != nil {
+				return err
+			}
+			d, err := b.coldStart(ctx, img, key)
+			if err != nil {
+				return fmt.Errorf("failed to start container: %w", err)
+			}
+			coldStart += d
+		}
+	}
+	r.Prepare = prepare / time.Duration(count)
+	r.Mount = mnt / time.Duration(count)
+	r.FirstRead = read / time.Duration(count)
+	r.ColdStart = coldStart / time.Duration(count)
+	return nil
+}
+
+// mountAndRead mounts the snapshot and reads the whole b.readPath, and
+// returns the durations of both.
+func (b *benchmark) mountAndRead(mounts []mount.Mount) (time.Duration, time.Duration, error) {
+	dir, err := os.MkdirTemp("", "ctr-erofs-benchmark-")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(dir)
+
+	start := time.Now()
+	if err := mount.All(mounts, dir); err != nil {
+		return 0, 0, fmt.Errorf("failed to mount snapshot: %w", err)
+	}
+	mountTime := time.Since(start)
+	defer mount.UnmountAll(dir, 0)
+
+	if b.readPath == "" {
+		return mountTime, 0, nil
+	}
+	start = time.Now()
+	p, err := symlink.FollowSymlinkInScope(filepath.Join(dir, b.readPath), dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(io.Discard, f); err != nil {
+		return 0, 0, err
+	}
+	return mountTime, time.Since(start), nil
+}
+
+// coldStart runs b.cmd in a new container and returns the time until it
+// exited.
+func (b *benchmark) coldStart(ctx gocontext.Context, img containerd.Image, id string) (time.Duration, error) {
+	start := time.Now()
+	container, err := b.client.NewContainer(ctx, id,
+		containerd.WithImage(img),
+		containerd.WithSnapshotter(b.snapshotter),
+		containerd.WithNewSnapshot(id, img),
+		containerd.WithNewSpec(oci.WithImageConfig(img), oci.WithProcessArgs(b.cmd...)),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer container.Delete(ctx, containerd.WithSnapshotCleanup)
+
+	task, err := container.NewTask(ctx, cio.NullIO)
+	if err != nil {
+		return 0, err
+	}
+	defer task.Delete(ctx)
+	statusC, err := task.Wait(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := task.Start(ctx); err != nil {
+		return 0, err
+	}
+	status := <-statusC
+	d := time.Since(start)
+	if code, _, err := status.Result(); err != nil {
+		return 0, err
+	} else if code != 0 {
+		return 0, fmt.Errorf("%v exited with status %d", b.cmd, code)
+	}
+	return d, nil
+}
+
+func (b *benchmark) dropPageCache() error {
+	if !b.dropCaches {
+		return nil
+	}
+	unix.Sync()
+	return os.WriteFile("/proc/sys/vm/drop_caches", []byte("3"), 0200)
+}
@@ -0,0 +1,412 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/pkg/progress"
+	"github.com/erofs/erofs-container-toolkit/pkg/imagemount"
+	"github.com/erofs/erofs-container-toolkit/pkg/layerfs"
+	"github.com/gdamore/tcell/v2"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+// BrowseCommand browses the contents of an EROFS image interactively
+var BrowseCommand = &cli.Command{
+	Name:      "browse",
+	Usage:     "browse the layers and files of an EROFS image interactively",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Browse the merged file tree of the EROFS layers of an image in a terminal
+UI, reading the layers in userspace.  Directories show the total size of
+their contents, and the files of the selected layer, the top-most one with
+them, are highlighted.
+
+Keys:
+   up/down, pgup/pgdn  move
+   right/left, enter   expand or collapse a directory
+   tab                 switch between the layers and the files
+   f                   only show the files of the selected layer
+   q, esc              quit
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+	},
+	Action: func(context *cli.Context) error {
+		ref := context.Args().First()
+		if ref == "" {
+			return errors.New("image ref needs to be specified")
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		manifest, err := imageManifest(ctx, context, client, ref)
+		if err != nil {
+			return err
+		}
+		for _, l := range manifest.Layers {
+			if !imagemount.IsErofsLayer(l) {
+				return fmt.Errorf("layer %s of %s isn't an EROFS layer (%s)", l.Digest, ref, l.MediaType)
+			}
+		}
+		fsys, err := layerfs.Open(ctx, client.ContentStore(), manifest.Layers)
+		if err != nil {
+			return err
+		}
+		defer fsys.Close()
+
+		root, err := buildTree(fsys, ".", len(manifest.Layers))
+		if err != nil {
+			return err
+		}
+		screen, err := tcell.NewScreen()
+		if err != nil {
+			return err
+		}
+		if err := screen.Init(); err != nil {
+			return err
+		}
+		defer screen.Fini()
+
+		b := &browser{screen: screen, ref: ref, layers: manifest.Layers, root: root}
+		b.flatten()
+		b.run()
+		return nil
+	},
+}
+
+// treeNode is an entry of the merged file tree.  Directories keep the
+// number of entries and the size of the files each layer brings in them.
+type treeNode struct {
+	name     string
+	path     string
+	info     fs.FileInfo
+	link     string
+	layer    int
+	size     int64
+	depth    int
+	parent   *treeNode
+	children []*treeNode
+	expanded bool
+
+	layerFiles []int
+	layerSizes []int64
+}
+
+func buildTree(fsys *layerfs.FS, name string, nlayers int) (*treeNode, error) {
+	fi, idx, err := fsys.LstatLayer(name)
+	if err != nil {
+		return nil, err
+	}
+	n := &treeNode{name: path.Base(name), path: path.Join("/", name), info: fi, layer: idx}
+	switch {
+	case fi.Mode().IsRegular():
+		n.size = fi.Size()
+	case fi.Mode()&fs.ModeSymlink != 0:
+		if n.link, err = fsys.ReadLink(name); err != nil {
+			return nil, err
+		}
+	case fi.IsDir():
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		n.layerFiles = make([]int, nlayers)
+		n.layerSizes = make([]int64, nlayers)
+		for _, e := range entries {
+			c, err := buildTree(fsys, path.Join(name, e.Name()), nlayers)
+			if err != nil {
+				return nil, err
+			}
+			c.parent = n
+			n.children = append(n.children, c)
+			n.size += c.size
+			n.layerFiles[c.layer]++
+			if c.info.IsDir() {
+				for i := range nlayers {
+					n.layerFiles[i] += c.layerFiles[i]
+					n.layerSizes[i] += c.layerSizes[i]
+				}
+			} else {
+				n.layerSizes[c.layer] += c.size
+			}
+		}
+	}
+	return n, nil
+}
+
+func (n *treeNode) inLayer(layer int) bool {
+	return n.layer == layer || n.layerFiles != nil && n.layerFiles[layer] > 0
+}
+
+type browser struct {
+	screen tcell.Screen
+	ref    string
+	layers []ocispec.Descriptor
+	root   *treeNode
+
+	focusLayers bool
+	filter      bool
+	layer       int
+	layerOffset int
+
+	rows   []*treeNode
+	cursor int
+	offset int
+}
+
+// flatten lists the visible rows of the tree, keeping the cursor on the same
+// node if it's still visible.
+func (b *browser) flatten() {
+	var selected *treeNode
+	if b.cursor < len(b.rows) {
+		selected = b.rows[b.cursor]
+	}
+	b.rows = b.rows[:0]
+	var walk func(n *treeNode, depth int)
+	walk = func(n *treeNode, depth int) {
+		for _, c := range n.children {
+			if b.filter && !c.inLayer(b.layer) {
+				continue
+			}
+			c.depth = depth
+			b.rows = append(b.rows, c)
+			if c.expanded {
+				walk(c, depth+1)
+			}
+		}
+	}
+	walk(b.root, 0)
+	if i := slices.Index(b.rows, selected); i >= 0 {
+		b.cursor = i
+	}
+	b.cursor = max(0, min(b.cursor, len(b.rows)-1))
+}
+
+func (b *browser) run() {
+	for {
+		b.draw()
+		switch ev := b.screen.PollEvent().(type) {
+		case *tcell.EventResize:
+			b.screen.Sync()
+		case *tcell.EventKey:
+			if !b.handleKey(ev) {
+				return
+			}
+		}
+	}
+}
+
+func (b *browser) handleKey(ev *tcell.EventKey) bool {
+	_, h := b.screen.Size()
+	page := max(1, h/2)
+	move := 0
+	switch ev.Key() {
+	case tcell.KeyEscape, tcell.KeyCtrlC:
+		return false
+	case tcell.KeyTab, tcell.KeyBacktab:
+		b.focusLayers = !b.focusLayers
+	case tcell.KeyUp:
+		move = -1
+	case tcell.KeyDown:
+		move = 1
+	case tcell.KeyPgUp:
+		move = -page
+	case tcell.KeyPgDn:
+		move = page
+	case tcell.KeyHome:
+		move = -len(b.rows) - len(b.layers)
+	case tcell.KeyEnd:
+		move = len(b.rows) + len(b.layers)
+	case tcell.KeyRight, tcell.KeyEnter:
+		b.expand(true)
+	case tcell.KeyLeft:
+		b.expand(false)
+	case tcell.KeyRune:
+		switch ev.Rune() {
+		case 'q':
+			return false
+		case 'k':
+			move = -1
+		case 'j':
+			move = 1
+		case 'l', ' ':
+			b.expand(true)
+		case 'h':
+			b.expand(false)
+		case 'f':
+			b.filter = !b.filter
+			b.flatten()
+		}
+	}
+	if move != 0 {
+		if b.focusLayers {
+			b.layer = max(0, min(b.layer+move, len(b.layers)-1))
+			if b.filter {
+				b.flatten()
+			}
+		} else {
+			b.cursor = max(0, min(b.cursor+move, len(b.rows)-1))
+		}
+	}
+	return true
+}
+
+// expand expands the directory under the cursor, or collapses it, or moves to
+// its parent if it's collapsed already.
+func (b *browser) expand(expand bool) {
+	if b.focusLayers || len(b.rows) == 0 {
+		return
+	}
+	n := b.rows[b.cursor]
+	switch {
+	case expand && n.info.IsDir():
+		n.expanded = true
+	case !expand && n.expanded:
+		n.expanded = false
+	case !expand && n.parent != b.root:
+		b.cursor = slices.Index(b.rows, n.parent)
+	}
+	b.flatten()
+}
+
+func drawText(s tcell.Screen, x, y, width int, style tcell.Style, text string) {
+	for _, r := range text {
+		if x >= width {
+			return
+		}
+		s.SetContent(x, y, r, nil, style)
+		x++
+	}
+	for ; x < width; x++ {
+		s.SetContent(x, y, ' ', nil, style)
+	}
+}
+
+// scroll returns the offset keeping cursor within the height rows from
+// offset.
+func scroll(offset, cursor, height int) int {
+	if cursor < offset {
+		return cursor
+	}
+	if cursor >= offset+height {
+		return cursor - height + 1
+	}
+	return offset
+}
+
+func (b *browser) draw() {
+	s := b.screen
+	s.Clear()
+	w, h := s.Size()
+	var (
+		title    = tcell.StyleDefault.Reverse(true)
+		header   = tcell.StyleDefault.Bold(true)
+		selected = tcell.StyleDefault.Foreground(tcell.ColorGreen)
+	)
+	rootFiles := 0
+	for _, n := range b.root.layerFiles {
+		rootFiles += n
+	}
+	drawText(s, 0, 0, w, title, fmt.Sprintf(" %s: %d layers, %d files, %s", b.ref, len(b.layers), rootFiles, progress.Bytes(b.root.size)))
+
+	// Layers, from the bottom one
+	lh := min(len(b.layers), max(3, h/4))
+	drawText(s, 0, 1, w, header, fmt.Sprintf(" %-3s %-12s %10s %8s %10s", "#", "DIGEST", "BLOB", "FILES", "CONTENT"))
+	b.layerOffset = scroll(b.layerOffset, b.layer, lh)
+	for i := 0; i < lh && b.layerOffset+i < len(b.layers); i++ {
+		idx := b.layerOffset + i
+		l := b.layers[idx]
+		style := tcell.StyleDefault
+		if idx == b.layer {
+			style = selected
+			if b.focusLayers {
+				style = style.Reverse(true)
+			}
+		}
+		drawText(s, 0, 2+i, w, style, fmt.Sprintf(" %-3d %-12s %10s %8d %10s", idx, l.Digest.Encoded()[:12],
+			progress.Bytes(l.Size), b.root.layerFiles[idx], progress.Bytes(b.root.layerSizes[idx])))
+	}
+
+	// Files
+	y := 3 + lh
+	files := "FILES"
+	if b.filter {
+		files += fmt.Sprintf(" (layer %d only)", b.layer)
+	}
+	drawText(s, 0, y-1, w, header, fmt.Sprintf(" %-11s %-11s %10s  %s", "MODE", "OWNER", "SIZE", files))
+	fh := h - y - 2
+	b.offset = scroll(b.offset, b.cursor, fh)
+	for i := 0; i < fh && b.offset+i < len(b.rows); i++ {
+		idx := b.offset + i
+		n := b.rows[idx]
+		size := n.size
+		if b.filter && n.layerSizes != nil {
+			size = n.layerSizes[b.layer]
+		}
+		name := strings.Repeat("  ", n.depth)
+		if n.info.IsDir() {
+			if n.expanded {
+				name += "▾ "
+			} else {
+				name += "▸ "
+			}
+		} else {
+			name += "  "
+		}
+		name += n.name
+		if n.link != "" {
+			name += " -> " + n.link
+		}
+		style := tcell.StyleDefault
+		if n.layer == b.layer {
+			style = selected
+		}
+		if idx == b.cursor && !b.focusLayers {
+			style = style.Reverse(true)
+		}
+		drawText(s, 0, y+i, w, style, fmt.Sprintf(" %-11s %-11s %10s  %s", n.info.Mode(), owner(n.info), progress.Bytes(size), name))
+	}
+
+	// Details of the entry under the cursor, and keys
+	if len(b.rows) > 0 {
+		n := b.rows[b.cursor]
+		drawText(s, 0, h-2, w, tcell.StyleDefault, fmt.Sprintf(" %s  (layer %d %s)", n.path, n.layer, b.layers[n.layer].Digest))
+	}
+	drawText(s, 0, h-1, w, title, " tab: layers/files  ←→: collapse/expand  f: filter layer  q: quit")
+	s.Show()
+}
+
+func owner(fi fs.FileInfo) string {
+	if o, ok := fi.(interface {
+		UID() uint32
+		GID() uint32
+	}); ok {
+		return fmt.Sprintf("%d:%d", o.UID(), o.GID())
+	}
+	return "-"
+}
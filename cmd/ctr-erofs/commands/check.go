@@ -0,0 +1,122 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/images"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	"github.com/urfave/cli/v2"
+)
+
+type imageCheck struct {
+	Name     string            `json:"name"`
+	Problems []convert.Problem `json:"problems,omitempty"`
+}
+
+// CheckCommand validates the consistency of converted images
+var CheckCommand = &cli.Command{
+	Name:      "erofs-check",
+	Usage:     "validate the manifests, configs and layers of converted images",
+	ArgsUsage: "[flags] [<ref>, ...]",
+	Description: `Validate converted images end-to-end, all images if none is given: the
+manifests, configs and layers must be in the content store, the config
+diff_ids must match the EROFS and uncompressed layers, the EROFS layers must
+have a valid superblock, and all media types must be known to containerd.
+
+Unlike 'images check', which only checks that the content is available, this
+catches broken conversions before they're deployed.  Exits non-zero if any
+image has a problem.
+`,
+	Flags: []cli.Flag{
+		formatFlag,
+	},
+	Action: func(context *cli.Context) error {
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		is := client.ImageService()
+		var imgs []images.Image
+		if context.NArg() == 0 {
+			if imgs, err = is.List(ctx); err != nil {
+				return err
+			}
+		}
+		for _, ref := range context.Args().Slice() {
+			img, err := is.Get(ctx, ref)
+			if err != nil {
+				return err
+			}
+			imgs = append(imgs, img)
+		}
+
+		var (
+			checks []imageCheck
+			broken int
+		)
+		for _, img := range imgs {
+			problems, err := convert.Check(ctx, client.ContentStore(), img.Target)
+			if err != nil {
+				return fmt.Errorf("failed to check %s: %w", img.Name, err)
+			}
+			if len(problems) > 0 {
+				broken++
+			}
+			checks = append(checks, imageCheck{Name: img.Name, Problems: problems})
+		}
+
+		switch context.String("format") {
+		case "json":
+			enc := json.NewEncoder(context.App.Writer)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(checks); err != nil {
+				return err
+			}
+		case "table":
+			w := tabwriter.NewWriter(context.App.Writer, 1, 8, 1, ' ', 0)
+			fmt.Fprintln(w, "REF\tSTATUS\tPROBLEMS")
+			for _, c := range checks {
+				status := "ok"
+				if len(c.Problems) > 0 {
+					status = "broken"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\n", c.Name, status, len(c.Problems))
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			for _, c := range checks {
+				for _, p := range c.Problems {
+					fmt.Fprintf(context.App.Writer, "%s: %s\n", c.Name, p)
+				}
+			}
+		default:
+			return fmt.Errorf("unknown format %q", context.String("format"))
+		}
+		if broken > 0 {
+			return fmt.Errorf("%d of %d images have problems", broken, len(checks))
+		}
+		return nil
+	},
+}
@@ -0,0 +1,141 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+// CommitCommand creates an EROFS image from the changes of a container
+var CommitCommand = &cli.Command{
+	Name:      "commit",
+	Usage:     "create an EROFS image from the changes of a container",
+	ArgsUsage: "[flags] <container> <target_ref>",
+	Description: `Convert the changes made to the rootfs of a container, its active snapshot, to
+an EROFS native layer with the diff service, and add it on top of the image of
+the container for one platform, e.g.:
+
+  ctr-erofs images commit --message "install tools" foo example.com/foo:tools-erofs
+
+The layer is EROFS even if the image of the container has tar layers, which
+are kept as they are.  The changes are read as they are: stop or pause the
+container first for a consistent layer.
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+		&cli.StringFlag{
+			Name:  "message",
+			Usage: "Comment of the history entry of the layer",
+		},
+		&cli.StringFlag{
+			Name:  "author",
+			Usage: "Author of the history entry of the layer",
+		},
+		&cli.StringFlag{
+			Name:  "erofs-compressors",
+			Usage: "Specify compression algorithm list when converting EROFS layers",
+		},
+		&cli.StringFlag{
+			Name:  "erofs-features",
+			Usage: "Comma-separated EROFS on-disk features to enable (48bit, force-inode-extended, xattr-name-filter)",
+		},
+		&cli.BoolFlag{
+			Name:  "erofs-verity",
+			Usage: "Record the fs-verity digest and dm-verity root hash of EROFS layers in their annotations",
+		},
+		&cli.StringFlag{
+			Name:  "erofs-mkfs-options",
+			Usage: "Extra mkfs options applied when converting EROFS layers. (e.g. '-Efragments,dedupe')",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		id := context.Args().Get(0)
+		targetRef := context.Args().Get(1)
+		if id == "" || targetRef == "" {
+			return errors.New("container and target image need to be specified")
+		}
+		p, err := platforms.Parse(context.String("platform"))
+		if err != nil {
+			return fmt.Errorf("invalid platform %q: %w", context.String("platform"), err)
+		}
+		opts, err := layerOpts(context)
+		if err != nil {
+			return err
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		c, err := client.ContainerService().Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if c.SnapshotKey == "" || c.Image == "" {
+			return fmt.Errorf("container %s has no rootfs snapshot of an image", id)
+		}
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+
+		desc, err := platformManifest(ctx, client, c.Image, p)
+		if err != nil {
+			return err
+		}
+		layer, err := erofsDiff(ctx, client, c.Snapshotter, c.SnapshotKey, "", opts)
+		if err != nil {
+			return err
+		}
+		created := time.Now().UTC()
+		newDesc, err := convert.AppendLayer(ctx, client.ContentStore(), desc, layer, ocispec.History{
+			Created:   &created,
+			CreatedBy: "ctr-erofs images commit",
+			Author:    context.String("author"),
+			Comment:   context.String("message"),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to commit %s: %w", id, err)
+		}
+		newDesc.Platform = nil
+
+		is := client.ImageService()
+		newImg := images.Image{Name: targetRef, Target: newDesc}
+		if _, err := is.Create(ctx, newImg); err != nil {
+			if !errdefs.IsAlreadyExists(err) {
+				return err
+			}
+			if _, err := is.Update(ctx, newImg); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(context.App.Writer, newDesc.Digest.String())
+		return nil
+	},
+}
@@ -0,0 +1,128 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/compare"
+	"github.com/erofs/erofs-container-toolkit/pkg/imagemount"
+	"github.com/urfave/cli/v2"
+)
+
+// compareResult is the machine-readable output of the compare command.
+type compareResult struct {
+	Files       int                  `json:"files"`
+	Differences []compare.Difference `json:"differences"`
+}
+
+// CompareCommand checks that a converted image matches its source
+var CompareCommand = &cli.Command{
+	Name:      "compare",
+	Usage:     "check that an EROFS image has the same files as its source image",
+	ArgsUsage: "[flags] <source_ref> <converted_ref>",
+	Description: `Compare the merged filesystem of the source image layers with the mounted
+EROFS image, file by file: type, mode, ownership, content, symlink targets,
+device numbers and xattrs.  Whiteouts of the source layers are applied before
+comparing.
+
+Mounting the EROFS image requires root privileges.
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+		formatFlag,
+	},
+	Action: func(context *cli.Context) error {
+		srcRef := context.Args().Get(0)
+		convertedRef := context.Args().Get(1)
+		if srcRef == "" || convertedRef == "" {
+			return errors.New("source and converted image need to be specified")
+		}
+		format, err := outputFormat(context)
+		if err != nil {
+			return err
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		srcManifest, err := imageManifest(ctx, context, client, srcRef)
+		if err != nil {
+			return err
+		}
+		convertedManifest, err := imageManifest(ctx, context, client, convertedRef)
+		if err != nil {
+			return err
+		}
+		cs := client.ContentStore()
+		src, err := compare.FromLayers(ctx, cs, srcManifest.Layers)
+		if err != nil {
+			return err
+		}
+
+		dir, err := os.MkdirTemp("", "ctr-erofs-compare-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		target := filepath.Join(dir, "rootfs")
+		if _, err := imagemount.Mount(ctx, cs, convertedRef, convertedManifest.Layers, target, dir, dir); err != nil {
+			return err
+		}
+		converted, err := compare.FromDir(target)
+		if uerr := imagemount.Unmount(ctx, dir, target); uerr != nil {
+			log.G(ctx).WithError(uerr).Warnf("failed to unmount %s", target)
+		}
+		if err != nil {
+			return err
+		}
+
+		diffs := compare.Compare(src, converted)
+		if diffs == nil {
+			diffs = []compare.Difference{}
+		}
+		if format != "table" {
+			if err := writeOutput(context.App.Writer, format, compareResult{Files: len(src), Differences: diffs}); err != nil {
+				return err
+			}
+		} else if len(diffs) > 0 {
+			tw := tabwriter.NewWriter(context.App.Writer, 1, 8, 1, ' ', 0)
+			fmt.Fprintln(tw, "PATH\tKIND\tSOURCE\tCONVERTED")
+			for _, d := range diffs {
+				fmt.Fprintf(tw, "/%s\t%s\t%s\t%s\n", d.Path, d.Kind, d.Source, d.Converted)
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+		}
+		if len(diffs) > 0 {
+			return fmt.Errorf("%d differences found between %s and %s", len(diffs), srcRef, convertedRef)
+		}
+		if format == "table" {
+			fmt.Fprintf(context.App.Writer, "%d files compared, no differences found\n", len(src))
+		}
+		return nil
+	},
+}
@@ -0,0 +1,181 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/pkg/labels"
+	"github.com/erofs/erofs-container-toolkit/pkg/erofs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+type blobStat struct {
+	Digest digest.Digest     `json:"digest"`
+	Size   int64             `json:"size"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Type   string            `json:"type"`
+	Erofs  *erofs.Info       `json:"erofs,omitempty"`
+	// DataSize is the size of the EROFS image, without appended data
+	DataSize int64             `json:"dataSize,omitempty"`
+	Verity   *erofs.VerityInfo `json:"verity,omitempty"`
+	Warnings []string          `json:"warnings,omitempty"`
+}
+
+// ContentStatErofsCommand inspects a blob of the content store
+var ContentStatErofsCommand = &cli.Command{
+	Name:      "stat-erofs",
+	Usage:     "show the EROFS details of a blob in the content store",
+	ArgsUsage: "[flags] <digest>",
+	Description: `Inspect a blob of the content store by digest: if it's an EROFS image, show
+its superblock, features and compression, and whether a dm-verity hash tree
+is appended to it.  Otherwise, the kind of blob is guessed from its magic.
+
+Inconsistencies which break unpacking, like an uncompressed label not matching
+the digest of an EROFS blob, are reported as warnings.
+`,
+	Flags: []cli.Flag{
+		formatFlag,
+	},
+	Action: func(context *cli.Context) error {
+		dgst, err := digest.Parse(context.Args().First())
+		if err != nil {
+			return fmt.Errorf("invalid digest %q: %w", context.Args().First(), err)
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		cs := client.ContentStore()
+		info, err := cs.Info(ctx, dgst)
+		if err != nil {
+			return err
+		}
+		ra, err := cs.ReaderAt(ctx, ocispec.Descriptor{Digest: dgst, Size: info.Size})
+		if err != nil {
+			return err
+		}
+		defer ra.Close()
+
+		st := blobStat{Digest: dgst, Size: info.Size, Labels: info.Labels}
+		sb, err := erofs.ReadSuperBlock(ra)
+		switch {
+		case errors.Is(err, erofs.ErrNotErofs):
+			st.Type = blobType(ra)
+		case err != nil:
+			return err
+		default:
+			st.Type = "erofs"
+			i := sb.Info()
+			st.Erofs = &i
+			st.DataSize = int64(sb.Blocks()) * int64(sb.BlockSize())
+			if sb.ExtraDevices == 0 && st.DataSize > st.Size {
+				st.Warnings = append(st.Warnings, fmt.Sprintf("truncated: %d blocks need %d bytes", sb.Blocks(), st.DataSize))
+			}
+			if st.DataSize < st.Size {
+				st.Verity, err = erofs.ReadVerity(ra, st.DataSize)
+				if errors.Is(err, erofs.ErrNoVerity) {
+					st.Warnings = append(st.Warnings, fmt.Sprintf("%d bytes of unknown data appended", st.Size-st.DataSize))
+				} else if err != nil {
+					return err
+				}
+			}
+			if u := info.Labels[labels.LabelUncompressed]; u != "" && u != dgst.String() {
+				st.Warnings = append(st.Warnings, fmt.Sprintf("uncompressed label %s doesn't match the digest of the EROFS blob", u))
+			}
+		}
+
+		switch context.String("format") {
+		case "json", "yaml":
+			return writeOutput(context.App.Writer, context.String("format"), st)
+		case "table":
+			w := tabwriter.NewWriter(context.App.Writer, 1, 8, 1, ' ', 0)
+			fmt.Fprintf(w, "Digest:\t%s\n", st.Digest)
+			fmt.Fprintf(w, "Size:\t%d\n", st.Size)
+			fmt.Fprintf(w, "Type:\t%s\n", st.Type)
+			keys := make([]string, 0, len(st.Labels))
+			for k := range st.Labels {
+				keys = append(keys, k)
+			}
+			slices.Sort(keys)
+			for _, k := range keys {
+				fmt.Fprintf(w, "Label:\t%s=%s\n", k, st.Labels[k])
+			}
+			if i := st.Erofs; i != nil {
+				compression := strings.Join(i.Compression, ",")
+				if compression == "" {
+					compression = "none"
+				}
+				fmt.Fprintf(w, "UUID:\t%s\n", i.UUID)
+				if i.VolumeName != "" {
+					fmt.Fprintf(w, "Volume name:\t%s\n", i.VolumeName)
+				}
+				fmt.Fprintf(w, "Block size:\t%d\n", i.BlockSize)
+				fmt.Fprintf(w, "Blocks:\t%d\n", i.Blocks)
+				fmt.Fprintf(w, "Inodes:\t%d\n", i.Inodes)
+				fmt.Fprintf(w, "Features:\t%s\n", strings.Join(i.Features, ","))
+				fmt.Fprintf(w, "Compression:\t%s\n", compression)
+				if i.ExtraDevices > 0 {
+					fmt.Fprintf(w, "Extra devices:\t%d\n", i.ExtraDevices)
+				}
+				fmt.Fprintf(w, "Built:\t%s\n", i.BuildTime.Format(time.RFC3339))
+				fmt.Fprintf(w, "Data size:\t%d\n", st.DataSize)
+				if v := st.Verity; v != nil {
+					fmt.Fprintf(w, "dm-verity:\t%s, %d/%d byte blocks, hash tree at %d\n", v.Algorithm, v.DataBlockSize, v.HashBlockSize, v.HashOffset)
+				} else {
+					fmt.Fprintf(w, "dm-verity:\tnone\n")
+				}
+			}
+			for _, warning := range st.Warnings {
+				fmt.Fprintf(w, "Warning:\t%s\n", warning)
+			}
+			return w.Flush()
+		default:
+			return fmt.Errorf("unknown format %q", context.String("format"))
+		}
+	},
+}
+
+// blobType guesses the kind of a non-EROFS blob from its magic.
+func blobType(r io.ReaderAt) string {
+	buf := make([]byte, 512)
+	n, _ := r.ReadAt(buf, 0)
+	buf = buf[:n]
+	switch {
+	case bytes.HasPrefix(buf, []byte{0x1f, 0x8b}):
+		return "gzip"
+	case bytes.HasPrefix(buf, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "zstd"
+	case len(buf) >= 262 && bytes.Equal(buf[257:262], []byte("ustar")):
+		return "tar"
+	case bytes.HasPrefix(bytes.TrimSpace(buf), []byte("{")):
+		return "json"
+	}
+	return "unknown"
+}
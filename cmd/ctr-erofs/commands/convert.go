@@ -18,19 +18,31 @@ package commands
 
 import (
 	gocontext "context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
+	containerd "github.com/containerd/containerd/v2/client"
 	"github.com/containerd/containerd/v2/cmd/ctr/commands"
-	"github.com/containerd/containerd/v2/core/content"
 	"github.com/containerd/containerd/v2/core/images"
 	"github.com/containerd/containerd/v2/core/images/converter"
 	"github.com/containerd/containerd/v2/core/images/converter/uncompress"
+	"github.com/containerd/containerd/v2/core/leases"
+	"github.com/containerd/errdefs"
 	"github.com/containerd/log"
 	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
 	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	"github.com/erofs/erofs-container-toolkit/pkg/reaper"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli/v2"
 )
@@ -39,28 +51,69 @@ import (
 var ConvertCommand = &cli.Command{
 	Name:      "convert",
 	Usage:     "convert an image",
-	ArgsUsage: "[flags] <source_ref> <target_ref>...",
+	ArgsUsage: "[flags] <source_ref> <target_ref> [<source_ref> <target_ref>...] | --suffix <suffix> <source_ref>...",
 	Description: `Convert an image format.
 
-e.g., 'ctr-remote convert --erofs --oci example.com/foo:orig example.com/foo:erofs'
+e.g., 'ctr-remote convert --erofs example.com/foo:orig example.com/foo:erofs'
+
+With '--erofs', Docker media types are converted to OCI ones as with '--oci',
+since Docker schema2 manifests can't describe EROFS layers.
 
 Use '--platform' to define the output platform.
 When '--all-platforms' is given all images in a manifest list must be available.
+
+Several images can be converted at once, by giving several source and target
+pairs or a '--batch' file.  Layers shared by the images are converted once.
+
+With '--suffix' or '--tag-template', only the sources need to be given, and
+the targets are named after them, e.g. 'ubuntu:24.04' is converted to
+'ubuntu:24.04-erofs' with '--suffix -erofs'.
+
+A 'docker://<name>' source converts an image of the local Docker daemon,
+streamed with 'docker save', without pushing it to a registry first.
 `,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		// erofs flags
 		&cli.BoolFlag{
 			Name:  "erofs",
-			Usage: "Convert docker or OCI layers to EROFS native layers. Should be used in conjunction with '--oci'",
+			Usage: "Convert docker or OCI layers to EROFS native layers, with OCI media types unless '--allow-docker-mediatypes' is given",
+		},
+		&cli.BoolFlag{
+			Name:  "allow-docker-mediatypes",
+			Usage: "Keep the Docker media types of the source with '--erofs' instead of enforcing '--oci' (experimental)",
 		},
 		&cli.StringFlag{
 			Name:  "erofs-compressors",
 			Usage: "Specify compression algorithm list when converting EROFS layers",
 		},
+		&cli.StringFlag{
+			Name:  "erofs-features",
+			Usage: "Comma-separated EROFS on-disk features to enable (48bit, force-inode-extended, xattr-name-filter)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "erofs-blob-label",
+			Usage: "Content store labels to attach to the converted EROFS blobs (key=value)",
+		},
+		&cli.BoolFlag{
+			Name:  "erofs-verity",
+			Usage: "Record the fs-verity digest and dm-verity root hash of EROFS layers in their annotations",
+		},
 		&cli.StringFlag{
 			Name:  "erofs-mkfs-options",
 			Usage: "Extra mkfs options applied when converting EROFS layers. (e.g. '-Efragments,dedupe')",
 		},
+		&cli.DurationFlag{
+			Name:  "layer-timeout",
+			Usage: "Abort the conversion of a layer taking longer than this, killing mkfs.erofs (0 for no timeout)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "annotation",
+			Usage: "Annotations to set on the converted manifests and indexes (key=value)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "layer-annotation",
+			Usage: "Annotations to set on the converted EROFS layer descriptors (key=value)",
+		},
 		// generic flags
 		&cli.BoolFlag{
 			Name:  "uncompress",
@@ -80,13 +133,87 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			Name:  "all-platforms",
 			Usage: "Exports content from all platforms",
 		},
-	},
+		&cli.IntFlag{
+			Name:  "platform-parallelism",
+			Usage: "Number of platform manifests converted concurrently",
+			Value: 4,
+		},
+		&cli.BoolFlag{
+			Name:  "continue-on-error",
+			Usage: "Skip platforms which fail to convert instead of aborting, and report them at the end",
+		},
+		&cli.StringFlag{
+			Name:  "mapping-output",
+			Usage: "Write the source diffID to EROFS layer mapping as JSON to this file",
+		},
+		&cli.DurationFlag{
+			Name:  "reap-stale-age",
+			Usage: "Remove temporary files and ingests left by crashed conversions older than this age (0 to disable)",
+			Value: reaper.DefaultMaxAge,
+		},
+		&cli.BoolFlag{
+			Name:  "pull",
+			Usage: "Pull the source image (for the selected platforms) before converting",
+		},
+		&cli.BoolFlag{
+			Name:  "push",
+			Usage: "Push the converted image to the target reference after converting",
+		},
+		&cli.BoolFlag{
+			Name:  "only-missing-platforms",
+			Usage: "Only convert the platforms which have no EROFS manifest in the existing target image, and merge them into it",
+		},
+		// lease flags
+		&cli.StringFlag{
+			Name:  "lease-id",
+			Usage: "Protect the content with this existing lease instead of a temporary one",
+		},
+		&cli.DurationFlag{
+			Name:  "lease-ttl",
+			Usage: "Expiration of the lease created for the conversion (0 for no expiration)",
+			Value: 24 * time.Hour,
+		},
+		&cli.BoolFlag{
+			Name:  "keep-lease",
+			Usage: "Keep the lease created for the conversion instead of deleting it afterwards",
+		},
+		// batch flags
+		&cli.StringFlag{
+			Name:  "batch",
+			Usage: "Convert the images listed in this file, one \"<source_ref> <target_ref>\" pair per line",
+		},
+		&cli.StringFlag{
+			Name:  "suffix",
+			Usage: "Name the targets by appending this suffix to the source tags (e.g. '-erofs')",
+		},
+		&cli.StringFlag{
+			Name:  "tag-template",
+			Usage: "Name the targets with this template of the source {{repo}} and {{tag}} (e.g. '{{repo}}:{{tag}}-erofs')",
+		},
+		&cli.IntFlag{
+			Name:  "batch-concurrency",
+			Usage: "Number of images converted concurrently in a batch",
+			Value: 2,
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print the layers which would be converted and their estimated sizes, without converting",
+		},
+		&cli.Int64Flag{
+			Name:  "dry-run-sample",
+			Usage: "Size of the uncompressed prefix of each layer converted to estimate its size",
+			Value: convert.DefaultSampleSize,
+		},
+		formatFlag,
+	}, commands.RegistryFlags...),
 	Action: func(context *cli.Context) error {
-		var convertOpts []converter.Opt
-		srcRef := context.Args().Get(0)
-		targetRef := context.Args().Get(1)
-		if srcRef == "" || targetRef == "" {
-			return errors.New("src and target image need to be specified")
+		jobs, err := convertJobs(context)
+		if err != nil {
+			return err
+		}
+		format, err := outputFormat(context)
+		if err != nil {
+			return err
 		}
 
 		var platformMC platforms.MatchComparer
@@ -107,35 +234,111 @@ When '--all-platforms' is given all images in a manifest list must be available.
 				platformMC = platforms.DefaultStrict()
 			}
 		}
-		convertOpts = append(convertOpts, converter.WithPlatform(platformMC))
 
-		var layerConvertFunc converter.ConvertFunc
-		var finalize func(ctx gocontext.Context, cs content.Store, ref string, desc *ocispec.Descriptor) (*images.Image, error)
 		if context.Bool("erofs") {
-			Opts := []convert.Option{
-				convert.WithCompressors(context.String("erofs-compressors")),
-				convert.WithExtraMkfsOption(context.String("erofs-mkfs-options")),
-			}
-
-			layerConvertFunc = convert.LayerConvertFunc(Opts...)
-			if !context.Bool("oci") {
-				log.L.Warn("option --erofs should be used in conjunction with --oci")
+			// Docker schema2 can't describe EROFS layers
+			if context.Bool("allow-docker-mediatypes") {
+				if !context.Bool("oci") {
+					log.L.Warn("Docker media types are kept with --erofs, the converted images may not be usable")
+				}
+			} else if err := context.Set("oci", "true"); err != nil {
+				return err
 			}
 			if context.Bool("uncompress") {
 				return errors.New("option --erofs conflicts with --uncompress")
 			}
 		}
 
-		if context.Bool("uncompress") {
-			layerConvertFunc = uncompress.LayerConvertFunc
+		if context.Bool("dry-run") {
+			if !context.Bool("erofs") {
+				return errors.New("option --dry-run requires --erofs")
+			}
+			return dryRun(context, jobs, platformMC, format)
 		}
 
-		if context.Bool("oci") {
-			convertOpts = append(convertOpts, converter.WithDockerToOCI(true))
+		var (
+			progressFn  convert.ProgressFunc
+			out         *machineOutput
+			stopDisplay = func() {}
+		)
+		switch {
+		case format != "table":
+			out = newMachineOutput(context.App.Writer, format)
+			progressFn = out.progress
+		case isTerminal(context.App.ErrWriter):
+			pd := newProgressDisplay()
+			progressFn = pd.update
+			displayCtx, cancelDisplay := gocontext.WithCancel(gocontext.Background())
+			displayDone := make(chan struct{})
+			go func() {
+				defer close(displayDone)
+				pd.show(displayCtx, context.App.ErrWriter)
+			}()
+			stopDisplay = sync.OnceFunc(func() {
+				cancelDisplay()
+				<-displayDone
+			})
+			defer stopDisplay()
+		default:
+			progressFn = newProgressDisplay().lines(context.App.ErrWriter)
 		}
 
-		if layerConvertFunc != nil {
-			convertOpts = append(convertOpts, converter.WithLayerConvertFunc(layerConvertFunc))
+		var (
+			mapping *convert.Mapping
+			cache   *convert.LayerCache
+		)
+		if context.String("mapping-output") != "" {
+			mapping = &convert.Mapping{}
+		}
+		if len(jobs) > 1 || context.Int("platform-parallelism") > 1 {
+			// Layers shared by the images or platforms are only converted
+			// once
+			cache = convert.NewLayerCache()
+		}
+		// convertOpts returns the options of a single image conversion,
+		// with its own platform summary and platforms.
+		convertOpts := func(summary *convert.Summary, platformMC platforms.MatchComparer) ([]converter.Opt, error) {
+			convertOpts := []converter.Opt{converter.WithPlatform(platformMC)}
+			if context.Bool("erofs") {
+				Opts, err := layerOpts(context)
+				if err != nil {
+					return nil, err
+				}
+				Opts = append(Opts,
+					convert.WithProgress(progressFn),
+					convert.WithPlatformParallelism(max(context.Int("platform-parallelism"), 1)),
+				)
+				if ls := context.StringSlice("erofs-blob-label"); len(ls) > 0 {
+					Opts = append(Opts, convert.WithBlobLabels(commands.LabelArgs(ls)))
+				}
+				if as := context.StringSlice("annotation"); len(as) > 0 {
+					Opts = append(Opts, convert.WithManifestAnnotations(convert.AddAnnotations(commands.LabelArgs(as))))
+				}
+				if as := context.StringSlice("layer-annotation"); len(as) > 0 {
+					Opts = append(Opts, convert.WithLayerAnnotations(commands.LabelArgs(as)))
+				}
+				if mapping != nil {
+					Opts = append(Opts, convert.WithMapping(mapping))
+				}
+				if cache != nil {
+					Opts = append(Opts, convert.WithLayerCache(cache))
+				}
+				if summary != nil {
+					Opts = append(Opts, convert.WithContinueOnError(summary))
+				}
+				indexConvertFunc, err := convert.IndexConvertFunc(context.Bool("oci"), platformMC, Opts...)
+				if err != nil {
+					return nil, err
+				}
+				convertOpts = append(convertOpts, converter.WithIndexConvertFunc(indexConvertFunc))
+			}
+			if context.Bool("uncompress") {
+				convertOpts = append(convertOpts, converter.WithLayerConvertFunc(uncompress.LayerConvertFunc))
+			}
+			if context.Bool("oci") {
+				convertOpts = append(convertOpts, converter.WithDockerToOCI(true))
+			}
+			return convertOpts, nil
 		}
 
 		client, ctx, cancel, err := commands.NewClient(context)
@@ -144,11 +347,24 @@ When '--all-platforms' is given all images in a manifest list must be available.
 		}
 		defer cancel()
 
-		ctx, done, err := client.WithLease(ctx)
+		ctx, done, err := withConvertLease(ctx, context, client)
 		if err != nil {
 			return err
 		}
-		defer done(ctx)
+		defer func() {
+			// ctx is cancelled on interrupt, and the lease must still go
+			ctx, cancel := gocontext.WithTimeout(gocontext.WithoutCancel(ctx), leaseReleaseTimeout)
+			defer cancel()
+			if err := done(ctx); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to release the conversion lease")
+			}
+		}()
+
+		if age := context.Duration("reap-stale-age"); age > 0 {
+			if _, err := reaper.Reap(ctx, client.ContentStore(), reaper.WithMaxAge(age)); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to reap stale conversion leftovers")
+			}
+		}
 
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, os.Interrupt)
@@ -161,24 +377,535 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			case <-ctx.Done():
 			}
 		}()
-		newImg, err := converter.Convert(ctx, client, targetRef, srcRef, convertOpts...)
-		if err != nil {
-			return err
-		}
-		if finalize != nil {
-			newI, err := finalize(ctx, client.ContentStore(), targetRef, &newImg.Target)
-			if err != nil {
-				return err
+
+		run := func(job *convertJob) {
+			if context.Bool("continue-on-error") {
+				job.summary = &convert.Summary{}
 			}
-			is := client.ImageService()
-			_ = is.Delete(ctx, newI.Name)
-			finimg, err := is.Create(ctx, *newI)
+			jobMC := platformMC
+			var converted []ocispec.Descriptor
+			if context.Bool("only-missing-platforms") {
+				if converted, job.err = convertedManifests(ctx, client, job.dst); job.err != nil {
+					return
+				}
+				if len(converted) > 0 {
+					jobMC = convert.ExcludeManifests(platformMC, converted)
+				}
+			}
+			opts, err := convertOpts(job.summary, jobMC)
 			if err != nil {
+				job.err = err
+				return
+			}
+			src := job.src
+			if name, ok := strings.CutPrefix(src, dockerSourcePrefix); ok {
+				if src, job.err = importDocker(ctx, client, name); job.err != nil {
+					return
+				}
+				defer func() {
+					if err := client.ImageService().Delete(ctx, src); err != nil {
+						log.G(ctx).WithError(err).Warnf("failed to delete %s", src)
+					}
+				}()
+			} else if context.Bool("pull") {
+				if job.err = pullSource(ctx, context, client, src, jobMC); job.err != nil {
+					return
+				}
+			}
+			var (
+				sourceDigest digest.Digest
+				upToDate     bool
+			)
+			if img, err := client.ImageService().Get(ctx, src); err == nil {
+				sourceDigest = img.Target.Digest
+				if len(converted) > 0 {
+					ps, err := images.Platforms(ctx, client.ContentStore(), img.Target)
+					upToDate = err == nil && !slices.ContainsFunc(ps, jobMC.Match)
+				}
+			}
+			if upToDate {
+				log.G(ctx).WithField("target", job.dst).Info("all platforms are already converted")
+				existing, err := client.ImageService().Get(ctx, job.dst)
+				job.image, job.err = &existing, err
+			} else {
+				conversion := convert.NewConversion(job.src, sourceDigest, conversionOptions(context))
+				job.image, job.err = converter.Convert(ctx, client, job.dst, src, opts...)
+				if job.err == nil && len(converted) > 0 {
+					job.err = mergeConverted(ctx, client, job.image, converted)
+				}
+				if job.err == nil {
+					if err := recordConversion(ctx, client, job.image, conversion); err != nil {
+						log.G(ctx).WithError(err).Warnf("failed to record the conversion of %s", job.dst)
+					}
+				}
+			}
+			if job.err == nil && context.Bool("push") {
+				job.err = pushTarget(ctx, context, client, job.image, platformMC)
+			}
+		}
+
+		if len(jobs) == 1 {
+			job := jobs[0]
+			run(job)
+			stopDisplay()
+			if out != nil {
+				if err := writeMapping(context.String("mapping-output"), mapping); err != nil {
+					return err
+				}
+				return out.result(job)
+			}
+			if job.err != nil {
+				return job.err
+			}
+			if err := writeMapping(context.String("mapping-output"), mapping); err != nil {
 				return err
 			}
-			fmt.Fprintln(context.App.Writer, "extra image:", finimg.Name)
+			fmt.Fprintln(context.App.Writer, job.image.Target.Digest.String())
+			if job.summary != nil {
+				return printSummary(context.App.Writer, job.summary)
+			}
+			return nil
 		}
-		fmt.Fprintln(context.App.Writer, newImg.Target.Digest.String())
-		return nil
+
+		var (
+			wg  sync.WaitGroup
+			sem = make(chan struct{}, max(context.Int("batch-concurrency"), 1))
+		)
+		for _, job := range jobs {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				log.G(ctx).WithField("source", job.src).WithField("target", job.dst).Info("converting image")
+				run(job)
+			}()
+		}
+		wg.Wait()
+		stopDisplay()
+
+		if err := writeMapping(context.String("mapping-output"), mapping); err != nil {
+			return err
+		}
+		if out != nil {
+			var errs []error
+			for _, job := range jobs {
+				if err := out.result(job); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", job.src, err))
+				}
+			}
+			return errors.Join(errs...)
+		}
+		return printBatchSummary(context.App.Writer, jobs)
 	},
 }
+
+// convertJob is the conversion of one image in a batch.
+type convertJob struct {
+	src, dst string
+
+	summary *convert.Summary
+	image   *images.Image
+	err     error
+}
+
+// convertJobs returns the images to convert, given either as pairs of
+// arguments or as "<source_ref> <target_ref>" lines in the batch file.  With
+// a target template, the targets may be omitted.
+func convertJobs(context *cli.Context) ([]*convertJob, error) {
+	targetFn, err := targetTemplate(context)
+	if err != nil {
+		return nil, err
+	}
+	args := context.Args().Slice()
+	var jobs []*convertJob
+	if targetFn != nil {
+		for _, src := range args {
+			jobs = append(jobs, &convertJob{src: src})
+		}
+	} else {
+		if len(args)%2 != 0 {
+			return nil, errors.New("src and target image need to be specified in pairs")
+		}
+		for i := 0; i < len(args); i += 2 {
+			jobs = append(jobs, &convertJob{src: args[i], dst: args[i+1]})
+		}
+	}
+	if path := context.String("batch"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for i, line := range strings.Split(string(b), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) == 2:
+				jobs = append(jobs, &convertJob{src: fields[0], dst: fields[1]})
+			case len(fields) == 1 && targetFn != nil:
+				jobs = append(jobs, &convertJob{src: fields[0]})
+			default:
+				return nil, fmt.Errorf("%s:%d: expected \"<source_ref> <target_ref>\"", path, i+1)
+			}
+		}
+	}
+	if len(jobs) == 0 {
+		return nil, errors.New("src and target image need to be specified")
+	}
+	targets := make(map[string]string, len(jobs))
+	for _, job := range jobs {
+		if job.dst == "" && targetFn != nil && job.src != "" {
+			if job.dst, err = targetFn(job.src); err != nil {
+				return nil, err
+			}
+		}
+		if job.src == "" || job.dst == "" {
+			return nil, errors.New("src and target image need to be specified")
+		}
+		if src, ok := targets[job.dst]; ok {
+			return nil, fmt.Errorf("target %s is used for both %s and %s", job.dst, src, job.src)
+		}
+		targets[job.dst] = job.src
+	}
+	return jobs, nil
+}
+
+// targetTemplate returns the function naming the target of a source from
+// '--tag-template' or '--suffix', or nil if neither is set.  The template
+// placeholders are {{repo}}, the repository of the source as given, and
+// {{tag}}, its tag ("latest" if unset, or "<algorithm>-<digest>" for a
+// digest reference).
+func targetTemplate(context *cli.Context) (func(string) (string, error), error) {
+	tmpl := context.String("tag-template")
+	if suffix := context.String("suffix"); suffix != "" {
+		if tmpl != "" {
+			return nil, errors.New("--suffix and --tag-template can't be used together")
+		}
+		tmpl = "{{repo}}:{{tag}}" + suffix
+	}
+	if tmpl == "" {
+		return nil, nil
+	}
+	return func(src string) (string, error) {
+		ref := strings.TrimPrefix(src, dockerSourcePrefix)
+		named, err := reference.ParseNormalizedNamed(ref)
+		if err != nil {
+			return "", fmt.Errorf("invalid source reference %q: %w", src, err)
+		}
+		repo := named.Name()
+		if !strings.HasPrefix(ref, repo) {
+			repo = reference.FamiliarName(named)
+		}
+		tag := "latest"
+		if t, ok := named.(reference.Tagged); ok {
+			tag = t.Tag()
+		} else if d, ok := named.(reference.Digested); ok {
+			tag = d.Digest().Algorithm().String() + "-" + d.Digest().Encoded()
+		}
+		dst := strings.NewReplacer("{{repo}}", repo, "{{tag}}", tag).Replace(tmpl)
+		if _, err := reference.ParseNormalizedNamed(dst); err != nil {
+			return "", fmt.Errorf("invalid target reference %q for %s: %w", dst, src, err)
+		}
+		return dst, nil
+	}, nil
+}
+
+// layerOpts returns the layer conversion options shared by all conversions.
+func layerOpts(context *cli.Context) ([]convert.Option, error) {
+	features, err := convert.ParseFeatures(context.String("erofs-features"))
+	if err != nil {
+		return nil, err
+	}
+	opts := []convert.Option{
+		convert.WithCompressors(context.String("erofs-compressors")),
+		convert.WithFeatures(features...),
+		convert.WithExtraMkfsOption(context.String("erofs-mkfs-options")),
+	}
+	if context.Bool("erofs-verity") {
+		opts = append(opts, convert.WithVerityAnnotations())
+	}
+	if timeout := context.Duration("layer-timeout"); timeout > 0 {
+		opts = append(opts, convert.WithLayerTimeout(timeout))
+	}
+	return opts, nil
+}
+
+// leaseReleaseTimeout bounds the release of the conversion lease, once the
+// conversion is over or cancelled.
+const leaseReleaseTimeout = 10 * time.Second
+
+// withConvertLease protects the content of the conversion with the lease given
+// by '--lease-id', which must exist, or with a new lease expiring after
+// '--lease-ttl'.  The new lease is deleted by the returned function unless
+// '--keep-lease' is set.
+func withConvertLease(ctx gocontext.Context, context *cli.Context, client *containerd.Client) (gocontext.Context, func(gocontext.Context) error, error) {
+	nop := func(gocontext.Context) error { return nil }
+	ls := client.LeasesService()
+	if id := context.String("lease-id"); id != "" {
+		if context.IsSet("lease-ttl") || context.Bool("keep-lease") {
+			return nil, nil, errors.New("--lease-id can't be used with --lease-ttl or --keep-lease")
+		}
+		existing, err := ls.List(ctx, fmt.Sprintf("id==%q", id))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(existing) == 0 {
+			return nil, nil, fmt.Errorf("lease %q: %w", id, errdefs.ErrNotFound)
+		}
+		return leases.WithLease(ctx, id), nop, nil
+	}
+
+	opts := []leases.Opt{leases.WithRandomID()}
+	if ttl := context.Duration("lease-ttl"); ttl > 0 {
+		opts = append(opts, leases.WithExpiration(ttl))
+	}
+	l, err := ls.Create(ctx, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx = leases.WithLease(ctx, l.ID)
+	if context.Bool("keep-lease") {
+		fmt.Fprintf(context.App.ErrWriter, "keeping lease %s\n", l.ID)
+		return ctx, nop, nil
+	}
+	return ctx, func(ctx gocontext.Context) error {
+		return ls.Delete(ctx, l)
+	}, nil
+}
+
+// convertedManifests returns the EROFS manifests of the target image, if it
+// exists, and protects them with the lease of ctx until they're merged into
+// the new target.
+func convertedManifests(ctx gocontext.Context, client *containerd.Client, ref string) ([]ocispec.Descriptor, error) {
+	img, err := client.ImageService().Get(ctx, ref)
+	if errdefs.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	manifests, err := convert.ConvertedManifests(ctx, client.ContentStore(), img.Target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the manifests of %s: %w", ref, err)
+	}
+	if id, ok := leases.FromContext(ctx); ok {
+		for _, m := range manifests {
+			r := leases.Resource{ID: m.Digest.String(), Type: "content"}
+			if err := client.LeasesService().AddResource(ctx, leases.Lease{ID: id}, r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, m := range manifests {
+		log.G(ctx).WithField("target", ref).Debugf("platform %s is already converted", platforms.FormatAll(*m.Platform))
+	}
+	return manifests, nil
+}
+
+// mergeConverted adds the previously converted manifests to the new target
+// image.
+func mergeConverted(ctx gocontext.Context, client *containerd.Client, img *images.Image, converted []ocispec.Descriptor) error {
+	target, err := convert.MergeManifests(ctx, client.ContentStore(), img.Target, converted)
+	if err != nil {
+		return err
+	}
+	img.Target = target
+	updated, err := client.ImageService().Update(ctx, *img, "target")
+	if err != nil {
+		return err
+	}
+	*img = updated
+	return nil
+}
+
+// conversionOptions returns the conversion flags recorded in the provenance
+// of the converted images.
+func conversionOptions(context *cli.Context) map[string]string {
+	opts := map[string]string{}
+	for _, name := range []string{"erofs", "erofs-verity", "oci", "uncompress", "all-platforms"} {
+		if context.Bool(name) {
+			opts[name] = "true"
+		}
+	}
+	for _, name := range []string{"erofs-compressors", "erofs-features", "erofs-mkfs-options"} {
+		if v := context.String(name); v != "" {
+			opts[name] = v
+		}
+	}
+	if pss := context.StringSlice("platform"); len(pss) > 0 {
+		opts["platform"] = strings.Join(pss, ",")
+	}
+	return opts
+}
+
+// recordConversion labels the converted image with conversion, for 'images
+// attest'.
+func recordConversion(ctx gocontext.Context, client *containerd.Client, img *images.Image, conversion *convert.Conversion) error {
+	conversion.FinishedOn = time.Now().UTC()
+	label, err := conversion.Label()
+	if err != nil {
+		return err
+	}
+	if img.Labels == nil {
+		img.Labels = map[string]string{}
+	}
+	img.Labels[convert.LabelConversion] = label
+	updated, err := client.ImageService().Update(ctx, *img, "labels."+convert.LabelConversion)
+	if err != nil {
+		return err
+	}
+	*img = updated
+	return nil
+}
+
+// writeMapping writes the layer mapping as JSON to path, if set.
+func writeMapping(path string, mapping *convert.Mapping) error {
+	if path == "" || mapping == nil {
+		return nil
+	}
+	b, err := json.MarshalIndent(mapping, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// pullSource fetches the content of the source image for the platforms to
+// convert, without unpacking it.
+func pullSource(ctx gocontext.Context, context *cli.Context, client *containerd.Client, ref string, platformMC platforms.MatchComparer) error {
+	resolver, err := commands.GetResolver(ctx, context)
+	if err != nil {
+		return err
+	}
+	log.G(ctx).WithField("ref", ref).Info("pulling source image")
+	img, err := client.Fetch(ctx, ref,
+		containerd.WithResolver(resolver),
+		containerd.WithPlatformMatcher(platformMC),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to pull %s: %w", ref, err)
+	}
+	log.G(ctx).WithField("digest", img.Target.Digest).Info("pulled source image")
+	return nil
+}
+
+// pushTarget pushes the converted image, for the converted platforms, to its
+// registry.
+func pushTarget(ctx gocontext.Context, context *cli.Context, client *containerd.Client, img *images.Image, platformMC platforms.MatchComparer) error {
+	resolver, err := commands.GetResolver(ctx, context)
+	if err != nil {
+		return err
+	}
+	log.G(ctx).WithField("ref", img.Name).Info("pushing converted image")
+	if err := client.Push(ctx, img.Name, img.Target,
+		containerd.WithResolver(resolver),
+		containerd.WithPlatformMatcher(platformMC),
+	); err != nil {
+		return fmt.Errorf("failed to push %s: %w", img.Name, err)
+	}
+	log.G(ctx).WithField("digest", img.Target.Digest).Info("pushed converted image")
+	return nil
+}
+
+// printSummary prints the per-platform results of a conversion, and returns
+// the platform failures if any.
+func printSummary(w io.Writer, summary *convert.Summary) error {
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "PLATFORM\tSOURCE\tRESULT")
+	for _, r := range summary.Results {
+		result := "ok"
+		if r.Err != nil {
+			result = "failed: " + r.Err.Error()
+		} else if r.Converted != nil {
+			result = r.Converted.Digest.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Platform, r.Source.Digest, result)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	return summary.Err()
+}
+
+// printBatchSummary prints the result of every image of a batch, and returns
+// the failures if any.
+func printBatchSummary(w io.Writer, jobs []*convertJob) error {
+	var errs []error
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tTARGET\tRESULT")
+	for _, job := range jobs {
+		err := job.err
+		if err == nil && job.summary != nil {
+			err = job.summary.Err()
+		}
+		var result string
+		switch {
+		case job.err != nil:
+			result = "failed: " + job.err.Error()
+		case err != nil:
+			result = fmt.Sprintf("%s (%d platforms failed)", job.image.Target.Digest, len(job.summary.Results)-len(job.summary.Succeeded()))
+		default:
+			result = job.image.Target.Digest.String()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", job.src, err))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", job.src, job.dst, result)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// imageResult is the output of an image conversion result.
+type imageResult struct {
+	Type      string           `json:"type"`
+	Source    string           `json:"source"`
+	Target    string           `json:"target"`
+	Digest    digest.Digest    `json:"digest,omitempty"`
+	Error     string           `json:"error,omitempty"`
+	Platforms []platformResult `json:"platforms,omitempty"`
+}
+
+type platformResult struct {
+	Platform string        `json:"platform"`
+	Source   digest.Digest `json:"source"`
+	Digest   digest.Digest `json:"digest,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// result writes the result of job, and returns its failures if any.
+func (o *machineOutput) result(job *convertJob) error {
+	r := imageResult{Type: "image", Source: job.src, Target: job.dst}
+	err := job.err
+	if job.image != nil {
+		r.Digest = job.image.Target.Digest
+	}
+	if job.summary != nil {
+		for _, pr := range job.summary.Results {
+			p := platformResult{Platform: pr.Platform, Source: pr.Source.Digest}
+			if pr.Converted != nil {
+				p.Digest = pr.Converted.Digest
+			}
+			if pr.Err != nil {
+				p.Error = pr.Err.Error()
+			}
+			r.Platforms = append(r.Platforms, p)
+		}
+		if err == nil {
+			err = job.summary.Err()
+		}
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if werr := o.write(r); werr != nil {
+		return werr
+	}
+	return err
+}
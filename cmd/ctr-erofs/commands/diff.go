@@ -0,0 +1,220 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/diff"
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/rootfs"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+// DiffCommand creates an EROFS layer from the diff of two snapshots
+var DiffCommand = &cli.Command{
+	Name:      "diff",
+	Usage:     "create an EROFS layer from the diff of two snapshots",
+	ArgsUsage: "[flags] <upper_key> [<lower_key>]",
+	Description: `Compare two snapshots with the diff service, and convert the changes to an
+EROFS native layer in the content store.  The lower snapshot defaults to the
+parent of the upper one.  With '--container', the changes of the rootfs of a
+container are used instead.
+
+The EROFS layer descriptor is printed, so that it can be added to an image.
+Unless '--keep' is given, the layer is garbage collected when no image
+refers to it.
+
+With '--media-type' set to an OCI layer media type, the tar diff itself is
+kept instead, e.g. to push the images built on EROFS nodes to clusters
+without EROFS.
+`,
+	Flags: append([]cli.Flag{
+		erofsSnapshotterFlag,
+		&cli.StringFlag{
+			Name:  "container",
+			Usage: "Diff the rootfs of this container against its image",
+		},
+		&cli.BoolFlag{
+			Name:  "keep",
+			Usage: "Keep the layer until it's removed from the content store",
+		},
+		&cli.StringFlag{
+			Name:  "media-type",
+			Usage: "Media type of the layer, application/vnd.erofs or an OCI tar, tar+gzip or tar+zstd layer",
+			Value: convert.MediaTypeErofsLayer,
+		},
+		&cli.StringFlag{
+			Name:  "erofs-compressors",
+			Usage: "Specify compression algorithm list when converting EROFS layers",
+		},
+		&cli.StringFlag{
+			Name:  "erofs-features",
+			Usage: "Comma-separated EROFS on-disk features to enable (48bit, force-inode-extended, xattr-name-filter)",
+		},
+		&cli.BoolFlag{
+			Name:  "erofs-verity",
+			Usage: "Record the fs-verity digest and dm-verity root hash of EROFS layers in their annotations",
+		},
+		&cli.StringFlag{
+			Name:  "erofs-mkfs-options",
+			Usage: "Extra mkfs options applied when converting EROFS layers. (e.g. '-Efragments,dedupe')",
+		},
+		formatFlag,
+	}, commands.LabelFlag),
+	Action: func(context *cli.Context) error {
+		var (
+			upper       = context.Args().Get(0)
+			lower       = context.Args().Get(1)
+			snapshotter = context.String("snapshotter")
+		)
+		format, err := outputFormat(context)
+		if err != nil {
+			return err
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		if id := context.String("container"); id != "" {
+			if upper != "" {
+				return errors.New("snapshot keys can't be used with --container")
+			}
+			c, err := client.ContainerService().Get(ctx, id)
+			if err != nil {
+				return err
+			}
+			if c.SnapshotKey == "" {
+				return fmt.Errorf("container %s has no rootfs snapshot", id)
+			}
+			upper, snapshotter = c.SnapshotKey, c.Snapshotter
+		} else if upper == "" {
+			return errors.New("upper snapshot key or --container needs to be specified")
+		}
+		mediaType := context.String("media-type")
+		switch mediaType {
+		case convert.MediaTypeErofsLayer, ocispec.MediaTypeImageLayer, ocispec.MediaTypeImageLayerGzip, ocispec.MediaTypeImageLayerZstd:
+		default:
+			return fmt.Errorf("unsupported media type %q", mediaType)
+		}
+		opts, err := layerOpts(context)
+		if err != nil {
+			return err
+		}
+		labels := commands.LabelArgs(context.StringSlice("label"))
+		if context.Bool("keep") {
+			labels["containerd.io/gc.root"] = time.Now().UTC().Format(time.RFC3339)
+		}
+		opts = append(opts, convert.WithBlobLabels(labels))
+
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+
+		var desc ocispec.Descriptor
+		if mediaType == convert.MediaTypeErofsLayer {
+			desc, err = erofsDiff(ctx, client, snapshotter, upper, lower, opts)
+		} else {
+			desc, err = snapshotDiff(ctx, client, snapshotter, upper, lower, diff.WithMediaType(mediaType), diff.WithLabels(labels))
+		}
+		if err != nil {
+			return err
+		}
+
+		if format != "table" {
+			return writeOutput(context.App.Writer, format, desc)
+		}
+		fmt.Fprintln(context.App.Writer, desc.Digest.String())
+		return nil
+	},
+}
+
+// erofsDiff creates the EROFS layer of the changes of the snapshot upper of
+// snapshotter from the snapshot lower, or its parent if empty.
+func erofsDiff(ctx gocontext.Context, client *containerd.Client, snapshotter, upper, lower string, opts []convert.Option) (ocispec.Descriptor, error) {
+	// The diff is taken as an uncompressed tar, and converted to EROFS
+	tarDesc, err := snapshotDiff(ctx, client, snapshotter, upper, lower, diff.WithMediaType(ocispec.MediaTypeImageLayer))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc, err := convert.LayerConvertFunc(opts...)(ctx, client.ContentStore(), tarDesc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if desc == nil {
+		return ocispec.Descriptor{}, fmt.Errorf("diff %s wasn't converted", tarDesc.Digest)
+	}
+	return *desc, nil
+}
+
+// snapshotDiff returns the tar diff of the snapshot upper of snapshotter from
+// the snapshot lower, or its parent if empty.
+func snapshotDiff(ctx gocontext.Context, client *containerd.Client, snapshotter, upper, lower string, opts ...diff.Opt) (ocispec.Descriptor, error) {
+	sn := client.SnapshotService(snapshotter)
+	var (
+		desc ocispec.Descriptor
+		err  error
+	)
+	if lower == "" {
+		desc, err = rootfs.CreateDiff(ctx, upper, sn, client.DiffService(), opts...)
+	} else {
+		err = withSnapshotMounts(ctx, sn, lower, func(lowerMounts []mount.Mount) error {
+			return withSnapshotMounts(ctx, sn, upper, func(upperMounts []mount.Mount) error {
+				desc, err = client.DiffService().Compare(ctx, lowerMounts, upperMounts, opts...)
+				return err
+			})
+		})
+	}
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to diff %s: %w", upper, err)
+	}
+	return desc, nil
+}
+
+// withSnapshotMounts calls f with the mounts of the snapshot key, through a
+// temporary view if it's committed.
+func withSnapshotMounts(ctx gocontext.Context, sn snapshots.Snapshotter, key string, f func([]mount.Mount) error) error {
+	info, err := sn.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	var mounts []mount.Mount
+	if info.Kind == snapshots.KindActive {
+		mounts, err = sn.Mounts(ctx, key)
+	} else {
+		view := fmt.Sprintf("%s-view-%d", key, time.Now().UnixNano())
+		if mounts, err = sn.View(ctx, view, key); err == nil {
+			defer sn.Remove(ctx, view)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return f(mounts)
+}
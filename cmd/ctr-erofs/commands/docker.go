@@ -0,0 +1,72 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	gocontext "context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+)
+
+// dockerSourcePrefix is the prefix of the source images read from the
+// Docker daemon.
+const dockerSourcePrefix = "docker://"
+
+// importDocker imports the image name of the Docker daemon by streaming
+// 'docker save' into the content store, and returns the name of the
+// temporary image created for it.  The caller deletes the image once done.
+func importDocker(ctx gocontext.Context, client *containerd.Client, name string) (string, error) {
+	ref := "ctr-erofs-docker/" + name
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "docker", "save", name)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to run docker save: %w", err)
+	}
+	log.G(ctx).WithField("image", name).Info("importing image from docker")
+	imgs, err := client.Import(ctx, stdout,
+		// Every manifest of the archive is the same image
+		containerd.WithImageRefTranslator(func(string) string { return ref }),
+		containerd.WithDigestRef(func(digest.Digest) string { return ref }),
+		containerd.WithSkipDigestRef(func(name string) bool { return name != "" }),
+		containerd.WithAllPlatforms(true),
+		containerd.WithSkipMissing(),
+	)
+	// Drain the output so that docker save doesn't block on a failed import
+	io.Copy(io.Discard, stdout)
+	if werr := cmd.Wait(); werr != nil {
+		return "", fmt.Errorf("docker save %s failed: %w: %s", name, werr, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to import %s from docker: %w", name, err)
+	}
+	if len(imgs) == 0 {
+		return "", fmt.Errorf("docker save %s returned no image", name)
+	}
+	return ref, nil
+}
@@ -0,0 +1,558 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bufio"
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/platforms"
+	infoapi "github.com/erofs/erofs-container-toolkit/api/info/v1"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const defaultErofsAddress = "/run/containerd-erofs-grpc/containerd-erofs-grpc.sock"
+
+// DoctorCommand checks the host prerequisites of EROFS images
+var DoctorCommand = &cli.Command{
+	Name:  "doctor",
+	Usage: "check the host prerequisites of EROFS images",
+	Description: `Check that the host is ready to run EROFS images: kernel EROFS support and
+the on-disk features it knows, loop devices, overlayfs, erofs-utils, the
+containerd proxy plugin configuration of containerd-erofs-grpc, the unpack
+configuration of the transfer service, and that the containerd and
+containerd-erofs-grpc sockets are reachable.  The capabilities reported by
+containerd-erofs-grpc are shown too, as seen from the daemon.
+
+Every failed check prints a hint on how to fix it, and the command fails if
+any check failed.  Warnings don't prevent using EROFS images, but may limit
+the features available.
+`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "containerd-config",
+			Usage: "Path to the containerd configuration file",
+			Value: "/etc/containerd/config.toml",
+		},
+		&cli.StringFlag{
+			Name:  "erofs-address",
+			Usage: "Address of the containerd-erofs-grpc socket",
+			Value: defaultErofsAddress,
+		},
+		formatFlag,
+	},
+	Action: func(context *cli.Context) error {
+		format, err := outputFormat(context)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := gocontext.WithTimeout(context.Context, context.Duration("timeout")+10*time.Second)
+		defer cancel()
+
+		erofsAddress := context.String("erofs-address")
+		config, proxied := checkProxyPlugins(context.String("containerd-config"), erofsAddress)
+		unpack := checkUnpackConfig(context.String("containerd-config"), erofsAddress)
+		grpc := checkSocket("containerd-erofs-grpc", erofsAddress,
+			"start containerd-erofs-grpc, or set '--erofs-address' to its '-addr'")
+		if !proxied && grpc.Status == checkFail {
+			grpc.Status, grpc.Hint = checkWarn, "not needed with the built-in erofs plugins of containerd"
+		}
+		results := []checkResult{
+			checkKernelErofs(),
+			checkErofsFeatures(),
+			checkLoop(),
+			checkOverlay(),
+			checkErofsUtils(ctx),
+			config,
+			unpack,
+			checkContainerd(ctx, context.String("address"), context.String("namespace")),
+			grpc,
+		}
+		if grpc.Status == checkOK {
+			results = append(results, checkDaemonInfo(ctx, erofsAddress))
+		}
+
+		if format != "table" {
+			if err := writeOutput(context.App.Writer, format, results); err != nil {
+				return err
+			}
+		} else {
+			printChecks(context.App.Writer, results)
+		}
+		var failed int
+		for _, r := range results {
+			if r.Status == checkFail {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d checks failed", failed, len(results))
+		}
+		return nil
+	},
+}
+
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+type checkResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+func printChecks(w io.Writer, results []checkResult) {
+	tw := tabwriter.NewWriter(w, 1, 8, 2, ' ', 0)
+	for _, r := range results {
+		fmt.Fprintf(tw, "[%s]\t%s\t%s\n", strings.ToUpper(r.Status), r.Name, r.Detail)
+		if r.Hint != "" {
+			fmt.Fprintf(tw, "\t\t-> %s\n", strings.ReplaceAll(r.Hint, "\n", "\n\t\t   "))
+		}
+	}
+	tw.Flush()
+}
+
+func kernelRelease() string {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(uts.Release[:])
+}
+
+// kernelVersion returns the major and minor versions of the running kernel.
+func kernelVersion() (major, minor int) {
+	fmt.Sscanf(kernelRelease(), "%d.%d", &major, &minor)
+	return major, minor
+}
+
+func kernelAtLeast(major, minor int) bool {
+	kmajor, kminor := kernelVersion()
+	return kmajor > major || kmajor == major && kminor >= minor
+}
+
+// hasFilesystem checks if the kernel lists fs in /proc/filesystems.
+func hasFilesystem(fs string) (bool, error) {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == fs {
+			return true, nil
+		}
+	}
+	return false, s.Err()
+}
+
+// hasModule checks if the filesystem kernel module name is available to be
+// loaded.  Its directory may be named differently, e.g. overlayfs/overlay.ko.
+func hasModule(name string) bool {
+	matches, _ := filepath.Glob(filepath.Join("/lib/modules", kernelRelease(), "kernel/fs/*", name+".ko*"))
+	return len(matches) > 0
+}
+
+func checkKernelErofs() checkResult {
+	r := checkResult{Name: "kernel erofs", Detail: "kernel " + kernelRelease()}
+	ok, err := hasFilesystem("erofs")
+	switch {
+	case err != nil:
+		r.Status, r.Detail = checkFail, err.Error()
+	case ok:
+		r.Status = checkOK
+	case hasModule("erofs"):
+		r.Status, r.Detail = checkFail, "erofs module isn't loaded"
+		r.Hint = "run 'modprobe erofs', and add erofs to /etc/modules-load.d to load it at boot"
+	default:
+		r.Status, r.Detail = checkFail, "kernel "+kernelRelease()+" has no EROFS support"
+		r.Hint = "use a kernel built with CONFIG_EROFS_FS (5.4 or later, 6.x recommended)"
+	}
+	return r
+}
+
+// erofsFeatures lists the on-disk features EROFS images may use, and the first
+// kernel supporting them.
+var erofsFeatures = []struct {
+	name  string
+	since string
+}{
+	{"zero_padding", "5.3"},
+	{"compr_cfgs", "5.13"},
+	{"big_pcluster", "5.13"},
+	{"chunked_file", "5.15"},
+	{"device_table", "5.16"},
+	{"compr_head2", "5.17"},
+	{"sb_chksum", "5.5"},
+	{"ztailpacking", "5.17"},
+	{"fragments", "6.1"},
+	{"dedupe", "6.1"},
+	{"48bit", "6.15"},
+}
+
+func checkErofsFeatures() checkResult {
+	r := checkResult{Name: "erofs features"}
+	entries, err := os.ReadDir("/sys/fs/erofs/features")
+	if err != nil {
+		r.Status, r.Detail = checkWarn, "no feature list in /sys/fs/erofs/features"
+		r.Hint = "the kernel EROFS support predates 5.13 or isn't loaded; convert with '--erofs-features' and '--erofs-mkfs-options' left empty"
+		return r
+	}
+	var have []string
+	for _, e := range entries {
+		have = append(have, e.Name())
+	}
+	var missing []string
+	for _, f := range erofsFeatures {
+		if !slices.Contains(have, f.name) {
+			missing = append(missing, fmt.Sprintf("%s (%s)", f.name, f.since))
+		}
+	}
+	r.Status, r.Detail = checkOK, strings.Join(have, ",")
+	if len(missing) > 0 {
+		r.Status = checkWarn
+		r.Hint = "images using these features can't be mounted, upgrade the kernel to use them: " + strings.Join(missing, ", ")
+	}
+	return r
+}
+
+func checkLoop() checkResult {
+	r := checkResult{Name: "loop devices"}
+	f, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		r.Status, r.Detail = checkFail, err.Error()
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			r.Hint = "run 'modprobe loop', or make /dev/loop-control available in this environment"
+		case errors.Is(err, os.ErrPermission):
+			r.Hint = "run as root, or with access to /dev/loop-control"
+		}
+		return r
+	}
+	defer f.Close()
+	n, err := unix.IoctlRetInt(int(f.Fd()), unix.LOOP_CTL_GET_FREE)
+	if err != nil {
+		r.Status, r.Detail = checkFail, fmt.Sprintf("no free loop device: %v", err)
+		r.Hint = "raise the max_loop parameter of the loop module, or detach unused loop devices with 'losetup -D'"
+		return r
+	}
+	r.Status, r.Detail = checkOK, fmt.Sprintf("/dev/loop%d free", n)
+	return r
+}
+
+func checkOverlay() checkResult {
+	r := checkResult{Name: "overlayfs"}
+	ok, err := hasFilesystem("overlay")
+	switch {
+	case err != nil:
+		r.Status, r.Detail = checkFail, err.Error()
+		return r
+	case !ok && hasModule("overlay"):
+		r.Status, r.Detail = checkFail, "overlay module isn't loaded"
+		r.Hint = "run 'modprobe overlay', and add overlay to /etc/modules-load.d to load it at boot"
+		return r
+	case !ok:
+		r.Status, r.Detail = checkFail, "kernel has no overlayfs support"
+		r.Hint = "use a kernel built with CONFIG_OVERLAY_FS"
+		return r
+	}
+	var params []string
+	for _, p := range []string{"index", "metacopy", "redirect_dir", "xino_auto"} {
+		if b, err := os.ReadFile(filepath.Join("/sys/module/overlay/parameters", p)); err == nil {
+			params = append(params, p+"="+strings.TrimSpace(string(b)))
+		}
+	}
+	r.Status, r.Detail = checkOK, strings.Join(params, ",")
+	if !kernelAtLeast(5, 11) {
+		r.Status = checkWarn
+		r.Hint = "overlayfs before 5.11 has no 'userxattr' and 'volatile' options, needed by rootless and volatile containers"
+	}
+	return r
+}
+
+func checkErofsUtils(ctx gocontext.Context) checkResult {
+	r := checkResult{Name: "erofs-utils"}
+	if _, err := exec.LookPath("mkfs.erofs"); err != nil {
+		r.Status, r.Detail = checkFail, "mkfs.erofs not found"
+		r.Hint = "install erofs-utils (1.8 or later recommended) to convert images"
+		return r
+	}
+	out, err := exec.CommandContext(ctx, "mkfs.erofs", "-V").Output()
+	if err != nil {
+		r.Status, r.Detail = checkFail, fmt.Sprintf("mkfs.erofs -V failed: %v", err)
+		return r
+	}
+	r.Status, r.Detail = checkOK, strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	var missing []string
+	for _, tool := range []string{"fsck.erofs", "dump.erofs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	if len(missing) > 0 {
+		r.Status = checkWarn
+		r.Hint = strings.Join(missing, " and ") + " not found, install the full erofs-utils for 'images fsck' and 'images info'"
+	}
+	return r
+}
+
+// containerdConfig is the part of the containerd configuration file the
+// EROFS plugins are read from.
+type containerdConfig struct {
+	Version      int            `toml:"version"`
+	Plugins      map[string]any `toml:"plugins"`
+	ProxyPlugins map[string]struct {
+		Type    string `toml:"type"`
+		Address string `toml:"address"`
+	} `toml:"proxy_plugins"`
+}
+
+// checkProxyPlugins checks that containerd is configured to use the EROFS
+// snapshotter and differ of containerd-erofs-grpc, or its built-in ones.  It
+// returns whether containerd-erofs-grpc is used.
+func checkProxyPlugins(path, erofsAddress string) (checkResult, bool) {
+	r := checkResult{Name: "containerd config"}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		r.Status, r.Detail = checkWarn, err.Error()
+		r.Hint = "set '--containerd-config' to the containerd configuration file to check its EROFS plugins"
+		return r, true
+	}
+	var config containerdConfig
+	if err := toml.Unmarshal(b, &config); err != nil {
+		r.Status, r.Detail = checkFail, fmt.Sprintf("failed to parse %s: %v", path, err)
+		return r, true
+	}
+	var found []string
+	for name, p := range config.ProxyPlugins {
+		if p.Address == erofsAddress && (p.Type == "snapshot" || p.Type == "diff") {
+			found = append(found, p.Type+"="+name)
+		}
+	}
+	slices.Sort(found)
+	if len(found) == 0 {
+		_, differ := config.Plugins["io.containerd.differ.v1.erofs"]
+		_, snapshotter := config.Plugins["io.containerd.snapshotter.v1.erofs"]
+		if differ || snapshotter {
+			r.Status, r.Detail = checkOK, "built-in erofs plugins"
+			return r, false
+		}
+	}
+	hint := fmt.Sprintf(`add to %s:
+[proxy_plugins.erofs]
+  type = "snapshot"
+  address = %q
+[proxy_plugins.erofs-diff]
+  type = "diff"
+  address = %q`, path, erofsAddress, erofsAddress)
+	switch len(found) {
+	case 0:
+		r.Status, r.Detail = checkFail, "no erofs plugin configured for "+erofsAddress
+		r.Hint = hint + "\nor configure the built-in erofs plugins of containerd"
+	case 1:
+		r.Status, r.Detail = checkWarn, strings.Join(found, ",")
+		r.Hint = "both the snapshot and diff proxy plugins are needed to unpack EROFS layers, " + hint
+	default:
+		r.Status, r.Detail = checkOK, strings.Join(found, ",")
+	}
+	return r, true
+}
+
+// tarLayerTypes are the media types of the OCI and Docker tar layers, which
+// the EROFS differ converts when unpacking them.
+var tarLayerTypes = []string{
+	ocispec.MediaTypeImageLayer,
+	ocispec.MediaTypeImageLayerGzip,
+	ocispec.MediaTypeImageLayerZstd,
+	images.MediaTypeDockerSchema2Layer,
+	images.MediaTypeDockerSchema2LayerGzip,
+}
+
+// checkUnpackConfig checks that the transfer service of containerd unpacks
+// the images pulled with the EROFS snapshotter, converting their tar layers
+// to EROFS, so that the OCI images don't need 'images convert' first.
+func checkUnpackConfig(path, erofsAddress string) checkResult {
+	r := checkResult{Name: "unpack config"}
+	var config struct {
+		Plugins struct {
+			Transfer struct {
+				UnpackConfig []struct {
+					Platform    string   `toml:"platform"`
+					Snapshotter string   `toml:"snapshotter"`
+					Differ      string   `toml:"differ"`
+					LayerTypes  []string `toml:"layer_types"`
+				} `toml:"unpack_config"`
+			} `toml:"io.containerd.transfer.v1.local"`
+		} `toml:"plugins"`
+		ProxyPlugins map[string]struct {
+			Type    string `toml:"type"`
+			Address string `toml:"address"`
+		} `toml:"proxy_plugins"`
+	}
+	b, err := os.ReadFile(path)
+	if err == nil {
+		err = toml.Unmarshal(b, &config)
+	}
+	if err != nil {
+		// Reported by the containerd config check
+		r.Status, r.Detail = checkWarn, "not checked"
+		return r
+	}
+	snapshotters := []string{"erofs"}
+	for name, p := range config.ProxyPlugins {
+		if p.Address == erofsAddress && p.Type == "snapshot" {
+			snapshotters = append(snapshotters, name)
+		}
+	}
+	layerTypes := []string{strconv.Quote(convert.MediaTypeErofsLayer)}
+	for _, t := range tarLayerTypes {
+		layerTypes = append(layerTypes, strconv.Quote(t))
+	}
+	unpackConfig := fmt.Sprintf(`[[plugins."io.containerd.transfer.v1.local".unpack_config]]
+  differ = "erofs"
+  platform = %q
+  snapshotter = "erofs"
+  layer_types = [%s]`, platforms.Format(platforms.DefaultSpec()), strings.Join(layerTypes, ", "))
+	var converted, native []string
+	for _, uc := range config.Plugins.Transfer.UnpackConfig {
+		if !slices.Contains(snapshotters, uc.Snapshotter) {
+			continue
+		}
+		desc := uc.Snapshotter + "/" + uc.Platform
+		if len(uc.LayerTypes) == 0 || slices.ContainsFunc(tarLayerTypes, func(t string) bool { return slices.Contains(uc.LayerTypes, t) }) {
+			converted = append(converted, desc)
+		} else {
+			native = append(native, desc)
+		}
+	}
+	switch {
+	case len(converted) > 0:
+		r.Status, r.Detail = checkOK, "OCI layers converted when pulled for "+strings.Join(converted, ",")
+	case len(native) > 0:
+		r.Status, r.Detail = checkWarn, "only EROFS layers unpacked for "+strings.Join(native, ",")
+		r.Hint = fmt.Sprintf("add the tar layer types to 'layer_types' in %s to convert the OCI images when pulled:\n%s", path, unpackConfig)
+	default:
+		r.Status, r.Detail = checkWarn, "no unpack_config for the erofs snapshotter"
+		r.Hint = fmt.Sprintf("add to %s to unpack the images pulled for the erofs snapshotter, converting their OCI layers:\n%s", path, unpackConfig)
+	}
+	return r
+}
+
+func checkContainerd(ctx gocontext.Context, address, namespace string) checkResult {
+	r := checkResult{Name: "containerd"}
+	client, err := containerd.New(address, containerd.WithTimeout(5*time.Second))
+	if err != nil {
+		r.Status, r.Detail = checkFail, err.Error()
+		r.Hint = "start containerd, or set '--address' to its socket"
+		return r
+	}
+	defer client.Close()
+	v, err := client.Version(namespaces.WithNamespace(ctx, namespace))
+	if err != nil {
+		r.Status, r.Detail = checkFail, err.Error()
+		r.Hint = "check that containerd is running and the socket is accessible"
+		return r
+	}
+	r.Status, r.Detail = checkOK, fmt.Sprintf("%s at %s", v.Version, address)
+	return r
+}
+
+func checkSocket(name, address, hint string) checkResult {
+	r := checkResult{Name: name}
+	conn, err := net.DialTimeout("unix", address, 5*time.Second)
+	if err != nil {
+		r.Status, r.Detail, r.Hint = checkFail, err.Error(), hint
+		return r
+	}
+	conn.Close()
+	r.Status, r.Detail = checkOK, address
+	return r
+}
+
+// checkDaemonInfo shows the capabilities reported by the Info API of
+// containerd-erofs-grpc at address.
+func checkDaemonInfo(ctx gocontext.Context, address string) checkResult {
+	r := checkResult{Name: "containerd-erofs-grpc info"}
+	conn, err := grpc.NewClient("unix://"+address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		r.Status, r.Detail = checkFail, err.Error()
+		return r
+	}
+	defer conn.Close()
+	info, err := infoapi.NewInfoClient(conn).Info(ctx, &infoapi.InfoRequest{})
+	if err != nil {
+		r.Status, r.Detail = checkWarn, err.Error()
+		if status.Code(err) == codes.Unimplemented {
+			r.Hint = "upgrade containerd-erofs-grpc to report its capabilities"
+		}
+		return r
+	}
+	details := []string{"kernel " + info.Kernel}
+	if len(info.Decompressors) > 0 {
+		details = append(details, "decompressors "+strings.Join(info.Decompressors, ","))
+	}
+	for _, f := range []struct {
+		name string
+		ok   bool
+	}{{"loop", info.Loop}, {"file-backed", info.FileBacked}, {"fsverity", info.Fsverity}} {
+		if f.ok {
+			details = append(details, f.name)
+		}
+	}
+	if info.ErofsUtils != "" {
+		details = append(details, info.ErofsUtils)
+	}
+	r.Status, r.Detail = checkOK, strings.Join(details, ", ")
+	switch {
+	case !info.Erofs:
+		r.Status, r.Hint = checkFail, "the kernel of containerd-erofs-grpc has no EROFS support"
+	case !info.Loop && !info.FileBacked:
+		r.Status, r.Hint = checkFail, "containerd-erofs-grpc can't mount layers: it has no loop devices and the kernel lacks EROFS file-backed mounts"
+	case info.ErofsUtils == "":
+		r.Status, r.Hint = checkWarn, "containerd-erofs-grpc doesn't find mkfs.erofs, install erofs-utils where it runs to convert layers"
+	}
+	return r
+}
@@ -0,0 +1,287 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	gocontext "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/pkg/progress"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/containerd/platforms"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+// imageSource reads the blobs of an image, either from the local content
+// store or straight from its registry.
+type imageSource struct {
+	target   ocispec.Descriptor
+	provider content.Provider
+	open     func(ctx gocontext.Context, desc ocispec.Descriptor) (io.ReadCloser, error)
+}
+
+// fetcherProvider reads small blobs (indexes, manifests) from a registry.
+type fetcherProvider struct {
+	fetcher remotes.Fetcher
+}
+
+func (p fetcherProvider) ReaderAt(ctx gocontext.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	rc, err := p.fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, desc.Size))
+	if err != nil {
+		return nil, err
+	}
+	return bytesReaderAt{bytes.NewReader(b)}, nil
+}
+
+type bytesReaderAt struct {
+	*bytes.Reader
+}
+
+func (bytesReaderAt) Close() error { return nil }
+
+// resolveSource looks up ref in the local image store, or resolves it in its
+// registry if it isn't there, without fetching anything into the content
+// store.
+func resolveSource(ctx gocontext.Context, context *cli.Context, client *containerd.Client, ref string) (*imageSource, error) {
+	if strings.HasPrefix(ref, dockerSourcePrefix) {
+		return nil, fmt.Errorf("%s sources are not supported with --dry-run", dockerSourcePrefix)
+	}
+	img, err := client.ImageService().Get(ctx, ref)
+	if err == nil {
+		cs := client.ContentStore()
+		return &imageSource{
+			target:   img.Target,
+			provider: cs,
+			open: func(ctx gocontext.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+				ra, err := cs.ReaderAt(ctx, desc)
+				if err != nil {
+					return nil, err
+				}
+				return struct {
+					io.Reader
+					io.Closer
+				}{content.NewReader(ra), ra}, nil
+			},
+		}, nil
+	}
+	if !errdefs.IsNotFound(err) {
+		return nil, err
+	}
+	log.G(ctx).WithField("ref", ref).Debug("image not found locally, resolving it remotely")
+	resolver, err := commands.GetResolver(ctx, context)
+	if err != nil {
+		return nil, err
+	}
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", ref, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &imageSource{
+		target:   desc,
+		provider: fetcherProvider{fetcher},
+		open:     fetcher.Fetch,
+	}, nil
+}
+
+// platformManifests returns the manifests of the image matching platformMC.
+func (s *imageSource) platformManifests(ctx gocontext.Context, platformMC platforms.MatchComparer) ([]ocispec.Descriptor, error) {
+	var manifests []ocispec.Descriptor
+	collect := images.HandlerFunc(func(ctx gocontext.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if images.IsManifestType(desc.MediaType) {
+			manifests = append(manifests, desc)
+			return nil, images.ErrSkipDesc
+		}
+		return nil, nil
+	})
+	handler := images.Handlers(collect, images.FilterPlatforms(images.ChildrenHandler(s.provider), platformMC))
+	if err := images.Walk(ctx, handler, s.target); err != nil {
+		return nil, err
+	}
+	return manifests, nil
+}
+
+// platformPlan is the dry-run plan of a manifest.
+type platformPlan struct {
+	Platform string              `json:"platform"`
+	Manifest digest.Digest       `json:"manifest"`
+	Layers   []*convert.Estimate `json:"layers"`
+	Errors   []string            `json:"errors,omitempty"`
+}
+
+// imagePlan is the output of the dry-run plan of an image.
+type imagePlan struct {
+	Type      string         `json:"type"`
+	Source    string         `json:"source"`
+	Target    string         `json:"target"`
+	Platforms []platformPlan `json:"platforms"`
+}
+
+// dryRun prints the conversion plans of jobs with the estimated layer sizes.
+func dryRun(context *cli.Context, jobs []*convertJob, platformMC platforms.MatchComparer, format string) error {
+	opts, err := layerOpts(context)
+	if err != nil {
+		return err
+	}
+	client, ctx, cancel, err := commands.NewClient(context)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	out := newMachineOutput(context.App.Writer, format)
+	var errs []error
+	for _, job := range jobs {
+		plan, err := planImage(ctx, context, client, job, platformMC, opts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", job.src, err))
+			continue
+		}
+		if format != "table" {
+			err = out.write(plan)
+		} else {
+			err = printPlan(context.App.Writer, plan)
+		}
+		if err != nil {
+			return err
+		}
+		for _, p := range plan.Platforms {
+			for _, e := range p.Errors {
+				errs = append(errs, fmt.Errorf("%s (%s): %s", job.src, p.Platform, e))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func planImage(ctx gocontext.Context, context *cli.Context, client *containerd.Client, job *convertJob, platformMC platforms.MatchComparer, opts []convert.Option) (*imagePlan, error) {
+	src, err := resolveSource(ctx, context, client, job.src)
+	if err != nil {
+		return nil, err
+	}
+	manifests, err := src.platformManifests(ctx, platformMC)
+	if err != nil {
+		return nil, err
+	}
+	if len(manifests) == 0 {
+		return nil, fmt.Errorf("no manifest matching the platforms: %w", errdefs.ErrNotFound)
+	}
+
+	plan := &imagePlan{Type: "plan", Source: job.src, Target: job.dst}
+	estimates := make(map[digest.Digest]*convert.Estimate)
+	for _, mdesc := range manifests {
+		p := platformPlan{Platform: "unknown", Manifest: mdesc.Digest}
+		if mdesc.Platform != nil {
+			p.Platform = platforms.FormatAll(*mdesc.Platform)
+		}
+		b, err := content.ReadBlob(ctx, src.provider, mdesc)
+		if err != nil {
+			return nil, err
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return nil, err
+		}
+		for _, l := range manifest.Layers {
+			est, ok := estimates[l.Digest]
+			if !ok {
+				est, err = estimateLayer(ctx, src, l, context.Int64("dry-run-sample"), opts)
+				if err != nil {
+					p.Errors = append(p.Errors, fmt.Sprintf("layer %s: %v", l.Digest, err))
+					est = &convert.Estimate{Source: l}
+				}
+				estimates[l.Digest] = est
+			}
+			p.Layers = append(p.Layers, est)
+		}
+		plan.Platforms = append(plan.Platforms, p)
+	}
+	return plan, nil
+}
+
+func estimateLayer(ctx gocontext.Context, src *imageSource, desc ocispec.Descriptor, sampleSize int64, opts []convert.Option) (*convert.Estimate, error) {
+	if images.IsNonDistributable(desc.MediaType) {
+		// Don't fetch layers which won't be converted anyway
+		return convert.EstimateLayer(ctx, nil, desc, sampleSize, opts...)
+	}
+	rc, err := src.open(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return convert.EstimateLayer(ctx, rc, desc, sampleSize, opts...)
+}
+
+func printPlan(w io.Writer, plan *imagePlan) error {
+	fmt.Fprintf(w, "%s -> %s\n", plan.Source, plan.Target)
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "PLATFORM\tLAYER\tSIZE\tUNCOMPRESSED\tESTIMATED\tACTION")
+	for _, p := range plan.Platforms {
+		var source, estimated int64
+		for _, est := range p.Layers {
+			source += est.Source.Size
+			switch {
+			case est.Skipped != "":
+				estimated += est.Source.Size
+				fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\tskip (%s)\n", p.Platform, est.Source.Digest, progress.Bytes(est.Source.Size), est.Skipped)
+			case est.Size == 0:
+				fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\tfailed\n", p.Platform, est.Source.Digest, progress.Bytes(est.Source.Size))
+			default:
+				estimated += est.Size
+				uncompressed, size := progress.Bytes(est.UncompressedSize).String(), progress.Bytes(est.Size).String()
+				if !est.Exact {
+					uncompressed, size = "~"+uncompressed, "~"+size
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\tconvert\n", p.Platform, est.Source.Digest,
+					progress.Bytes(est.Source.Size), uncompressed, size)
+			}
+		}
+		fmt.Fprintf(tw, "%s\ttotal\t%s\t\t~%s\t\n", p.Platform, progress.Bytes(source), progress.Bytes(estimated))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, p := range plan.Platforms {
+		for _, e := range p.Errors {
+			fmt.Fprintf(w, "%s: %s\n", p.Platform, e)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"archive/tar"
+	"cmp"
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/containerd/containerd/v2/pkg/progress"
+	"github.com/erofs/erofs-container-toolkit/pkg/imagemount"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+// DuCommand shows the sizes of the layers of an image
+var DuCommand = &cli.Command{
+	Name:      "du",
+	Usage:     "show per-layer sizes, compression ratios and largest files",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Show, for each layer of an image, the size of the original blob, of its
+uncompressed tar stream and of the EROFS blob, the resulting ratio, and the
+largest files of the layer.
+
+For an EROFS image, pass the image it was converted from with '--source' to
+get the original sizes and files.  Layers are matched by position.
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+		formatFlag,
+		&cli.StringFlag{
+			Name:  "source",
+			Usage: "Image the EROFS image was converted from",
+		},
+		&cli.IntFlag{
+			Name:  "top",
+			Usage: "Number of largest files shown per layer (0 to disable)",
+			Value: 10,
+		},
+	},
+	Action: func(context *cli.Context) error {
+		ref := context.Args().First()
+		if ref == "" {
+			return errors.New("image ref needs to be specified")
+		}
+		format, err := outputFormat(context)
+		if err != nil {
+			return err
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		manifest, err := imageManifest(ctx, context, client, ref)
+		if err != nil {
+			return err
+		}
+		var sourceLayers []ocispec.Descriptor
+		if src := context.String("source"); src != "" {
+			m, err := imageManifest(ctx, context, client, src)
+			if err != nil {
+				return err
+			}
+			if len(m.Layers) != len(manifest.Layers) {
+				return fmt.Errorf("%s has %d layers but %s has %d", src, len(m.Layers), ref, len(manifest.Layers))
+			}
+			sourceLayers = m.Layers
+		}
+
+		cs := client.ContentStore()
+		var usage []layerUsage
+		for i, l := range manifest.Layers {
+			u := layerUsage{Digest: l.Digest, MediaType: l.MediaType}
+			tarLayer := l
+			if imagemount.IsErofsLayer(l) {
+				u.ErofsSize = l.Size
+				if sourceLayers == nil {
+					usage = append(usage, u)
+					continue
+				}
+				tarLayer = sourceLayers[i]
+			}
+			u.Size = tarLayer.Size
+			if images.IsNonDistributable(tarLayer.MediaType) {
+				usage = append(usage, u)
+				continue
+			}
+			u.Uncompressed, u.Files, err = scanLayerFiles(ctx, cs, tarLayer, context.Int("top"))
+			if err != nil {
+				return fmt.Errorf("failed to read layer %s: %w", tarLayer.Digest, err)
+			}
+			if u.ErofsSize > 0 && u.Uncompressed > 0 {
+				u.Ratio = float64(u.ErofsSize) / float64(u.Uncompressed)
+			}
+			usage = append(usage, u)
+		}
+
+		if format != "table" {
+			return writeOutput(context.App.Writer, format, usage)
+		}
+		return printUsage(context.App.Writer, usage)
+	},
+}
+
+// layerUsage holds the sizes of a layer.
+type layerUsage struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	// Size is the size of the original blob
+	Size         int64 `json:"size,omitempty"`
+	Uncompressed int64 `json:"uncompressed,omitempty"`
+	ErofsSize    int64 `json:"erofsSize,omitempty"`
+	// Ratio is the EROFS size relative to the uncompressed size
+	Ratio float64    `json:"ratio,omitempty"`
+	Files []fileSize `json:"files,omitempty"`
+}
+
+type fileSize struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// scanLayerFiles reads a tar layer and returns its uncompressed size and its
+// top largest regular files.
+func scanLayerFiles(ctx gocontext.Context, cs content.Provider, desc ocispec.Descriptor, top int) (int64, []fileSize, error) {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer ra.Close()
+	ds, err := compression.DecompressStream(content.NewReader(ra))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer ds.Close()
+	cr := &countingReader{r: ds}
+
+	var files []fileSize
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if top <= 0 || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		files = append(files, fileSize{Path: path.Clean("/" + hdr.Name), Size: hdr.Size})
+		if len(files) > top {
+			slices.SortFunc(files, bySizeDesc)
+			files = files[:top]
+		}
+	}
+	// Trailing padding is part of the stream too
+	if _, err := io.Copy(io.Discard, cr); err != nil {
+		return 0, nil, err
+	}
+	slices.SortFunc(files, bySizeDesc)
+	return cr.n, files, nil
+}
+
+func bySizeDesc(a, b fileSize) int {
+	return cmp.Compare(b.Size, a.Size)
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func printUsage(w io.Writer, usage []layerUsage) error {
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "#\tDIGEST\tSIZE\tUNCOMPRESSED\tEROFS\tRATIO")
+	var size, uncompressed, erofsSize int64
+	for i, u := range usage {
+		size += u.Size
+		uncompressed += u.Uncompressed
+		erofsSize += u.ErofsSize
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", i, u.Digest,
+			formatSize(u.Size), formatSize(u.Uncompressed), formatSize(u.ErofsSize), formatRatio(u.Ratio))
+	}
+	var ratio float64
+	if erofsSize > 0 && uncompressed > 0 {
+		ratio = float64(erofsSize) / float64(uncompressed)
+	}
+	fmt.Fprintf(tw, "\ttotal\t%s\t%s\t%s\t%s\n", formatSize(size), formatSize(uncompressed), formatSize(erofsSize), formatRatio(ratio))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for i, u := range usage {
+		if len(u.Files) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\nlayer %d (%s) largest files:\n", i, u.Digest)
+		tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+		for _, f := range u.Files {
+			fmt.Fprintf(tw, "  %s\t%s\n", progress.Bytes(f.Size), f.Path)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatSize(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return progress.Bytes(n).String()
+}
+
+func formatRatio(r float64) string {
+	if r == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", r*100)
+}
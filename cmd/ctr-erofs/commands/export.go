@@ -0,0 +1,172 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/erofs"
+	"github.com/erofs/erofs-container-toolkit/pkg/imagemount"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+// ExportCommand flattens an EROFS image into a single EROFS file
+var ExportCommand = &cli.Command{
+	Name:      "export-erofs",
+	Usage:     "flatten an EROFS image into a single EROFS file",
+	ArgsUsage: "[flags] <ref> <file>",
+	Description: `Write the merged filesystem of an EROFS image to a single EROFS file, e.g.
+to attach it to a microVM as a block device.
+
+Single-layer images are written as they are unless '--erofs-compressors' is
+given.  Multi-layer images are mounted and rebuilt with mkfs.erofs, which
+requires root privileges, converting their tar layers, if any, to EROFS
+first.
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+		&cli.StringFlag{
+			Name:  "erofs-compressors",
+			Usage: "Rebuild the image with this compression algorithm list",
+		},
+		&cli.BoolFlag{
+			Name:  "verity",
+			Usage: "Append a dm-verity hash tree to the file (requires veritysetup) and print its root hash",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "Overwrite the file if it exists",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		ref := context.Args().Get(0)
+		output := context.Args().Get(1)
+		if ref == "" || output == "" {
+			return errors.New("image ref and output file need to be specified")
+		}
+		if _, err := os.Lstat(output); err == nil && !context.Bool("force") {
+			return fmt.Errorf("%s already exists, use --force to overwrite it", output)
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		manifest, err := imageManifest(ctx, context, client, ref)
+		if err != nil {
+			return err
+		}
+		for _, l := range manifest.Layers {
+			if !imagemount.IsErofsLayer(l) && !images.IsLayerType(l.MediaType) {
+				return fmt.Errorf("layer %s is neither an EROFS nor a tar layer (%s)", l.Digest, l.MediaType)
+			}
+		}
+		if len(manifest.Layers) == 0 {
+			return errors.New("image has no layer")
+		}
+
+		tmp, err := os.CreateTemp(filepath.Dir(output), ".export-erofs-")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+
+		cs := client.ContentStore()
+		compressors := context.String("erofs-compressors")
+		if len(manifest.Layers) == 1 && imagemount.IsErofsLayer(manifest.Layers[0]) && compressors == "" {
+			err = exportBlob(ctx, cs, manifest.Layers[0], tmp.Name())
+		} else {
+			var args []string
+			if compressors != "" {
+				args = append(args, "-z", compressors)
+			}
+			err = exportMerged(ctx, cs, ref, manifest.Layers, tmp.Name(), args)
+		}
+		if err != nil {
+			return err
+		}
+
+		var verity *erofs.Verity
+		if context.Bool("verity") {
+			if verity, err = erofs.AppendVerity(ctx, tmp.Name()); err != nil {
+				return err
+			}
+		}
+		if err := os.Chmod(tmp.Name(), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp.Name(), output); err != nil {
+			return err
+		}
+		fmt.Fprintln(context.App.Writer, output)
+		if verity != nil {
+			fmt.Fprintf(context.App.Writer, "verity root hash: %s\n", verity.RootHash)
+			fmt.Fprintf(context.App.Writer, "verity hash offset: %d\n", verity.HashOffset)
+		}
+		return nil
+	},
+}
+
+func exportBlob(ctx gocontext.Context, cs content.Store, desc ocispec.Descriptor, path string) error {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, content.NewReader(ra)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// exportMerged mounts the layers and rebuilds their merged filesystem into a
+// single EROFS image at path.
+func exportMerged(ctx gocontext.Context, cs content.Store, ref string, layers []ocispec.Descriptor, path string, args []string) error {
+	dir, err := os.MkdirTemp("", "ctr-erofs-export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "rootfs")
+	if _, err := imagemount.Mount(ctx, cs, ref, layers, target, dir, dir); err != nil {
+		return err
+	}
+	defer func() {
+		if err := imagemount.Unmount(ctx, dir, target); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to unmount %s", target)
+		}
+	}()
+	return erofs.MkfsDir(ctx, path, target, args...)
+}
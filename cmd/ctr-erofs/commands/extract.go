@@ -0,0 +1,167 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/imagemount"
+	"github.com/erofs/erofs-container-toolkit/pkg/layerfs"
+	"github.com/urfave/cli/v2"
+)
+
+// ExtractCommand copies a file or directory out of an EROFS image
+var ExtractCommand = &cli.Command{
+	Name:      "extract",
+	Usage:     "copy a file or directory out of an EROFS image without mounting it",
+	ArgsUsage: "[flags] <ref> <path> [<dest>]",
+	Description: `Copy a file or directory out of the EROFS layers of an image, reading them in
+userspace the way overlayfs stacks them, so that no mount privileges are
+needed.
+
+The destination defaults to the base name of the path in the current
+directory, and '-' writes a file to stdout.  Like 'docker cp', a symlink is
+copied as is unless written to stdout.  Ownership isn't preserved, and
+device nodes are skipped.  Layers with compressed files can't be read yet.
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+	},
+	Action: func(context *cli.Context) error {
+		var (
+			ref  = context.Args().Get(0)
+			name = context.Args().Get(1)
+			dest = context.Args().Get(2)
+		)
+		if ref == "" || name == "" {
+			return errors.New("image ref and path need to be specified")
+		}
+		name = strings.TrimPrefix(path.Clean("/"+name), "/")
+		if name == "" {
+			name = "."
+		}
+		if dest == "" {
+			if name == "." {
+				return errors.New("destination needs to be specified to extract the whole image")
+			}
+			dest = path.Base(name)
+		} else if st, err := os.Stat(dest); err == nil && st.IsDir() && name != "." {
+			dest = filepath.Join(dest, path.Base(name))
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		manifest, err := imageManifest(ctx, context, client, ref)
+		if err != nil {
+			return err
+		}
+		for _, l := range manifest.Layers {
+			if !imagemount.IsErofsLayer(l) {
+				return fmt.Errorf("layer %s of %s isn't an EROFS layer (%s)", l.Digest, ref, l.MediaType)
+			}
+		}
+		fsys, err := layerfs.Open(ctx, client.ContentStore(), manifest.Layers)
+		if err != nil {
+			return err
+		}
+		defer fsys.Close()
+
+		if dest == "-" {
+			f, err := fsys.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(context.App.Writer, f)
+			return err
+		}
+		return extractTree(ctx, fsys, name, dest)
+	},
+}
+
+// extractTree copies name from fsys to dest, recursively.
+func extractTree(ctx gocontext.Context, fsys *layerfs.FS, name, dest string) error {
+	fi, err := fsys.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return extractEntry(ctx, fsys, name, dest, fi)
+	}
+	return fs.WalkDir(fsys, name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(name, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return extractEntry(ctx, fsys, p, filepath.Join(dest, rel), fi)
+	})
+}
+
+func extractEntry(ctx gocontext.Context, fsys *layerfs.FS, name, dest string, fi fs.FileInfo) error {
+	switch mode := fi.Mode(); {
+	case mode.IsDir():
+		// Keep directories writable to extract their contents
+		return os.MkdirAll(dest, mode.Perm()|0700)
+	case mode.IsRegular():
+		src, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, src); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case mode&fs.ModeSymlink != 0:
+		target, err := fsys.ReadLink(name)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dest)
+	default:
+		log.G(ctx).Warnf("skipping %s (%s)", name, mode.Type())
+		return nil
+	}
+	return os.Chtimes(dest, fi.ModTime(), fi.ModTime())
+}
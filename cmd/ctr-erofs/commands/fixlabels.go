@@ -0,0 +1,106 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	"github.com/urfave/cli/v2"
+)
+
+// FixLabelsCommand repairs the content labels of converted images
+var FixLabelsCommand = &cli.Command{
+	Name:      "fix-labels",
+	Usage:     "repair the content labels of converted images without reconverting them",
+	ArgsUsage: "[flags] <ref> [<ref>, ...]",
+	Description: `Recompute the content labels of converted images and set those which are
+missing or wrong: the 'containerd.io/uncompressed' label of the EROFS layers,
+which must be their own digest for unpacking to work, and the GC references of
+the indexes and manifests to their children.
+
+Images converted by older versions of ctr-erofs or by other tools can then be
+unpacked without being converted again.  Use '--dry-run' to only list the
+labels to set.
+`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Only list the labels to set",
+		},
+		formatFlag,
+	},
+	Action: func(context *cli.Context) error {
+		if context.NArg() == 0 {
+			return errors.New("image ref needs to be specified")
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		var (
+			cs    = client.ContentStore()
+			fixes []convert.LabelFix
+		)
+		for _, ref := range context.Args().Slice() {
+			img, err := client.ImageService().Get(ctx, ref)
+			if err != nil {
+				return err
+			}
+			f, err := convert.FixLabels(ctx, cs, img.Target)
+			if err != nil {
+				return fmt.Errorf("failed to check the labels of %s: %w", ref, err)
+			}
+			fixes = append(fixes, f...)
+		}
+		if !context.Bool("dry-run") {
+			if err := convert.ApplyLabelFixes(ctx, cs, fixes); err != nil {
+				return err
+			}
+		}
+
+		switch context.String("format") {
+		case "json", "yaml":
+			if fixes == nil {
+				fixes = []convert.LabelFix{}
+			}
+			return writeOutput(context.App.Writer, context.String("format"), fixes)
+		case "table":
+			if len(fixes) == 0 {
+				fmt.Fprintln(context.App.Writer, "no label to fix")
+				return nil
+			}
+			w := tabwriter.NewWriter(context.App.Writer, 1, 8, 1, ' ', 0)
+			fmt.Fprintln(w, "DIGEST\tLABEL\tOLD\tNEW")
+			for _, f := range fixes {
+				old := f.Old
+				if old == "" {
+					old = "-"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", f.Digest, f.Label, old, f.New)
+			}
+			return w.Flush()
+		default:
+			return fmt.Errorf("unknown format %q", context.String("format"))
+		}
+	},
+}
@@ -0,0 +1,173 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/erofs"
+	"github.com/erofs/erofs-container-toolkit/pkg/imagemount"
+	"github.com/erofs/erofs-container-toolkit/pkg/verity"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+// FsckCommand checks the EROFS layers of an image for corruption
+var FsckCommand = &cli.Command{
+	Name:      "fsck",
+	Usage:     "check the EROFS layers of an image for corruption",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Check every EROFS layer blob of an image in the content store.
+
+fsck.erofs is used if available, otherwise only the built-in superblock
+checks are done.  Exits non-zero if any layer is corrupted.
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+		formatFlag,
+		&cli.BoolFlag{
+			Name:  "extract",
+			Usage: "Also decompress and verify all file data (requires fsck.erofs)",
+		},
+		&cli.BoolFlag{
+			Name:  "builtin",
+			Usage: "Only run the built-in checks even if fsck.erofs is available",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		ref := context.Args().First()
+		if ref == "" {
+			return errors.New("image ref needs to be specified")
+		}
+		format, err := outputFormat(context)
+		if err != nil {
+			return err
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		manifest, err := imageManifest(ctx, context, client, ref)
+		if err != nil {
+			return err
+		}
+		useFsck := erofs.HasFsck() && !context.Bool("builtin")
+		if !useFsck {
+			if context.Bool("extract") {
+				return errors.New("--extract requires fsck.erofs")
+			}
+			log.G(ctx).Warn("fsck.erofs not used, only running built-in checks")
+		}
+
+		cs := client.ContentStore()
+		var (
+			results []layerStatus
+			errs    []error
+		)
+		for _, l := range manifest.Layers {
+			if !imagemount.IsErofsLayer(l) {
+				continue
+			}
+			r := layerStatus{Digest: l.Digest, Status: "ok"}
+			if err := checkLayer(ctx, cs, l, useFsck, context.Bool("extract")); err != nil {
+				r.Status, r.Error = "corrupted", err.Error()
+				errs = append(errs, fmt.Errorf("layer %s: %w", l.Digest, err))
+			}
+			results = append(results, r)
+		}
+		if err := printLayerStatus(context.App.Writer, format, results); err != nil {
+			return err
+		}
+		return errors.Join(errs...)
+	},
+}
+
+// layerStatus is the result of checking an EROFS layer.
+type layerStatus struct {
+	Digest digest.Digest `json:"digest"`
+	Status string        `json:"status"`
+	Error  string        `json:"error,omitempty"`
+	// Mismatches are the verity annotations not matching the layer
+	Mismatches []verity.Mismatch `json:"mismatches,omitempty"`
+}
+
+func printLayerStatus(w io.Writer, format string, results []layerStatus) error {
+	if format != "table" {
+		if results == nil {
+			results = []layerStatus{}
+		}
+		return writeOutput(w, format, results)
+	}
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "DIGEST\tSTATUS")
+	for _, r := range results {
+		status := r.Status
+		if r.Error != "" {
+			status += ": " + r.Error
+		}
+		if len(r.Mismatches) > 0 {
+			var ms []string
+			for _, m := range r.Mismatches {
+				ms = append(ms, m.String())
+			}
+			status += ": " + strings.Join(ms, "; ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", r.Digest, status)
+	}
+	return tw.Flush()
+}
+
+func checkLayer(ctx gocontext.Context, cs content.Store, desc ocispec.Descriptor, useFsck, extract bool) error {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	if err := erofs.Check(ra, ra.Size()); err != nil {
+		return err
+	}
+	if !useFsck {
+		return nil
+	}
+
+	f, err := os.CreateTemp("", "erofs-fsck-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, content.NewReader(ra))
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	return erofs.Fsck(ctx, f.Name(), extract)
+}
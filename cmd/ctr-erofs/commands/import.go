@@ -0,0 +1,97 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	"github.com/urfave/cli/v2"
+)
+
+// ImportCommand imports an EROFS file as a single-layer image
+var ImportCommand = &cli.Command{
+	Name:      "import-erofs",
+	Usage:     "import an EROFS file as a single-layer image",
+	ArgsUsage: "[flags] <file> <ref>",
+	Description: `Import an EROFS filesystem image built by mkfs.erofs (or exported with
+'ctr-erofs images export-erofs') as a single-layer image.
+
+Data past the end of the filesystem, such as an appended dm-verity hash tree,
+is not imported.
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+	},
+	Action: func(context *cli.Context) error {
+		file := context.Args().Get(0)
+		ref := context.Args().Get(1)
+		if file == "" || ref == "" {
+			return errors.New("EROFS file and image ref need to be specified")
+		}
+		p, err := platforms.Parse(context.String("platform"))
+		if err != nil {
+			return fmt.Errorf("invalid platform %q: %w", context.String("platform"), err)
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+
+		desc, err := convert.ImportErofs(ctx, client.ContentStore(), f, fi.Size(), p)
+		if err != nil {
+			return fmt.Errorf("failed to import %s: %w", file, err)
+		}
+		desc.Platform = nil
+
+		is := client.ImageService()
+		img := images.Image{Name: ref, Target: desc}
+		if _, err := is.Create(ctx, img); err != nil {
+			if !errdefs.IsAlreadyExists(err) {
+				return err
+			}
+			if _, err := is.Update(ctx, img); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(context.App.Writer, desc.Digest.String())
+		return nil
+	},
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/erofs/erofs-container-toolkit/pkg/erofs"
+	"github.com/erofs/erofs-container-toolkit/pkg/imagemount"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli/v2"
+)
+
+var formatFlag = &cli.StringFlag{
+	Name:    "format",
+	Aliases: []string{"output"},
+	Usage:   "Output format (table, json or yaml)",
+	Value:   "table",
+}
+
+type layerInfo struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+	erofs.Info
+}
+
+// InfoCommand prints the superblock details of the EROFS layers of an image
+var InfoCommand = &cli.Command{
+	Name:      "erofs-info",
+	Usage:     "show EROFS superblock details of the layers of an image",
+	ArgsUsage: "[flags] <ref>",
+	Flags: []cli.Flag{
+		platformFlag,
+		formatFlag,
+	},
+	Action: func(context *cli.Context) error {
+		ref := context.Args().First()
+		if ref == "" {
+			return errors.New("image ref needs to be specified")
+		}
+		format, err := outputFormat(context)
+		if err != nil {
+			return err
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		manifest, err := imageManifest(ctx, context, client, ref)
+		if err != nil {
+			return err
+		}
+		cs := client.ContentStore()
+		var infos []layerInfo
+		for _, l := range manifest.Layers {
+			if !imagemount.IsErofsLayer(l) {
+				continue
+			}
+			ra, err := cs.ReaderAt(ctx, l)
+			if err != nil {
+				return err
+			}
+			sb, err := erofs.ReadSuperBlock(ra)
+			ra.Close()
+			if err != nil {
+				return fmt.Errorf("layer %s: %w", l.Digest, err)
+			}
+			infos = append(infos, layerInfo{Digest: l.Digest, Size: l.Size, Info: sb.Info()})
+		}
+		if len(infos) == 0 {
+			return fmt.Errorf("image %s has no EROFS layer", ref)
+		}
+
+		switch format {
+		case "table":
+			w := tabwriter.NewWriter(context.App.Writer, 1, 8, 1, ' ', 0)
+			fmt.Fprintln(w, "DIGEST\tSIZE\tBLKSZ\tBLOCKS\tINODES\tCOMPRESSION\tFEATURES\tUUID\tBUILT")
+			for _, i := range infos {
+				compression := strings.Join(i.Compression, ",")
+				if compression == "" {
+					compression = "none"
+				}
+				fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n",
+					i.Digest, i.Size, i.BlockSize, i.Blocks, i.Inodes, compression,
+					strings.Join(i.Features, ","), i.UUID, i.BuildTime.Format(time.RFC3339))
+			}
+			return w.Flush()
+		default:
+			return writeOutput(context.App.Writer, format, infos)
+		}
+	},
+}
@@ -0,0 +1,110 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli/v2"
+)
+
+type erofsImage struct {
+	Name   string             `json:"name"`
+	Digest digest.Digest      `json:"digest"`
+	Status string             `json:"status"`
+	Layers convert.LayerCount `json:"layers"`
+}
+
+// WithErofsFilter adds '--erofs' to the ctr images list command, which only
+// lists the images with EROFS layers and flags those mixing them with other
+// layers.
+func WithErofsFilter(cmd *cli.Command) {
+	cmd.Flags = append(cmd.Flags,
+		&cli.BoolFlag{
+			Name:  "erofs",
+			Usage: "Only list images with EROFS layers, flagging images mixing them with other layers",
+		},
+		&cli.BoolFlag{
+			Name:  "mixed",
+			Usage: "With --erofs, only list images mixing EROFS and other layers",
+		},
+		formatFlag,
+	)
+	action := cmd.Action
+	cmd.Action = func(context *cli.Context) error {
+		if !context.Bool("erofs") {
+			return action(context)
+		}
+		return listErofs(context)
+	}
+}
+
+// listErofs lists the images matching the filters given as arguments which
+// have EROFS layers in their manifests available locally.
+func listErofs(context *cli.Context) error {
+	client, ctx, cancel, err := commands.NewClient(context)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	imgs, err := client.ImageService().List(ctx, context.Args().Slice()...)
+	if err != nil {
+		return fmt.Errorf("failed to list images: %w", err)
+	}
+	var listed []erofsImage
+	for _, img := range imgs {
+		count, err := convert.CountLayers(ctx, client.ContentStore(), img.Target)
+		if err != nil {
+			return fmt.Errorf("failed to read the manifests of %s: %w", img.Name, err)
+		}
+		if count.Erofs == 0 || context.Bool("mixed") && !count.Mixed() {
+			continue
+		}
+		status := "erofs"
+		if count.Mixed() {
+			status = "mixed"
+		}
+		listed = append(listed, erofsImage{Name: img.Name, Digest: img.Target.Digest, Status: status, Layers: count})
+	}
+
+	if context.Bool("quiet") {
+		for _, img := range listed {
+			fmt.Fprintln(context.App.Writer, img.Name)
+		}
+		return nil
+	}
+	switch context.String("format") {
+	case "json", "yaml":
+		return writeOutput(context.App.Writer, context.String("format"), listed)
+	case "table":
+		w := tabwriter.NewWriter(context.App.Writer, 1, 8, 1, ' ', 0)
+		fmt.Fprintln(w, "REF\tDIGEST\tSTATUS\tEROFS LAYERS\tOTHER LAYERS\tPLATFORMS")
+		for _, img := range listed {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", img.Name, img.Digest, img.Status,
+				img.Layers.Erofs, img.Layers.Others, strings.Join(img.Layers.Platforms, ","))
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown format %q", context.String("format"))
+	}
+}
@@ -0,0 +1,145 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/erofs/erofs-container-toolkit/pkg/imagemount"
+	"github.com/erofs/erofs-container-toolkit/pkg/layerfs"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli/v2"
+)
+
+type fileEntry struct {
+	Path    string        `json:"path"`
+	Mode    string        `json:"mode"`
+	Size    int64         `json:"size"`
+	UID     uint32        `json:"uid"`
+	GID     uint32        `json:"gid"`
+	ModTime time.Time     `json:"modTime"`
+	Link    string        `json:"link,omitempty"`
+	Layer   digest.Digest `json:"layer"`
+}
+
+// LsFilesCommand lists the merged file tree of an EROFS image
+var LsFilesCommand = &cli.Command{
+	Name:      "ls-files",
+	Usage:     "list the files of an EROFS image without mounting it",
+	ArgsUsage: "[flags] <ref> [<path>]",
+	Description: `List the merged file tree of the EROFS layers of an image, or of a directory
+in it, reading the layers in userspace the way overlayfs stacks them.  Every
+entry shows the layer it comes from, the top-most one with it.
+
+Like 'tar -tvf', but for EROFS-native images.  Layers with compressed files
+can't be read yet.
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+		formatFlag,
+	},
+	Action: func(context *cli.Context) error {
+		ref := context.Args().Get(0)
+		if ref == "" {
+			return errors.New("image ref needs to be specified")
+		}
+		root := strings.TrimPrefix(path.Clean("/"+context.Args().Get(1)), "/")
+		if root == "" {
+			root = "."
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		manifest, err := imageManifest(ctx, context, client, ref)
+		if err != nil {
+			return err
+		}
+		for _, l := range manifest.Layers {
+			if !imagemount.IsErofsLayer(l) {
+				return fmt.Errorf("layer %s of %s isn't an EROFS layer (%s)", l.Digest, ref, l.MediaType)
+			}
+		}
+		fsys, err := layerfs.Open(ctx, client.ContentStore(), manifest.Layers)
+		if err != nil {
+			return err
+		}
+		defer fsys.Close()
+
+		var files []fileEntry
+		err = fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			fi, idx, err := fsys.LstatLayer(p)
+			if err != nil {
+				return err
+			}
+			e := fileEntry{
+				Path:    path.Join("/", p),
+				Mode:    fi.Mode().String(),
+				Size:    fi.Size(),
+				ModTime: fi.ModTime().UTC(),
+				Layer:   manifest.Layers[idx].Digest,
+			}
+			if owner, ok := fi.(interface {
+				UID() uint32
+				GID() uint32
+			}); ok {
+				e.UID, e.GID = owner.UID(), owner.GID()
+			}
+			if fi.Mode()&fs.ModeSymlink != 0 {
+				if e.Link, err = fsys.ReadLink(p); err != nil {
+					return err
+				}
+			}
+			files = append(files, e)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		switch context.String("format") {
+		case "json", "yaml":
+			return writeOutput(context.App.Writer, context.String("format"), files)
+		case "table":
+			w := tabwriter.NewWriter(context.App.Writer, 1, 8, 1, ' ', 0)
+			fmt.Fprintln(w, "MODE\tOWNER\tSIZE\tMODIFIED\tLAYER\tPATH")
+			for _, e := range files {
+				name := e.Path
+				if e.Link != "" {
+					name += " -> " + e.Link
+				}
+				fmt.Fprintf(w, "%s\t%d/%d\t%d\t%s\t%s\t%s\n", e.Mode, e.UID, e.GID, e.Size,
+					e.ModTime.Format(time.DateTime), e.Layer.Encoded()[:12], name)
+			}
+			return w.Flush()
+		default:
+			return fmt.Errorf("unknown format %q", context.String("format"))
+		}
+	},
+}
@@ -0,0 +1,79 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/erofs/erofs-container-toolkit/pkg/imagemount"
+	"github.com/urfave/cli/v2"
+)
+
+var stateDirFlag = &cli.StringFlag{
+	Name:  "state-dir",
+	Usage: "Directory keeping the state of EROFS image mounts",
+	Value: imagemount.DefaultStateRoot,
+}
+
+var blobDirFlag = &cli.StringFlag{
+	Name:  "blob-dir",
+	Usage: "Directory keeping the layer blobs of EROFS image mounts",
+	Value: imagemount.DefaultBlobRoot,
+}
+
+// MountCommand mounts the EROFS layers of an image for inspection
+var MountCommand = &cli.Command{
+	Name:      "mount",
+	Usage:     "mount an EROFS image to a target path (read-only)",
+	ArgsUsage: "[flags] <ref> <target>",
+	Description: `Mount the EROFS-native layers of an image read-only, stacking them with
+overlayfs if there is more than one layer.  The tar layers of images mixing
+them with EROFS layers are converted with mkfs.erofs first.
+
+Use 'ctr-erofs images unmount <target>' to tear the mount down.
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+		stateDirFlag,
+		blobDirFlag,
+	},
+	Action: func(context *cli.Context) error {
+		ref := context.Args().Get(0)
+		target := context.Args().Get(1)
+		if ref == "" || target == "" {
+			return errors.New("image ref and target need to be specified")
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		manifest, err := imageManifest(ctx, context, client, ref)
+		if err != nil {
+			return err
+		}
+		s, err := imagemount.Mount(ctx, client.ContentStore(), ref, manifest.Layers, target, context.String("state-dir"), context.String("blob-dir"))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(context.App.Writer, s.Target)
+		return nil
+	},
+}
@@ -0,0 +1,59 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/urfave/cli/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// outputFormat returns the --format of the command: "table", or "json" or
+// "yaml" for a machine-readable output with a stable schema, the same in JSON
+// and YAML as the YAML is produced from the JSON encoding.
+func outputFormat(context *cli.Context) (string, error) {
+	switch f := context.String("format"); f {
+	case "table", "json", "yaml":
+		return f, nil
+	case "":
+		return "table", nil
+	default:
+		return "", fmt.Errorf("unknown format %q, expected table, json or yaml", f)
+	}
+}
+
+// writeOutput writes v to w as indented JSON or as a YAML document.
+func writeOutput(w io.Writer, format string, v any) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "yaml":
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
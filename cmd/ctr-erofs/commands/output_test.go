@@ -0,0 +1,310 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/erofs/erofs-container-toolkit/pkg/compare"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	"github.com/erofs/erofs-container-toolkit/pkg/erofs"
+	"github.com/erofs/erofs-container-toolkit/pkg/verity"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	testSource = digest.Digest("sha256:1111111111111111111111111111111111111111111111111111111111111111")
+	testErofs  = digest.Digest("sha256:2222222222222222222222222222222222222222222222222222222222222222")
+)
+
+// TestOutputSchemas pins the machine-readable outputs documented as stable.
+func TestOutputSchemas(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		v    any
+		json string
+		yaml string
+	}{
+		{
+			name: "erofs-info",
+			v: []layerInfo{{Digest: testErofs, Size: 4096, Info: erofs.Info{
+				UUID: "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0", BlockSize: 4096, Blocks: 1, Inodes: 2,
+				Features: []string{"sb_csum"}, Compression: []string{"lz4"},
+				BuildTime: time.Date(2024, 5, 1, 10, 12, 41, 0, time.UTC),
+			}}},
+			json: `[
+  {
+    "digest": "sha256:2222222222222222222222222222222222222222222222222222222222222222",
+    "size": 4096,
+    "uuid": "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0",
+    "blockSize": 4096,
+    "blocks": 1,
+    "inodes": 2,
+    "features": [
+      "sb_csum"
+    ],
+    "compression": [
+      "lz4"
+    ],
+    "buildTime": "2024-05-01T10:12:41Z"
+  }
+]
+`,
+			yaml: `- blockSize: 4096
+  blocks: 1
+  buildTime: "2024-05-01T10:12:41Z"
+  compression:
+  - lz4
+  digest: sha256:2222222222222222222222222222222222222222222222222222222222222222
+  features:
+  - sb_csum
+  inodes: 2
+  size: 4096
+  uuid: 0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0
+`,
+		},
+		{
+			name: "fsck",
+			v: []layerStatus{
+				{Digest: testErofs, Status: "ok"},
+				{Digest: testSource, Status: "corrupted", Error: "image truncated"},
+			},
+			json: `[
+  {
+    "digest": "sha256:2222222222222222222222222222222222222222222222222222222222222222",
+    "status": "ok"
+  },
+  {
+    "digest": "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+    "status": "corrupted",
+    "error": "image truncated"
+  }
+]
+`,
+			yaml: `- digest: sha256:2222222222222222222222222222222222222222222222222222222222222222
+  status: ok
+- digest: sha256:1111111111111111111111111111111111111111111111111111111111111111
+  error: image truncated
+  status: corrupted
+`,
+		},
+		{
+			name: "verify",
+			v: []layerStatus{{Digest: testErofs, Status: "mismatch", Mismatches: []verity.Mismatch{
+				{Annotation: "io.github.erofs.verity.root-hash", Expected: "aa", Actual: "bb"},
+			}}},
+			json: `[
+  {
+    "digest": "sha256:2222222222222222222222222222222222222222222222222222222222222222",
+    "status": "mismatch",
+    "mismatches": [
+      {
+        "annotation": "io.github.erofs.verity.root-hash",
+        "expected": "aa",
+        "actual": "bb"
+      }
+    ]
+  }
+]
+`,
+			yaml: `- digest: sha256:2222222222222222222222222222222222222222222222222222222222222222
+  mismatches:
+  - actual: bb
+    annotation: io.github.erofs.verity.root-hash
+    expected: aa
+  status: mismatch
+`,
+		},
+		{
+			name: "du",
+			v: []layerUsage{{
+				Digest: testSource, MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
+				Size: 100, Uncompressed: 300, ErofsSize: 200, Ratio: 0.5,
+				Files: []fileSize{{Path: "usr/bin/sh", Size: 150}},
+			}},
+			json: `[
+  {
+    "digest": "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+    "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
+    "size": 100,
+    "uncompressed": 300,
+    "erofsSize": 200,
+    "ratio": 0.5,
+    "files": [
+      {
+        "path": "usr/bin/sh",
+        "size": 150
+      }
+    ]
+  }
+]
+`,
+			yaml: `- digest: sha256:1111111111111111111111111111111111111111111111111111111111111111
+  erofsSize: 200
+  files:
+  - path: usr/bin/sh
+    size: 150
+  mediaType: application/vnd.oci.image.layer.v1.tar+gzip
+  ratio: 0.5
+  size: 100
+  uncompressed: 300
+`,
+		},
+		{
+			name: "compare",
+			v: compareResult{Files: 3, Differences: []compare.Difference{
+				{Path: "/etc/passwd", Kind: "content"},
+				{Path: "/bin/sh", Kind: "symlink", Source: "busybox", Converted: "dash"},
+			}},
+			json: `{
+  "files": 3,
+  "differences": [
+    {
+      "path": "/etc/passwd",
+      "kind": "content"
+    },
+    {
+      "path": "/bin/sh",
+      "kind": "symlink",
+      "source": "busybox",
+      "converted": "dash"
+    }
+  ]
+}
+`,
+			yaml: `differences:
+- kind: content
+  path: /etc/passwd
+- converted: dash
+  kind: symlink
+  path: /bin/sh
+  source: busybox
+files: 3
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, f := range []struct{ format, expected string }{{"json", tc.json}, {"yaml", tc.yaml}} {
+				var b bytes.Buffer
+				if err := writeOutput(&b, f.format, tc.v); err != nil {
+					t.Fatal(err)
+				}
+				if b.String() != f.expected {
+					t.Errorf("%s output:\n%s\nexpected:\n%s", f.format, b.String(), f.expected)
+				}
+			}
+		})
+	}
+}
+
+// TestConvertOutputSchema pins the events and results of convert, written as
+// JSON lines or YAML documents.
+func TestConvertOutputSchema(t *testing.T) {
+	events := func(format string) string {
+		var b bytes.Buffer
+		o := newMachineOutput(&b, format)
+		o.progress(convert.ProgressEvent{
+			Time:   time.Date(2024, 5, 1, 10, 12, 41, 0, time.UTC),
+			Status: convert.ProgressDone, Source: testSource, SourceSize: 100,
+			Digest: testErofs, Size: 200,
+		})
+		if err := o.write(imageResult{Type: "image", Source: "example.com/foo:orig", Target: "example.com/foo:erofs", Digest: testErofs,
+			Platforms: []platformResult{{Platform: "linux/amd64", Source: testSource, Digest: testErofs}}}); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+	expected := `{"type":"layer","time":"2024-05-01T10:12:41Z","status":"` + string(convert.ProgressDone) + `","source":"sha256:1111111111111111111111111111111111111111111111111111111111111111","sourceSize":100,"digest":"sha256:2222222222222222222222222222222222222222222222222222222222222222","size":200}
+{"type":"image","source":"example.com/foo:orig","target":"example.com/foo:erofs","digest":"sha256:2222222222222222222222222222222222222222222222222222222222222222","platforms":[{"platform":"linux/amd64","source":"sha256:1111111111111111111111111111111111111111111111111111111111111111","digest":"sha256:2222222222222222222222222222222222222222222222222222222222222222"}]}
+`
+	if out := events("json"); out != expected {
+		t.Errorf("json output:\n%s\nexpected:\n%s", out, expected)
+	}
+	expected = `---
+digest: sha256:2222222222222222222222222222222222222222222222222222222222222222
+size: 200
+source: sha256:1111111111111111111111111111111111111111111111111111111111111111
+sourceSize: 100
+status: ` + string(convert.ProgressDone) + `
+time: "2024-05-01T10:12:41Z"
+type: layer
+---
+digest: sha256:2222222222222222222222222222222222222222222222222222222222222222
+platforms:
+- digest: sha256:2222222222222222222222222222222222222222222222222222222222222222
+  platform: linux/amd64
+  source: sha256:1111111111111111111111111111111111111111111111111111111111111111
+source: example.com/foo:orig
+target: example.com/foo:erofs
+type: image
+`
+	if out := events("yaml"); out != expected {
+		t.Errorf("yaml output:\n%s\nexpected:\n%s", out, expected)
+	}
+}
+
+// TestOutputFlag checks that --output is an alias of --format for the
+// commands with a machine-readable output.
+func TestOutputFlag(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		expected string
+		err      bool
+	}{
+		{args: nil, expected: "table"},
+		{args: []string{"--format", "json"}, expected: "json"},
+		{args: []string{"--output", "json"}, expected: "json"},
+		{args: []string{"--output", "yaml"}, expected: "yaml"},
+		{args: []string{"--output", "xml"}, err: true},
+	} {
+		var format string
+		app := &cli.App{
+			Flags: []cli.Flag{formatFlag},
+			Action: func(context *cli.Context) (err error) {
+				format, err = outputFormat(context)
+				return err
+			},
+		}
+		err := app.Run(append([]string{"ctr-erofs"}, tc.args...))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%v: expected an error", tc.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tc.args, err)
+		} else if format != tc.expected {
+			t.Errorf("%v: format %q, expected %q", tc.args, format, tc.expected)
+		}
+	}
+
+	for _, cmd := range []*cli.Command{ConvertCommand, InfoCommand, FsckCommand, DuCommand, VerifyCommand, CompareCommand} {
+		found := false
+		for _, f := range cmd.Flags {
+			for _, name := range f.Names() {
+				found = found || name == "output"
+			}
+		}
+		if !found {
+			t.Errorf("%s has no --output flag", cmd.Name)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/pkg/progress"
+	"github.com/containerd/log"
+	"github.com/containerd/platforms"
+	"github.com/erofs/erofs-container-toolkit/pkg/prefetch"
+	"github.com/opencontainers/image-spec/identity"
+	"github.com/urfave/cli/v2"
+)
+
+// PrefetchCommand warms the page cache with the layers of an image
+var PrefetchCommand = &cli.Command{
+	Name:      "prefetch",
+	Usage:     "warm the host page cache with the EROFS layers of an image",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Read the EROFS layer blobs of an image, as kept by the erofs snapshotter,
+so that they are in the page cache before the first container starts.  The
+image is unpacked first if needed.
+
+With '--list', only the files listed in the given file (one path per line,
+'#' for comments) are read, through a temporary read-only mount of the
+image.  Files missing from the image are skipped.
+
+Requires root privileges.
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+		formatFlag,
+		&cli.StringFlag{
+			Name:  "snapshotter",
+			Usage: "Snapshotter the image is unpacked to",
+			Value: "erofs",
+		},
+		&cli.StringFlag{
+			Name:  "list",
+			Usage: "File listing the paths to prefetch instead of the whole blobs",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		ref := context.Args().First()
+		if ref == "" {
+			return errors.New("image ref needs to be specified")
+		}
+		format, err := outputFormat(context)
+		if err != nil {
+			return err
+		}
+		p, err := platforms.Parse(context.String("platform"))
+		if err != nil {
+			return fmt.Errorf("invalid platform %q: %w", context.String("platform"), err)
+		}
+		var list []string
+		if path := context.String("list"); path != "" {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			list, err = prefetch.ParseList(f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("invalid prefetch list %s: %w", path, err)
+			}
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+
+		i, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		sn := context.String("snapshotter")
+		img := containerd.NewImageWithPlatform(client, i, platforms.OnlyStrict(p))
+		if unpacked, err := img.IsUnpacked(ctx, sn); err != nil {
+			return err
+		} else if !unpacked {
+			if err := img.Unpack(ctx, sn); err != nil {
+				return fmt.Errorf("failed to unpack %s: %w", ref, err)
+			}
+		}
+		diffIDs, err := img.RootFS(ctx)
+		if err != nil {
+			return err
+		}
+
+		key := fmt.Sprintf("erofs-prefetch-%d", time.Now().UnixNano())
+		mounts, err := client.SnapshotService(sn).View(ctx, key, identity.ChainID(diffIDs).String())
+		if err != nil {
+			return fmt.Errorf("failed to create view: %w", err)
+		}
+		defer func() {
+			if err := client.SnapshotService(sn).Remove(ctx, key); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to remove snapshot %s", key)
+			}
+		}()
+
+		var st prefetch.Stats
+		if list == nil {
+			blobs := prefetch.Blobs(mounts)
+			if len(blobs) == 0 {
+				return fmt.Errorf("no EROFS layer blob found for %s with the %s snapshotter", ref, sn)
+			}
+			st, err = prefetch.ReadFiles(ctx, blobs)
+		} else {
+			err = mount.WithTempMount(ctx, mounts, func(root string) error {
+				var err error
+				st, err = prefetch.ReadList(ctx, root, list)
+				return err
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		if format != "table" {
+			return writeOutput(context.App.Writer, format, st)
+		}
+		fmt.Fprintf(context.App.Writer, "prefetched %d files, %s in %s\n",
+			st.Files, progress.Bytes(st.Bytes), st.Duration.Round(time.Millisecond))
+		return nil
+	},
+}
@@ -0,0 +1,171 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/v2/pkg/progress"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+	"sigs.k8s.io/yaml"
+)
+
+// isTerminal checks if w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// machineOutput writes JSON lines, or YAML documents, one per event or
+// result.
+type machineOutput struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+func newMachineOutput(w io.Writer, format string) *machineOutput {
+	return &machineOutput{w: w, format: format}
+}
+
+func (o *machineOutput) write(v any) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.format == "yaml" {
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(o.w, "---\n%s", b)
+		return err
+	}
+	return json.NewEncoder(o.w).Encode(v)
+}
+
+// layerEvent is the output of a layer progress event.
+type layerEvent struct {
+	Type string `json:"type"`
+	convert.ProgressEvent
+}
+
+func (o *machineOutput) progress(ev convert.ProgressEvent) {
+	_ = o.write(layerEvent{Type: "layer", ProgressEvent: ev})
+}
+
+// progressDisplay shows the state of the layer conversions.
+type progressDisplay struct {
+	mu     sync.Mutex
+	layers map[digest.Digest]convert.ProgressEvent
+	order  []digest.Digest
+	start  time.Time
+}
+
+func newProgressDisplay() *progressDisplay {
+	return &progressDisplay{
+		layers: make(map[digest.Digest]convert.ProgressEvent),
+		start:  time.Now(),
+	}
+}
+
+func (p *progressDisplay) update(ev convert.ProgressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.layers[ev.Source]; !ok {
+		p.order = append(p.order, ev.Source)
+	}
+	p.layers[ev.Source] = ev
+}
+
+// lines returns a ProgressFunc printing a line for each layer state change,
+// for non-interactive outputs.
+func (p *progressDisplay) lines(w io.Writer) convert.ProgressFunc {
+	return func(ev convert.ProgressEvent) {
+		p.update(ev)
+		switch ev.Status {
+		case convert.ProgressConverting:
+			return
+		case convert.ProgressFailed:
+			fmt.Fprintf(w, "%s: %s: %s\n", ev.Source, ev.Status, ev.Error)
+		case convert.ProgressDone, convert.ProgressCached:
+			fmt.Fprintf(w, "%s: %s %s (%s)\n", ev.Source, ev.Status, ev.Digest, progress.Bytes(ev.Size))
+		default:
+			fmt.Fprintf(w, "%s: %s\n", ev.Source, ev.Status)
+		}
+	}
+}
+
+// show redraws the state of all layers on w until ctx is done.
+func (p *progressDisplay) show(ctx gocontext.Context, w io.Writer) {
+	var (
+		ticker = time.NewTicker(100 * time.Millisecond)
+		fw     = progress.NewWriter(w)
+	)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+		tw := tabwriter.NewWriter(fw, 1, 8, 1, ' ', 0)
+		p.display(tw)
+		tw.Flush()
+		fw.Flush()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (p *progressDisplay) display(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var total int64
+	for _, dgst := range p.order {
+		ev := p.layers[dgst]
+		total += ev.Offset
+		switch ev.Status {
+		case convert.ProgressStarted, convert.ProgressConverting:
+			var bar progress.Bar
+			if ev.Total > 0 {
+				bar = progress.Bar(float64(ev.Offset) / float64(ev.Total))
+			}
+			fmt.Fprintf(w, "%s:\t%s\t%40r\t%8.8s/%s\t\n",
+				dgst, ev.Status, bar, progress.Bytes(ev.Offset), progress.Bytes(ev.Total))
+		case convert.ProgressFailed:
+			fmt.Fprintf(w, "%s:\t%s\t%40r\t\n", dgst, ev.Status, progress.Bar(0))
+		default:
+			fmt.Fprintf(w, "%s:\t%s\t%40r\t\n", dgst, ev.Status, progress.Bar(1))
+		}
+	}
+	fmt.Fprintf(w, "elapsed: %-4.1fs\ttotal: %7.6v\t(%v)\t\n",
+		time.Since(p.start).Seconds(),
+		progress.Bytes(total),
+		progress.NewBytesPerSecond(total, time.Since(p.start)))
+}
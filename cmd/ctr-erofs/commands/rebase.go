@@ -0,0 +1,149 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+// RebaseCommand moves a converted image onto a new base image
+var RebaseCommand = &cli.Command{
+	Name:      "rebase",
+	Usage:     "move a converted image onto a new base image, reusing its upper layers",
+	ArgsUsage: "[flags] <source_ref> <target_ref>",
+	Description: `Replace the base layers of a converted image, those of '--old-base', with the
+layers of '--new-base' for one platform.  The layers above the base are reused
+as they are, so bumping the base image of an application doesn't require
+converting the application layers again, e.g.:
+
+  ctr-erofs images rebase --old-base example.com/base:1-erofs --new-base example.com/base:2-erofs \
+    example.com/app:1-erofs example.com/app:1-base2-erofs
+
+The layers of the new base are converted to EROFS if they aren't yet.  The
+configuration of the image is kept, with the history of the new base.
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+		&cli.StringFlag{
+			Name:     "old-base",
+			Usage:    "Base image the source image is built on",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "new-base",
+			Usage:    "Base image to move the source image onto",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "erofs-compressors",
+			Usage: "Specify compression algorithm list when converting EROFS layers",
+		},
+		&cli.StringFlag{
+			Name:  "erofs-features",
+			Usage: "Comma-separated EROFS on-disk features to enable (48bit, force-inode-extended, xattr-name-filter)",
+		},
+		&cli.BoolFlag{
+			Name:  "erofs-verity",
+			Usage: "Record the fs-verity digest and dm-verity root hash of EROFS layers in their annotations",
+		},
+		&cli.StringFlag{
+			Name:  "erofs-mkfs-options",
+			Usage: "Extra mkfs options applied when converting EROFS layers. (e.g. '-Efragments,dedupe')",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		srcRef := context.Args().Get(0)
+		targetRef := context.Args().Get(1)
+		if srcRef == "" || targetRef == "" {
+			return errors.New("src and target image need to be specified")
+		}
+		p, err := platforms.Parse(context.String("platform"))
+		if err != nil {
+			return fmt.Errorf("invalid platform %q: %w", context.String("platform"), err)
+		}
+		opts, err := layerOpts(context)
+		if err != nil {
+			return err
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+
+		var descs []ocispec.Descriptor
+		for _, ref := range []string{srcRef, context.String("old-base"), context.String("new-base")} {
+			desc, err := platformManifest(ctx, client, ref, p)
+			if err != nil {
+				return err
+			}
+			descs = append(descs, desc)
+		}
+		newDesc, err := convert.Rebase(ctx, client.ContentStore(), descs[0], descs[1], descs[2], opts...)
+		if err != nil {
+			return fmt.Errorf("failed to rebase %s: %w", srcRef, err)
+		}
+		newDesc.Platform = nil
+
+		is := client.ImageService()
+		newImg := images.Image{Name: targetRef, Target: newDesc}
+		if _, err := is.Create(ctx, newImg); err != nil {
+			if !errdefs.IsAlreadyExists(err) {
+				return err
+			}
+			if _, err := is.Update(ctx, newImg); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(context.App.Writer, newDesc.Digest.String())
+		return nil
+	},
+}
+
+// platformManifest returns the manifest of the image ref for the platform p.
+func platformManifest(ctx gocontext.Context, client *containerd.Client, ref string, p ocispec.Platform) (ocispec.Descriptor, error) {
+	img, err := client.ImageService().Get(ctx, ref)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	src := &imageSource{target: img.Target, provider: client.ContentStore()}
+	manifests, err := src.platformManifests(ctx, platforms.OnlyStrict(p))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if len(manifests) == 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("%s has no manifest for %s: %w", ref, platforms.Format(p), errdefs.ErrNotFound)
+	}
+	return manifests[0], nil
+}
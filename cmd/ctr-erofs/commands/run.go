@@ -0,0 +1,198 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/console"
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/cmd/ctr/commands/tasks"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/pkg/cio"
+	"github.com/containerd/containerd/v2/pkg/oci"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/containerd/platforms"
+	"github.com/erofs/erofs-container-toolkit/pkg/imagemount"
+	"github.com/urfave/cli/v2"
+)
+
+// WithErofsDirect adds '--erofs-direct' to the ctr run command, which runs a
+// container from the EROFS layers of an image mounted directly on the host
+// instead of going through a snapshotter.
+func WithErofsDirect(cmd *cli.Command) {
+	cmd.Flags = append(cmd.Flags,
+		&cli.BoolFlag{
+			Name:  "erofs-direct",
+			Usage: "Run from the EROFS layers loop-mounted on the host, bypassing the snapshotter (for debugging)",
+		},
+		stateDirFlag,
+		blobDirFlag,
+	)
+	action := cmd.Action
+	cmd.Action = func(context *cli.Context) error {
+		if !context.Bool("erofs-direct") {
+			return action(context)
+		}
+		return runDirect(context)
+	}
+}
+
+// runDirect mounts the EROFS layers of the image with imagemount, stacks a
+// writable overlay on top of them as the container rootfs, and runs the
+// container in the foreground.  Everything is removed when it exits.
+func runDirect(context *cli.Context) error {
+	var (
+		ref  = context.Args().Get(0)
+		id   = context.Args().Get(1)
+		args = context.Args().Slice()
+		tty  = context.Bool("tty")
+	)
+	if ref == "" || id == "" {
+		return errors.New("image ref and container id need to be specified")
+	}
+	if context.Bool("detach") {
+		return errors.New("--erofs-direct can't be used with --detach")
+	}
+	platform := context.String("platform")
+	if platform == "" {
+		platform = platforms.DefaultString()
+	}
+	p, err := platforms.Parse(platform)
+	if err != nil {
+		return fmt.Errorf("invalid platform %q: %w", platform, err)
+	}
+
+	client, ctx, cancel, err := commands.NewClient(context)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	i, err := client.ImageService().Get(ctx, ref)
+	if err != nil {
+		return err
+	}
+	cs := client.ContentStore()
+	img := containerd.NewImageWithPlatform(client, i, platforms.OnlyStrict(p))
+	manifest, err := images.Manifest(ctx, cs, i.Target, platforms.OnlyStrict(p))
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "ctr-erofs-run-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	lower := filepath.Join(dir, "lower")
+	s, err := imagemount.Mount(ctx, cs, ref, manifest.Layers, lower, context.String("state-dir"), context.String("blob-dir"))
+	if err != nil {
+		return fmt.Errorf("failed to mount %s: %w", ref, err)
+	}
+	defer func() {
+		if err := imagemount.Unmount(ctx, context.String("state-dir"), s.Target); err != nil {
+			log.G(ctx).WithError(err).Errorf("failed to unmount %s", s.Target)
+		}
+	}()
+	upper, work := filepath.Join(dir, "upper"), filepath.Join(dir, "work")
+	for _, d := range []string{upper, work} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			return err
+		}
+	}
+	rootfs := []mount.Mount{{
+		Type:    "overlay",
+		Source:  "overlay",
+		Options: []string{"lowerdir=" + s.Target, "upperdir=" + upper, "workdir=" + work},
+	}}
+
+	specOpts := []oci.SpecOpts{oci.WithDefaultSpec(), oci.WithDefaultUnixDevices, oci.WithImageConfig(img)}
+	if len(args) > 2 {
+		specOpts = append(specOpts, oci.WithProcessArgs(args[2:]...))
+	}
+	if env := context.StringSlice("env"); len(env) > 0 {
+		specOpts = append(specOpts, oci.WithEnv(env))
+	}
+	if cwd := context.String("cwd"); cwd != "" {
+		specOpts = append(specOpts, oci.WithProcessCwd(cwd))
+	}
+	if tty {
+		specOpts = append(specOpts, oci.WithTTY)
+	}
+	container, err := client.NewContainer(ctx, id,
+		containerd.WithImageName(i.Name),
+		containerd.WithNewSpec(specOpts...),
+	)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := container.Delete(ctx); err != nil {
+			log.G(ctx).WithError(err).Error("failed to clean up container")
+		}
+	}()
+
+	var con console.Console
+	if tty {
+		con = console.Current()
+		defer con.Reset()
+		if err := con.SetRaw(); err != nil {
+			return err
+		}
+	}
+	task, err := tasks.NewTask(ctx, client, container, "", con, context.Bool("null-io"), context.String("log-uri"),
+		[]cio.Opt{cio.WithFIFODir(context.String("fifo-dir"))}, containerd.WithRootFS(rootfs))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := task.Delete(ctx, containerd.WithProcessKill); err != nil && !errdefs.IsNotFound(err) {
+			log.G(ctx).WithError(err).Error("failed to clean up task")
+		}
+	}()
+	statusC, err := task.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if err := task.Start(ctx); err != nil {
+		return err
+	}
+	if tty {
+		if err := tasks.HandleConsoleResize(ctx, task, con); err != nil {
+			log.G(ctx).WithError(err).Error("console resize")
+		}
+	} else {
+		sigc := commands.ForwardAllSignals(ctx, task)
+		defer commands.StopCatch(sigc)
+	}
+	status := <-statusC
+	code, _, err := status.Result()
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return cli.Exit("", int(code))
+	}
+	return nil
+}
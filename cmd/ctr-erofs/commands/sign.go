@@ -0,0 +1,175 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/imagemount"
+	"github.com/erofs/erofs-container-toolkit/pkg/verity"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli/v2"
+)
+
+// VerityPredicateType is the in-toto predicate type of the verity digests
+// attached by 'images sign --verity-predicate'.
+const VerityPredicateType = "https://github.com/erofs/erofs-container-toolkit/verity/v1"
+
+// SignCommand signs a converted image with cosign
+var SignCommand = &cli.Command{
+	Name:      "sign",
+	Usage:     "sign an image with cosign",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Sign the manifest of a pushed image with cosign, either with a key
+('--key') or keyless.  The image is signed by digest, as resolved from the
+local image store.
+
+With '--verity-predicate', the verity digests recorded for its EROFS layers
+(see 'convert --erofs-verity') are also attached as a signed attestation.
+
+Requires the cosign binary, see https://github.com/sigstore/cosign.
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+		&cli.StringFlag{
+			Name:  "key",
+			Usage: "Signing key (path or KMS URI), keyless signing if unset",
+		},
+		&cli.BoolFlag{
+			Name:  "verity-predicate",
+			Usage: "Attach the verity digests of the EROFS layers as a signed attestation",
+		},
+		&cli.StringFlag{
+			Name:  "cosign",
+			Usage: "Path to the cosign binary",
+			Value: "cosign",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		ref := context.Args().First()
+		if ref == "" {
+			return errors.New("image ref needs to be specified")
+		}
+		cosign, err := exec.LookPath(context.String("cosign"))
+		if err != nil {
+			return fmt.Errorf("cosign is required to sign images: %w", err)
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		target := fmt.Sprintf("%s@%s", img.Name, img.Target.Digest)
+
+		// Check the predicate before signing anything
+		var predicate *verityPredicate
+		if context.Bool("verity-predicate") {
+			manifest, err := imageManifest(ctx, context, client, ref)
+			if err != nil {
+				return err
+			}
+			predicate = &verityPredicate{Platform: context.String("platform")}
+			for _, l := range manifest.Layers {
+				if !imagemount.IsErofsLayer(l) {
+					continue
+				}
+				pl := verityLayer{
+					Digest:         l.Digest,
+					FsverityDigest: l.Annotations[verity.AnnotationFsverityDigest],
+					DmVerityRoot:   l.Annotations[verity.AnnotationDmVerityRootHash],
+				}
+				if pl.FsverityDigest == "" && pl.DmVerityRoot == "" {
+					return fmt.Errorf("layer %s has no verity annotations, convert with --erofs-verity", l.Digest)
+				}
+				predicate.Layers = append(predicate.Layers, pl)
+			}
+			if len(predicate.Layers) == 0 {
+				return fmt.Errorf("%s has no EROFS layer for %s", ref, predicate.Platform)
+			}
+		}
+
+		var keyArgs []string
+		if key := context.String("key"); key != "" {
+			keyArgs = append(keyArgs, "--key", key)
+		}
+		if err := runCosign(ctx, cosign, append(append([]string{"sign", "--yes"}, keyArgs...), target)...); err != nil {
+			return err
+		}
+		fmt.Fprintf(context.App.Writer, "signed %s\n", target)
+
+		if predicate == nil {
+			return nil
+		}
+		f, err := os.CreateTemp("", "ctr-erofs-predicate-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		err = json.NewEncoder(f).Encode(predicate)
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		if err != nil {
+			return err
+		}
+		args := append([]string{"attest", "--yes", "--type", VerityPredicateType, "--predicate", f.Name()}, keyArgs...)
+		if err := runCosign(ctx, cosign, append(args, target)...); err != nil {
+			return err
+		}
+		fmt.Fprintf(context.App.Writer, "attached verity predicate to %s\n", target)
+		return nil
+	},
+}
+
+// verityPredicate is the attestation predicate listing the verity digests of
+// the EROFS layers of an image.
+type verityPredicate struct {
+	Platform string        `json:"platform"`
+	Layers   []verityLayer `json:"layers"`
+}
+
+type verityLayer struct {
+	Digest         digest.Digest `json:"digest"`
+	FsverityDigest string        `json:"fsverityDigest,omitempty"`
+	DmVerityRoot   string        `json:"dmVerityRootHash,omitempty"`
+}
+
+func runCosign(ctx gocontext.Context, cosign string, args ...string) error {
+	cmd := exec.CommandContext(ctx, cosign, args...)
+	// cosign may prompt for the key password or keyless login
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	log.G(ctx).Debugf("running %s", cmd.Args)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w", cmd.Args, err)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	gocontext "context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/pkg/cio"
+	"github.com/containerd/containerd/v2/pkg/oci"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/containerd/platforms"
+	"github.com/urfave/cli/v2"
+)
+
+// SmokeTestCommand checks that a converted image runs with the EROFS
+// snapshotter
+var SmokeTestCommand = &cli.Command{
+	Name:      "smoke-test",
+	Usage:     "check that an image starts and exits cleanly with the EROFS snapshotter",
+	ArgsUsage: "[flags] <ref> [<command> [<arg>, ...]]",
+	Description: `Unpack the image with the EROFS snapshotter, run its entrypoint, or the
+given command, in a short-lived container, and check that it exits with status
+0 before '--timeout'.  The output of the container is printed if it fails.
+
+An end-to-end sanity check of a conversion for CI, e.g.:
+
+  ctr-erofs images smoke-test example.com/foo:erofs /bin/true
+
+With '--allow-running', containers still running at the timeout, like servers,
+pass too.  Requires root privileges.
+`,
+	Flags: []cli.Flag{
+		erofsSnapshotterFlag,
+		platformFlag,
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Time the container has to exit",
+			Value: 30 * time.Second,
+		},
+		&cli.BoolFlag{
+			Name:  "allow-running",
+			Usage: "Pass if the container is still running at the timeout, and kill it",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		ref := context.Args().First()
+		if ref == "" {
+			return errors.New("image ref needs to be specified")
+		}
+		p, err := platforms.Parse(context.String("platform"))
+		if err != nil {
+			return fmt.Errorf("invalid platform %q: %w", context.String("platform"), err)
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		i, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		img := containerd.NewImageWithPlatform(client, i, platforms.OnlyStrict(p))
+		sn := context.String("snapshotter")
+		start := time.Now()
+		if err := img.Unpack(ctx, sn); err != nil {
+			return fmt.Errorf("failed to unpack %s with %s: %w", ref, sn, err)
+		}
+		fmt.Fprintf(context.App.Writer, "unpacked with %s in %s\n", sn, time.Since(start).Round(time.Millisecond))
+
+		st := &smokeTest{
+			client:       client,
+			image:        img,
+			snapshotter:  sn,
+			args:         context.Args().Tail(),
+			timeout:      context.Duration("timeout"),
+			allowRunning: context.Bool("allow-running"),
+		}
+		msg, err := st.run(ctx)
+		if err != nil {
+			if out := st.output.String(); out != "" {
+				fmt.Fprintf(context.App.ErrWriter, "container output:\n%s", out)
+			}
+			return err
+		}
+		fmt.Fprintln(context.App.Writer, msg)
+		return nil
+	},
+}
+
+type smokeTest struct {
+	client       *containerd.Client
+	image        containerd.Image
+	snapshotter  string
+	args         []string
+	timeout      time.Duration
+	allowRunning bool
+	output       lockedBuffer
+}
+
+// run runs the container until it exits or the timeout expires, and
+// describes the result.
+func (st *smokeTest) run(ctx gocontext.Context) (string, error) {
+	id := fmt.Sprintf("erofs-smoke-test-%d", time.Now().UnixNano())
+	specOpts := []oci.SpecOpts{oci.WithImageConfig(st.image)}
+	if len(st.args) > 0 {
+		specOpts = append(specOpts, oci.WithProcessArgs(st.args...))
+	}
+	container, err := st.client.NewContainer(ctx, id,
+		containerd.WithImage(st.image),
+		containerd.WithSnapshotter(st.snapshotter),
+		containerd.WithNewSnapshot(id, st.image),
+		containerd.WithNewSpec(specOpts...),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create container: %w", err)
+	}
+	defer func() {
+		if err := container.Delete(ctx, containerd.WithSnapshotCleanup); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to delete container %s", id)
+		}
+	}()
+
+	task, err := container.NewTask(ctx, cio.NewCreator(cio.WithStreams(nil, &st.output, &st.output)))
+	if err != nil {
+		return "", fmt.Errorf("failed to create task: %w", err)
+	}
+	defer func() {
+		if _, err := task.Delete(ctx, containerd.WithProcessKill); err != nil && !errdefs.IsNotFound(err) {
+			log.G(ctx).WithError(err).Warnf("failed to delete task %s", id)
+		}
+	}()
+	statusC, err := task.Wait(ctx)
+	if err != nil {
+		return "", err
+	}
+	start := time.Now()
+	if err := task.Start(ctx); err != nil {
+		return "", fmt.Errorf("failed to start container: %w", err)
+	}
+
+	select {
+	case status := <-statusC:
+		code, _, err := status.Result()
+		if err != nil {
+			return "", err
+		}
+		if code != 0 {
+			return "", fmt.Errorf("container exited with status %d", code)
+		}
+		return fmt.Sprintf("container exited cleanly in %s", time.Since(start).Round(time.Millisecond)), nil
+	case <-time.After(st.timeout):
+		if err := task.Kill(ctx, syscall.SIGKILL); err != nil && !errdefs.IsNotFound(err) {
+			log.G(ctx).WithError(err).Warnf("failed to kill container %s", id)
+		}
+		<-statusC
+		if !st.allowRunning {
+			return "", fmt.Errorf("container still running after %s", st.timeout)
+		}
+		return fmt.Sprintf("container still running after %s", st.timeout), nil
+	}
+}
+
+// lockedBuffer is a bytes.Buffer written by concurrent goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,62 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// SnapshotCleanupCommand cleans up the EROFS snapshotter of
+// containerd-erofs-grpc
+var SnapshotCleanupCommand = &cli.Command{
+	Name:  "cleanup",
+	Usage: "reclaim the resources of the removed EROFS snapshots",
+	Description: `Call the Cleanup method of the snapshotter of the containerd-erofs-grpc
+socket, which removes the snapshot directories left without metadata and
+detaches the loop devices of the removed layers.
+
+containerd calls it after its garbage collection, but not through all the
+proxy snapshotters: the socket is called directly.
+`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "erofs-address",
+			Usage: "Address of the containerd-erofs-grpc socket of the snapshotter",
+			Value: defaultErofsAddress,
+		},
+	},
+	Action: func(context *cli.Context) error {
+		ctx, cancel := commands.AppContext(context)
+		defer cancel()
+
+		conn, err := grpc.NewClient("unix://"+context.String("erofs-address"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if _, err := snapshotsapi.NewSnapshotsClient(conn).Cleanup(ctx, &snapshotsapi.CleanupRequest{}); err != nil {
+			return fmt.Errorf("failed to clean up the snapshotter: %w", err)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,236 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/progress"
+	"github.com/containerd/log"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/image-spec/identity"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// labelLayerDigest is the digest of the layer blob of a committed
+	// snapshot of containerd-erofs-grpc
+	labelLayerDigest = "containerd.io/snapshot/erofs.layer-digest"
+	// labelPageCacheDomain is the page cache domain of its layer
+	labelPageCacheDomain = "containerd.io/snapshot/erofs.page-cache-domain"
+)
+
+// SnapshotDuCommand shows the disk usage of EROFS snapshots and images
+var SnapshotDuCommand = &cli.Command{
+	Name:  "du",
+	Usage: "show the disk usage of EROFS snapshots and images",
+	Description: `Show the disk usage of the snapshots of the EROFS snapshotter, telling the
+read-only EROFS layer blobs of committed snapshots apart from the writable
+upper directories of active ones, and the usage of every image unpacked to
+the snapshotter.
+
+Layer blobs are shared by all the images (and containers) based on them: an
+image's unique space is what removing it alone would free, and the summary
+shows the space saved by sharing.
+
+The identical layers mounted in the same page cache domain of
+containerd-erofs-grpc share their page cache: the summary shows the memory
+they save.
+`,
+	Flags: []cli.Flag{
+		erofsSnapshotterFlag,
+		platformFlag,
+		formatFlag,
+	},
+	Action: func(context *cli.Context) error {
+		format, err := outputFormat(context)
+		if err != nil {
+			return err
+		}
+		p, err := platforms.Parse(context.String("platform"))
+		if err != nil {
+			return fmt.Errorf("invalid platform %q: %w", context.String("platform"), err)
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		sn := client.SnapshotService(context.String("snapshotter"))
+		var usage snapshotterUsage
+		idx := map[string]int{}
+		// The identical layers by page cache domain
+		cached := map[[2]string]bool{}
+		err = sn.Walk(ctx, func(ctx gocontext.Context, info snapshots.Info) error {
+			u, err := sn.Usage(ctx, info.Name)
+			if err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to get the usage of snapshot %s", info.Name)
+			}
+			su := snapshotUsage{Key: info.Name, Parent: info.Parent, Kind: info.Kind.String(), Size: u.Size, Inodes: u.Inodes}
+			switch info.Kind {
+			case snapshots.KindCommitted:
+				su.Type = "erofs"
+				usage.Summary.Erofs += u.Size
+				domain, ok := info.Labels[labelPageCacheDomain]
+				if dgst := info.Labels[labelLayerDigest]; ok && dgst != "" {
+					if cached[[2]string{domain, dgst}] {
+						usage.Summary.PageCacheShared += u.Size
+					}
+					cached[[2]string{domain, dgst}] = true
+				}
+			case snapshots.KindActive:
+				su.Type = "upper"
+				usage.Summary.Writable += u.Size
+			}
+			idx[info.Name] = len(usage.Snapshots)
+			usage.Snapshots = append(usage.Snapshots, su)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		imgs, err := client.ImageService().List(ctx)
+		if err != nil {
+			return err
+		}
+		var chains [][]int
+		for _, i := range imgs {
+			diffIDs, err := containerd.NewImageWithPlatform(client, i, platforms.OnlyStrict(p)).RootFS(ctx)
+			if err != nil {
+				log.G(ctx).WithError(err).Debugf("skipping image %s", i.Name)
+				continue
+			}
+			var chain []int
+			for _, id := range identity.ChainIDs(diffIDs) {
+				if n, ok := idx[id.String()]; ok {
+					chain = append(chain, n)
+					usage.Snapshots[n].Images++
+				}
+			}
+			if len(chain) == 0 {
+				continue
+			}
+			usage.Images = append(usage.Images, imageUsage{Name: i.Name, Layers: len(chain)})
+			chains = append(chains, chain)
+		}
+		referenced := map[int]struct{}{}
+		for i, chain := range chains {
+			iu := &usage.Images[i]
+			for _, n := range chain {
+				s := usage.Snapshots[n]
+				iu.Size += s.Size
+				if s.Images == 1 {
+					iu.Unique += s.Size
+				}
+				if _, ok := referenced[n]; !ok {
+					referenced[n] = struct{}{}
+					usage.Summary.Referenced += s.Size
+				}
+			}
+			usage.Summary.ImagesTotal += iu.Size
+		}
+		usage.Summary.Saved = usage.Summary.ImagesTotal - usage.Summary.Referenced
+
+		if format != "table" {
+			return writeOutput(context.App.Writer, format, usage)
+		}
+		return printSnapshotUsage(context.App.Writer, usage)
+	},
+}
+
+type snapshotUsage struct {
+	Key    string `json:"key"`
+	Parent string `json:"parent,omitempty"`
+	Kind   string `json:"kind"`
+	// Type is "erofs" for layer blobs and "upper" for writable directories
+	Type   string `json:"type,omitempty"`
+	Size   int64  `json:"size"`
+	Inodes int64  `json:"inodes"`
+	// Images is the number of images using the snapshot
+	Images int `json:"images"`
+}
+
+type imageUsage struct {
+	Name   string `json:"name"`
+	Layers int    `json:"layers"`
+	Size   int64  `json:"size"`
+	// Unique is the size of the layers used by no other image
+	Unique int64 `json:"unique"`
+}
+
+type usageSummary struct {
+	// Erofs is the size of all the layer blobs
+	Erofs int64 `json:"erofs"`
+	// Writable is the size of all the upper directories
+	Writable int64 `json:"writable"`
+	// Referenced is the size of the layer blobs used by images
+	Referenced int64 `json:"referenced"`
+	// ImagesTotal is the sum of the image sizes, as if nothing was shared
+	ImagesTotal int64 `json:"imagesTotal"`
+	Saved       int64 `json:"saved"`
+	// PageCacheShared is the size of the layers cached once with an
+	// identical layer in their page cache domain, as if fully read
+	PageCacheShared int64 `json:"pageCacheShared"`
+}
+
+type snapshotterUsage struct {
+	Snapshots []snapshotUsage `json:"snapshots"`
+	Images    []imageUsage    `json:"images"`
+	Summary   usageSummary    `json:"summary"`
+}
+
+func printSnapshotUsage(w io.Writer, usage snapshotterUsage) error {
+	slices.SortFunc(usage.Snapshots, func(a, b snapshotUsage) int { return strings.Compare(a.Key, b.Key) })
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tKIND\tTYPE\tSIZE\tINODES\tIMAGES")
+	for _, s := range usage.Snapshots {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\n", s.Key, s.Kind, s.Type, progress.Bytes(s.Size), s.Inodes, s.Images)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tLAYERS\tSIZE\tUNIQUE\tSHARED")
+	for _, i := range usage.Images {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", i.Name, i.Layers,
+			progress.Bytes(i.Size), progress.Bytes(i.Unique), progress.Bytes(i.Size-i.Unique))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	s := usage.Summary
+	fmt.Fprintf(w, "\nread-only EROFS layers: %s (%s used by images)\n", progress.Bytes(s.Erofs), progress.Bytes(s.Referenced))
+	fmt.Fprintf(w, "writable upper directories: %s\n", progress.Bytes(s.Writable))
+	fmt.Fprintf(w, "saved by sharing layers: %s of %s\n", progress.Bytes(s.Saved), progress.Bytes(s.ImagesTotal))
+	if s.PageCacheShared > 0 {
+		fmt.Fprintf(w, "page cache saved by sharing identical layers: up to %s\n", progress.Bytes(s.PageCacheShared))
+	}
+	return nil
+}
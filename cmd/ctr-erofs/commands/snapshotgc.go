@@ -0,0 +1,166 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/containerd/v2/pkg/progress"
+	"github.com/erofs/erofs-container-toolkit/pkg/snapshotgc"
+	"github.com/urfave/cli/v2"
+)
+
+var erofsSnapshotterFlag = &cli.StringFlag{
+	Name:  "snapshotter",
+	Usage: "Name of the EROFS snapshotter in containerd",
+	Value: "erofs",
+}
+
+var snapshotterRootFlag = &cli.StringFlag{
+	Name:  "root",
+	Usage: "Root directory of the EROFS snapshotter",
+	Value: snapshotgc.DefaultRoot,
+}
+
+// SnapshotGCCommand finds and removes orphaned EROFS snapshot directories
+var SnapshotGCCommand = &cli.Command{
+	Name:  "gc",
+	Usage: "list or remove orphaned EROFS snapshot directories",
+	Description: `Cross-reference the EROFS snapshotter root directory with the snapshotter
+metadata and the snapshots known to containerd in all namespaces, and list
+the snapshot directories left behind by crashes:
+
+  untracked     directories without snapshotter metadata
+  unreferenced  snapshots which containerd doesn't know about
+
+Directories modified within '--min-age' are skipped, as they may belong to
+snapshots being created.  With '--delete', the orphaned directories are
+removed, after unmounting their stale mountpoints.
+
+The snapshotter metadata can't be read consistently while the snapshotter is
+running, which locks it: stop it first.
+`,
+	Flags: []cli.Flag{
+		erofsSnapshotterFlag,
+		snapshotterRootFlag,
+		formatFlag,
+		&cli.DurationFlag{
+			Name:  "min-age",
+			Usage: "Minimum age of the orphaned directories",
+			Value: snapshotgc.DefaultMinAge,
+		},
+		&cli.BoolFlag{
+			Name:  "delete",
+			Usage: "Remove the orphaned directories",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		format, err := outputFormat(context)
+		if err != nil {
+			return err
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		known, err := knownSnapshots(ctx, client, context.String("snapshotter"))
+		if err != nil {
+			return err
+		}
+		orphans, err := snapshotgc.Scan(ctx, context.String("root"), known, context.Duration("min-age"))
+		if errors.Is(err, snapshotgc.ErrLocked) {
+			return fmt.Errorf("%w: stop it, or remove its untracked directories with 'ctr-erofs snapshots cleanup'", err)
+		} else if err != nil {
+			return err
+		}
+
+		var errs []error
+		if context.Bool("delete") {
+			for _, o := range orphans {
+				if err := snapshotgc.Remove(ctx, o); err != nil {
+					errs = append(errs, fmt.Errorf("failed to remove %s: %w", o.Path, err))
+				}
+			}
+		}
+		if format != "table" {
+			if err := writeOutput(context.App.Writer, format, orphans); err != nil {
+				return err
+			}
+			return errors.Join(errs...)
+		}
+		w := tabwriter.NewWriter(context.App.Writer, 1, 8, 1, ' ', 0)
+		fmt.Fprintln(w, "ID\tREASON\tSIZE\tMOUNTS\tKEY")
+		var total int64
+		for _, o := range orphans {
+			total += o.Size
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", o.ID, o.Reason, progress.Bytes(o.Size), len(o.Mounts), o.Key)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		verb := "reclaimable"
+		if context.Bool("delete") {
+			verb = "removed"
+		}
+		fmt.Fprintf(context.App.Writer, "%d orphaned directories, %s %s\n", len(orphans), progress.Bytes(total), verb)
+		return errors.Join(errs...)
+	},
+}
+
+// knownSnapshots returns the snapshots of the snapshotter known to
+// containerd in all namespaces, by snapshotter key.  containerd names them
+// "<namespace>/<id>/<name>"; other keys are assumed to be in use.
+func knownSnapshots(ctx gocontext.Context, client *containerd.Client, snapshotter string) (snapshotgc.KnownFunc, error) {
+	nss, err := client.NamespaceService().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]map[string]struct{}{}
+	for _, ns := range nss {
+		names[ns] = map[string]struct{}{}
+		nctx := namespaces.WithNamespace(ctx, ns)
+		err := client.SnapshotService(snapshotter).Walk(nctx, func(_ gocontext.Context, info snapshots.Info) error {
+			names[ns][info.Name] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the snapshots of namespace %s: %w", ns, err)
+		}
+	}
+	return func(key string) bool {
+		parts := strings.SplitN(key, "/", 3)
+		if len(parts) != 3 {
+			return true
+		}
+		ns, ok := names[parts[0]]
+		if !ok {
+			return false
+		}
+		_, ok = ns[parts[2]]
+		return ok
+	}, nil
+}
@@ -0,0 +1,154 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	"github.com/urfave/cli/v2"
+)
+
+// SquashCommand squashes a range of layers into one EROFS layer
+var SquashCommand = &cli.Command{
+	Name:      "squash",
+	Usage:     "convert an image to EROFS, squashing a range of its layers into one",
+	ArgsUsage: "[flags] <source_ref> <target_ref>",
+	Description: `Convert an image to EROFS for one platform, squashing the layers from
+'--from' (0 being the bottom layer) up to, but not including, '--to' into a
+single EROFS layer.  The other layers are converted one by one, so that base
+layers are still shared with other images converted from the same base.
+
+'--base' squashes everything above the given base image instead, e.g.:
+
+  ctr-erofs images squash --base example.com/base:1 example.com/foo:orig example.com/foo:squashed
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+		&cli.IntFlag{
+			Name:  "from",
+			Usage: "Index of the first squashed layer",
+		},
+		&cli.IntFlag{
+			Name:  "to",
+			Usage: "Index of the layer after the last squashed one (0 for all the layers)",
+		},
+		&cli.StringFlag{
+			Name:  "base",
+			Usage: "Squash the layers above this base image",
+		},
+		&cli.StringFlag{
+			Name:  "erofs-compressors",
+			Usage: "Specify compression algorithm list when converting EROFS layers",
+		},
+		&cli.StringFlag{
+			Name:  "erofs-features",
+			Usage: "Comma-separated EROFS on-disk features to enable (48bit, force-inode-extended, xattr-name-filter)",
+		},
+		&cli.BoolFlag{
+			Name:  "erofs-verity",
+			Usage: "Record the fs-verity digest and dm-verity root hash of EROFS layers in their annotations",
+		},
+		&cli.StringFlag{
+			Name:  "erofs-mkfs-options",
+			Usage: "Extra mkfs options applied when converting EROFS layers. (e.g. '-Efragments,dedupe')",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		srcRef := context.Args().Get(0)
+		targetRef := context.Args().Get(1)
+		if srcRef == "" || targetRef == "" {
+			return errors.New("src and target image need to be specified")
+		}
+		if context.IsSet("base") && context.IsSet("from") {
+			return errors.New("--base and --from can't be used together")
+		}
+		p, err := platforms.Parse(context.String("platform"))
+		if err != nil {
+			return fmt.Errorf("invalid platform %q: %w", context.String("platform"), err)
+		}
+		opts, err := layerOpts(context)
+		if err != nil {
+			return err
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+
+		cs := client.ContentStore()
+		desc, err := platformManifest(ctx, client, srcRef, p)
+		if err != nil {
+			return err
+		}
+		manifest, err := images.Manifest(ctx, cs, desc, nil)
+		if err != nil {
+			return err
+		}
+
+		from, to := context.Int("from"), context.Int("to")
+		if base := context.String("base"); base != "" {
+			baseManifest, err := imageManifest(ctx, context, client, base)
+			if err != nil {
+				return err
+			}
+			from = len(baseManifest.Layers)
+			if from > len(manifest.Layers) {
+				return fmt.Errorf("%s is not based on %s", srcRef, base)
+			}
+			for i, l := range baseManifest.Layers {
+				if manifest.Layers[i].Digest != l.Digest {
+					return fmt.Errorf("%s is not based on %s: layer %d differs", srcRef, base, i)
+				}
+			}
+		}
+		if to == 0 {
+			to = len(manifest.Layers)
+		}
+
+		newDesc, err := convert.SquashLayers(ctx, cs, desc, from, to, opts...)
+		if err != nil {
+			return err
+		}
+		newDesc.Platform = nil
+
+		is := client.ImageService()
+		newImg := images.Image{Name: targetRef, Target: newDesc}
+		if _, err := is.Create(ctx, newImg); err != nil {
+			if !errdefs.IsAlreadyExists(err) {
+				return err
+			}
+			if _, err := is.Update(ctx, newImg); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(context.App.Writer, newDesc.Digest.String())
+		return nil
+	},
+}
@@ -0,0 +1,73 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+
+	"github.com/erofs/erofs-container-toolkit/pkg/imagemount"
+	"github.com/urfave/cli/v2"
+)
+
+// UnmountCommand tears down mounts created by MountCommand
+var UnmountCommand = &cli.Command{
+	Name:      "unmount",
+	Usage:     "unmount an EROFS image from a target path",
+	ArgsUsage: "[flags] <target>",
+	Description: `Unmount an image mounted by 'ctr-erofs images mount', and release the loop
+devices attached for its layers.  Partially set up mounts are cleaned up as
+well, and the command can be retried if anything fails.
+`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "all",
+			Usage: "Unmount all images mounted by ctr-erofs",
+		},
+		stateDirFlag,
+	},
+	Action: func(context *cli.Context) error {
+		ctx := gocontext.Background()
+		root := context.String("state-dir")
+		if context.Bool("all") {
+			states, err := imagemount.List(root)
+			if err != nil {
+				return err
+			}
+			var errs []error
+			for _, s := range states {
+				if err := imagemount.Unmount(ctx, root, s.Target); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", s.Target, err))
+					continue
+				}
+				fmt.Fprintln(context.App.Writer, s.Target)
+			}
+			return errors.Join(errs...)
+		}
+
+		target := context.Args().First()
+		if target == "" {
+			return errors.New("target path needs to be specified")
+		}
+		if err := imagemount.Unmount(ctx, root, target); err != nil {
+			return err
+		}
+		fmt.Fprintln(context.App.Writer, target)
+		return nil
+	},
+}
@@ -0,0 +1,48 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"fmt"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+var platformFlag = &cli.StringFlag{
+	Name:  "platform",
+	Usage: "Use the image for the specified platform",
+	Value: platforms.DefaultString(),
+}
+
+// imageManifest returns the manifest of ref for the platform given by
+// --platform.
+func imageManifest(ctx gocontext.Context, context *cli.Context, client *containerd.Client, ref string) (ocispec.Manifest, error) {
+	p, err := platforms.Parse(context.String("platform"))
+	if err != nil {
+		return ocispec.Manifest{}, fmt.Errorf("invalid platform %q: %w", context.String("platform"), err)
+	}
+	img, err := client.ImageService().Get(ctx, ref)
+	if err != nil {
+		return ocispec.Manifest{}, err
+	}
+	return images.Manifest(ctx, client.ContentStore(), img.Target, platforms.Only(p))
+}
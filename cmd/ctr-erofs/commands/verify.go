@@ -0,0 +1,102 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/erofs/erofs-container-toolkit/pkg/imagemount"
+	"github.com/erofs/erofs-container-toolkit/pkg/verity"
+	"github.com/urfave/cli/v2"
+)
+
+// VerifyCommand checks the verity digests recorded in an EROFS image
+var VerifyCommand = &cli.Command{
+	Name:      "verify",
+	Usage:     "verify the verity digests recorded for the EROFS layers of an image",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Recompute the fs-verity digest and dm-verity root hash of every EROFS layer
+blob and compare them with the values recorded in the layer annotations
+(see 'convert --erofs-verity').  Exits non-zero on any mismatch, and for
+layers without verity annotations unless '--allow-unannotated' is given.
+`,
+	Flags: []cli.Flag{
+		platformFlag,
+		formatFlag,
+		&cli.BoolFlag{
+			Name:  "allow-unannotated",
+			Usage: "Don't fail on EROFS layers without verity annotations",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		ref := context.Args().First()
+		if ref == "" {
+			return errors.New("image ref needs to be specified")
+		}
+		format, err := outputFormat(context)
+		if err != nil {
+			return err
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		manifest, err := imageManifest(ctx, context, client, ref)
+		if err != nil {
+			return err
+		}
+		cs := client.ContentStore()
+		var (
+			results []layerStatus
+			errs    []error
+		)
+		for _, l := range manifest.Layers {
+			if !imagemount.IsErofsLayer(l) {
+				continue
+			}
+			ra, err := cs.ReaderAt(ctx, l)
+			if err != nil {
+				return err
+			}
+			mismatches, err := verity.Verify(ra, ra.Size(), l.Annotations)
+			ra.Close()
+			r := layerStatus{Digest: l.Digest, Status: "ok"}
+			switch {
+			case errors.Is(err, verity.ErrNoAnnotation):
+				r.Status = "unannotated"
+				if !context.Bool("allow-unannotated") {
+					errs = append(errs, fmt.Errorf("layer %s: %w", l.Digest, err))
+				}
+			case err != nil:
+				r.Status, r.Error = "failed", err.Error()
+				errs = append(errs, fmt.Errorf("layer %s: %w", l.Digest, err))
+			case len(mismatches) > 0:
+				r.Status, r.Mismatches = "mismatch", mismatches
+				errs = append(errs, fmt.Errorf("layer %s: verity mismatch", l.Digest))
+			}
+			results = append(results, r)
+		}
+		if err := printLayerStatus(context.App.Writer, format, results); err != nil {
+			return err
+		}
+		return errors.Join(errs...)
+	},
+}
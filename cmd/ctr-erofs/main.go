@@ -26,30 +26,24 @@ import (
 )
 
 func main() {
-	customCommands := []*cli.Command{commands.ConvertCommand}
+	customCommands := []*cli.Command{commands.ConvertCommand, commands.MountCommand, commands.UnmountCommand, commands.InfoCommand, commands.FsckCommand, commands.CompareCommand, commands.ExportCommand, commands.ImportCommand, commands.BenchmarkCommand, commands.DuCommand, commands.VerifyCommand, commands.SignCommand, commands.PrefetchCommand, commands.SquashCommand, commands.AttestCommand, commands.DiffCommand, commands.ExtractCommand, commands.LsFilesCommand, commands.BrowseCommand, commands.CheckCommand, commands.FixLabelsCommand, commands.RebaseCommand, commands.SmokeTestCommand, commands.CommitCommand}
 	app := app.New()
+	app.Commands = append(app.Commands, commands.DoctorCommand)
 	for i := range app.Commands {
-		if app.Commands[i].Name == "images" {
-			sc := map[string]*cli.Command{}
-			for _, subcmd := range customCommands {
-				sc[subcmd.Name] = subcmd
-			}
-
-			// First, replace duplicated subcommands
-			for j := range app.Commands[i].Subcommands {
-				for name, subcmd := range sc {
-					if name == app.Commands[i].Subcommands[j].Name {
-						app.Commands[i].Subcommands[j] = subcmd
-						delete(sc, name)
-					}
+		switch app.Commands[i].Name {
+		case "run":
+			commands.WithErofsDirect(app.Commands[i])
+		case "images":
+			addSubcommands(app.Commands[i], customCommands)
+			for _, subcmd := range app.Commands[i].Subcommands {
+				if subcmd.Name == "list" {
+					commands.WithErofsFilter(subcmd)
 				}
 			}
-
-			// Next, append all new sub commands
-			for _, subcmd := range sc {
-				app.Commands[i].Subcommands = append(app.Commands[i].Subcommands, subcmd)
-			}
-			break
+		case "content":
+			addSubcommands(app.Commands[i], []*cli.Command{commands.ContentStatErofsCommand})
+		case "snapshots":
+			addSubcommands(app.Commands[i], []*cli.Command{commands.SnapshotGCCommand, commands.SnapshotDuCommand, commands.SnapshotCleanupCommand})
 		}
 	}
 	if err := app.Run(os.Args); err != nil {
@@ -57,3 +51,27 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// addSubcommands replaces the subcommands of cmd with the same names as
+// subcmds, and appends the others.
+func addSubcommands(cmd *cli.Command, subcmds []*cli.Command) {
+	sc := map[string]*cli.Command{}
+	for _, subcmd := range subcmds {
+		sc[subcmd.Name] = subcmd
+	}
+
+	// First, replace duplicated subcommands
+	for j := range cmd.Subcommands {
+		for name, subcmd := range sc {
+			if name == cmd.Subcommands[j].Name {
+				cmd.Subcommands[j] = subcmd
+				delete(sc, name)
+			}
+		}
+	}
+
+	// Next, append all new sub commands
+	for _, subcmd := range sc {
+		cmd.Subcommands = append(cmd.Subcommands, subcmd)
+	}
+}
@@ -0,0 +1,267 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/plugins/content/local"
+	"github.com/containerd/log"
+	"github.com/containerd/platforms"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+func main() {
+	app := &cli.App{
+		Name:      "erofs-convert",
+		Usage:     "convert an image to EROFS layers from registry to registry",
+		ArgsUsage: "[flags] <source_ref> <target_ref>",
+		Description: `Pull an image from its registry, convert its layers to EROFS native layers
+and push the converted image to the target registry, without containerd.
+
+The blobs are kept in a temporary content store under '--work-dir', which is
+removed at the end.  mkfs.erofs needs to be installed.
+`,
+		Flags: append([]cli.Flag{
+			&cli.BoolFlag{
+				Name:  "debug",
+				Usage: "Enable debug output in logs",
+			},
+			&cli.StringFlag{
+				Name:  "erofs-compressors",
+				Usage: "Specify compression algorithm list when converting EROFS layers",
+			},
+			&cli.StringFlag{
+				Name:  "erofs-features",
+				Usage: "Comma-separated EROFS on-disk features to enable (48bit, force-inode-extended, xattr-name-filter)",
+			},
+			&cli.BoolFlag{
+				Name:  "erofs-verity",
+				Usage: "Record the fs-verity digest and dm-verity root hash of EROFS layers in their annotations",
+			},
+			&cli.StringFlag{
+				Name:  "erofs-mkfs-options",
+				Usage: "Extra mkfs options applied when converting EROFS layers. (e.g. '-Efragments,dedupe')",
+			},
+			&cli.StringSliceFlag{
+				Name:  "annotation",
+				Usage: "Annotations to set on the converted manifests and indexes (key=value)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "layer-annotation",
+				Usage: "Annotations to set on the converted EROFS layer descriptors (key=value)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "platform",
+				Usage: "Convert a specific platform",
+			},
+			&cli.BoolFlag{
+				Name:  "all-platforms",
+				Usage: "Convert all platforms",
+			},
+			&cli.IntFlag{
+				Name:  "platform-parallelism",
+				Usage: "Number of platform manifests converted concurrently",
+				Value: 4,
+			},
+			&cli.StringFlag{
+				Name:  "work-dir",
+				Usage: "Directory of the temporary content store",
+				Value: os.TempDir(),
+			},
+		}, commands.RegistryFlags...),
+		Before: func(context *cli.Context) error {
+			if context.Bool("debug") {
+				return log.SetLevel("debug")
+			}
+			return nil
+		},
+		Action: run,
+	}
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "erofs-convert: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(context *cli.Context) error {
+	src, dst := context.Args().Get(0), context.Args().Get(1)
+	if src == "" || dst == "" {
+		return errors.New("src and target image need to be specified")
+	}
+	platformMC := platforms.DefaultStrict()
+	if context.Bool("all-platforms") {
+		platformMC = platforms.All
+	} else if pss := context.StringSlice("platform"); len(pss) > 0 {
+		var all []ocispec.Platform
+		for _, ps := range pss {
+			p, err := platforms.Parse(ps)
+			if err != nil {
+				return fmt.Errorf("invalid platform %q: %w", ps, err)
+			}
+			all = append(all, p)
+		}
+		platformMC = platforms.Ordered(all...)
+	}
+	features, err := convert.ParseFeatures(context.String("erofs-features"))
+	if err != nil {
+		return err
+	}
+	opts := []convert.Option{
+		convert.WithCompressors(context.String("erofs-compressors")),
+		convert.WithFeatures(features...),
+		convert.WithExtraMkfsOption(context.String("erofs-mkfs-options")),
+		convert.WithPlatformParallelism(max(context.Int("platform-parallelism"), 1)),
+		convert.WithProgress(logProgress),
+	}
+	if context.Bool("erofs-verity") {
+		opts = append(opts, convert.WithVerityAnnotations())
+	}
+	if as := context.StringSlice("annotation"); len(as) > 0 {
+		opts = append(opts, convert.WithManifestAnnotations(convert.AddAnnotations(commands.LabelArgs(as))))
+	}
+	if as := context.StringSlice("layer-annotation"); len(as) > 0 {
+		opts = append(opts, convert.WithLayerAnnotations(commands.LabelArgs(as)))
+	}
+	convertFunc, err := convert.IndexConvertFunc(true, platformMC, opts...)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Context, os.Interrupt)
+	defer cancel()
+
+	dir, err := os.MkdirTemp(context.String("work-dir"), "erofs-convert-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	cs, err := local.NewLabeledStore(filepath.Join(dir, "content"), newLabelStore())
+	if err != nil {
+		return err
+	}
+
+	resolver, err := commands.GetResolver(ctx, context)
+	if err != nil {
+		return err
+	}
+	name, desc, err := resolver.Resolve(ctx, src)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", src, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return err
+	}
+	log.G(ctx).WithField("ref", name).WithField("digest", desc.Digest).Info("pulling source image")
+	handler := images.Handlers(
+		remotes.FetchHandler(cs, fetcher),
+		images.FilterPlatforms(images.ChildrenHandler(cs), platformMC),
+	)
+	if err := images.Dispatch(ctx, handler, nil, desc); err != nil {
+		return fmt.Errorf("failed to pull %s: %w", src, err)
+	}
+
+	newDesc, err := convertFunc(ctx, cs, desc)
+	if err != nil {
+		return fmt.Errorf("failed to convert %s: %w", src, err)
+	}
+	if newDesc == nil {
+		newDesc = &desc
+	}
+
+	pusher, err := resolver.Pusher(ctx, dst)
+	if err != nil {
+		return err
+	}
+	log.G(ctx).WithField("ref", dst).WithField("digest", newDesc.Digest).Info("pushing converted image")
+	if err := remotes.PushContent(ctx, pusher, *newDesc, cs, nil, platformMC, nil); err != nil {
+		return fmt.Errorf("failed to push %s: %w", dst, err)
+	}
+	fmt.Fprintln(context.App.Writer, newDesc.Digest.String())
+	return nil
+}
+
+func logProgress(ev convert.ProgressEvent) {
+	l := log.L.WithField("layer", ev.Source)
+	switch ev.Status {
+	case convert.ProgressDone:
+		l.WithField("digest", ev.Digest).WithField("size", ev.Size).Info("converted layer")
+	case convert.ProgressFailed:
+		l.Errorf("failed to convert layer: %s", ev.Error)
+	case convert.ProgressConverting:
+		l.Debugf("converting layer: %d/%d", ev.Offset, ev.Total)
+	default:
+		l.Debug(string(ev.Status))
+	}
+}
+
+// labelStore keeps the labels of the temporary content store in memory, for
+// the converter to update them.
+type labelStore struct {
+	mu     sync.Mutex
+	labels map[digest.Digest]map[string]string
+}
+
+var _ local.LabelStore = &labelStore{}
+
+func newLabelStore() *labelStore {
+	return &labelStore{labels: map[digest.Digest]map[string]string{}}
+}
+
+func (s *labelStore) Get(dgst digest.Digest) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.labels[dgst]), nil
+}
+
+func (s *labelStore) Set(dgst digest.Digest, labels map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labels[dgst] = maps.Clone(labels)
+	return nil
+}
+
+func (s *labelStore) Update(dgst digest.Digest, update map[string]string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	labels := s.labels[dgst]
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	s.labels[dgst] = labels
+	return maps.Clone(labels), nil
+}
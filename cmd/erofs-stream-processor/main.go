@@ -0,0 +1,155 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	convert "github.com/erofs/erofs-container-toolkit/pkg/converter"
+	"github.com/erofs/erofs-container-toolkit/pkg/erofs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
+)
+
+// mediaTypeEnv is the media type of the stream given to stream processors
+const mediaTypeEnv = "STREAM_PROCESSOR_MEDIATYPE"
+
+// layerTypes are the media types of the layers converted to EROFS.
+var layerTypes = []string{
+	ocispec.MediaTypeImageLayer,
+	ocispec.MediaTypeImageLayerGzip,
+	ocispec.MediaTypeImageLayerZstd,
+	images.MediaTypeDockerSchema2Layer,
+	images.MediaTypeDockerSchema2LayerGzip,
+}
+
+func main() {
+	app := &cli.App{
+		Name:  "erofs-stream-processor",
+		Usage: "convert a tar layer stream to an EROFS layer",
+		Description: `Read a tar layer, uncompressed or compressed with gzip or zstd, on stdin and
+write the EROFS layer converted by mkfs.erofs on stdout, as a stream processor
+of the EROFS differ of containerd-erofs-grpc: the layers are then converted
+when unpacked, e.g. when the kubelet pulls an image.
+
+The 'config' subcommand prints the stream processor configuration to add to
+containerd-erofs-grpc.
+`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "erofs-mkfs-options",
+				Usage: "Extra mkfs options applied when converting EROFS layers. (e.g. '-Efragments,dedupe')",
+			},
+			&cli.StringFlag{
+				Name:  "work-dir",
+				Usage: "Directory of the temporary EROFS layers",
+				Value: os.TempDir(),
+			},
+		},
+		Action: run,
+		Commands: []*cli.Command{
+			{
+				Name:  "config",
+				Usage: "print the stream processor configuration of containerd-erofs-grpc",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "id",
+						Usage: "ID of the stream processor",
+						Value: "io.github.erofs.stream-processor",
+					},
+				},
+				Action: printConfig,
+			},
+		},
+	}
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "erofs-stream-processor: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(context *cli.Context) error {
+	if mt := os.Getenv(mediaTypeEnv); mt != "" && !slices.Contains(layerTypes, mt) {
+		return fmt.Errorf("unsupported media type %s", mt)
+	}
+	ctx, cancel := signal.NotifyContext(context.Context, os.Interrupt, unix.SIGTERM)
+	defer cancel()
+
+	r, err := compression.DecompressStream(os.Stdin)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// mkfs.erofs seeks in its output, which is written out once complete
+	dir, err := os.MkdirTemp(context.String("work-dir"), "erofs-stream-processor-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	layer := filepath.Join(dir, "layer.erofs")
+	if err := erofs.MkfsTar(ctx, layer, r, strings.Fields(context.String("erofs-mkfs-options"))...); err != nil {
+		return err
+	}
+	// Read any trailing data, like the differ
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	f, err := os.Open(layer)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
+
+func printConfig(context *cli.Context) error {
+	if context.Args().Present() {
+		return errors.New("config takes no arguments")
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var args []string
+	if opts := context.String("erofs-mkfs-options"); opts != "" {
+		args = append(args, strconv.Quote("--erofs-mkfs-options="+opts))
+	}
+	accepts := make([]string, 0, len(layerTypes))
+	for _, t := range layerTypes {
+		accepts = append(accepts, strconv.Quote(t))
+	}
+	fmt.Fprintf(context.App.Writer, `[differ.stream_processors.%q]
+  accepts = [%s]
+  returns = %q
+  path = %q
+  args = [%s]
+`, context.String("id"), strings.Join(accepts, ", "), convert.MediaTypeErofsLayer, path, strings.Join(args, ", "))
+	return nil
+}
@@ -0,0 +1,402 @@
+// Package compare checks that a converted image is faithful to its source, by
+// comparing the merged filesystem of the source tar layers with the mounted
+// EROFS image file by file.
+package compare
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+
+	paxXattrPrefix     = "SCHILY.xattr."
+	overlayXattrPrefix = "trusted.overlay."
+)
+
+// Entry is a file of a merged filesystem.
+type Entry struct {
+	Path     string
+	Mode     fs.FileMode
+	UID      int
+	GID      int
+	Size     int64
+	Linkname string
+	// Digest is the digest of the content of regular files
+	Digest digest.Digest
+	Major  uint32
+	Minor  uint32
+	Xattrs map[string]string
+
+	// implicit is set for parent directories missing in the tar layers,
+	// whose metadata is unspecified
+	implicit bool
+	// layer is the index of the layer the entry comes from
+	layer int
+}
+
+// Tree is a merged filesystem, keyed by cleaned path without leading slash.
+type Tree map[string]*Entry
+
+func cleanPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// treeBuilder applies tar layers to a Tree.
+type treeBuilder struct {
+	t     Tree
+	layer int
+	// lower are the sorted names of the entries of the layers below layer,
+	// some of which may have been removed since, so that the whiteouts
+	// remove a range of them rather than scan the tree
+	lower []string
+	// added are the names of the entries added by layer
+	added []string
+}
+
+func (b *treeBuilder) add(e *Entry) {
+	if _, ok := b.t[e.Path]; !ok {
+		b.added = append(b.added, e.Path)
+	}
+	b.t[e.Path] = e
+}
+
+// removeAll removes everything under dir, and dir itself if self, which
+// comes from layers below layer.  The root is "".
+func (b *treeBuilder) removeAll(dir string, layer int, self bool) {
+	remove := func(name string) {
+		if e, ok := b.t[name]; ok && e.layer < layer {
+			delete(b.t, name)
+		}
+	}
+	prefix := dir + "/"
+	under := func(name string) bool {
+		return dir == "" || strings.HasPrefix(name, prefix) || self && name == dir
+	}
+	if dir == "" {
+		for _, name := range b.lower {
+			remove(name)
+		}
+	} else {
+		if i, ok := slices.BinarySearch(b.lower, dir); ok && self {
+			remove(b.lower[i])
+		}
+		i, _ := slices.BinarySearch(b.lower, prefix)
+		for ; i < len(b.lower) && strings.HasPrefix(b.lower[i], prefix); i++ {
+			remove(b.lower[i])
+		}
+	}
+	// The entries of the current layer only go with a directory it replaces
+	if layer > b.layer {
+		for _, name := range b.added {
+			if under(name) {
+				remove(name)
+			}
+		}
+	}
+}
+
+func (b *treeBuilder) addParents(p string) {
+	for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if _, ok := b.t[dir]; ok {
+			return
+		}
+		b.add(&Entry{Path: dir, Mode: fs.ModeDir, implicit: true, layer: b.layer})
+	}
+}
+
+// next merges the names added by the current layer into the sorted names of
+// the lower layers, before applying the next one.
+func (b *treeBuilder) next() {
+	names := make([]string, 0, len(b.lower)+len(b.added))
+	for _, n := range [][]string{b.lower, b.added} {
+		for _, name := range n {
+			if _, ok := b.t[name]; ok {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+	b.lower, b.added = slices.Compact(names), nil
+	b.layer++
+}
+
+// FromLayers builds the merged filesystem of tar layers, ordered from the
+// bottom to the top layer, applying OCI whiteouts.
+func FromLayers(ctx context.Context, provider content.Provider, layers []ocispec.Descriptor) (Tree, error) {
+	b := &treeBuilder{t: Tree{}}
+	for _, desc := range layers {
+		if err := b.applyLayer(ctx, provider, desc); err != nil {
+			return nil, fmt.Errorf("failed to read layer %s: %w", desc.Digest, err)
+		}
+		b.next()
+	}
+	return b.t, nil
+}
+
+func (b *treeBuilder) applyLayer(ctx context.Context, provider content.Provider, desc ocispec.Descriptor) error {
+	ra, err := provider.ReaderAt(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	ds, err := compression.DecompressStream(content.NewReader(ra))
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+
+	tr := tar.NewReader(ds)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanPath(hdr.Name)
+		if name == "" {
+			continue
+		}
+		dir, base := path.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+		switch {
+		case base == whiteoutOpaque:
+			b.removeAll(dir, b.layer, false)
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			b.removeAll(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), b.layer, true)
+			continue
+		}
+
+		var e *Entry
+		if hdr.Typeflag == tar.TypeLink {
+			target, ok := b.t[cleanPath(hdr.Linkname)]
+			if !ok {
+				return fmt.Errorf("hardlink %s to missing file %s", name, hdr.Linkname)
+			}
+			le := *target
+			e = &le
+		} else {
+			e = &Entry{
+				Mode:     hdr.FileInfo().Mode(),
+				UID:      hdr.Uid,
+				GID:      hdr.Gid,
+				Linkname: hdr.Linkname,
+				Major:    uint32(hdr.Devmajor),
+				Minor:    uint32(hdr.Devminor),
+			}
+			for k, v := range hdr.PAXRecords {
+				if strings.HasPrefix(k, paxXattrPrefix) {
+					if e.Xattrs == nil {
+						e.Xattrs = make(map[string]string)
+					}
+					e.Xattrs[strings.TrimPrefix(k, paxXattrPrefix)] = v
+				}
+			}
+			if e.Mode.IsRegular() {
+				h := sha256.New()
+				if e.Size, err = io.Copy(h, tr); err != nil {
+					return err
+				}
+				e.Digest = digest.NewDigest(digest.SHA256, h)
+			}
+		}
+		e.Path = name
+		e.layer = b.layer
+		if old, ok := b.t[name]; ok && old.Mode.IsDir() && !e.Mode.IsDir() {
+			b.removeAll(name, b.layer+1, true)
+		}
+		b.add(e)
+		b.addParents(name)
+	}
+}
+
+// FromDir builds the tree of a mounted filesystem.  Overlay whiteouts and
+// xattrs are ignored since they only matter to the mount itself.
+func FromDir(root string) (Tree, error) {
+	t := Tree{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name := cleanPath(filepath.ToSlash(rel))
+		if name == "" {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st, ok := fi.Sys().(*unix.Stat_t)
+		if !ok {
+			return fmt.Errorf("unsupported file info for %s", p)
+		}
+		e := &Entry{
+			Path:  name,
+			Mode:  fi.Mode(),
+			UID:   int(st.Uid),
+			GID:   int(st.Gid),
+			Major: unix.Major(uint64(st.Rdev)),
+			Minor: unix.Minor(uint64(st.Rdev)),
+		}
+		if e.Mode&fs.ModeCharDevice != 0 && st.Rdev == 0 {
+			// overlayfs whiteout of a single-layer image
+			return nil
+		}
+		switch {
+		case e.Mode.IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			h := sha256.New()
+			e.Size, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			e.Digest = digest.NewDigest(digest.SHA256, h)
+		case e.Mode&fs.ModeSymlink != 0:
+			if e.Linkname, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		if e.Xattrs, err = readXattrs(p); err != nil {
+			return fmt.Errorf("failed to read xattrs of %s: %w", p, err)
+		}
+		t[name] = e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func readXattrs(p string) (map[string]string, error) {
+	size, err := unix.Llistxattr(p, nil)
+	if err != nil || size == 0 {
+		if err == unix.ENOTSUP {
+			err = nil
+		}
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(p, buf); err != nil {
+		return nil, err
+	}
+	var xattrs map[string]string
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" || strings.HasPrefix(name, overlayXattrPrefix) {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(p, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		val := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(p, name, val); err != nil {
+			return nil, err
+		}
+		if xattrs == nil {
+			xattrs = make(map[string]string)
+		}
+		xattrs[name] = string(val[:vsize])
+	}
+	return xattrs, nil
+}
+
+// Difference is a mismatch between the source and converted filesystems.
+type Difference struct {
+	Path string `json:"path"`
+	// Kind is what differs: missing, extra, type, mode, owner, content,
+	// symlink, device or xattrs
+	Kind      string `json:"kind"`
+	Source    string `json:"source,omitempty"`
+	Converted string `json:"converted,omitempty"`
+}
+
+// Compare returns the differences between the source and converted trees,
+// sorted by path.
+func Compare(source, converted Tree) []Difference {
+	var diffs []Difference
+	add := func(p, kind string, s, c any) {
+		diffs = append(diffs, Difference{Path: p, Kind: kind, Source: fmt.Sprint(s), Converted: fmt.Sprint(c)})
+	}
+	for p, s := range source {
+		c, ok := converted[p]
+		if !ok {
+			diffs = append(diffs, Difference{Path: p, Kind: "missing"})
+			continue
+		}
+		if s.Mode.Type() != c.Mode.Type() {
+			add(p, "type", s.Mode.Type(), c.Mode.Type())
+			continue
+		}
+		if s.implicit {
+			continue
+		}
+		if s.Mode != c.Mode && s.Mode&fs.ModeSymlink == 0 {
+			add(p, "mode", s.Mode, c.Mode)
+		}
+		if s.UID != c.UID || s.GID != c.GID {
+			add(p, "owner", fmt.Sprintf("%d:%d", s.UID, s.GID), fmt.Sprintf("%d:%d", c.UID, c.GID))
+		}
+		if s.Digest != c.Digest || s.Size != c.Size {
+			add(p, "content", s.Digest, c.Digest)
+		}
+		if s.Linkname != c.Linkname {
+			add(p, "symlink", s.Linkname, c.Linkname)
+		}
+		if s.Mode&fs.ModeDevice != 0 && (s.Major != c.Major || s.Minor != c.Minor) {
+			add(p, "device", fmt.Sprintf("%d:%d", s.Major, s.Minor), fmt.Sprintf("%d:%d", c.Major, c.Minor))
+		}
+		if !maps.Equal(s.Xattrs, c.Xattrs) {
+			add(p, "xattrs", formatXattrs(s.Xattrs), formatXattrs(c.Xattrs))
+		}
+	}
+	for p := range converted {
+		if _, ok := source[p]; !ok {
+			diffs = append(diffs, Difference{Path: p, Kind: "extra"})
+		}
+	}
+	slices.SortFunc(diffs, func(a, b Difference) int {
+		if c := strings.Compare(a.Path, b.Path); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Kind, b.Kind)
+	})
+	return diffs
+}
+
+func formatXattrs(xattrs map[string]string) string {
+	keys := slices.Sorted(maps.Keys(xattrs))
+	for i, k := range keys {
+		keys[i] = fmt.Sprintf("%s=%q", k, xattrs[k])
+	}
+	return strings.Join(keys, ",")
+}
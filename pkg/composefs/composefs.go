@@ -0,0 +1,129 @@
+// Package composefs mounts a stack of EROFS layers the way composefs does: the
+// merged tree of the layers in an EROFS metadata image whose regular files
+// redirect to their data, which stays in the layers.
+//
+// The metadata image is mounted as the lower layer of an overlay, with the
+// layers as its data-only lower layers, which requires Linux 6.5 or later and
+// the overlayfs metacopy feature.
+package composefs
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/erofs/erofs-container-toolkit/pkg/layerfs"
+	"github.com/erofs/go-erofs"
+)
+
+const (
+	// redirectXattr and metacopyXattr make a regular file of a lower layer
+	// read its data from the file of the data-only layers redirected to
+	redirectXattr = "trusted.overlay.redirect"
+	metacopyXattr = "trusted.overlay.metacopy"
+)
+
+// MountOptions returns the overlayfs options of the lower layers of the
+// metadata image mounted on mountpoint, with the mountpoints of its layers
+// dirs, from the top one.
+func MountOptions(mountpoint string, dirs []string) []string {
+	return []string{"lowerdir=" + mountpoint + "::" + strings.Join(dirs, "::"), "metacopy=on"}
+}
+
+// Build writes the metadata image of the merged tree of layers, ordered from
+// the bottom, at image.  The regular files redirect to the same path: the
+// data-only layers are looked up from the top one, and the first which has
+// the file is the one it comes from, as the layers above have no entry there.
+func Build(image string, layers []fs.FS) error {
+	tree := layerfs.New(layers...)
+	meta := metaFS{FS: tree, redirects: map[string]string{}}
+	err := fs.WalkDir(tree, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil || fi.Size() == 0 {
+			return err
+		}
+		meta.redirects[name] = "/" + name
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk the layers: %w", err)
+	}
+
+	f, err := os.Create(image)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := erofs.Create(f)
+	if err := w.CopyFrom(meta, erofs.MetadataOnly()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// metaFS is the merged tree of the layers with the regular files redirected
+// to their data, without it.
+type metaFS struct {
+	*layerfs.FS
+	// redirects are the data of the regular files by name
+	redirects map[string]string
+}
+
+func (m metaFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := m.FS.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		if r, ok := m.redirects[path.Join(name, e.Name())]; ok {
+			entries[i] = metaEntry{e, r}
+		}
+	}
+	return entries, nil
+}
+
+type metaEntry struct {
+	fs.DirEntry
+	redirect string
+}
+
+func (e metaEntry) Info() (fs.FileInfo, error) {
+	fi, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return metaInfo{fi, e.redirect}, nil
+}
+
+// metaInfo is the info of a regular file with the overlayfs xattrs of its
+// redirect.
+type metaInfo struct {
+	fs.FileInfo
+	redirect string
+}
+
+func (fi metaInfo) Sys() any {
+	st := &erofs.Stat{Mode: fi.Mode(), Size: fi.Size()}
+	if s, ok := fi.FileInfo.Sys().(*erofs.Stat); ok {
+		c := *s
+		st = &c
+	}
+	st.Xattrs = maps.Clone(st.Xattrs)
+	if st.Xattrs == nil {
+		st.Xattrs = map[string]string{}
+	}
+	st.Xattrs[redirectXattr] = fi.redirect
+	st.Xattrs[metacopyXattr] = ""
+	// The hard links are separate files of the same data
+	st.Nlink = 1
+	return st
+}
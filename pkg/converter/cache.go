@@ -0,0 +1,98 @@
+package converter
+
+import (
+	"context"
+	"maps"
+	"sync"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayerCache shares converted layers between conversions, e.g. when
+// converting a batch of images with common base layers.  A cache must only
+// be shared by conversions using the same layer options.
+type LayerCache struct {
+	mu      sync.Mutex
+	entries map[digest.Digest]*cacheEntry
+}
+
+type cacheEntry struct {
+	// mu serializes conversions of the same source layer
+	mu   sync.Mutex
+	desc *ocispec.Descriptor
+	// annotations are the annotations added by the conversion
+	annotations map[string]string
+}
+
+// NewLayerCache returns an empty LayerCache.
+func NewLayerCache() *LayerCache {
+	return &LayerCache{entries: make(map[digest.Digest]*cacheEntry)}
+}
+
+// WithLayerCache reuses the layers already converted in cache.
+func WithLayerCache(cache *LayerCache) Option {
+	return func(o *options) error {
+		o.cache = cache
+		return nil
+	}
+}
+
+func (c *LayerCache) entry(dgst digest.Digest) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[dgst]
+	if !ok {
+		e = &cacheEntry{}
+		c.entries[dgst] = e
+	}
+	return e
+}
+
+// get returns the cached conversion of desc if its blob is still in the
+// content store, or calls convert otherwise.  Failures aren't cached.
+func (c *LayerCache) get(ctx context.Context, cs content.Store, desc ocispec.Descriptor, convert func() (*ocispec.Descriptor, error)) (*ocispec.Descriptor, error) {
+	e := c.entry(desc.Digest)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.desc != nil {
+		if _, err := cs.Info(ctx, e.desc.Digest); err == nil {
+			log.G(ctx).Debugf("reusing converted layer %s for %s", e.desc.Digest, desc.Digest)
+			// Keep the annotations of the layer in this manifest
+			newDesc := desc
+			newDesc.MediaType = e.desc.MediaType
+			newDesc.Digest = e.desc.Digest
+			newDesc.Size = e.desc.Size
+			if len(e.annotations) > 0 {
+				newDesc.Annotations = maps.Clone(desc.Annotations)
+				if newDesc.Annotations == nil {
+					newDesc.Annotations = make(map[string]string, len(e.annotations))
+				}
+				maps.Copy(newDesc.Annotations, e.annotations)
+			}
+			return &newDesc, nil
+		}
+		e.desc = nil
+	}
+	newDesc, err := convert()
+	if err != nil {
+		return nil, err
+	}
+	if newDesc != nil {
+		d := *newDesc
+		e.desc = &d
+		e.annotations = nil
+		for k, v := range newDesc.Annotations {
+			if ov, ok := desc.Annotations[k]; !ok || ov != v {
+				if e.annotations == nil {
+					e.annotations = make(map[string]string)
+				}
+				e.annotations[k] = v
+			}
+		}
+	}
+	return newDesc, nil
+}
@@ -0,0 +1,175 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/pkg/labels"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	"github.com/erofs/erofs-container-toolkit/pkg/erofs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// attestationAnnotation marks the attestation manifests of BuildKit images,
+// which aren't runnable images.
+const attestationAnnotation = "vnd.docker.reference.type"
+
+// Problem is an inconsistency found in an image by Check.
+type Problem struct {
+	Manifest digest.Digest `json:"manifest,omitempty"`
+	Platform string        `json:"platform,omitempty"`
+	Digest   digest.Digest `json:"digest,omitempty"`
+	Message  string        `json:"message"`
+}
+
+func (p Problem) String() string {
+	s := p.Manifest.String()
+	if p.Platform != "" {
+		s += " (" + p.Platform + ")"
+	}
+	if p.Digest != "" {
+		s += ": " + p.Digest.String()
+	}
+	return s + ": " + p.Message
+}
+
+// Check validates the image target in cs end-to-end: the manifests available
+// locally and their config and layers must be in the content store, the
+// config diff_ids must match the EROFS and uncompressed layers, and all media
+// types must be known to containerd.  It returns the problems found.
+func Check(ctx context.Context, cs content.Store, target ocispec.Descriptor) ([]Problem, error) {
+	var (
+		problems  []Problem
+		manifests int
+	)
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch {
+		case images.IsIndexType(desc.MediaType):
+			var index ocispec.Index
+			if err := readJSON(ctx, cs, desc, &index); err != nil {
+				return nil, err
+			}
+			var children []ocispec.Descriptor
+			for _, m := range index.Manifests {
+				if _, ok := m.Annotations[attestationAnnotation]; ok || m.ArtifactType != "" {
+					continue
+				}
+				if !images.IsManifestType(m.MediaType) && !images.IsIndexType(m.MediaType) {
+					problems = append(problems, Problem{Manifest: desc.Digest, Digest: m.Digest,
+						Message: fmt.Sprintf("unsupported manifest media type %q", m.MediaType)})
+					continue
+				}
+				// Only some platforms may have been pulled
+				if _, err := cs.Info(ctx, m.Digest); errdefs.IsNotFound(err) {
+					continue
+				} else if err != nil {
+					return nil, err
+				}
+				children = append(children, m)
+			}
+			return children, nil
+		case images.IsManifestType(desc.MediaType):
+			manifests++
+			p, err := checkManifest(ctx, cs, desc)
+			problems = append(problems, p...)
+			return nil, err
+		default:
+			problems = append(problems, Problem{Manifest: desc.Digest,
+				Message: fmt.Sprintf("unsupported media type %q", desc.MediaType)})
+			return nil, nil
+		}
+	})
+	if err := images.Walk(ctx, handler, target); err != nil {
+		return nil, err
+	}
+	if manifests == 0 && len(problems) == 0 {
+		problems = append(problems, Problem{Manifest: target.Digest, Message: "no manifest available locally"})
+	}
+	return problems, nil
+}
+
+func checkManifest(ctx context.Context, cs content.Store, desc ocispec.Descriptor) ([]Problem, error) {
+	var problems []Problem
+	report := func(d digest.Digest, format string, args ...any) {
+		p := Problem{Manifest: desc.Digest, Digest: d, Message: fmt.Sprintf(format, args...)}
+		if desc.Platform != nil {
+			p.Platform = platforms.Format(*desc.Platform)
+		}
+		problems = append(problems, p)
+	}
+
+	var manifest ocispec.Manifest
+	if err := readJSON(ctx, cs, desc, &manifest); err != nil {
+		if errdefs.IsNotFound(err) {
+			report("", "manifest missing from the content store")
+			return problems, nil
+		}
+		return nil, err
+	}
+	if manifest.MediaType != "" && manifest.MediaType != desc.MediaType {
+		report("", "manifest media type %q doesn't match its descriptor (%q)", manifest.MediaType, desc.MediaType)
+	}
+
+	var config ocispec.Image
+	if !images.IsConfigType(manifest.Config.MediaType) {
+		report(manifest.Config.Digest, "unsupported config media type %q", manifest.Config.MediaType)
+	} else if err := readJSON(ctx, cs, manifest.Config, &config); errdefs.IsNotFound(err) {
+		report(manifest.Config.Digest, "config missing from the content store")
+	} else if err != nil {
+		return nil, err
+	} else if config.RootFS.Type != "layers" {
+		report(manifest.Config.Digest, "unsupported rootfs type %q", config.RootFS.Type)
+	} else if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		report(manifest.Config.Digest, "config has %d diff_ids for %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+		config.RootFS.DiffIDs = nil
+	}
+
+	for i, l := range manifest.Layers {
+		erofsLayer := l.MediaType == MediaTypeErofsLayer
+		if !erofsLayer && !images.IsLayerType(l.MediaType) {
+			report(l.Digest, "unsupported layer media type %q", l.MediaType)
+			continue
+		}
+		info, err := cs.Info(ctx, l.Digest)
+		if errdefs.IsNotFound(err) {
+			if !images.IsNonDistributable(l.MediaType) {
+				report(l.Digest, "layer missing from the content store")
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if info.Size != l.Size {
+			report(l.Digest, "layer size %d doesn't match its descriptor (%d)", info.Size, l.Size)
+		}
+
+		// EROFS and uncompressed tar layers are their own diffs
+		diffID := info.Labels[labels.LabelUncompressed]
+		if erofsLayer || l.MediaType == ocispec.MediaTypeImageLayer || l.MediaType == images.MediaTypeDockerSchema2Layer {
+			if diffID != "" && diffID != l.Digest.String() {
+				report(l.Digest, "uncompressed label %s doesn't match the layer digest", diffID)
+			}
+			diffID = l.Digest.String()
+		}
+		if i < len(config.RootFS.DiffIDs) && diffID != "" && config.RootFS.DiffIDs[i].String() != diffID {
+			report(l.Digest, "diff_id %s of layer %d doesn't match the layer (%s)", config.RootFS.DiffIDs[i], i, diffID)
+		}
+
+		if erofsLayer {
+			ra, err := cs.ReaderAt(ctx, l)
+			if err != nil {
+				return nil, err
+			}
+			_, err = erofs.ReadSuperBlock(ra)
+			ra.Close()
+			if err != nil {
+				report(l.Digest, "invalid EROFS layer: %v", err)
+			}
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,67 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/core/content"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AppendLayer adds the EROFS layer on top of the image manifest desc, e.g.
+// the changes of a container, recording history in the image config.  The
+// layers of desc may mix EROFS and tar layers.  It returns the new manifest.
+func AppendLayer(ctx context.Context, cs content.Store, desc, layer ocispec.Descriptor, history ocispec.History) (ocispec.Descriptor, error) {
+	if layer.MediaType != MediaTypeErofsLayer {
+		return ocispec.Descriptor{}, fmt.Errorf("layer %s is not an EROFS layer", layer.Digest)
+	}
+	var manifest ocispec.Manifest
+	if err := readJSON(ctx, cs, desc, &manifest); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to read manifest %s: %w", desc.Digest, err)
+	}
+
+	var config map[string]json.RawMessage
+	if err := readJSON(ctx, cs, manifest.Config, &config); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to read image config: %w", err)
+	}
+	var rootfs ocispec.RootFS
+	if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("invalid image config: %w", err)
+	}
+	if len(rootfs.DiffIDs) != len(manifest.Layers) {
+		return ocispec.Descriptor{}, fmt.Errorf("image config has %d diffIDs for %d layers", len(rootfs.DiffIDs), len(manifest.Layers))
+	}
+	// The diffID of an EROFS layer is its digest
+	rootfs.DiffIDs = append(rootfs.DiffIDs, layer.Digest)
+	if err := setJSON(config, "rootfs", rootfs); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var histories []ocispec.History
+	if h, ok := config["history"]; ok {
+		if err := json.Unmarshal(h, &histories); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("invalid image config history: %w", err)
+		}
+	}
+	if err := setJSON(config, "history", append(histories, history)); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	configDesc, err := writeJSON(ctx, cs, ocispec.MediaTypeImageConfig, config, nil)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	manifest.MediaType = ocispec.MediaTypeImageManifest
+	manifest.Config = configDesc
+	manifest.Layers = append(manifest.Layers, layer)
+	gcLabels := map[string]string{"containerd.io/gc.ref.content.config": configDesc.Digest.String()}
+	for i, l := range manifest.Layers {
+		gcLabels[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", i)] = l.Digest.String()
+	}
+	newDesc, err := writeJSON(ctx, cs, ocispec.MediaTypeImageManifest, manifest, gcLabels)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	newDesc.Platform = desc.Platform
+	return newDesc, nil
+}
@@ -2,12 +2,17 @@ package converter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"maps"
 	"os"
 	"os/exec"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/containerd/containerd/v2/core/content"
 	"github.com/containerd/containerd/v2/core/images"
@@ -16,13 +21,101 @@ import (
 	"github.com/containerd/containerd/v2/pkg/labels"
 	"github.com/containerd/errdefs"
 	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/verity"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
 )
 
+const (
+	// MediaTypeErofsLayer is the media type of EROFS-native layers.
+	MediaTypeErofsLayer = "application/vnd.erofs"
+
+	// AnnotationLayerSkipped is set on layer descriptors which were left
+	// unconverted on purpose, with the reason as its value.
+	AnnotationLayerSkipped = "io.github.erofs.layer.skipped"
+
+	skipReasonNonDistributable = "nondistributable"
+
+	// mkfsWaitDelay is how long mkfs.erofs may keep its output open after
+	// being killed.
+	mkfsWaitDelay = 5 * time.Second
+
+	// TempFilePrefix is the name prefix of the temporary files holding
+	// layers being built.  They're locked (LOCK_SH) while in use.
+	TempFilePrefix = "erofs-layer-"
+	// IngestRefPrefix is the prefix of content store ingest refs used by
+	// the converter.
+	IngestRefPrefix = "convert-erofs-"
+)
+
+// Feature is an EROFS on-disk feature which can be explicitly selected when
+// building layers, instead of passing raw mkfs.erofs options.
+type Feature string
+
+const (
+	// Feature48Bit enables 48-bit block addressing for very large layers
+	// (requires Linux 6.15+ to mount).
+	Feature48Bit Feature = "48bit"
+	// FeatureExtendedInodes forces extended (64-byte) on-disk inodes so that
+	// large uids/gids, nanosecond timestamps and huge files are kept as-is.
+	FeatureExtendedInodes Feature = "force-inode-extended"
+	// FeatureXattrNameFilter records a bloom filter of the xattr names of
+	// each inode, so that the lookups of missing xattrs (e.g.
+	// security.capability) don't read the xattrs (used by Linux 6.6+, ignored
+	// before).  It doesn't change how large or shared xattrs are stored.
+	FeatureXattrNameFilter Feature = "xattr-name-filter"
+)
+
+// conflictingMkfsOpts are the mkfs.erofs extended options undoing a feature,
+// besides its negation ("^feature").
+var conflictingMkfsOpts = map[Feature][]string{
+	FeatureExtendedInodes: {"force-inode-compact"},
+}
+
+var knownFeatures = map[Feature]struct{}{
+	Feature48Bit:           {},
+	FeatureExtendedInodes:  {},
+	FeatureXattrNameFilter: {},
+}
+
+// ParseFeatures parses a comma-separated feature list, e.g.
+// "48bit,force-inode-extended".
+func ParseFeatures(s string) ([]Feature, error) {
+	var features []Feature
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if _, ok := knownFeatures[Feature(f)]; !ok {
+			return nil, fmt.Errorf("unsupported EROFS feature %q: %w", f, errdefs.ErrInvalidArgument)
+		}
+		features = append(features, Feature(f))
+	}
+	return features, nil
+}
+
+// ErrLayerTimeout is the error of layers not converted within the timeout set
+// by WithLayerTimeout.
+var ErrLayerTimeout = errors.New("layer conversion timed out")
+
 type options struct {
 	uuid          string
 	compressors   string
 	extraMkfsOpts string
+	features      []Feature
+	blobLabels    map[string]string
+
+	layerAnnotations    map[string]string
+	manifestAnnotations AnnotationsFunc
+	summary             *Summary
+	mapping             *Mapping
+	cache               *LayerCache
+	progress            ProgressFunc
+	verity              bool
+	platformParallelism int
+	layerTimeout        time.Duration
 }
 
 type Option func(o *options) error
@@ -44,17 +137,132 @@ func WithUUID(uuid string) Option {
 func WithExtraMkfsOption(extraMkfsOpts string) Option {
 	return func(o *options) error {
 		o.extraMkfsOpts = extraMkfsOpts
+		return o.checkFeatures()
+	}
+}
+
+// WithLayerTimeout aborts the conversion of a layer, killing mkfs.erofs, if it
+// takes longer than timeout.  The conversion fails with ErrLayerTimeout.
+func WithLayerTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		o.layerTimeout = timeout
 		return nil
 	}
 }
 
+// WithFeatures selects EROFS on-disk features for the generated layers.
+func WithFeatures(features ...Feature) Option {
+	return func(o *options) error {
+		for _, f := range features {
+			if _, ok := knownFeatures[f]; !ok {
+				return fmt.Errorf("unsupported EROFS feature %q: %w", f, errdefs.ErrInvalidArgument)
+			}
+			if !slices.Contains(o.features, f) {
+				o.features = append(o.features, f)
+			}
+		}
+		return o.checkFeatures()
+	}
+}
+
+// checkFeatures fails if the extra mkfs.erofs options disable one of the
+// selected features, whichever option was given first.
+func (o *options) checkFeatures() error {
+	extended := mkfsExtendedOpts(o.extraMkfsOpts)
+	for _, f := range o.features {
+		for _, e := range append([]string{"^" + string(f)}, conflictingMkfsOpts[f]...) {
+			if slices.Contains(extended, e) {
+				return fmt.Errorf("EROFS feature %q conflicts with mkfs.erofs option -E%s: %w", f, e, errdefs.ErrInvalidArgument)
+			}
+		}
+	}
+	return nil
+}
+
+// mkfsExtendedOpts returns the extended options (-E) in the mkfs.erofs
+// options s, e.g. ["^xattr-name-filter", "force-inode-compact"] for
+// "-E^xattr-name-filter -E force-inode-compact".
+func mkfsExtendedOpts(s string) []string {
+	var extended []string
+	fields := strings.Fields(s)
+	for i, f := range fields {
+		var value string
+		switch {
+		case f == "-E" && i+1 < len(fields):
+			value = fields[i+1]
+		case strings.HasPrefix(f, "-E"):
+			value = f[len("-E"):]
+		default:
+			continue
+		}
+		extended = append(extended, strings.Split(value, ",")...)
+	}
+	return extended
+}
+
+// WithBlobLabels attaches extra content store labels to the generated EROFS
+// blobs, e.g. tenant IDs or GC hints.  "containerd.io/uncompressed" is always
+// set by the converter and cannot be overridden.
+func WithBlobLabels(labelz map[string]string) Option {
+	return func(o *options) error {
+		for k, v := range labelz {
+			if err := labels.Validate(k, v); err != nil {
+				return err
+			}
+			if k == labels.LabelUncompressed {
+				return fmt.Errorf("label %q is reserved: %w", k, errdefs.ErrInvalidArgument)
+			}
+			if o.blobLabels == nil {
+				o.blobLabels = make(map[string]string)
+			}
+			o.blobLabels[k] = v
+		}
+		return nil
+	}
+}
+
+// WithLayerAnnotations sets extra annotations on the descriptors of the
+// generated EROFS layers.  The verity annotations set by the converter take
+// precedence.
+func WithLayerAnnotations(annotations map[string]string) Option {
+	return func(o *options) error {
+		if o.layerAnnotations == nil {
+			o.layerAnnotations = make(map[string]string, len(annotations))
+		}
+		maps.Copy(o.layerAnnotations, annotations)
+		return nil
+	}
+}
+
+// featureMkfsOpts returns the mkfs.erofs arguments for the given features.
+func featureMkfsOpts(features []Feature) []string {
+	if len(features) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(features))
+	for _, f := range features {
+		names = append(names, string(f))
+	}
+	return []string{"-E" + strings.Join(names, ",")}
+}
+
 func convertTarErofs(ctx context.Context, r io.Reader, layerPath string, mkfsExtraOpts []string) error {
 	args := append([]string{"--tar=f", "--aufs", "--quiet"}, mkfsExtraOpts...)
 	args = append(args, layerPath)
 	cmd := exec.CommandContext(ctx, "mkfs.erofs", args...)
 	cmd.Stdin = r
+	// Kill the whole process group of mkfs.erofs when ctx is done, and don't
+	// wait for r forever
+	cmd.SysProcAttr = &unix.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
+	}
+	cmd.WaitDelay = mkfsWaitDelay
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("mkfs.erofs killed: %w", context.Cause(ctx))
+		}
 		return fmt.Errorf("mkfs.erofs %s failed: %s: %w", cmd.Args, out, err)
 	}
 	log.G(ctx).Debugf("running %s %s %v", cmd.Path, cmd.Args, string(out))
@@ -75,6 +283,60 @@ func hasMkfsErofs() bool {
 	return hasMkfs
 }
 
+// WithVerityAnnotations records the fs-verity digest and dm-verity root hash
+// of converted layers in their descriptor annotations.
+func WithVerityAnnotations() Option {
+	return func(o *options) error {
+		o.verity = true
+		return nil
+	}
+}
+
+// withLayerTimeout returns a context for the conversion of the layer dgst,
+// cancelled after the layer timeout if any.
+func (o *options) withLayerTimeout(ctx context.Context, dgst digest.Digest) (context.Context, context.CancelFunc) {
+	if o.layerTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, o.layerTimeout,
+		fmt.Errorf("layer %s not converted after %s: %w", dgst, o.layerTimeout, ErrLayerTimeout))
+}
+
+// mkfsOpts returns the extra mkfs.erofs options of a layer.
+func (o *options) mkfsOpts(sparse bool) []string {
+	var extraopts []string
+
+	if o.uuid != "" {
+		extraopts = append(extraopts, o.uuid)
+	} else {
+		extraopts = append(extraopts, []string{"-U", "fead9a88-fd26-578a-a655-9cbddcb89e76"}...)
+	}
+	if o.compressors != "" {
+		extraopts = append(extraopts, []string{"-z", o.compressors}...)
+		extraopts = append(extraopts, []string{"-C", "65536"}...)
+	} else if sparse {
+		// Zeroed chunks of uncompressed layers are deduplicated
+		extraopts = append(extraopts, fmt.Sprintf("--chunksize=%d", sparseChunkSize))
+	}
+	extraopts = append(extraopts, featureMkfsOpts(o.features)...)
+	if o.extraMkfsOpts != "" {
+		extraopts = append(extraopts, o.extraMkfsOpts)
+	}
+	return extraopts
+}
+
+// skippedLayer returns a copy of desc (keeping its media type and URLs) which
+// records why the layer was not converted.
+func skippedLayer(desc ocispec.Descriptor, reason string) *ocispec.Descriptor {
+	newDesc := desc
+	newDesc.Annotations = make(map[string]string, len(desc.Annotations)+1)
+	for k, v := range desc.Annotations {
+		newDesc.Annotations[k] = v
+	}
+	newDesc.Annotations[AnnotationLayerSkipped] = reason
+	return &newDesc
+}
+
 func LayerConvertFunc(opt ...Option) converter.ConvertFunc {
 	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
 		var opts options
@@ -92,95 +354,226 @@ func LayerConvertFunc(opt ...Option) converter.ConvertFunc {
 			// No conversion. No need to return an error here.
 			return nil, nil
 		}
-		uncompressedDesc := &desc
-		// We need to uncompress the archive first
-		if !uncompress.IsUncompressedType(desc.MediaType) {
-			var err error
-			uncompressedDesc, err = uncompress.LayerConvertFunc(ctx, cs, desc)
-			if err != nil {
-				return nil, err
-			}
-			if uncompressedDesc == nil {
-				return nil, fmt.Errorf("unexpectedly got the same blob after compression (%s, %q)", desc.Digest, desc.MediaType)
-			}
-			log.G(ctx).Debugf("uncompressed %s into %s", desc.Digest, uncompressedDesc.Digest)
+		if images.IsNonDistributable(desc.MediaType) {
+			// Foreign layers are usually absent from the content store and
+			// must be fetched from their URLs, so keep them untouched.
+			log.G(ctx).Debugf("skipping non-distributable layer %s (%q)", desc.Digest, desc.MediaType)
+			opts.report(desc, ProgressEvent{Status: ProgressSkipped})
+			return skippedLayer(desc, skipReasonNonDistributable), nil
 		}
 
-		info, err := cs.Info(ctx, desc.Digest)
-		labelz := info.Labels
-		if labelz == nil {
-			labelz = make(map[string]string)
+		var (
+			newDesc *ocispec.Descriptor
+			err     error
+		)
+		if opts.cache != nil {
+			converted := false
+			newDesc, err = opts.cache.get(ctx, cs, desc, func() (*ocispec.Descriptor, error) {
+				converted = true
+				return convertLayer(ctx, cs, desc, opts)
+			})
+			if err == nil && !converted {
+				opts.report(desc, ProgressEvent{Status: ProgressCached, Digest: newDesc.Digest, Size: newDesc.Size})
+			}
+		} else {
+			newDesc, err = convertLayer(ctx, cs, desc, opts)
 		}
-
-		ra, err := cs.ReaderAt(ctx, *uncompressedDesc)
 		if err != nil {
+			opts.report(desc, ProgressEvent{Status: ProgressFailed, Error: err.Error()})
 			return nil, err
 		}
-		defer ra.Close()
-		sr := io.NewSectionReader(ra, 0, uncompressedDesc.Size)
+		return newDesc, nil
+	}
+}
 
-		blob, err := ioutil.TempFile("", "erofs-layer-")
+// convertLayer converts a tar layer into an EROFS blob in the content store.
+func convertLayer(ctx context.Context, cs content.Store, desc ocispec.Descriptor, opts options) (*ocispec.Descriptor, error) {
+	ctx, cancel := opts.withLayerTimeout(ctx, desc.Digest)
+	defer cancel()
+	uncompressedDesc := &desc
+	// We need to uncompress the archive first
+	if !uncompress.IsUncompressedType(desc.MediaType) {
+		var err error
+		uncompressedDesc, err = uncompress.LayerConvertFunc(ctx, cs, desc)
 		if err != nil {
 			return nil, err
 		}
-		defer os.Remove(blob.Name()) // clean up
-		defer blob.Close()
+		if uncompressedDesc == nil {
+			return nil, fmt.Errorf("unexpectedly got the same blob after compression (%s, %q)", desc.Digest, desc.MediaType)
+		}
+		log.G(ctx).Debugf("uncompressed %s into %s", desc.Digest, uncompressedDesc.Digest)
+	}
 
-		var extraopts []string
+	info, err := cs.Info(ctx, desc.Digest)
+	labelz := info.Labels
+	if labelz == nil {
+		labelz = make(map[string]string)
+	}
 
-		if opts.uuid != "" {
-			extraopts = append(extraopts, opts.uuid)
-		} else {
-			extraopts = append(extraopts, []string{"-U", "fead9a88-fd26-578a-a655-9cbddcb89e76"}...)
-		}
-		if opts.compressors != "" {
-			extraopts = append(extraopts, []string{"-z", opts.compressors}...)
-			extraopts = append(extraopts, []string{"-C", "65536"}...)
-		}
-		if opts.extraMkfsOpts != "" {
-			extraopts = append(extraopts, opts.extraMkfsOpts)
-		}
+	ra, err := cs.ReaderAt(ctx, *uncompressedDesc)
+	if err != nil {
+		return nil, err
+	}
+	defer ra.Close()
+	sr := io.NewSectionReader(ra, 0, uncompressedDesc.Size)
 
-		err = convertTarErofs(ctx, sr, blob.Name(), extraopts)
-		if err != nil {
-			return nil, err
-		}
+	stats, err := scanTar(io.NewSectionReader(ra, 0, uncompressedDesc.Size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", uncompressedDesc.Digest, err)
+	}
+	opts.report(desc, ProgressEvent{Status: ProgressStarted, Total: uncompressedDesc.Size})
+	var tr io.Reader = sr
+	if opts.progress != nil {
+		tr = &progressReader{r: sr, report: func(n int64) {
+			opts.report(desc, ProgressEvent{Status: ProgressConverting, Offset: n, Total: uncompressedDesc.Size})
+		}}
+	}
+	var (
+		pr    *io.PipeReader
+		holes = make(chan int64, 1)
+	)
+	if stats.needsRewrite() {
+		log.G(ctx).Debugf("rewriting %s: %d sparse files, %d/%d hardlinks to fix up",
+			desc.Digest, stats.sparseFiles, stats.linkFixups, stats.hardlinks)
+		var pw *io.PipeWriter
+		pr, pw = io.Pipe()
+		src := tr
+		go func() {
+			n, err := rewriteTar(src, pw)
+			pw.CloseWithError(err)
+			holes <- n
+		}()
+		defer pr.Close()
+		tr = pr
+	}
 
-		ref := fmt.Sprintf("convert-erofs-from-%s", desc.Digest)
-		w, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
+	blob, err := ioutil.TempFile("", TempFilePrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(blob.Name()) // clean up
+	defer blob.Close()
+	// Mark the file as in use so that it won't be reaped as stale
+	if err := unix.Flock(int(blob.Fd()), unix.LOCK_SH); err != nil {
+		return nil, err
+	}
+
+	err = convertTarErofs(ctx, tr, blob.Name(), opts.mkfsOpts(stats.sparseFiles > 0))
+	if err != nil {
+		return nil, err
+	}
+	if stats.sparseFiles > 0 {
+		// mkfs.erofs may not read the end of the archive
+		pr.Close()
+		stats.holeBytes = <-holes
+		log.G(ctx).Debugf("%d hole bytes in the sparse files of %s", stats.holeBytes, desc.Digest)
+		fi, err := blob.Stat()
 		if err != nil {
 			return nil, err
 		}
-		defer w.Close()
+		if err := verifySparse(stats, uncompressedDesc.Size, fi.Size()); err != nil {
+			return nil, fmt.Errorf("failed to convert %s: %w", desc.Digest, err)
+		}
+	}
 
-		// Reset the writing position
-		// Old writer possibly remains without aborted
-		// (e.g. conversion interrupted by a signal)
-		if err := w.Truncate(0); err != nil {
-			return nil, err
+	blobDesc, err := commitBlob(ctx, cs, blob, fmt.Sprintf("%sfrom-%s", IngestRefPrefix, desc.Digest), labelz, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit %s: %w", desc.Digest, err)
+	}
+	n := blobDesc.Size
+
+	if opts.mapping != nil {
+		opts.mapping.add(LayerMapping{
+			SourceDigest: desc.Digest,
+			SourceDiffID: uncompressedDesc.Digest,
+			Digest:       blobDesc.Digest,
+			DiffID:       blobDesc.Digest,
+			Size:         n,
+		})
+	}
+
+	opts.report(desc, ProgressEvent{
+		Status: ProgressDone,
+		Offset: uncompressedDesc.Size,
+		Total:  uncompressedDesc.Size,
+		Digest: blobDesc.Digest,
+		Size:   n,
+	})
+
+	newDesc := desc
+	newDesc.MediaType = blobDesc.MediaType
+	newDesc.Digest = blobDesc.Digest
+	newDesc.Size = n
+	if len(blobDesc.Annotations) > 0 {
+		newDesc.Annotations = maps.Clone(desc.Annotations)
+		if newDesc.Annotations == nil {
+			newDesc.Annotations = make(map[string]string, len(blobDesc.Annotations))
 		}
+		maps.Copy(newDesc.Annotations, blobDesc.Annotations)
+	}
+	return &newDesc, nil
+}
 
-		n, err := io.Copy(w, blob)
+// commitBlob writes the EROFS blob built in the temporary file blob to the
+// content store under the ingest ref, with labelz and the labels given by
+// opts.  The returned descriptor carries the verity annotations if enabled.
+func commitBlob(ctx context.Context, cs content.Store, blob *os.File, ref string, labelz map[string]string, opts options) (ocispec.Descriptor, error) {
+	var verityAnnotations map[string]string
+	if opts.verity {
+		fi, err := blob.Stat()
 		if err != nil {
-			return nil, err
+			return ocispec.Descriptor{}, err
 		}
-		if err := blob.Close(); err != nil {
-			return nil, err
+		if verityAnnotations, err = verity.Annotations(blob, fi.Size()); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to compute verity digests: %w", err)
 		}
+	}
 
-		// update diffID label
-		labelz[labels.LabelUncompressed] = w.Digest().String()
-		if err = w.Commit(ctx, n, "", content.WithLabels(labelz)); err != nil && !errdefs.IsAlreadyExists(err) {
-			return nil, err
-		}
-		if err := w.Close(); err != nil {
-			return nil, err
-		}
+	w, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer w.Close()
+
+	// Reset the writing position
+	// Old writer possibly remains without aborted
+	// (e.g. conversion interrupted by a signal)
+	if err := w.Truncate(0); err != nil {
+		return ocispec.Descriptor{}, err
+	}
 
-		newDesc := desc
-		newDesc.MediaType = "application/vnd.erofs"
-		newDesc.Digest = w.Digest()
-		newDesc.Size = n
-		return &newDesc, nil
+	n, err := io.Copy(w, blob)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := blob.Close(); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	for k, v := range opts.blobLabels {
+		labelz[k] = v
+	}
+	// update diffID label
+	labelz[labels.LabelUncompressed] = w.Digest().String()
+	if err = w.Commit(ctx, n, "", content.WithLabels(labelz)); err != nil && !errdefs.IsAlreadyExists(err) {
+		return ocispec.Descriptor{}, err
+	}
+	if err := w.Close(); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	var annotations map[string]string
+	if len(opts.layerAnnotations) > 0 || len(verityAnnotations) > 0 {
+		annotations = maps.Clone(opts.layerAnnotations)
+		if annotations == nil {
+			annotations = make(map[string]string, len(verityAnnotations))
+		}
+		maps.Copy(annotations, verityAnnotations)
 	}
+	return ocispec.Descriptor{
+		MediaType:   MediaTypeErofsLayer,
+		Digest:      w.Digest(),
+		Size:        n,
+		Annotations: annotations,
+	}, nil
 }
@@ -0,0 +1,75 @@
+package converter
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/containerd/errdefs"
+)
+
+func TestParseFeatures(t *testing.T) {
+	features, err := ParseFeatures(" 48bit, ,xattr-name-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(features, []Feature{Feature48Bit, FeatureXattrNameFilter}) {
+		t.Fatalf("unexpected features %v", features)
+	}
+	for _, s := range []string{"large-xattrs", "^48bit", "48bit,force-inode-compact"} {
+		if _, err := ParseFeatures(s); !errors.Is(err, errdefs.ErrInvalidArgument) {
+			t.Errorf("%q: expected ErrInvalidArgument, got %v", s, err)
+		}
+	}
+}
+
+func TestFeatureCombinations(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		features []Feature
+		mkfsOpts string
+		err      bool
+	}{
+		{name: "features", features: []Feature{Feature48Bit, FeatureExtendedInodes, FeatureXattrNameFilter}},
+		{name: "unrelated mkfs options", features: []Feature{Feature48Bit}, mkfsOpts: "-Eall-fragments -x-1"},
+		{name: "negated", features: []Feature{Feature48Bit}, mkfsOpts: "-E^48bit", err: true},
+		{name: "negated among others", features: []Feature{FeatureXattrNameFilter}, mkfsOpts: "-Eztailpacking,^xattr-name-filter", err: true},
+		{name: "negated separate value", features: []Feature{FeatureXattrNameFilter}, mkfsOpts: "-E ^xattr-name-filter", err: true},
+		{name: "compact inodes", features: []Feature{FeatureExtendedInodes}, mkfsOpts: "-Eforce-inode-compact", err: true},
+		{name: "unknown", features: []Feature{"large-xattrs"}, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The conflicts are found whichever option comes first
+			for _, opts := range [][]Option{
+				{WithFeatures(tc.features...), WithExtraMkfsOption(tc.mkfsOpts)},
+				{WithExtraMkfsOption(tc.mkfsOpts), WithFeatures(tc.features...)},
+			} {
+				var o options
+				var err error
+				for _, opt := range opts {
+					if err = opt(&o); err != nil {
+						break
+					}
+				}
+				if tc.err {
+					if !errors.Is(err, errdefs.ErrInvalidArgument) {
+						t.Fatalf("expected ErrInvalidArgument, got %v", err)
+					}
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestFeatureMkfsOpts(t *testing.T) {
+	var o options
+	if err := WithFeatures(Feature48Bit, FeatureXattrNameFilter, Feature48Bit)(&o); err != nil {
+		t.Fatal(err)
+	}
+	opts := o.mkfsOpts(false)
+	if !slices.Contains(opts, "-E48bit,xattr-name-filter") {
+		t.Fatalf("no extended options for the features in %v", opts)
+	}
+}
@@ -0,0 +1,163 @@
+package converter
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/containerd/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultSampleSize is the default size of the uncompressed prefix of a layer
+// which is converted to estimate its EROFS size.
+const DefaultSampleSize = 16 << 20
+
+// Estimate is the estimated conversion of a layer.
+type Estimate struct {
+	Source ocispec.Descriptor `json:"source"`
+	// Skipped is the reason why the layer would be kept as it is, if any
+	Skipped string `json:"skipped,omitempty"`
+	// UncompressedSize is the size of the source tar stream, extrapolated
+	// from the compression ratio of the sample unless exact
+	UncompressedSize int64 `json:"uncompressedSize,omitempty"`
+	// SampleSize and SampleOutput are the sizes of the converted prefix of
+	// the tar stream and of its EROFS blob
+	SampleSize   int64 `json:"sampleSize,omitempty"`
+	SampleOutput int64 `json:"sampleOutput,omitempty"`
+	// Size is the estimated size of the EROFS blob, which is exact if the
+	// whole layer fitted in the sample
+	Size  int64 `json:"size,omitempty"`
+	Exact bool  `json:"exact,omitempty"`
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// EstimateLayer estimates the size of the EROFS blob that desc would be
+// converted into, by converting the first sampleSize bytes of its tar stream
+// (read from r) with the given options, without writing to any content store.
+// The rest of the layer is not read: its size is extrapolated from the sample.
+func EstimateLayer(ctx context.Context, r io.Reader, desc ocispec.Descriptor, sampleSize int64, opt ...Option) (*Estimate, error) {
+	var opts options
+	for _, o := range opt {
+		if err := o(&opts); err != nil {
+			return nil, err
+		}
+	}
+	est := &Estimate{Source: desc}
+	if !images.IsLayerType(desc.MediaType) {
+		return nil, fmt.Errorf("%s is not a layer (%q): %w", desc.Digest, desc.MediaType, errdefs.ErrInvalidArgument)
+	}
+	if images.IsNonDistributable(desc.MediaType) {
+		est.Skipped = skipReasonNonDistributable
+		return est, nil
+	}
+	if !hasMkfsErofs() {
+		return nil, errdefs.ErrNotImplemented
+	}
+	if sampleSize <= 0 {
+		sampleSize = DefaultSampleSize
+	}
+
+	// The compressed bytes read for the sample, including those the
+	// decompressor buffered ahead
+	compressed := &countingReader{r: r}
+	ds, err := compression.DecompressStream(compressed)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.Close()
+	cr := &countingReader{r: ds}
+
+	blob, err := os.CreateTemp("", TempFilePrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(blob.Name())
+	defer blob.Close()
+	if err := unix.Flock(int(blob.Fd()), unix.LOCK_SH); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		err := convertTarErofs(ctx, pr, blob.Name(), opts.mkfsOpts(false))
+		pr.CloseWithError(err)
+		errCh <- err
+	}()
+
+	lt := linkTracker{}
+	tr := tar.NewReader(cr)
+	tw := tar.NewWriter(pw)
+	est.Exact = true
+	for {
+		if cr.n >= sampleSize {
+			est.Exact = false
+			break
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			<-errCh
+			return nil, err
+		}
+		lt.rewriteHeader(hdr)
+		if err := tw.WriteHeader(hdr); err != nil {
+			pw.CloseWithError(err)
+			<-errCh
+			return nil, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			pw.CloseWithError(err)
+			<-errCh
+			return nil, err
+		}
+	}
+	est.SampleSize = cr.n
+	pw.CloseWithError(tw.Close())
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+
+	// The rest of the layer isn't read: it's assumed to compress like the
+	// sample
+	switch {
+	case est.Exact:
+		est.UncompressedSize = cr.n
+	case ds.GetCompression() == compression.Uncompressed:
+		est.UncompressedSize = desc.Size
+	case compressed.n > 0:
+		est.UncompressedSize = int64(float64(cr.n) * float64(desc.Size) / float64(compressed.n))
+	}
+
+	fi, err := blob.Stat()
+	if err != nil {
+		return nil, err
+	}
+	est.SampleOutput = fi.Size()
+	if est.Exact || est.SampleSize == 0 {
+		est.Size = est.SampleOutput
+	} else {
+		est.Size = int64(float64(est.SampleOutput) * float64(est.UncompressedSize) / float64(est.SampleSize))
+	}
+	return est, nil
+}
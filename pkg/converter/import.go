@@ -0,0 +1,106 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/pkg/labels"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/erofs"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ImportErofs imports the EROFS filesystem image in r, which is size bytes
+// long, as a single-layer image for platform, and returns its manifest.
+// Data past the end of the filesystem (e.g. an appended dm-verity hash tree)
+// isn't imported.
+func ImportErofs(ctx context.Context, cs content.Store, r io.ReaderAt, size int64, platform ocispec.Platform) (ocispec.Descriptor, error) {
+	sb, err := erofs.ReadSuperBlock(r)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if sb.ExtraDevices != 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("images with %d extra devices can't be imported: %w", sb.ExtraDevices, errdefs.ErrNotImplemented)
+	}
+	if err := erofs.Check(r, size); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if fsSize := int64(sb.Blocks()) * int64(sb.BlockSize()); fsSize < size {
+		log.G(ctx).Debugf("ignoring %d bytes past the end of the filesystem", size-fsSize)
+		size = fsSize
+	}
+
+	dgstr := digest.SHA256.Digester()
+	if _, err := io.Copy(dgstr.Hash(), io.NewSectionReader(r, 0, size)); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	layer := ocispec.Descriptor{
+		MediaType: MediaTypeErofsLayer,
+		Digest:    dgstr.Digest(),
+		Size:      size,
+	}
+	layerLabels := map[string]string{labels.LabelUncompressed: layer.Digest.String()}
+	ref := IngestRefPrefix + "import-" + layer.Digest.Encoded()
+	if err := content.WriteBlob(ctx, cs, ref, io.NewSectionReader(r, 0, size), layer, content.WithLabels(layerLabels)); err != nil && !errdefs.IsAlreadyExists(err) {
+		return ocispec.Descriptor{}, err
+	}
+
+	created := time.Now().UTC()
+	img := ocispec.Image{
+		Created:  &created,
+		Platform: platform,
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{layer.Digest},
+		},
+		History: []ocispec.History{{
+			Created:   &created,
+			CreatedBy: "import-erofs",
+		}},
+	}
+	config, err := writeJSON(ctx, cs, ocispec.MediaTypeImageConfig, img, nil)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	m := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	}
+	desc, err := writeJSON(ctx, cs, ocispec.MediaTypeImageManifest, m, map[string]string{
+		"containerd.io/gc.ref.content.config": config.Digest.String(),
+		"containerd.io/gc.ref.content.l.0":    layer.Digest.String(),
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc.Platform = &platform
+	return desc, nil
+}
+
+func writeJSON(ctx context.Context, cs content.Store, mediaType string, v any, labels map[string]string) (ocispec.Descriptor, error) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	ref := IngestRefPrefix + "import-" + desc.Digest.Encoded()
+	if err := content.WriteBlob(ctx, cs, ref, bytes.NewReader(b), desc, content.WithLabels(labels)); err != nil && !errdefs.IsAlreadyExists(err) {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
@@ -0,0 +1,144 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/images/converter"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AnnotationsFunc returns the annotations to set on a converted manifest or
+// index.  desc is the converted descriptor and annotations are the current
+// annotations of its content, which may be modified in place.
+type AnnotationsFunc func(ctx context.Context, desc ocispec.Descriptor, annotations map[string]string) (map[string]string, error)
+
+// WithManifestAnnotations sets a hook which injects or transforms the
+// annotations of converted manifests and indexes.  It only takes effect with
+// IndexConvertFunc, and is skipped for Docker media types which don't support
+// annotations.
+func WithManifestAnnotations(fn AnnotationsFunc) Option {
+	return func(o *options) error {
+		o.manifestAnnotations = fn
+		return nil
+	}
+}
+
+// AddAnnotations returns an AnnotationsFunc which sets the given annotations.
+func AddAnnotations(annotations map[string]string) AnnotationsFunc {
+	return func(_ context.Context, _ ocispec.Descriptor, a map[string]string) (map[string]string, error) {
+		if a == nil {
+			a = make(map[string]string, len(annotations))
+		}
+		maps.Copy(a, annotations)
+		return a, nil
+	}
+}
+
+// IndexConvertFunc returns the image-level convert func which converts the
+// layers with LayerConvertFunc, and applies the manifest-level options.
+func IndexConvertFunc(docker2oci bool, platformMC platforms.MatchComparer, opt ...Option) (converter.ConvertFunc, error) {
+	var opts options
+	for _, o := range opt {
+		if err := o(&opts); err != nil {
+			return nil, err
+		}
+	}
+	var hooks converter.ConvertHooks
+	if opts.manifestAnnotations != nil {
+		hooks.PostConvertHook = annotateHook(opts.manifestAnnotations)
+	}
+	convertFunc := converter.IndexConvertFuncWithHook(LayerConvertFunc(opt...), docker2oci, platformMC, hooks)
+	if opts.summary == nil && opts.platformParallelism == 0 {
+		return convertFunc, nil
+	}
+	ic := &indexConverter{
+		convertFunc:     convertFunc,
+		docker2oci:      docker2oci,
+		platformMC:      platformMC,
+		hooks:           hooks,
+		summary:         opts.summary,
+		continueOnError: opts.summary != nil,
+		parallelism:     opts.platformParallelism,
+	}
+	if ic.summary == nil {
+		ic.summary = &Summary{}
+	}
+	return ic.convert, nil
+}
+
+func annotateHook(fn AnnotationsFunc) converter.ConvertHookFunc {
+	return func(ctx context.Context, cs content.Store, orgDesc ocispec.Descriptor, newDesc *ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		desc := orgDesc
+		if newDesc != nil {
+			desc = *newDesc
+		}
+		if !images.IsManifestType(desc.MediaType) && !images.IsIndexType(desc.MediaType) {
+			return nil, nil
+		}
+		return rewriteAnnotations(ctx, cs, desc, fn)
+	}
+}
+
+// rewriteAnnotations updates the annotations of a manifest or index, keeping
+// all other fields and the content labels (e.g. GC references) as they are.
+func rewriteAnnotations(ctx context.Context, cs content.Store, desc ocispec.Descriptor, fn AnnotationsFunc) (*ocispec.Descriptor, error) {
+	b, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		raw  map[string]json.RawMessage
+		head struct {
+			MediaType   string            `json:"mediaType,omitempty"`
+			Annotations map[string]string `json:"annotations,omitempty"`
+		}
+	)
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &head); err != nil {
+		return nil, err
+	}
+	if images.IsDockerType(head.MediaType) {
+		return nil, nil
+	}
+
+	annotations, err := fn(ctx, desc, maps.Clone(head.Annotations))
+	if err != nil {
+		return nil, fmt.Errorf("failed to annotate %s: %w", desc.Digest, err)
+	}
+	if maps.Equal(annotations, head.Annotations) {
+		return nil, nil
+	}
+	if len(annotations) == 0 {
+		delete(raw, "annotations")
+	} else if raw["annotations"], err = json.Marshal(annotations); err != nil {
+		return nil, err
+	}
+	nb, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := cs.Info(ctx, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	newDesc := desc
+	newDesc.Digest = digest.FromBytes(nb)
+	newDesc.Size = int64(len(nb))
+	ref := fmt.Sprintf("%sannotate-%s", IngestRefPrefix, newDesc.Digest)
+	if err := content.WriteBlob(ctx, cs, ref, bytes.NewReader(nb), newDesc, content.WithLabels(info.Labels)); err != nil && !errdefs.IsAlreadyExists(err) {
+		return nil, err
+	}
+	return &newDesc, nil
+}
@@ -0,0 +1,103 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/pkg/labels"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LabelFix is a content label to set for an image to unpack and to be
+// garbage collected correctly.
+type LabelFix struct {
+	Digest digest.Digest `json:"digest"`
+	Label  string        `json:"label"`
+	// Old is the current value of the label, if any
+	Old string `json:"old,omitempty"`
+	New string `json:"new"`
+}
+
+// FixLabels returns the content labels missing or wrong in the image target,
+// e.g. converted by older versions or by other tools: the uncompressed label
+// of the EROFS layers, which must be their own digest, and the GC references
+// of the indexes and manifests to their children.  Manifests which weren't
+// pulled are skipped.
+func FixLabels(ctx context.Context, cs content.Store, target ocispec.Descriptor) ([]LabelFix, error) {
+	var fixes []LabelFix
+	expect := func(dgst digest.Digest, want map[string]string) error {
+		info, err := cs.Info(ctx, dgst)
+		if err != nil {
+			return err
+		}
+		for _, k := range slices.Sorted(maps.Keys(want)) {
+			if old := info.Labels[k]; old != want[k] {
+				fixes = append(fixes, LabelFix{Digest: dgst, Label: k, Old: old, New: want[k]})
+			}
+		}
+		return nil
+	}
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch {
+		case images.IsIndexType(desc.MediaType):
+			var index ocispec.Index
+			if err := readJSON(ctx, cs, desc, &index); err != nil {
+				return nil, err
+			}
+			want := map[string]string{}
+			var children []ocispec.Descriptor
+			for i, m := range index.Manifests {
+				want[fmt.Sprintf("containerd.io/gc.ref.content.m.%d", i)] = m.Digest.String()
+				if !images.IsManifestType(m.MediaType) && !images.IsIndexType(m.MediaType) {
+					continue
+				}
+				if _, err := cs.Info(ctx, m.Digest); errdefs.IsNotFound(err) {
+					continue
+				} else if err != nil {
+					return nil, err
+				}
+				children = append(children, m)
+			}
+			return children, expect(desc.Digest, want)
+		case images.IsManifestType(desc.MediaType):
+			var manifest ocispec.Manifest
+			if err := readJSON(ctx, cs, desc, &manifest); err != nil {
+				return nil, err
+			}
+			want := map[string]string{"containerd.io/gc.ref.content.config": manifest.Config.Digest.String()}
+			for i, l := range manifest.Layers {
+				want[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", i)] = l.Digest.String()
+				if l.MediaType != MediaTypeErofsLayer {
+					continue
+				}
+				err := expect(l.Digest, map[string]string{labels.LabelUncompressed: l.Digest.String()})
+				if err != nil && !errdefs.IsNotFound(err) {
+					return nil, err
+				}
+			}
+			return nil, expect(desc.Digest, want)
+		}
+		return nil, nil
+	})
+	if err := images.Walk(ctx, handler, target); err != nil {
+		return nil, err
+	}
+	return fixes, nil
+}
+
+// ApplyLabelFixes sets the labels of fixes in cs.
+func ApplyLabelFixes(ctx context.Context, cs content.Store, fixes []LabelFix) error {
+	for _, f := range fixes {
+		info := content.Info{Digest: f.Digest, Labels: map[string]string{f.Label: f.New}}
+		if _, err := cs.Update(ctx, info, "labels."+f.Label); err != nil {
+			return fmt.Errorf("failed to set label %s of %s: %w", f.Label, f.Digest, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package converter
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// LayerMapping correlates a source layer with the EROFS layer it was
+// converted into.
+type LayerMapping struct {
+	// SourceDigest is the digest of the original (possibly compressed) blob
+	SourceDigest digest.Digest `json:"sourceDigest"`
+	// SourceDiffID is the digest of the original uncompressed tar stream
+	SourceDiffID digest.Digest `json:"sourceDiffID"`
+	// Digest is the digest of the EROFS blob
+	Digest digest.Digest `json:"digest"`
+	// DiffID is the uncompressed digest recorded for the EROFS blob, which
+	// is what image configs refer to
+	DiffID digest.Digest `json:"diffID"`
+	Size   int64         `json:"size"`
+}
+
+// Mapping collects the layer mappings of a conversion.
+type Mapping struct {
+	mu     sync.Mutex
+	layers map[digest.Digest]LayerMapping
+}
+
+func (m *Mapping) add(l LayerMapping) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.layers == nil {
+		m.layers = make(map[digest.Digest]LayerMapping)
+	}
+	m.layers[l.SourceDigest] = l
+}
+
+// Layers returns the recorded mappings, sorted by source digest.
+func (m *Mapping) Layers() []LayerMapping {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	layers := make([]LayerMapping, 0, len(m.layers))
+	for _, l := range m.layers {
+		layers = append(layers, l)
+	}
+	slices.SortFunc(layers, func(a, b LayerMapping) int {
+		return strings.Compare(string(a.SourceDigest), string(b.SourceDigest))
+	})
+	return layers
+}
+
+// Lookup returns the mapping of a source layer.
+func (m *Mapping) Lookup(source digest.Digest) (LayerMapping, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.layers[source]
+	return l, ok
+}
+
+func (m *Mapping) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Layers []LayerMapping `json:"layers"`
+	}{m.Layers()})
+}
+
+// WithMapping records the source → EROFS layer mapping of every converted
+// layer into m.
+func WithMapping(m *Mapping) Option {
+	return func(o *options) error {
+		o.mapping = m
+		return nil
+	}
+}
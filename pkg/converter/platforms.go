@@ -0,0 +1,434 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/images/converter"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PlatformResult is the conversion result of a single manifest of an index.
+type PlatformResult struct {
+	// Platform is the formatted platform, or "unknown"
+	Platform string
+	// Source is the original manifest
+	Source ocispec.Descriptor
+	// Converted is the converted manifest if the conversion succeeded
+	Converted *ocispec.Descriptor
+	Err       error
+}
+
+// PlatformError is the error of a manifest which failed to convert.
+type PlatformError struct {
+	Platform string
+	Digest   digest.Digest
+	Err      error
+}
+
+func (e *PlatformError) Error() string {
+	return fmt.Sprintf("platform %s (%s): %v", e.Platform, e.Digest, e.Err)
+}
+
+func (e *PlatformError) Unwrap() error {
+	return e.Err
+}
+
+// Summary collects the per-platform results of an index conversion.
+type Summary struct {
+	mu      sync.Mutex
+	Results []PlatformResult
+}
+
+func (s *Summary) add(r PlatformResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Results = append(s.Results, r)
+}
+
+// Succeeded returns the platforms which were converted.
+func (s *Summary) Succeeded() []string {
+	var p []string
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.Results {
+		if r.Err == nil {
+			p = append(p, r.Platform)
+		}
+	}
+	return p
+}
+
+// Err returns all platform failures as a joined error of *PlatformError, or
+// nil if every platform was converted.
+func (s *Summary) Err() error {
+	var errs []error
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.Results {
+		if r.Err != nil {
+			errs = append(errs, &PlatformError{Platform: r.Platform, Digest: r.Source.Digest, Err: r.Err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WithContinueOnError makes IndexConvertFunc skip the manifests of an index
+// which fail to convert instead of aborting the whole conversion.  The
+// per-platform results are recorded in summary.  The conversion still fails
+// if no manifest could be converted.
+func WithContinueOnError(summary *Summary) Option {
+	return func(o *options) error {
+		o.summary = summary
+		return nil
+	}
+}
+
+func platformString(p *ocispec.Platform) string {
+	if p == nil {
+		return "unknown"
+	}
+	return platforms.FormatAll(*p)
+}
+
+// WithPlatformParallelism makes IndexConvertFunc convert up to n manifests
+// of an index concurrently.  Their layers are still converted concurrently
+// within each manifest.
+func WithPlatformParallelism(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return fmt.Errorf("invalid platform parallelism %d: %w", n, errdefs.ErrInvalidArgument)
+		}
+		o.platformParallelism = n
+		return nil
+	}
+}
+
+// indexConverter converts the manifests of an index with a bounded
+// concurrency, and optionally keeps going when some of them fail.
+type indexConverter struct {
+	convertFunc converter.ConvertFunc
+	docker2oci  bool
+	platformMC  platforms.MatchComparer
+	hooks       converter.ConvertHooks
+	summary     *Summary
+	// continueOnError skips the manifests which fail to convert
+	continueOnError bool
+	parallelism     int
+}
+
+func (c *indexConverter) convert(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	if !images.IsIndexType(desc.MediaType) {
+		return c.convertFunc(ctx, cs, desc)
+	}
+
+	info, err := cs.Info(ctx, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	labels := info.Labels
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	b, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		return nil, err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, err
+	}
+
+	var matched []ocispec.Descriptor
+	for _, mani := range index.Manifests {
+		converter.ClearGCLabels(labels, mani.Digest)
+		if mani.Platform != nil && !c.platformMC.Match(*mani.Platform) {
+			continue
+		}
+		matched = append(matched, mani)
+	}
+
+	// Abort the other manifests on the first failure unless skipping them
+	convertCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, max(c.parallelism, 1))
+		results = make([]PlatformResult, len(matched))
+	)
+	for i, mani := range matched {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			newMani, err := c.convertFunc(convertCtx, cs, mani)
+			if err != nil && !c.continueOnError {
+				cancel()
+			}
+			results[i] = PlatformResult{
+				Platform:  platformString(mani.Platform),
+				Source:    mani,
+				Converted: newMani,
+				Err:       err,
+			}
+		}()
+	}
+	wg.Wait()
+
+	var manifests []ocispec.Descriptor
+	for _, res := range results {
+		if res.Err != nil {
+			if !c.continueOnError {
+				if errors.Is(res.Err, context.Canceled) && ctx.Err() == nil {
+					// Canceled after another manifest failed
+					continue
+				}
+				return nil, res.Err
+			}
+			log.G(ctx).WithError(res.Err).WithField("platform", res.Platform).Warn("skipping manifest which failed to convert")
+			c.summary.add(res)
+			continue
+		}
+		if res.Converted == nil {
+			mani := res.Source
+			res.Converted = &mani
+		}
+		c.summary.add(res)
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.m.%d", len(manifests))] = res.Converted.Digest.String()
+		manifests = append(manifests, *res.Converted)
+	}
+	if len(manifests) == 0 {
+		if err := c.summary.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no manifest of %s matches the platforms: %w", desc.Digest, errdefs.ErrNotFound)
+	}
+	index.Manifests = manifests
+
+	newDesc := desc
+	if c.docker2oci && images.IsDockerType(index.MediaType) {
+		index.MediaType = converter.ConvertDockerMediaTypeToOCI(index.MediaType)
+	}
+	if c.docker2oci {
+		newDesc.MediaType = converter.ConvertDockerMediaTypeToOCI(newDesc.MediaType)
+	}
+	nb, err := json.Marshal(&index)
+	if err != nil {
+		return nil, err
+	}
+	newDesc.Digest = digest.FromBytes(nb)
+	newDesc.Size = int64(len(nb))
+	ref := fmt.Sprintf("%sindex-%s", IngestRefPrefix, newDesc.Digest)
+	if err := content.WriteBlob(ctx, cs, ref, bytes.NewReader(nb), newDesc, content.WithLabels(labels)); err != nil && !errdefs.IsAlreadyExists(err) {
+		return nil, err
+	}
+
+	if c.hooks.PostConvertHook != nil {
+		if d, err := c.hooks.PostConvertHook(ctx, cs, desc, &newDesc); err != nil {
+			return nil, err
+		} else if d != nil {
+			newDesc = *d
+		}
+	}
+	return &newDesc, nil
+}
+
+// ConvertedManifests returns the manifests of the image target which have
+// EROFS layers, with their platforms.
+func ConvertedManifests(ctx context.Context, provider content.Provider, target ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	manifests := []ocispec.Descriptor{target}
+	if images.IsIndexType(target.MediaType) {
+		b, err := content.ReadBlob(ctx, provider, target)
+		if err != nil {
+			return nil, err
+		}
+		var index ocispec.Index
+		if err := json.Unmarshal(b, &index); err != nil {
+			return nil, err
+		}
+		manifests = index.Manifests
+	}
+	var converted []ocispec.Descriptor
+	for _, desc := range manifests {
+		if !images.IsManifestType(desc.MediaType) {
+			continue
+		}
+		manifest, err := images.Manifest(ctx, provider, desc, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(manifest.Layers, func(l ocispec.Descriptor) bool { return l.MediaType == MediaTypeErofsLayer }) {
+			continue
+		}
+		if desc.Platform == nil {
+			ps, err := images.Platforms(ctx, provider, desc)
+			if err != nil {
+				return nil, err
+			}
+			if len(ps) == 0 {
+				continue
+			}
+			desc.Platform = &ps[0]
+		}
+		converted = append(converted, desc)
+	}
+	return converted, nil
+}
+
+// LayerCount is the number of EROFS and other layers in the manifests of an
+// image available locally.
+type LayerCount struct {
+	Erofs     int `json:"erofs"`
+	Others    int `json:"others"`
+	Manifests int `json:"manifests"`
+	// Platforms are the platforms of the manifests with EROFS layers
+	Platforms []string `json:"platforms,omitempty"`
+}
+
+// Mixed reports whether the image has both EROFS and other layers, in the
+// same manifest or across its platforms.
+func (c LayerCount) Mixed() bool {
+	return c.Erofs > 0 && c.Others > 0
+}
+
+// CountLayers counts the EROFS and other layers of the manifests of the image
+// target in provider, skipping the manifests which weren't pulled and
+// attestations.
+func CountLayers(ctx context.Context, provider content.Provider, target ocispec.Descriptor) (LayerCount, error) {
+	var count LayerCount
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch {
+		case images.IsIndexType(desc.MediaType):
+			var index ocispec.Index
+			if err := readJSON(ctx, provider, desc, &index); err != nil {
+				return nil, err
+			}
+			var children []ocispec.Descriptor
+			for _, m := range index.Manifests {
+				if _, ok := m.Annotations[attestationAnnotation]; ok || m.ArtifactType != "" {
+					continue
+				}
+				if !images.IsManifestType(m.MediaType) && !images.IsIndexType(m.MediaType) {
+					continue
+				}
+				children = append(children, m)
+			}
+			return children, nil
+		case images.IsManifestType(desc.MediaType):
+			var manifest ocispec.Manifest
+			if err := readJSON(ctx, provider, desc, &manifest); errdefs.IsNotFound(err) {
+				return nil, nil
+			} else if err != nil {
+				return nil, err
+			}
+			count.Manifests++
+			converted := false
+			for _, l := range manifest.Layers {
+				if l.MediaType == MediaTypeErofsLayer {
+					count.Erofs++
+					converted = true
+				} else if images.IsLayerType(l.MediaType) {
+					count.Others++
+				}
+			}
+			if converted {
+				platform := "unknown"
+				if desc.Platform != nil {
+					platform = platforms.Format(*desc.Platform)
+				} else if ps, err := images.Platforms(ctx, provider, desc); err == nil && len(ps) > 0 {
+					platform = platforms.Format(ps[0])
+				}
+				if !slices.Contains(count.Platforms, platform) {
+					count.Platforms = append(count.Platforms, platform)
+				}
+			}
+		}
+		return nil, nil
+	})
+	if err := images.Walk(ctx, handler, target); err != nil {
+		return LayerCount{}, err
+	}
+	return count, nil
+}
+
+// ExcludeManifests returns a MatchComparer matching the platforms of mc
+// except those of manifests.
+func ExcludeManifests(mc platforms.MatchComparer, manifests []ocispec.Descriptor) platforms.MatchComparer {
+	var excluded []platforms.Matcher
+	for _, m := range manifests {
+		if m.Platform != nil {
+			excluded = append(excluded, platforms.NewMatcher(*m.Platform))
+		}
+	}
+	return excludeMatcher{MatchComparer: mc, excluded: excluded}
+}
+
+type excludeMatcher struct {
+	platforms.MatchComparer
+	excluded []platforms.Matcher
+}
+
+func (m excludeMatcher) Match(p ocispec.Platform) bool {
+	for _, e := range m.excluded {
+		if e.Match(p) {
+			return false
+		}
+	}
+	return m.MatchComparer.Match(p)
+}
+
+// MergeManifests returns the index of the image target (an index or a
+// manifest) with the given manifests added, unless it already has manifests
+// for their platforms.
+func MergeManifests(ctx context.Context, cs content.Store, target ocispec.Descriptor, manifests []ocispec.Descriptor) (ocispec.Descriptor, error) {
+	index := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+	}
+	if images.IsIndexType(target.MediaType) {
+		b, err := content.ReadBlob(ctx, cs, target)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if err := json.Unmarshal(b, &index); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	} else {
+		if target.Platform == nil {
+			ps, err := images.Platforms(ctx, cs, target)
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			if len(ps) > 0 {
+				target.Platform = &ps[0]
+			}
+		}
+		index.Manifests = []ocispec.Descriptor{target}
+	}
+	for _, m := range manifests {
+		if slices.ContainsFunc(index.Manifests, func(d ocispec.Descriptor) bool {
+			return d.Digest == m.Digest || (d.Platform != nil && m.Platform != nil && platforms.NewMatcher(*m.Platform).Match(*d.Platform))
+		}) {
+			continue
+		}
+		index.Manifests = append(index.Manifests, m)
+	}
+	labels := map[string]string{}
+	for i, m := range index.Manifests {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.m.%d", i)] = m.Digest.String()
+	}
+	return writeJSON(ctx, cs, index.MediaType, index, labels)
+}
@@ -0,0 +1,89 @@
+package converter
+
+import (
+	"io"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ProgressStatus is the state of a layer conversion.
+type ProgressStatus string
+
+const (
+	// ProgressStarted is reported once the source layer is uncompressed and
+	// mkfs.erofs is about to run
+	ProgressStarted ProgressStatus = "started"
+	// ProgressConverting is reported periodically while mkfs.erofs reads
+	// the tar stream
+	ProgressConverting ProgressStatus = "converting"
+	ProgressDone       ProgressStatus = "done"
+	// ProgressCached is reported for layers reused from a LayerCache
+	ProgressCached ProgressStatus = "cached"
+	// ProgressSkipped is reported for layers which are kept as they are
+	ProgressSkipped ProgressStatus = "skipped"
+	ProgressFailed  ProgressStatus = "failed"
+)
+
+// progressInterval is the minimum interval between two ProgressConverting
+// events of a layer.
+const progressInterval = 500 * time.Millisecond
+
+// ProgressEvent reports the progress of a layer conversion.
+type ProgressEvent struct {
+	Time   time.Time      `json:"time"`
+	Status ProgressStatus `json:"status"`
+	// Source is the digest of the layer being converted
+	Source     digest.Digest `json:"source"`
+	SourceSize int64         `json:"sourceSize"`
+	// Offset and Total are the bytes of the uncompressed tar stream read by
+	// mkfs.erofs so far, and in total
+	Offset int64 `json:"offset,omitempty"`
+	Total  int64 `json:"total,omitempty"`
+	// Digest and Size describe the converted EROFS blob once done
+	Digest digest.Digest `json:"digest,omitempty"`
+	Size   int64         `json:"size,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// ProgressFunc receives progress events.  It may be called concurrently for
+// different layers, and must not block.
+type ProgressFunc func(ProgressEvent)
+
+// WithProgress reports the progress of every layer conversion to fn.
+func WithProgress(fn ProgressFunc) Option {
+	return func(o *options) error {
+		o.progress = fn
+		return nil
+	}
+}
+
+func (o *options) report(desc ocispec.Descriptor, ev ProgressEvent) {
+	if o.progress == nil {
+		return
+	}
+	ev.Time = time.Now()
+	ev.Source = desc.Digest
+	ev.SourceSize = desc.Size
+	o.progress(ev)
+}
+
+// progressReader counts the bytes read from r, and reports them at most every
+// progressInterval.
+type progressReader struct {
+	r      io.Reader
+	n      int64
+	last   time.Time
+	report func(n int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.report(p.n)
+	}
+	return n, err
+}
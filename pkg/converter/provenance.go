@@ -0,0 +1,278 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// LabelConversion is the image label recording the conversion which
+	// produced the image, as JSON.
+	LabelConversion = "io.github.erofs.conversion"
+
+	// MediaTypeInToto is the media type of in-toto statements.
+	MediaTypeInToto = "application/vnd.in-toto+json"
+	// MediaTypeDSSE is the media type of DSSE envelopes.
+	MediaTypeDSSE = "application/vnd.dsse.envelope.v1+json"
+	// StatementType is the in-toto statement type.
+	StatementType = "https://in-toto.io/Statement/v1"
+	// ProvenancePredicateType is the SLSA provenance predicate type.
+	ProvenancePredicateType = "https://slsa.dev/provenance/v1"
+	// ConversionBuildType is the SLSA build type of EROFS conversions.
+	ConversionBuildType = "https://github.com/erofs/erofs-container-toolkit/convert/v1"
+
+	builderID = "https://github.com/erofs/erofs-container-toolkit"
+)
+
+// Conversion records the source, options and environment of an image
+// conversion.
+type Conversion struct {
+	Source       string            `json:"source"`
+	SourceDigest digest.Digest     `json:"sourceDigest"`
+	Options      map[string]string `json:"options,omitempty"`
+	Environment  map[string]string `json:"environment,omitempty"`
+	StartedOn    time.Time         `json:"startedOn"`
+	FinishedOn   time.Time         `json:"finishedOn,omitempty"`
+}
+
+// NewConversion starts recording the conversion of source with the given
+// options, in the current environment.
+func NewConversion(source string, sourceDigest digest.Digest, options map[string]string) *Conversion {
+	env := map[string]string{
+		"os":   runtime.GOOS,
+		"arch": runtime.GOARCH,
+		"tool": toolVersion(),
+	}
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err == nil {
+		env["kernel"] = unix.ByteSliceToString(uts.Release[:])
+	}
+	if out, err := exec.Command("mkfs.erofs", "-V").Output(); err == nil {
+		env["mkfs.erofs"] = strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	}
+	return &Conversion{
+		Source:       source,
+		SourceDigest: sourceDigest,
+		Options:      options,
+		Environment:  env,
+		StartedOn:    time.Now().UTC(),
+	}
+}
+
+// ParseConversion parses the LabelConversion label of an image.
+func ParseConversion(labels map[string]string) (*Conversion, error) {
+	v, ok := labels[LabelConversion]
+	if !ok {
+		return nil, fmt.Errorf("no %s label", LabelConversion)
+	}
+	var c Conversion
+	if err := json.Unmarshal([]byte(v), &c); err != nil {
+		return nil, fmt.Errorf("invalid %s label: %w", LabelConversion, err)
+	}
+	return &c, nil
+}
+
+// Label returns the LabelConversion label value of c.
+func (c *Conversion) Label() (string, error) {
+	b, err := json.Marshal(c)
+	return string(b), err
+}
+
+func toolVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	return bi.Main.Version
+}
+
+// Statement is an in-toto statement.
+type Statement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     Provenance           `json:"predicate"`
+}
+
+// ResourceDescriptor is an in-toto resource descriptor.
+type ResourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Provenance is a SLSA v1 provenance predicate.
+type Provenance struct {
+	BuildDefinition struct {
+		BuildType            string               `json:"buildType"`
+		ExternalParameters   any                  `json:"externalParameters"`
+		InternalParameters   any                  `json:"internalParameters,omitempty"`
+		ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies,omitempty"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version,omitempty"`
+		} `json:"builder"`
+		Metadata struct {
+			StartedOn  *time.Time `json:"startedOn,omitempty"`
+			FinishedOn *time.Time `json:"finishedOn,omitempty"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// Envelope is a DSSE envelope of an in-toto statement.  The payload is
+// base64-encoded in JSON.
+type Envelope struct {
+	PayloadType string      `json:"payloadType"`
+	Payload     []byte      `json:"payload"`
+	Signatures  []Signature `json:"signatures"`
+}
+
+// Signature is a signature of a DSSE envelope.
+type Signature struct {
+	KeyID string `json:"keyid,omitempty"`
+	Sig   []byte `json:"sig"`
+}
+
+// Envelope returns st in an unsigned DSSE envelope, to be signed, e.g. by
+// cosign, or attached as it is.
+func (st Statement) Envelope() (Envelope, error) {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{PayloadType: MediaTypeInToto, Payload: b, Signatures: []Signature{}}, nil
+}
+
+func digestSet(d digest.Digest) map[string]string {
+	return map[string]string{d.Algorithm().String(): d.Encoded()}
+}
+
+// Statement returns the SLSA provenance statement of the conversion which
+// produced the image name with the target descriptor.
+func (c *Conversion) Statement(name string, target ocispec.Descriptor) Statement {
+	st := Statement{
+		Type:          StatementType,
+		Subject:       []ResourceDescriptor{{Name: name, Digest: digestSet(target.Digest)}},
+		PredicateType: ProvenancePredicateType,
+	}
+	p := &st.Predicate
+	p.BuildDefinition.BuildType = ConversionBuildType
+	p.BuildDefinition.ExternalParameters = map[string]any{
+		"source":  c.Source,
+		"options": c.Options,
+	}
+	p.BuildDefinition.InternalParameters = c.Environment
+	if c.SourceDigest != "" {
+		p.BuildDefinition.ResolvedDependencies = []ResourceDescriptor{{
+			URI:    c.Source,
+			Digest: digestSet(c.SourceDigest),
+		}}
+	}
+	p.RunDetails.Builder.ID = builderID
+	if v := c.Environment["tool"]; v != "" {
+		p.RunDetails.Builder.Version = map[string]string{"erofs-container-toolkit": v}
+	}
+	if !c.StartedOn.IsZero() {
+		p.RunDetails.Metadata.StartedOn = &c.StartedOn
+	}
+	if !c.FinishedOn.IsZero() {
+		p.RunDetails.Metadata.FinishedOn = &c.FinishedOn
+	}
+	return st
+}
+
+// WriteReferrer writes st, in a DSSE envelope, as the single layer of an
+// artifact manifest referring to subject, and returns the manifest
+// descriptor.
+func WriteReferrer(ctx context.Context, cs content.Store, subject ocispec.Descriptor, st Statement) (ocispec.Descriptor, error) {
+	env, err := st.Envelope()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	layer, err := writeJSON(ctx, cs, MediaTypeDSSE, env, nil)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	config := ocispec.DescriptorEmptyJSON
+	if err := content.WriteBlob(ctx, cs, IngestRefPrefix+config.Digest.Encoded(), strings.NewReader("{}"), config); err != nil && !errdefs.IsAlreadyExists(err) {
+		return ocispec.Descriptor{}, err
+	}
+	subject = ocispec.Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size}
+	m := ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: MediaTypeInToto,
+		Config:       config,
+		Layers:       []ocispec.Descriptor{layer},
+		Subject:      &subject,
+		Annotations: map[string]string{
+			"in-toto.io/predicate-type": st.PredicateType,
+			ocispec.AnnotationCreated:   time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	desc, err := writeJSON(ctx, cs, ocispec.MediaTypeImageManifest, m, map[string]string{
+		"containerd.io/gc.ref.content.config": config.Digest.String(),
+		"containerd.io/gc.ref.content.l.0":    layer.Digest.String(),
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc.ArtifactType = MediaTypeInToto
+	desc.Annotations = m.Annotations
+	return desc, nil
+}
+
+// ReferrersTag returns the tag of the referrers index of the manifest d, for
+// registries without the OCI referrers API.
+func ReferrersTag(d digest.Digest) string {
+	return d.Algorithm().String() + "-" + d.Encoded()
+}
+
+// AddReferrer returns the referrers index with referrer added to the
+// manifests of indexes, e.g. the local and the pushed ones, replacing the
+// referrers of the same artifact type.
+func AddReferrer(ctx context.Context, cs content.Store, referrer ocispec.Descriptor, indexes ...ocispec.Descriptor) (ocispec.Descriptor, error) {
+	idx := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+	}
+	seen := map[digest.Digest]struct{}{}
+	for _, index := range indexes {
+		b, err := content.ReadBlob(ctx, cs, index)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		var old ocispec.Index
+		if err := json.Unmarshal(b, &old); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		for _, m := range old.Manifests {
+			if _, ok := seen[m.Digest]; ok || m.ArtifactType == referrer.ArtifactType {
+				continue
+			}
+			seen[m.Digest] = struct{}{}
+			idx.Manifests = append(idx.Manifests, m)
+		}
+	}
+	idx.Manifests = append(idx.Manifests, referrer)
+	labels := map[string]string{}
+	for i, m := range idx.Manifests {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.m.%d", i)] = m.Digest.String()
+	}
+	return writeJSON(ctx, cs, ocispec.MediaTypeImageIndex, idx, labels)
+}
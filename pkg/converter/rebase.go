@@ -0,0 +1,128 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Rebase moves the image manifest desc from the base image manifest oldBase
+// onto newBase: the layers of oldBase, which must be the bottom layers of desc,
+// are replaced by those of newBase, converted to EROFS with opt if they aren't
+// yet.  The layers above the base are reused as they are, since EROFS layers
+// don't depend on the layers below them.  It returns the new manifest.
+func Rebase(ctx context.Context, cs content.Store, desc, oldBase, newBase ocispec.Descriptor, opt ...Option) (ocispec.Descriptor, error) {
+	var manifest, oldManifest, newManifest ocispec.Manifest
+	for _, m := range []struct {
+		desc     ocispec.Descriptor
+		manifest *ocispec.Manifest
+	}{{desc, &manifest}, {oldBase, &oldManifest}, {newBase, &newManifest}} {
+		if err := readJSON(ctx, cs, m.desc, m.manifest); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to read manifest %s: %w", m.desc.Digest, err)
+		}
+	}
+	base := len(oldManifest.Layers)
+	if base > len(manifest.Layers) {
+		return ocispec.Descriptor{}, fmt.Errorf("image has %d layers but its base has %d", len(manifest.Layers), base)
+	}
+	for i, l := range oldManifest.Layers {
+		if manifest.Layers[i].Digest != l.Digest {
+			return ocispec.Descriptor{}, fmt.Errorf("image is not based on %s: layer %d differs", oldBase.Digest, i)
+		}
+	}
+
+	var config map[string]json.RawMessage
+	if err := readJSON(ctx, cs, manifest.Config, &config); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to read image config: %w", err)
+	}
+	var rootfs ocispec.RootFS
+	if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("invalid image config: %w", err)
+	}
+	if len(rootfs.DiffIDs) != len(manifest.Layers) {
+		return ocispec.Descriptor{}, fmt.Errorf("image config has %d diffIDs for %d layers", len(rootfs.DiffIDs), len(manifest.Layers))
+	}
+	var oldConfig, newConfig ocispec.Image
+	if err := readJSON(ctx, cs, oldManifest.Config, &oldConfig); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to read base image config: %w", err)
+	}
+	if err := readJSON(ctx, cs, newManifest.Config, &newConfig); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to read new base image config: %w", err)
+	}
+	if len(newConfig.RootFS.DiffIDs) != len(newManifest.Layers) {
+		return ocispec.Descriptor{}, fmt.Errorf("new base image config has %d diffIDs for %d layers", len(newConfig.RootFS.DiffIDs), len(newManifest.Layers))
+	}
+
+	convertFn := LayerConvertFunc(opt...)
+	var (
+		layers  []ocispec.Descriptor
+		diffIDs []digest.Digest
+	)
+	for i, l := range newManifest.Layers {
+		if l.MediaType == MediaTypeErofsLayer {
+			layers = append(layers, l)
+			diffIDs = append(diffIDs, l.Digest)
+			continue
+		}
+		newDesc, err := convertFn(ctx, cs, l)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to convert layer %s: %w", l.Digest, err)
+		}
+		if newDesc == nil || newDesc.MediaType != MediaTypeErofsLayer {
+			if newDesc != nil {
+				l = *newDesc
+			}
+			layers = append(layers, l)
+			diffIDs = append(diffIDs, newConfig.RootFS.DiffIDs[i])
+			continue
+		}
+		layers = append(layers, *newDesc)
+		diffIDs = append(diffIDs, newDesc.Digest)
+	}
+	layers = append(layers, manifest.Layers[base:]...)
+	diffIDs = append(diffIDs, rootfs.DiffIDs[base:]...)
+
+	rootfs.DiffIDs = diffIDs
+	if err := setJSON(config, "rootfs", rootfs); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if h, ok := config["history"]; ok {
+		var history []ocispec.History
+		if err := json.Unmarshal(h, &history); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("invalid image config history: %w", err)
+		}
+		// The history of the base is at the bottom, if it was kept
+		if len(history) >= len(oldConfig.History) {
+			history = append(newConfig.History, history[len(oldConfig.History):]...)
+		}
+		if err := setJSON(config, "history", history); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	configDesc, err := writeJSON(ctx, cs, ocispec.MediaTypeImageConfig, config, nil)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	manifest.MediaType = ocispec.MediaTypeImageManifest
+	manifest.Config = configDesc
+	manifest.Layers = layers
+	if manifest.Annotations == nil {
+		manifest.Annotations = map[string]string{}
+	}
+	manifest.Annotations[ocispec.AnnotationBaseImageDigest] = newBase.Digest.String()
+	gcLabels := map[string]string{"containerd.io/gc.ref.content.config": configDesc.Digest.String()}
+	for i, l := range layers {
+		gcLabels[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", i)] = l.Digest.String()
+	}
+	newDesc, err := writeJSON(ctx, cs, ocispec.MediaTypeImageManifest, manifest, gcLabels)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	newDesc.Platform = desc.Platform
+	return newDesc, nil
+}
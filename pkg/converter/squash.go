@@ -0,0 +1,531 @@
+package converter
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// squashEntry is an entry of the squashed tar layers, identified by its
+// position in them.
+type squashEntry struct {
+	name string
+	pos  entryPos
+	dir  bool
+	// link is the entry a hardlink refers to
+	link *squashEntry
+	// promote is set on the first remaining hardlink to a removed file, which
+	// is written out as a regular file with its data instead
+	promote bool
+}
+
+// entryPos is the position of an entry: its layer, and its index in the
+// layer.
+type entryPos struct {
+	layer, index int
+}
+
+// squashTree tracks the result of applying tar layers on top of each other.
+// Whiteouts and opaque directories are kept when they may hide files of the
+// layers below the squashed ones.
+type squashTree struct {
+	entries   map[string]*squashEntry
+	whiteouts map[string]struct{}
+	opaques   map[string]struct{}
+	sparse    bool
+
+	// layer is the layer being applied, and lower the sorted names of the
+	// layers below it, some of which may have been removed since, so that
+	// remove only looks at the range of a directory.  added and marked are
+	// the names of the entries, and of the whiteouts and opaque directories,
+	// of layer.
+	layer  int
+	lower  []string
+	added  []string
+	marked []string
+}
+
+func under(name, dir string) bool {
+	return dir == "." || strings.HasPrefix(name, dir+"/")
+}
+
+// remove drops name (if self is set) and everything below it which comes
+// from a layer below layer.
+func (t *squashTree) remove(name string, layer int, self bool) {
+	drop := func(p string) {
+		if !under(p, name) && !(self && p == name) {
+			return
+		}
+		if e, ok := t.entries[p]; ok && e.pos.layer < layer {
+			delete(t.entries, p)
+		}
+		delete(t.whiteouts, p)
+		delete(t.opaques, p)
+	}
+	if name == "." {
+		for _, p := range t.lower {
+			drop(p)
+		}
+	} else {
+		if i, ok := slices.BinarySearch(t.lower, name); ok {
+			drop(t.lower[i])
+		}
+		prefix := name + "/"
+		i, _ := slices.BinarySearch(t.lower, prefix)
+		for ; i < len(t.lower) && strings.HasPrefix(t.lower[i], prefix); i++ {
+			drop(t.lower[i])
+		}
+	}
+	for _, p := range t.marked {
+		drop(p)
+	}
+	// The entries of the current layer only go with a directory it replaces
+	if layer > t.layer {
+		for _, p := range t.added {
+			drop(p)
+		}
+	}
+}
+
+// next merges the names of the current layer into the sorted names of the
+// lower layers, before applying layer.
+func (t *squashTree) next(layer int) {
+	names := make([]string, 0, len(t.lower)+len(t.added)+len(t.marked))
+	for _, n := range [][]string{t.lower, t.added, t.marked} {
+		for _, p := range n {
+			_, entry := t.entries[p]
+			_, whiteout := t.whiteouts[p]
+			_, opaque := t.opaques[p]
+			if entry || whiteout || opaque {
+				names = append(names, p)
+			}
+		}
+	}
+	slices.Sort(names)
+	t.lower, t.added, t.marked = slices.Compact(names), nil, nil
+	t.layer = layer
+}
+
+// apply applies the entry hdr at pos.  Whiteouts only hide entries of the
+// layers below, as in the OCI image spec.
+func (t *squashTree) apply(hdr *tar.Header, pos entryPos) {
+	if pos.layer != t.layer {
+		t.next(pos.layer)
+	}
+	name := cleanName(hdr.Name)
+	dir, base := path.Dir(name), path.Base(name)
+	switch {
+	case base == whiteoutOpaque:
+		t.remove(dir, pos.layer, false)
+		t.opaques[dir] = struct{}{}
+		t.marked = append(t.marked, dir)
+		return
+	case strings.HasPrefix(base, whiteoutPrefix):
+		p := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+		t.remove(p, pos.layer, true)
+		if _, ok := t.entries[p]; !ok {
+			t.whiteouts[p] = struct{}{}
+			t.marked = append(t.marked, p)
+		}
+		return
+	}
+	if isSparseHeader(hdr) {
+		t.sparse = true
+	}
+
+	e := &squashEntry{name: name, pos: pos, dir: hdr.Typeflag == tar.TypeDir}
+	old := t.entries[name]
+	_, whiteout := t.whiteouts[name]
+	if e.dir {
+		// A directory created again must hide what it had in lower layers
+		if whiteout || old != nil && !old.dir {
+			t.opaques[name] = struct{}{}
+			t.marked = append(t.marked, name)
+		}
+	} else if old != nil && old.dir {
+		t.remove(name, pos.layer+1, false)
+		delete(t.opaques, name)
+	}
+	delete(t.whiteouts, name)
+	if hdr.Typeflag == tar.TypeLink {
+		if target := t.entries[cleanName(hdr.Linkname)]; target != nil {
+			if target.link != nil {
+				target = target.link
+			}
+			e.link = target
+		}
+	}
+	t.entries[name] = e
+	t.added = append(t.added, name)
+}
+
+// resolveLinks returns the remaining entries by position, and the removed
+// entries whose data is still needed by hardlinks.
+func (t *squashTree) resolveLinks() (map[entryPos]*squashEntry, map[entryPos]*squashEntry) {
+	kept := make(map[entryPos]*squashEntry, len(t.entries))
+	var links []*squashEntry
+	for _, e := range t.entries {
+		kept[e.pos] = e
+		if e.link != nil {
+			links = append(links, e)
+		}
+	}
+	slices.SortFunc(links, func(a, b *squashEntry) int {
+		if a.pos.layer != b.pos.layer {
+			return a.pos.layer - b.pos.layer
+		}
+		return a.pos.index - b.pos.index
+	})
+	orphans := map[entryPos]*squashEntry{}
+	promoted := map[*squashEntry]*squashEntry{}
+	for _, e := range links {
+		if t.entries[e.link.name] == e.link {
+			continue
+		}
+		if p, ok := promoted[e.link]; ok {
+			e.link = p
+			continue
+		}
+		promoted[e.link] = e
+		orphans[e.link.pos] = e.link
+		e.promote = true
+	}
+	return kept, orphans
+}
+
+// walkLayer calls fn for every entry of the tar layer desc.
+func walkLayer(ctx context.Context, cs content.Provider, desc ocispec.Descriptor, fn func(index int, hdr *tar.Header, r io.Reader) error) error {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	ds, err := compression.DecompressStream(content.NewReader(ra))
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	tr := tar.NewReader(ds)
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(i, hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// scanSquash applies the tar layers, ordered from the bottom to the top.
+func scanSquash(ctx context.Context, cs content.Provider, layers []ocispec.Descriptor) (*squashTree, error) {
+	t := &squashTree{
+		entries:   map[string]*squashEntry{},
+		whiteouts: map[string]struct{}{},
+		opaques:   map[string]struct{}{},
+	}
+	for i, l := range layers {
+		err := walkLayer(ctx, cs, l, func(index int, hdr *tar.Header, _ io.Reader) error {
+			t.apply(hdr, entryPos{i, index})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read layer %s: %w", l.Digest, err)
+		}
+	}
+	return t, nil
+}
+
+// orphanData is the data of a removed file kept for its hardlinks.
+type orphanData struct {
+	hdr  *tar.Header
+	path string
+}
+
+// writeTar writes the squashed layers as a single tar stream for mkfs.erofs.
+func (t *squashTree) writeTar(ctx context.Context, cs content.Provider, layers []ocispec.Descriptor, w io.Writer) error {
+	kept, orphans := t.resolveLinks()
+	data := map[*squashEntry]orphanData{}
+	defer func() {
+		for _, d := range data {
+			os.Remove(d.path)
+		}
+	}()
+
+	lt := linkTracker{}
+	tw := tar.NewWriter(w)
+	for i, l := range layers {
+		err := walkLayer(ctx, cs, l, func(index int, hdr *tar.Header, r io.Reader) error {
+			pos := entryPos{i, index}
+			if o, ok := orphans[pos]; ok {
+				f, err := os.CreateTemp("", "erofs-squash-")
+				if err != nil {
+					return err
+				}
+				data[o] = orphanData{hdr: hdr, path: f.Name()}
+				_, err = io.Copy(f, r)
+				if err1 := f.Close(); err == nil {
+					err = err1
+				}
+				if err != nil {
+					return err
+				}
+			}
+			e, ok := kept[pos]
+			if !ok {
+				return nil
+			}
+			if e.promote {
+				return writeOrphan(tw, &lt, hdr.Name, data[e.link])
+			}
+			if e.link != nil {
+				hdr.Linkname = e.link.name
+			}
+			lt.rewriteHeader(hdr)
+			if err := tw.WriteHeader(hdr); err != nil {
+				return fmt.Errorf("failed to write %q: %w", hdr.Name, err)
+			}
+			_, err := io.Copy(tw, r)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read layer %s: %w", l.Digest, err)
+		}
+	}
+
+	var markers []string
+	for p := range t.whiteouts {
+		markers = append(markers, path.Join(path.Dir(p), whiteoutPrefix+path.Base(p)))
+	}
+	for p := range t.opaques {
+		markers = append(markers, path.Join(p, whiteoutOpaque))
+	}
+	slices.Sort(markers)
+	for _, m := range markers {
+		if err := tw.WriteHeader(&tar.Header{Name: m, Typeflag: tar.TypeReg, Mode: 0600}); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeOrphan writes the data of a removed file as name.
+func writeOrphan(tw *tar.Writer, lt *linkTracker, name string, d orphanData) error {
+	hdr := *d.hdr
+	hdr.Name = name
+	lt.rewriteHeader(&hdr)
+	if err := tw.WriteHeader(&hdr); err != nil {
+		return fmt.Errorf("failed to write %q: %w", name, err)
+	}
+	f, err := os.Open(d.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// SquashLayers converts the image manifest desc to EROFS, squashing its
+// layers [from, to) into a single EROFS layer.  The other layers are
+// converted one by one as with LayerConvertFunc, so that they are still
+// shared with other images.  It returns the descriptor of the new manifest.
+func SquashLayers(ctx context.Context, cs content.Store, desc ocispec.Descriptor, from, to int, opt ...Option) (ocispec.Descriptor, error) {
+	var opts options
+	for _, o := range opt {
+		if err := o(&opts); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	if !hasMkfsErofs() {
+		return ocispec.Descriptor{}, errdefs.ErrNotImplemented
+	}
+
+	var manifest ocispec.Manifest
+	if err := readJSON(ctx, cs, desc, &manifest); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if from < 0 || to > len(manifest.Layers) || from >= to {
+		return ocispec.Descriptor{}, fmt.Errorf("invalid layer range [%d, %d) for %d layers: %w", from, to, len(manifest.Layers), errdefs.ErrInvalidArgument)
+	}
+	squashed := manifest.Layers[from:to]
+	for _, l := range squashed {
+		if !images.IsLayerType(l.MediaType) || images.IsNonDistributable(l.MediaType) {
+			return ocispec.Descriptor{}, fmt.Errorf("layer %s (%s) can't be squashed: %w", l.Digest, l.MediaType, errdefs.ErrInvalidArgument)
+		}
+	}
+	// Keep unknown (e.g. Docker-specific) config fields as they are
+	var config map[string]json.RawMessage
+	if err := readJSON(ctx, cs, manifest.Config, &config); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var rootfs ocispec.RootFS
+	if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("invalid image config: %w", err)
+	}
+	if len(rootfs.DiffIDs) != len(manifest.Layers) {
+		return ocispec.Descriptor{}, fmt.Errorf("image config has %d diffIDs for %d layers", len(rootfs.DiffIDs), len(manifest.Layers))
+	}
+
+	convertFn := LayerConvertFunc(opt...)
+	var (
+		layers  []ocispec.Descriptor
+		diffIDs []digest.Digest
+	)
+	for i := 0; i < len(manifest.Layers); i++ {
+		if i == from {
+			l, err := squashLayers(ctx, cs, squashed, opts)
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			layers = append(layers, l)
+			diffIDs = append(diffIDs, l.Digest)
+			i = to - 1
+			continue
+		}
+		l := manifest.Layers[i]
+		newDesc, err := convertFn(ctx, cs, l)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to convert layer %s: %w", l.Digest, err)
+		}
+		if newDesc == nil || newDesc.MediaType != MediaTypeErofsLayer {
+			if newDesc != nil {
+				l = *newDesc
+			}
+			layers = append(layers, l)
+			diffIDs = append(diffIDs, rootfs.DiffIDs[i])
+			continue
+		}
+		layers = append(layers, *newDesc)
+		diffIDs = append(diffIDs, newDesc.Digest)
+	}
+
+	rootfs.DiffIDs = diffIDs
+	if err := setJSON(config, "rootfs", rootfs); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if h, ok := config["history"]; ok {
+		var history []ocispec.History
+		if err := json.Unmarshal(h, &history); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("invalid image config history: %w", err)
+		}
+		squashHistory(history, len(manifest.Layers), from, to)
+		if err := setJSON(config, "history", history); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	configDesc, err := writeJSON(ctx, cs, ocispec.MediaTypeImageConfig, config, nil)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	manifest.MediaType = ocispec.MediaTypeImageManifest
+	manifest.Config = configDesc
+	manifest.Layers = layers
+	gcLabels := map[string]string{"containerd.io/gc.ref.content.config": configDesc.Digest.String()}
+	for i, l := range layers {
+		gcLabels[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", i)] = l.Digest.String()
+	}
+	newDesc, err := writeJSON(ctx, cs, ocispec.MediaTypeImageManifest, manifest, gcLabels)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	newDesc.Platform = desc.Platform
+	return newDesc, nil
+}
+
+// squashLayers builds a single EROFS layer from the tar layers.
+func squashLayers(ctx context.Context, cs content.Store, layers []ocispec.Descriptor, opts options) (ocispec.Descriptor, error) {
+	t, err := scanSquash(ctx, cs, layers)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	log.G(ctx).Debugf("squashing %d layers: %d entries, %d whiteouts, %d opaque directories",
+		len(layers), len(t.entries), len(t.whiteouts), len(t.opaques))
+
+	blob, err := os.CreateTemp("", TempFilePrefix)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer os.Remove(blob.Name())
+	defer blob.Close()
+	// Mark the file as in use so that it won't be reaped as stale
+	if err := unix.Flock(int(blob.Fd()), unix.LOCK_SH); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	dgstr := digest.SHA256.Digester()
+	for _, l := range layers {
+		dgstr.Hash().Write([]byte(l.Digest))
+	}
+	convertCtx, cancel := opts.withLayerTimeout(ctx, dgstr.Digest())
+	defer cancel()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(t.writeTar(convertCtx, cs, layers, pw))
+	}()
+	defer pr.Close()
+	if err := convertTarErofs(convertCtx, pr, blob.Name(), opts.mkfsOpts(t.sparse)); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	ref := fmt.Sprintf("%ssquash-%s", IngestRefPrefix, dgstr.Digest().Encoded())
+	return commitBlob(ctx, cs, blob, ref, map[string]string{}, opts)
+}
+
+// squashHistory marks the history entries of the layers [from, to), but the
+// last one, as empty.  It's left as is if it doesn't match the layers.
+func squashHistory(history []ocispec.History, layers, from, to int) {
+	var idx []int
+	for i, h := range history {
+		if !h.EmptyLayer {
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) != layers {
+		return
+	}
+	for _, i := range idx[from : to-1] {
+		history[i].EmptyLayer = true
+	}
+}
+
+func readJSON(ctx context.Context, cs content.Provider, desc ocispec.Descriptor, v any) error {
+	b, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func setJSON(m map[string]json.RawMessage, key string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m[key] = b
+	return nil
+}
@@ -0,0 +1,211 @@
+package converter
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+)
+
+// sparseChunkSize is the chunk size used for layers with sparse files, so
+// that all-zero ranges are deduplicated by mkfs.erofs instead of being
+// written out block by block.
+const sparseChunkSize = 65536
+
+// entrySlack is how much larger than in a tar stream an entry may be in an
+// EROFS blob, as its data is padded to a block instead of 512 bytes.
+const entrySlack = 4096
+
+// tarStats describes the entries of a tar stream which need special care.
+type tarStats struct {
+	// entries is the number of entries
+	entries int
+	// sparseFiles is the number of sparse entries
+	sparseFiles int
+	// holeBytes is the size of the holes of the sparse entries, measured
+	// by rewriteTar
+	holeBytes int64
+	// hardlinks is the number of hardlink entries
+	hardlinks int
+	// linkFixups is the number of hardlinks which point to other hardlinks
+	linkFixups int
+}
+
+// needsRewrite returns true if the tar stream must be rewritten before
+// being fed to mkfs.erofs.
+func (st tarStats) needsRewrite() bool {
+	return st.sparseFiles > 0 || st.linkFixups > 0
+}
+
+// cleanName returns the canonical form of a tar entry name, e.g.
+// "./usr//bin/" becomes "usr/bin".
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// linkTracker resolves hardlink chains in a single pass.  Only hardlink
+// entries are recorded, so memory usage is bounded by the number of links
+// rather than the number of files in the layer.
+type linkTracker struct {
+	// targets are the resolved targets of the hardlinks, by canonical name
+	targets map[string]string
+	// links are the hardlinks to each resolved target
+	links map[string][]string
+}
+
+// resolve returns the canonical name of the file that a hardlink to name
+// really refers to.
+func (lt *linkTracker) resolve(name string) string {
+	name = cleanName(name)
+	if target, ok := lt.targets[name]; ok {
+		// Chains are collapsed when recorded, so one lookup is enough
+		return target
+	}
+	return name
+}
+
+// add records the hardlink entry hdr and returns its resolved target.
+func (lt *linkTracker) add(hdr *tar.Header) string {
+	if lt.targets == nil {
+		lt.targets, lt.links = map[string]string{}, map[string][]string{}
+	}
+	name, target := cleanName(hdr.Name), lt.resolve(hdr.Linkname)
+	lt.forget(name)
+	lt.targets[name] = target
+	lt.links[target] = append(lt.links[target], name)
+	return target
+}
+
+// forget drops name when it's replaced by another entry, and the hardlinks
+// to it: they're still the file it replaces, which they now resolve to.
+func (lt *linkTracker) forget(name string) {
+	if len(lt.targets) == 0 {
+		return
+	}
+	name = cleanName(name)
+	if target, ok := lt.targets[name]; ok {
+		delete(lt.targets, name)
+		if links := slices.DeleteFunc(lt.links[target], func(l string) bool { return l == name }); len(links) > 0 {
+			lt.links[target] = links
+		} else {
+			delete(lt.links, target)
+		}
+	}
+	for _, l := range lt.links[name] {
+		delete(lt.targets, l)
+	}
+	delete(lt.links, name)
+}
+
+func isSparseHeader(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// scanTar walks the headers of a tar stream and collects statistics about
+// sparse files and hardlinks.  File data is skipped, without being read if r
+// is seekable: the holes are only measured when the stream is rewritten.
+func scanTar(r io.Reader) (tarStats, error) {
+	var st tarStats
+	lt := linkTracker{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return st, nil
+		}
+		if err != nil {
+			return st, err
+		}
+		st.entries++
+		if hdr.Typeflag == tar.TypeLink {
+			st.hardlinks++
+			if lt.add(hdr) != cleanName(hdr.Linkname) {
+				st.linkFixups++
+			}
+			continue
+		}
+		lt.forget(hdr.Name)
+		if isSparseHeader(hdr) {
+			st.sparseFiles++
+		}
+	}
+}
+
+// rewriteHeader rewrites a tar header for mkfs.erofs, see rewriteTar.
+func (lt *linkTracker) rewriteHeader(hdr *tar.Header) {
+	if hdr.Typeflag == tar.TypeLink {
+		hdr.Linkname = lt.add(hdr)
+	} else {
+		lt.forget(hdr.Name)
+	}
+	if isSparseHeader(hdr) {
+		hdr.Typeflag = tar.TypeReg
+		for k := range hdr.PAXRecords {
+			if strings.HasPrefix(k, "GNU.sparse.") {
+				delete(hdr.PAXRecords, k)
+			}
+		}
+		hdr.Format = tar.FormatUnknown
+	}
+}
+
+// rewriteTar rewrites a tar stream for mkfs.erofs: sparse entries become
+// regular files since GNU sparse maps aren't parsed, and hardlinks are
+// pointed directly at the canonical names of their original files so that
+// link counts are kept exactly.  It returns the size of the holes of the
+// sparse entries: their size less the data stored in the stream.
+func rewriteTar(r io.Reader, w io.Writer) (int64, error) {
+	var holes int64
+	lt := linkTracker{}
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return holes, err
+		}
+		sparse := isSparseHeader(hdr)
+		lt.rewriteHeader(hdr)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return holes, fmt.Errorf("failed to rewrite %q: %w", hdr.Name, err)
+		}
+		stored := cr.n
+		n, err := io.Copy(tw, tr)
+		if err != nil {
+			return holes, err
+		}
+		if sparse {
+			holes += n - (cr.n - stored)
+		}
+	}
+	return holes, tw.Close()
+}
+
+// verifySparse checks that holes weren't materialized in the generated blob:
+// a tar stream only carries the data of sparse files, so an EROFS blob which
+// grew by (most of) the hole size, beyond the padding of its entries, has
+// failed to keep them.
+func verifySparse(st tarStats, tarSize, blobSize int64) error {
+	if st.sparseFiles == 0 || st.holeBytes == 0 {
+		return nil
+	}
+	if blobSize-tarSize-int64(st.entries)*entrySlack >= st.holeBytes/2 {
+		return fmt.Errorf("sparse files were materialized: %d-byte blob from %d-byte tar with %d hole bytes in %d files",
+			blobSize, tarSize, st.holeBytes, st.sparseFiles)
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// rawHeader returns a ustar header block, as archive/tar can't write the
+// headers of sparse files.
+func rawHeader(name string, typeflag byte, size int64) []byte {
+	b := make([]byte, 512)
+	copy(b[0:100], name)
+	copy(b[100:108], "0000644\x00")
+	copy(b[108:116], "0000000\x00")
+	copy(b[116:124], "0000000\x00")
+	copy(b[124:136], fmt.Sprintf("%011o\x00", size))
+	copy(b[136:148], fmt.Sprintf("%011o\x00", 0))
+	b[156] = typeflag
+	copy(b[257:265], "ustar\x0000")
+	copy(b[148:156], "        ")
+	var sum int
+	for _, c := range b {
+		sum += int(c)
+	}
+	copy(b[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return b
+}
+
+// pad pads b to a multiple of 512 bytes.
+func pad(b []byte) []byte {
+	if r := len(b) % 512; r != 0 {
+		b = append(b, make([]byte, 512-r)...)
+	}
+	return b
+}
+
+// paxHeader returns a PAX extended header block with records, in order.
+func paxHeader(records ...string) []byte {
+	var data []byte
+	for i := 0; i < len(records); i += 2 {
+		kv := records[i] + "=" + records[i+1] + "\n"
+		// The length includes itself
+		n := len(kv) + 2
+		for len(fmt.Sprintf("%d %s", n, kv)) != n {
+			n++
+		}
+		data = append(data, fmt.Sprintf("%d %s", n, kv)...)
+	}
+	return append(rawHeader("PaxHeaders/sparse", tar.TypeXHeader, int64(len(data))), pad(data)...)
+}
+
+// sparseChunk is a data range of a sparse file.
+type sparseChunk struct {
+	offset int64
+	data   string
+}
+
+// sparseTar returns a tar stream with a regular file "before", the sparse
+// file "sparse" of realSize bytes with chunks, in the GNU PAX sparse format
+// version, and a regular file "after".
+func sparseTar(t *testing.T, version string, realSize int64, chunks []sparseChunk) []byte {
+	t.Helper()
+	var (
+		stored  []byte
+		offsets []string
+		entries []string
+	)
+	for _, c := range chunks {
+		stored = append(stored, c.data...)
+		offsets = append(offsets, fmt.Sprint(c.offset), fmt.Sprint(len(c.data)))
+		entries = append(entries, "GNU.sparse.offset", fmt.Sprint(c.offset), "GNU.sparse.numbytes", fmt.Sprint(len(c.data)))
+	}
+	numBlocks := fmt.Sprint(len(chunks))
+	size := fmt.Sprint(realSize)
+
+	var b bytes.Buffer
+	b.Write(rawHeader("before", tar.TypeReg, 5))
+	b.Write(pad([]byte("hello")))
+	switch version {
+	case "0.0":
+		b.Write(paxHeader(append([]string{"GNU.sparse.size", size, "GNU.sparse.numblocks", numBlocks}, entries...)...))
+		b.Write(rawHeader("sparse", tar.TypeReg, int64(len(stored))))
+		b.Write(pad(stored))
+	case "0.1":
+		b.Write(paxHeader("GNU.sparse.size", size, "GNU.sparse.numblocks", numBlocks, "GNU.sparse.map", strings.Join(offsets, ",")))
+		b.Write(rawHeader("sparse", tar.TypeReg, int64(len(stored))))
+		b.Write(pad(stored))
+	case "1.0":
+		b.Write(paxHeader("GNU.sparse.major", "1", "GNU.sparse.minor", "0", "GNU.sparse.name", "sparse", "GNU.sparse.realsize", size))
+		sparseMap := pad([]byte(numBlocks + "\n" + strings.Join(offsets, "\n") + "\n"))
+		b.Write(rawHeader("GNUSparseFile.0/sparse", tar.TypeReg, int64(len(sparseMap)+len(stored))))
+		b.Write(pad(append(sparseMap, stored...)))
+	default:
+		t.Fatalf("unknown sparse version %s", version)
+	}
+	b.Write(rawHeader("after", tar.TypeReg, 3))
+	b.Write(pad([]byte("bye")))
+	b.Write(make([]byte, 1024))
+	return b.Bytes()
+}
+
+func TestRewriteTarSparse(t *testing.T) {
+	chunks := []sparseChunk{{0, "start"}, {8192, "middle"}, {65536, "end"}}
+	const realSize = 65539
+	expected := make([]byte, realSize)
+	for _, c := range chunks {
+		copy(expected[c.offset:], c.data)
+	}
+	for _, version := range []string{"0.0", "0.1", "1.0"} {
+		t.Run(version, func(t *testing.T) {
+			in := sparseTar(t, version, realSize, chunks)
+
+			st, err := scanTar(bytes.NewReader(in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.sparseFiles != 1 || st.entries != 3 || !st.needsRewrite() {
+				t.Fatalf("unexpected stats %+v", st)
+			}
+
+			var out bytes.Buffer
+			holes, err := rewriteTar(bytes.NewReader(in), &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored := int64(len("start") + len("middle") + len("end")); holes != realSize-stored {
+				t.Errorf("%d hole bytes, expected %d", holes, realSize-stored)
+			}
+
+			tr := tar.NewReader(&out)
+			files := map[string][]byte{}
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hdr.Typeflag != tar.TypeReg || isSparseHeader(hdr) {
+					t.Errorf("%s: rewritten entry isn't a plain regular file: %c %v", hdr.Name, hdr.Typeflag, hdr.PAXRecords)
+				}
+				if files[hdr.Name], err = io.ReadAll(tr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(files["before"]) != "hello" || string(files["after"]) != "bye" {
+				t.Errorf("regular files changed: %q %q", files["before"], files["after"])
+			}
+			if !bytes.Equal(files["sparse"], expected) {
+				t.Errorf("sparse file expanded to %d bytes, expected its %d bytes with zeroed holes", len(files["sparse"]), realSize)
+			}
+		})
+	}
+}
+
+func TestRewriteTarNoHoles(t *testing.T) {
+	// A sparse file fully stored has no holes
+	in := sparseTar(t, "0.1", 5, []sparseChunk{{0, "dense"}})
+	holes, err := rewriteTar(bytes.NewReader(in), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holes != 0 {
+		t.Errorf("%d hole bytes, expected none", holes)
+	}
+}
+
+func TestVerifySparse(t *testing.T) {
+	const mib = 1 << 20
+	for _, tc := range []struct {
+		name          string
+		st            tarStats
+		tarSize, blob int64
+		fail          bool
+	}{
+		{name: "no sparse files", st: tarStats{entries: 10}, tarSize: mib, blob: 100 * mib},
+		{name: "holes kept", st: tarStats{entries: 3, sparseFiles: 1, holeBytes: 100 * mib}, tarSize: mib, blob: mib},
+		{name: "holes materialized", st: tarStats{entries: 3, sparseFiles: 1, holeBytes: 100 * mib}, tarSize: mib, blob: 101 * mib, fail: true},
+		{name: "half the holes materialized", st: tarStats{entries: 3, sparseFiles: 1, holeBytes: 100 * mib}, tarSize: mib, blob: 51*mib + 3*entrySlack, fail: true},
+		{name: "no holes", st: tarStats{entries: 3, sparseFiles: 1}, tarSize: mib, blob: 2 * mib},
+		// Random data padded to blocks grows the blob by more than the
+		// few hole bytes of a sparse file
+		{name: "poorly compressible", st: tarStats{entries: 1000, sparseFiles: 1, holeBytes: 8192}, tarSize: 100 * mib, blob: 100*mib + 1000*3584},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifySparse(tc.st, tc.tarSize, tc.blob)
+			if tc.fail && err == nil {
+				t.Fatal("expected the materialized holes to be detected")
+			} else if !tc.fail && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestLinkTracker(t *testing.T) {
+	reg := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+	}
+	link := func(name, target string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: target, Mode: 0644}
+	}
+	for _, tc := range []struct {
+		name    string
+		entries []*tar.Header
+		// links are the expected targets of the rewritten hardlinks
+		links  map[string]string
+		fixups int
+	}{
+		{
+			name:    "link to a link",
+			entries: []*tar.Header{reg("a"), link("b", "a"), link("c", "b"), link("d", "./c")},
+			links:   map[string]string{"b": "a", "c": "a", "d": "a"},
+			fixups:  2,
+		},
+		{
+			name:    "canonical names",
+			entries: []*tar.Header{reg("./usr/bin/a"), link("usr/bin/b", "./usr//bin/a"), link("./usr/bin/c", "usr/bin/b/")},
+			links:   map[string]string{"usr/bin/b": "usr/bin/a", "usr/bin/c": "usr/bin/a"},
+			fixups:  1,
+		},
+		{
+			// b is still the file a replaced, and c links to the new a
+			name:    "target replaced",
+			entries: []*tar.Header{reg("a"), link("b", "a"), reg("a"), link("c", "a"), link("d", "b")},
+			links:   map[string]string{"b": "a", "c": "a", "d": "b"},
+		},
+		{
+			// c links to the file replacing b, not to a
+			name:    "link across forget",
+			entries: []*tar.Header{reg("a"), link("b", "a"), reg("b"), link("c", "b")},
+			links:   map[string]string{"b": "a", "c": "b"},
+		},
+		{
+			name:    "link replaced by a link",
+			entries: []*tar.Header{reg("a"), reg("x"), link("b", "a"), link("b", "x"), link("c", "b")},
+			links:   map[string]string{"b": "x", "c": "x"},
+			fixups:  1,
+		},
+		{
+			// The whiteouts of a layer only hide the lower layers, the
+			// links of the layer to a are kept
+			name:    "link to a whiteout-deleted file",
+			entries: []*tar.Header{reg("a"), link("b", "a"), reg(".wh.a"), link("c", "b")},
+			links:   map[string]string{"b": "a", "c": "a"},
+			fixups:  1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var in bytes.Buffer
+			tw := tar.NewWriter(&in)
+			for _, hdr := range tc.entries {
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			st, err := scanTar(bytes.NewReader(in.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.linkFixups != tc.fixups || st.needsRewrite() != (tc.fixups > 0) {
+				t.Errorf("%d link fixups, expected %d", st.linkFixups, tc.fixups)
+			}
+
+			var out bytes.Buffer
+			if _, err := rewriteTar(bytes.NewReader(in.Bytes()), &out); err != nil {
+				t.Fatal(err)
+			}
+			links := map[string]string{}
+			tr := tar.NewReader(&out)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hdr.Typeflag == tar.TypeLink {
+					links[cleanName(hdr.Name)] = hdr.Linkname
+				}
+			}
+			if fmt.Sprint(links) != fmt.Sprint(tc.links) {
+				t.Errorf("rewritten links %v, expected %v", links, tc.links)
+			}
+		})
+	}
+}
+
+func TestLinkTrackerForget(t *testing.T) {
+	var lt linkTracker
+	// forget before any link is a no-op
+	lt.forget("a")
+	lt.add(&tar.Header{Name: "b", Typeflag: tar.TypeLink, Linkname: "a"})
+	lt.add(&tar.Header{Name: "c", Typeflag: tar.TypeLink, Linkname: "a"})
+	lt.forget("b")
+	if got := lt.resolve("b"); got != "b" {
+		t.Errorf("forgotten link resolves to %q", got)
+	}
+	if got := lt.resolve("c"); got != "a" {
+		t.Errorf("c resolves to %q, expected a", got)
+	}
+	lt.forget("a")
+	if got := lt.resolve("c"); got != "c" {
+		t.Errorf("link to a forgotten target resolves to %q", got)
+	}
+	if len(lt.targets) != 0 || len(lt.links) != 0 {
+		t.Errorf("links left after forgetting them all: %v %v", lt.targets, lt.links)
+	}
+}
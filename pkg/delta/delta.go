@@ -0,0 +1,383 @@
+// Package delta computes block-level deltas between two EROFS blobs, so that
+// nodes which already have the old blob only need to fetch the changed
+// blocks of the new one.
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// DefaultBlockSize is the delta granularity, which matches the usual
+	// EROFS block size.
+	DefaultBlockSize = 4096
+
+	magic   = "EROFSDLT"
+	version = 1
+
+	opCopy = 'C'
+	opData = 'D'
+	opEnd  = 'E'
+
+	// maxDataSize bounds the changed blocks kept in memory before they're
+	// written as a data op
+	maxDataSize = 1 << 20
+)
+
+// Header describes a delta artifact.
+type Header struct {
+	BlockSize uint32
+	// OldDigest and NewDigest identify the blobs the delta was computed
+	// between.
+	OldDigest digest.Digest
+	NewDigest digest.Digest
+	NewSize   int64
+}
+
+// Stats reports how much of the new blob is carried by a delta.
+type Stats struct {
+	TotalBlocks   int64
+	CopiedBlocks  int64
+	ChangedBlocks int64
+	// Size is the size of the delta artifact itself
+	Size int64
+}
+
+type options struct {
+	blockSize uint32
+}
+
+type Opt func(o *options) error
+
+// WithBlockSize overrides DefaultBlockSize.
+func WithBlockSize(bs uint32) Opt {
+	return func(o *options) error {
+		if bs < 512 || bs&(bs-1) != 0 {
+			return fmt.Errorf("invalid delta block size %d: %w", bs, errdefs.ErrInvalidArgument)
+		}
+		o.blockSize = bs
+		return nil
+	}
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func writeString(w io.Writer, s string) error {
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func readString(r io.Reader) (string, error) {
+	var l uint16
+	if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+		return "", err
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func writeHeader(w io.Writer, h Header) error {
+	if _, err := io.WriteString(w, magic); err != nil {
+		return err
+	}
+	for _, v := range []any{uint32(version), h.BlockSize, h.NewSize} {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	if err := writeString(w, h.OldDigest.String()); err != nil {
+		return err
+	}
+	return writeString(w, h.NewDigest.String())
+}
+
+// ReadHeader reads the header of a delta artifact.
+func ReadHeader(r io.Reader) (Header, error) {
+	var (
+		h   Header
+		m   [len(magic)]byte
+		ver uint32
+	)
+	if _, err := io.ReadFull(r, m[:]); err != nil {
+		return h, err
+	}
+	if string(m[:]) != magic {
+		return h, fmt.Errorf("not an EROFS delta: %w", errdefs.ErrInvalidArgument)
+	}
+	for _, v := range []any{&ver, &h.BlockSize, &h.NewSize} {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return h, err
+		}
+	}
+	if ver != version {
+		return h, fmt.Errorf("unsupported delta version %d: %w", ver, errdefs.ErrNotImplemented)
+	}
+	for _, d := range []*digest.Digest{&h.OldDigest, &h.NewDigest} {
+		s, err := readString(r)
+		if err != nil {
+			return h, err
+		}
+		if *d, err = digest.Parse(s); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// indexBlocks returns the first block number of every distinct block in r.
+func indexBlocks(r io.Reader, bs uint32) (map[[sha256.Size]byte]uint64, digest.Digest, error) {
+	index := make(map[[sha256.Size]byte]uint64)
+	dgstr := digest.Canonical.Digester()
+	buf := make([]byte, bs)
+	for blk := uint64(0); ; blk++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			dgstr.Hash().Write(buf[:n])
+			if n == len(buf) {
+				sum := sha256.Sum256(buf)
+				if _, ok := index[sum]; !ok {
+					index[sum] = blk
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return index, dgstr.Digest(), nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+// Generate writes the delta transforming old into new to w.
+func Generate(old, new io.Reader, w io.Writer, opts ...Opt) (*Stats, error) {
+	o := options{blockSize: DefaultBlockSize}
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+	bs := o.blockSize
+
+	index, oldDigest, err := indexBlocks(old, bs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to index old blob: %w", err)
+	}
+
+	// The new blob is streamed once; its digest and size are only known at
+	// the end, so ops are spooled to a temporary file before the header is
+	// written.
+	spool, err := os.CreateTemp("", "erofs-delta-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	ops := bufio.NewWriter(spool)
+	var (
+		stats   Stats
+		newSize int64
+		pending []byte // changed blocks not yet flushed
+		copyAt  uint64
+		copyN   uint32
+	)
+	// The write errors of ops are returned by its Flush
+	flushCopy := func() {
+		if copyN > 0 {
+			ops.WriteByte(opCopy)
+			binary.Write(ops, binary.LittleEndian, copyAt)
+			binary.Write(ops, binary.LittleEndian, copyN)
+			copyN = 0
+		}
+	}
+	flushData := func() {
+		if len(pending) > 0 {
+			ops.WriteByte(opData)
+			binary.Write(ops, binary.LittleEndian, uint32(len(pending)/int(bs)))
+			ops.Write(pending)
+			pending = pending[:0]
+		}
+	}
+
+	dgstr := digest.Canonical.Digester()
+	buf := make([]byte, bs)
+	for {
+		n, err := io.ReadFull(new, buf)
+		if n > 0 {
+			dgstr.Hash().Write(buf[:n])
+			newSize += int64(n)
+			stats.TotalBlocks++
+			clear(buf[n:])
+			if blk, ok := index[sha256.Sum256(buf)]; ok && n == len(buf) {
+				flushData()
+				if copyN > 0 && copyAt+uint64(copyN) != blk {
+					flushCopy()
+				}
+				if copyN == 0 {
+					copyAt = blk
+				}
+				copyN++
+				stats.CopiedBlocks++
+			} else {
+				flushCopy()
+				pending = append(pending, buf...)
+				stats.ChangedBlocks++
+				if len(pending) >= maxDataSize {
+					flushData()
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read new blob: %w", err)
+		}
+	}
+	flushCopy()
+	flushData()
+	ops.WriteByte(opEnd)
+	if err := ops.Flush(); err != nil {
+		return nil, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	if err := writeHeader(bw, Header{
+		BlockSize: bs,
+		OldDigest: oldDigest,
+		NewDigest: dgstr.Digest(),
+		NewSize:   newSize,
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(bw, spool); err != nil {
+		return nil, err
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	stats.Size = cw.n
+	return &stats, nil
+}
+
+// Apply reconstructs the new blob from old and a delta to w.  old must be the
+// blob the delta was generated from, and the new blob is spooled to a
+// temporary file until its digest is verified, so that nothing is written to
+// w unless it matches.
+func Apply(old io.ReaderAt, delta io.Reader, w io.Writer) (Header, error) {
+	br := bufio.NewReader(delta)
+	h, err := ReadHeader(br)
+	if err != nil {
+		return h, err
+	}
+	oldDgstr := h.OldDigest.Algorithm().Digester()
+	if _, err := io.Copy(oldDgstr.Hash(), io.NewSectionReader(old, 0, math.MaxInt64)); err != nil {
+		return h, fmt.Errorf("failed to read old blob: %w", err)
+	}
+	if d := oldDgstr.Digest(); d != h.OldDigest {
+		return h, fmt.Errorf("old blob %s, delta generated from %s: %w", d, h.OldDigest, errdefs.ErrFailedPrecondition)
+	}
+
+	spool, err := os.CreateTemp("", "erofs-delta-")
+	if err != nil {
+		return h, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	out := bufio.NewWriter(spool)
+	bs := int64(h.BlockSize)
+	dgstr := h.NewDigest.Algorithm().Digester()
+	mw := io.MultiWriter(out, dgstr.Hash())
+	remaining := h.NewSize
+	// The last block may be partial, so never emit more than NewSize bytes
+	emit := func(r io.Reader, n int64) error {
+		keep := min(n, remaining)
+		if _, err := io.CopyN(mw, r, keep); err != nil {
+			return err
+		}
+		remaining -= keep
+		if n > keep {
+			_, err := io.CopyN(io.Discard, r, n-keep)
+			return err
+		}
+		return nil
+	}
+
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return h, fmt.Errorf("truncated delta: %w", err)
+		}
+		switch op {
+		case opCopy:
+			var (
+				blk uint64
+				n   uint32
+			)
+			if err := binary.Read(br, binary.LittleEndian, &blk); err != nil {
+				return h, err
+			}
+			if err := binary.Read(br, binary.LittleEndian, &n); err != nil {
+				return h, err
+			}
+			sr := io.NewSectionReader(old, int64(blk)*bs, int64(n)*bs)
+			if err := emit(sr, int64(n)*bs); err != nil {
+				return h, fmt.Errorf("failed to copy old blocks %d+%d: %w", blk, n, err)
+			}
+		case opData:
+			var n uint32
+			if err := binary.Read(br, binary.LittleEndian, &n); err != nil {
+				return h, err
+			}
+			if err := emit(br, int64(n)*bs); err != nil {
+				return h, fmt.Errorf("failed to read delta data: %w", err)
+			}
+		case opEnd:
+			if remaining != 0 {
+				return h, fmt.Errorf("delta ended %d bytes early", remaining)
+			}
+			if d := dgstr.Digest(); d != h.NewDigest {
+				return h, fmt.Errorf("unexpected digest %s, expected %s: %w", d, h.NewDigest, errdefs.ErrFailedPrecondition)
+			}
+			if err := out.Flush(); err != nil {
+				return h, err
+			}
+			if _, err := spool.Seek(0, io.SeekStart); err != nil {
+				return h, err
+			}
+			_, err := io.Copy(w, spool)
+			return h, err
+		default:
+			return h, fmt.Errorf("invalid delta op %q", op)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package delta
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func generate(t *testing.T, old, new []byte, opts ...Opt) ([]byte, *Stats) {
+	t.Helper()
+	var delta bytes.Buffer
+	stats, err := Generate(bytes.NewReader(old), bytes.NewReader(new), &delta, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Size != int64(delta.Len()) {
+		t.Fatalf("delta size %d, written %d", stats.Size, delta.Len())
+	}
+	return delta.Bytes(), stats
+}
+
+func TestRoundTrip(t *testing.T) {
+	old := randomBytes(1, 8*DefaultBlockSize+100)
+	changed := bytes.Clone(old)
+	copy(changed[3*DefaultBlockSize:], randomBytes(2, DefaultBlockSize))
+
+	for _, tc := range []struct {
+		name string
+		old  []byte
+		new  []byte
+		// copied are the blocks of new expected to be copied from old
+		copied int64
+	}{
+		{name: "identical", old: old, new: old, copied: 8},
+		{name: "appended", old: old, new: append(bytes.Clone(old[:8*DefaultBlockSize]), randomBytes(3, 2*DefaultBlockSize+10)...), copied: 8},
+		{name: "truncated", old: old, new: old[:5*DefaultBlockSize+7], copied: 5},
+		{name: "changed block", old: old, new: changed, copied: 7},
+		{name: "moved blocks", old: old, new: append(bytes.Clone(old[4*DefaultBlockSize:8*DefaultBlockSize]), old[:4*DefaultBlockSize]...), copied: 8},
+		{name: "empty old", old: nil, new: old},
+		{name: "empty new", old: old, new: nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			delta, stats := generate(t, tc.old, tc.new)
+			if stats.CopiedBlocks != tc.copied {
+				t.Errorf("copied %d blocks, expected %d", stats.CopiedBlocks, tc.copied)
+			}
+			if stats.CopiedBlocks+stats.ChangedBlocks != stats.TotalBlocks {
+				t.Errorf("%d copied and %d changed blocks of %d", stats.CopiedBlocks, stats.ChangedBlocks, stats.TotalBlocks)
+			}
+
+			var out bytes.Buffer
+			h, err := Apply(bytes.NewReader(tc.old), bytes.NewReader(delta), &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), tc.new) {
+				t.Fatalf("reconstructed %d bytes differ from the %d bytes of the new blob", out.Len(), len(tc.new))
+			}
+			if h.OldDigest != digest.FromBytes(tc.old) || h.NewDigest != digest.FromBytes(tc.new) || h.NewSize != int64(len(tc.new)) {
+				t.Errorf("unexpected header %+v", h)
+			}
+		})
+	}
+}
+
+func TestRoundTripBlockSize(t *testing.T) {
+	old := randomBytes(1, 10*512+3)
+	new := append(bytes.Clone(old[512:]), randomBytes(2, 700)...)
+	delta, stats := generate(t, old, new, WithBlockSize(512))
+	if stats.CopiedBlocks != 9 {
+		t.Errorf("copied %d blocks, expected 9", stats.CopiedBlocks)
+	}
+	var out bytes.Buffer
+	if _, err := Apply(bytes.NewReader(old), bytes.NewReader(delta), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), new) {
+		t.Fatal("reconstructed blob differs from the new blob")
+	}
+}
+
+func TestApplyWrongBase(t *testing.T) {
+	old := randomBytes(1, 4*DefaultBlockSize)
+	new := append(bytes.Clone(old), randomBytes(2, DefaultBlockSize)...)
+	delta, _ := generate(t, old, new)
+
+	other := bytes.Clone(old)
+	other[0] ^= 0xff
+	var out bytes.Buffer
+	_, err := Apply(bytes.NewReader(other), bytes.NewReader(delta), &out)
+	if !errors.Is(err, errdefs.ErrFailedPrecondition) {
+		t.Fatalf("expected ErrFailedPrecondition, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("%d bytes written with a wrong base", out.Len())
+	}
+}
+
+func TestApplyCorruptedDelta(t *testing.T) {
+	old := randomBytes(1, 4*DefaultBlockSize)
+	new := append(bytes.Clone(old), randomBytes(2, DefaultBlockSize)...)
+	delta, _ := generate(t, old, new)
+
+	// The data of the last block is at the end, before the end op
+	delta[len(delta)-2] ^= 0xff
+	var out bytes.Buffer
+	_, err := Apply(bytes.NewReader(old), bytes.NewReader(delta), &out)
+	if !errors.Is(err, errdefs.ErrFailedPrecondition) {
+		t.Fatalf("expected ErrFailedPrecondition, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("%d bytes written from a corrupted delta", out.Len())
+	}
+
+	out.Reset()
+	if _, err := Apply(bytes.NewReader(old), bytes.NewReader(delta[:len(delta)-100]), &out); err == nil {
+		t.Fatal("expected a truncated delta to fail")
+	}
+	if out.Len() != 0 {
+		t.Fatalf("%d bytes written from a truncated delta", out.Len())
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	if _, err := ReadHeader(bytes.NewReader([]byte("NOTADELTA..."))); !errors.Is(err, errdefs.ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument, got %v", err)
+	}
+	if err := WithBlockSize(1000)(&options{}); !errors.Is(err, errdefs.ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument for a block size which isn't a power of 2, got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// MediaTypeDelta is the media type of delta blobs.
+	MediaTypeDelta = "application/vnd.erofs.delta.v1"
+	// ArtifactTypeDelta is the artifact type of delta manifests.
+	ArtifactTypeDelta = "application/vnd.erofs.delta.manifest.v1"
+
+	// AnnotationBase is the digest of the old layer a delta applies to.
+	AnnotationBase = "io.github.erofs.delta.base"
+	// AnnotationTarget is the digest of the layer a delta reconstructs.
+	AnnotationTarget = "io.github.erofs.delta.target"
+
+	// IngestRefPrefix is the prefix of content store ingest refs used for
+	// generating deltas.
+	IngestRefPrefix = "erofs-delta-"
+)
+
+// GenerateLayer computes the delta between two blobs of the content store
+// and commits it.
+func GenerateLayer(ctx context.Context, cs content.Store, oldDesc, newDesc ocispec.Descriptor, opts ...Opt) (ocispec.Descriptor, *Stats, error) {
+	var old io.Reader = bytes.NewReader(nil)
+	if oldDesc.Digest != "" {
+		ra, err := cs.ReaderAt(ctx, oldDesc)
+		if err != nil {
+			return ocispec.Descriptor{}, nil, err
+		}
+		defer ra.Close()
+		old = content.NewReader(ra)
+	}
+	ra, err := cs.ReaderAt(ctx, newDesc)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	defer ra.Close()
+
+	ref := fmt.Sprintf("%s%s-%s", IngestRefPrefix, oldDesc.Digest.Encoded(), newDesc.Digest.Encoded())
+	w, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	defer w.Close()
+	if err := w.Truncate(0); err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+
+	stats, err := Generate(old, content.NewReader(ra), w, opts...)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	if err := w.Commit(ctx, stats.Size, ""); err != nil && !errdefs.IsAlreadyExists(err) {
+		return ocispec.Descriptor{}, nil, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: MediaTypeDelta,
+		Digest:    w.Digest(),
+		Size:      stats.Size,
+		Annotations: map[string]string{
+			AnnotationTarget: newDesc.Digest.String(),
+		},
+	}
+	if oldDesc.Digest != "" {
+		desc.Annotations[AnnotationBase] = oldDesc.Digest.String()
+	}
+	return desc, stats, nil
+}
+
+func isErofsLayer(desc ocispec.Descriptor) bool {
+	return strings.HasSuffix(desc.MediaType, ".erofs")
+}
+
+// GenerateImage computes the deltas between the EROFS layers of two image
+// manifests of the same platform and commits a delta manifest referring to
+// newManifest.  Layers already present in the old image are skipped, and
+// each changed layer is diffed against the old layer at the same position.
+func GenerateImage(ctx context.Context, cs content.Store, oldManifest, newManifest ocispec.Descriptor, opts ...Opt) (ocispec.Descriptor, error) {
+	var oldM, newM ocispec.Manifest
+	for _, m := range []struct {
+		desc ocispec.Descriptor
+		v    *ocispec.Manifest
+	}{{oldManifest, &oldM}, {newManifest, &newM}} {
+		if !images.IsManifestType(m.desc.MediaType) {
+			return ocispec.Descriptor{}, fmt.Errorf("%s is not an image manifest (%s)", m.desc.Digest, m.desc.MediaType)
+		}
+		b, err := content.ReadBlob(ctx, cs, m.desc)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if err := json.Unmarshal(b, m.v); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+
+	existing := make(map[digest.Digest]struct{}, len(oldM.Layers))
+	for _, l := range oldM.Layers {
+		existing[l.Digest] = struct{}{}
+	}
+
+	labels := map[string]string{}
+	var layers []ocispec.Descriptor
+	for i, l := range newM.Layers {
+		if _, ok := existing[l.Digest]; ok || !isErofsLayer(l) {
+			continue
+		}
+		var base ocispec.Descriptor
+		if i < len(oldM.Layers) && isErofsLayer(oldM.Layers[i]) {
+			base = oldM.Layers[i]
+		}
+		d, stats, err := GenerateLayer(ctx, cs, base, l, opts...)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to generate delta for layer %s: %w", l.Digest, err)
+		}
+		log.G(ctx).WithField("layer", l.Digest).Debugf("delta: %d/%d blocks changed, %d bytes",
+			stats.ChangedBlocks, stats.TotalBlocks, stats.Size)
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", len(layers))] = d.Digest.String()
+		layers = append(layers, d)
+	}
+
+	config := ocispec.DescriptorEmptyJSON
+	if err := content.WriteBlob(ctx, cs, IngestRefPrefix+"config", bytes.NewReader(config.Data), config); err != nil && !errdefs.IsAlreadyExists(err) {
+		return ocispec.Descriptor{}, err
+	}
+	config.Data = nil
+	labels["containerd.io/gc.ref.content.config"] = config.Digest.String()
+	labels["containerd.io/gc.ref.content.m.0"] = newManifest.Digest.String()
+
+	subject := newManifest
+	subject.Annotations = nil
+	subject.Platform = nil
+	m := ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: ArtifactTypeDelta,
+		Config:       config,
+		Layers:       layers,
+		Subject:      &subject,
+		Annotations: map[string]string{
+			AnnotationBase: oldManifest.Digest.String(),
+		},
+	}
+	if len(m.Layers) == 0 {
+		m.Layers = []ocispec.Descriptor{}
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: ArtifactTypeDelta,
+		Digest:       digest.FromBytes(b),
+		Size:         int64(len(b)),
+	}
+	ref := IngestRefPrefix + "manifest-" + desc.Digest.Encoded()
+	if err := content.WriteBlob(ctx, cs, ref, bytes.NewReader(b), desc, content.WithLabels(labels)); err != nil && !errdefs.IsAlreadyExists(err) {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
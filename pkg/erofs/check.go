@@ -0,0 +1,92 @@
+package erofs
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// verifyChecksum verifies the crc32c of the superblock block, which covers
+// everything from the superblock to the end of its block, or a block from the
+// superblock if the blocks are no larger than its offset.
+func verifyChecksum(r io.ReaderAt, sb *SuperBlock) error {
+	n := int(sb.BlockSize())
+	if n > SuperOffset {
+		n -= SuperOffset
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, SuperOffset); err != nil {
+		return fmt.Errorf("failed to read superblock: %w", err)
+	}
+	binary.LittleEndian.PutUint32(buf[4:], 0)
+	// The kernel uses crc32c(~0, ...) without the final inversion
+	if crc := ^crc32.Checksum(buf, castagnoli); crc != sb.Checksum {
+		return fmt.Errorf("superblock checksum mismatch: %#x != %#x", crc, sb.Checksum)
+	}
+	return nil
+}
+
+// Check runs the built-in consistency checks on the EROFS image in r, which
+// is size bytes long: the superblock must be valid, its checksum must match
+// if present, and the image must hold all the blocks it claims.
+func Check(r io.ReaderAt, size int64) error {
+	sb, err := ReadSuperBlock(r)
+	if err != nil {
+		return err
+	}
+	// The kernel mounts blocks from 512 bytes up to the page size
+	if int(sb.BlockSize()) > os.Getpagesize() {
+		return fmt.Errorf("unsupported block size %d, larger than the page size %d", sb.BlockSize(), os.Getpagesize())
+	}
+	if sb.FeatureCompat&FeatureCompatSbChksum != 0 {
+		if err := verifyChecksum(r, sb); err != nil {
+			return err
+		}
+	}
+	if sb.ExtraDevices == 0 {
+		if need := int64(sb.Blocks()) * int64(sb.BlockSize()); need > size {
+			return fmt.Errorf("image truncated: %d blocks need %d bytes, got %d", sb.Blocks(), need, size)
+		}
+	}
+	if sb.Inos == 0 {
+		return fmt.Errorf("no valid inode")
+	}
+	return nil
+}
+
+var (
+	hasFsck     bool
+	hasFsckOnce sync.Once
+)
+
+// HasFsck checks if fsck.erofs is available.
+func HasFsck() bool {
+	hasFsckOnce.Do(func() {
+		_, err := exec.LookPath("fsck.erofs")
+		hasFsck = err == nil
+	})
+	return hasFsck
+}
+
+// Fsck runs fsck.erofs on the image at path.  If extract is set, all file
+// data is decompressed and verified too, which is much slower.
+func Fsck(ctx context.Context, path string, extract bool) error {
+	args := []string{}
+	if extract {
+		args = append(args, "--extract")
+	}
+	args = append(args, path)
+	cmd := exec.CommandContext(ctx, "fsck.erofs", args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("fsck.erofs %s failed: %s: %w", cmd.Args, out, err)
+	}
+	return nil
+}
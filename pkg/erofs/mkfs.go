@@ -0,0 +1,48 @@
+package erofs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// MkfsDir builds the EROFS image at path from the directory dir with
+// mkfs.erofs, passing it the extra args.
+func MkfsDir(ctx context.Context, path, dir string, args ...string) error {
+	args = append(append([]string{"--quiet"}, args...), path, dir)
+	cmd := exec.CommandContext(ctx, "mkfs.erofs", args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mkfs.erofs %s failed: %s: %w", cmd.Args, out, err)
+	}
+	return nil
+}
+
+// MkfsTar builds the EROFS image at path from the tar stream r with mkfs.erofs,
+// passing it the extra args.
+func MkfsTar(ctx context.Context, path string, r io.Reader, args ...string) error {
+	args = append(append([]string{"--tar=f", "--aufs", "--quiet"}, args...), path)
+	cmd := exec.CommandContext(ctx, "mkfs.erofs", args...)
+	cmd.Stdin = r
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mkfs.erofs %s failed: %s: %w", cmd.Args, out, err)
+	}
+	return nil
+}
+
+// MkfsMerge builds the EROFS metadata image at path merging the EROFS images
+// of the layers, from the lowest, with mkfs.erofs 1.8 or later.  The image
+// references the data of the layers as its extra devices, in the same order,
+// to be mounted with a device option each.  The whiteouts of the layers are
+// kept, so that the image is mounted as the lower directory of an overlay.
+func MkfsMerge(ctx context.Context, path string, layers ...string) error {
+	args := append([]string{"--quiet", path}, layers...)
+	cmd := exec.CommandContext(ctx, "mkfs.erofs", args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mkfs.erofs %s failed: %s: %w", cmd.Args, out, err)
+	}
+	return nil
+}
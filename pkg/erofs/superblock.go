@@ -0,0 +1,233 @@
+// Package erofs reads EROFS on-disk structures in userspace.
+package erofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// SuperOffset is the offset of the superblock in an EROFS image.
+	SuperOffset = 1024
+	// SuperMagic is the EROFS superblock magic.
+	SuperMagic = 0xE0F5E1E2
+
+	superBlockSize = 128
+)
+
+// ErrNotErofs is returned when the data doesn't contain an EROFS superblock.
+var ErrNotErofs = errors.New("not an EROFS image")
+
+// Compatible feature bits.
+const (
+	FeatureCompatSbChksum          = 0x00000001
+	FeatureCompatMtime             = 0x00000002
+	FeatureCompatXattrFilter       = 0x00000004
+	FeatureCompatSharedEaInMetabox = 0x00000008
+	FeatureCompatPlainXattrPfx     = 0x00000010
+)
+
+// Incompatible feature bits.
+const (
+	FeatureIncompatZeroPadding   = 0x00000001
+	FeatureIncompatComprCfgs     = 0x00000002
+	FeatureIncompatBigPcluster   = 0x00000002
+	FeatureIncompatChunkedFile   = 0x00000004
+	FeatureIncompatDeviceTable   = 0x00000008
+	FeatureIncompatZtailpacking  = 0x00000010
+	FeatureIncompatFragments     = 0x00000020
+	FeatureIncompatDedupe        = 0x00000020
+	FeatureIncompatXattrPrefixes = 0x00000040
+	FeatureIncompat48Bit         = 0x00000080
+	FeatureIncompatMetabox       = 0x00000100
+)
+
+var compatNames = []struct {
+	bit  uint32
+	name string
+}{
+	{FeatureCompatSbChksum, "sb_csum"},
+	{FeatureCompatMtime, "mtime"},
+	{FeatureCompatXattrFilter, "xattr_filter"},
+	{FeatureCompatSharedEaInMetabox, "shared_ea_in_metabox"},
+	{FeatureCompatPlainXattrPfx, "plain_xattr_pfx"},
+}
+
+var incompatNames = []struct {
+	bit  uint32
+	name string
+}{
+	{FeatureIncompatZeroPadding, "0padding"},
+	{FeatureIncompatComprCfgs, "compr_cfgs"},
+	{FeatureIncompatChunkedFile, "chunked_file"},
+	{FeatureIncompatDeviceTable, "device_table"},
+	{FeatureIncompatZtailpacking, "ztailpacking"},
+	{FeatureIncompatFragments, "fragments"},
+	{FeatureIncompatXattrPrefixes, "xattr_prefixes"},
+	{FeatureIncompat48Bit, "48bit"},
+	{FeatureIncompatMetabox, "metabox"},
+}
+
+var algorithmNames = []string{"lz4", "lzma", "deflate", "zstd"}
+
+// SuperBlock is the EROFS on-disk superblock.
+type SuperBlock struct {
+	Magic           uint32
+	Checksum        uint32
+	FeatureCompat   uint32
+	BlkSzBits       uint8
+	SbExtSlots      uint8
+	RootNid2b       uint16
+	Inos            uint64
+	Epoch           uint64
+	FixedNsec       uint32
+	BlocksLo        uint32
+	MetaBlkAddr     uint32
+	XattrBlkAddr    uint32
+	UUID            [16]byte
+	VolumeName      [16]byte
+	FeatureIncompat uint32
+	// AvailableComprAlgs is lz4_max_distance if compr_cfgs is unset
+	AvailableComprAlgs uint16
+	ExtraDevices       uint16
+	DevtSlotOff        uint16
+	DirBlkBits         uint8
+	XattrPrefixCount   uint8
+	XattrPrefixStart   uint32
+	PackedNid          uint64
+	XattrFilterRes     uint8
+	Reserved           [3]uint8
+	BuildTime          uint32
+	RootNid8b          uint64
+	Reserved2          uint64
+}
+
+// ReadSuperBlock reads the superblock of the EROFS image in r.
+func ReadSuperBlock(r io.ReaderAt) (*SuperBlock, error) {
+	var buf [superBlockSize]byte
+	if _, err := r.ReadAt(buf[:], SuperOffset); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrNotErofs
+		}
+		return nil, err
+	}
+	var sb SuperBlock
+	if err := binary.Read(bytes.NewReader(buf[:]), binary.LittleEndian, &sb); err != nil {
+		return nil, err
+	}
+	if sb.Magic != SuperMagic {
+		return nil, ErrNotErofs
+	}
+	if sb.BlkSzBits < 9 || sb.BlkSzBits > 16 {
+		return nil, fmt.Errorf("invalid block size bits %d: %w", sb.BlkSzBits, ErrNotErofs)
+	}
+	return &sb, nil
+}
+
+// BlockSize returns the filesystem block size.
+func (sb *SuperBlock) BlockSize() uint32 {
+	return 1 << sb.BlkSzBits
+}
+
+// Blocks returns the total block count.
+func (sb *SuperBlock) Blocks() uint64 {
+	blocks := uint64(sb.BlocksLo)
+	if sb.FeatureIncompat&FeatureIncompat48Bit != 0 {
+		// rootnid_2b is reused as blocks_hi for 48-bit layouts
+		blocks |= uint64(sb.RootNid2b) << 32
+	}
+	return blocks
+}
+
+// RootNid returns the nid of the root directory.
+func (sb *SuperBlock) RootNid() uint64 {
+	if sb.FeatureIncompat&FeatureIncompat48Bit != 0 {
+		return sb.RootNid8b
+	}
+	return uint64(sb.RootNid2b)
+}
+
+// UUIDString returns the volume UUID in its canonical form.
+func (sb *SuperBlock) UUIDString() string {
+	u := sb.UUID
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// Volume returns the volume name.
+func (sb *SuperBlock) Volume() string {
+	return strings.TrimRight(string(sb.VolumeName[:]), "\x00")
+}
+
+// Time returns the time the image was built at.
+func (sb *SuperBlock) Time() time.Time {
+	return time.Unix(int64(sb.Epoch)+int64(sb.BuildTime), int64(sb.FixedNsec)).UTC()
+}
+
+// Features returns the names of the enabled compatible and incompatible
+// features.
+func (sb *SuperBlock) Features() []string {
+	var f []string
+	for _, c := range compatNames {
+		if sb.FeatureCompat&c.bit != 0 {
+			f = append(f, c.name)
+		}
+	}
+	for _, c := range incompatNames {
+		if sb.FeatureIncompat&c.bit != 0 {
+			f = append(f, c.name)
+		}
+	}
+	return f
+}
+
+// Algorithms returns the names of the compression algorithms available in
+// the image, which is empty for uncompressed images.
+func (sb *SuperBlock) Algorithms() []string {
+	if sb.FeatureIncompat&FeatureIncompatComprCfgs == 0 {
+		if sb.FeatureIncompat&FeatureIncompatZeroPadding != 0 || sb.AvailableComprAlgs != 0 {
+			// lz4 is the only algorithm without compression configs
+			return []string{"lz4"}
+		}
+		return nil
+	}
+	var algs []string
+	for i, name := range algorithmNames {
+		if sb.AvailableComprAlgs&(1<<i) != 0 {
+			algs = append(algs, name)
+		}
+	}
+	return algs
+}
+
+// Info is a summary of a superblock, suitable for reports.
+type Info struct {
+	UUID         string    `json:"uuid"`
+	VolumeName   string    `json:"volumeName,omitempty"`
+	BlockSize    uint32    `json:"blockSize"`
+	Blocks       uint64    `json:"blocks"`
+	Inodes       uint64    `json:"inodes"`
+	Features     []string  `json:"features"`
+	Compression  []string  `json:"compression,omitempty"`
+	ExtraDevices uint16    `json:"extraDevices,omitempty"`
+	BuildTime    time.Time `json:"buildTime"`
+}
+
+// Info returns the summary of sb.
+func (sb *SuperBlock) Info() Info {
+	return Info{
+		UUID:         sb.UUIDString(),
+		VolumeName:   sb.Volume(),
+		BlockSize:    sb.BlockSize(),
+		Blocks:       sb.Blocks(),
+		Inodes:       sb.Inos,
+		Features:     sb.Features(),
+		Compression:  sb.Algorithms(),
+		ExtraDevices: sb.ExtraDevices,
+		BuildTime:    sb.Time(),
+	}
+}
@@ -0,0 +1,160 @@
+package erofs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ErrNoVerity is returned when there is no dm-verity superblock at the given
+// offset.
+var ErrNoVerity = errors.New("no dm-verity superblock")
+
+var veritySignature = [8]byte{'v', 'e', 'r', 'i', 't', 'y'}
+
+// veritySuperBlock is the dm-verity on-disk superblock written by veritysetup.
+type veritySuperBlock struct {
+	Signature     [8]byte
+	Version       uint32
+	HashType      uint32
+	UUID          [16]byte
+	Algorithm     [32]byte
+	DataBlockSize uint32
+	HashBlockSize uint32
+	DataBlocks    uint64
+	SaltSize      uint16
+	Pad1          [6]byte
+	Salt          [256]byte
+}
+
+// VerityInfo describes a dm-verity hash tree found after an image.
+type VerityInfo struct {
+	HashOffset    int64  `json:"hashOffset"`
+	Version       uint32 `json:"version"`
+	Algorithm     string `json:"algorithm"`
+	DataBlockSize uint32 `json:"dataBlockSize"`
+	HashBlockSize uint32 `json:"hashBlockSize"`
+	DataBlocks    uint64 `json:"dataBlocks"`
+	Salt          string `json:"salt,omitempty"`
+}
+
+// ReadVerity reads the dm-verity superblock at offset in r, where
+// AppendVerity puts it.
+func ReadVerity(r io.ReaderAt, offset int64) (*VerityInfo, error) {
+	var sb veritySuperBlock
+	buf := make([]byte, binary.Size(sb))
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrNoVerity
+		}
+		return nil, err
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &sb); err != nil {
+		return nil, err
+	}
+	if sb.Signature != veritySignature {
+		return nil, ErrNoVerity
+	}
+	return &VerityInfo{
+		HashOffset:    offset,
+		Version:       sb.Version,
+		Algorithm:     string(bytes.TrimRight(sb.Algorithm[:], "\x00")),
+		DataBlockSize: sb.DataBlockSize,
+		HashBlockSize: sb.HashBlockSize,
+		DataBlocks:    sb.DataBlocks,
+		Salt:          hex.EncodeToString(sb.Salt[:min(int(sb.SaltSize), len(sb.Salt))]),
+	}, nil
+}
+
+// Verity describes a dm-verity hash tree appended to an image.
+type Verity struct {
+	RootHash string `json:"rootHash"`
+	// HashOffset is where the hash tree starts, i.e. the size of the data
+	HashOffset int64  `json:"hashOffset"`
+	Salt       string `json:"salt,omitempty"`
+}
+
+// AppendVerity appends a dm-verity hash tree to the image at path with
+// veritysetup, and returns the parameters needed to open it.
+func AppendVerity(ctx context.Context, path string) (*Verity, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	v, err := veritysetupFormat(ctx, fmt.Sprintf("--hash-offset=%d", fi.Size()), path, path)
+	if err != nil {
+		return nil, err
+	}
+	v.HashOffset = fi.Size()
+	return v, nil
+}
+
+// FormatVerity writes the dm-verity hash tree of the image at path to
+// hashPath with veritysetup, without salt as the dm-verity root hash
+// annotations, and returns its root hash.
+func FormatVerity(ctx context.Context, path, hashPath string) (string, error) {
+	v, err := veritysetupFormat(ctx, "--salt=-", path, hashPath)
+	if err != nil {
+		return "", err
+	}
+	return v.RootHash, nil
+}
+
+// OpenVerity opens the dm-verity device name of the image at path, with the
+// hash tree at hashPath, and returns its path.  veritysetup fails if the hash
+// tree doesn't match rootHash.
+func OpenVerity(ctx context.Context, name, path, hashPath, rootHash string) (string, error) {
+	cmd := exec.CommandContext(ctx, "veritysetup", "open", path, name, hashPath, rootHash)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("veritysetup %s failed: %s: %w", cmd.Args, out, err)
+	}
+	return VerityDevice(name), nil
+}
+
+// CloseVerity closes the dm-verity device name, once unused.
+func CloseVerity(ctx context.Context, name string) error {
+	cmd := exec.CommandContext(ctx, "veritysetup", "close", "--deferred", name)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("veritysetup %s failed: %s: %w", cmd.Args, out, err)
+	}
+	return nil
+}
+
+// VerityDevice returns the path of the dm-verity device name.
+func VerityDevice(name string) string {
+	return "/dev/mapper/" + name
+}
+
+func veritysetupFormat(ctx context.Context, args ...string) (*Verity, error) {
+	cmd := exec.CommandContext(ctx, "veritysetup", append([]string{"format"}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("veritysetup %s failed: %s: %w", cmd.Args, out, err)
+	}
+	v := &Verity{}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		k, val, ok := strings.Cut(s.Text(), ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(k) {
+		case "Root hash":
+			v.RootHash = strings.TrimSpace(val)
+		case "Salt":
+			v.Salt = strings.TrimSpace(val)
+		}
+	}
+	if v.RootHash == "" {
+		return nil, fmt.Errorf("no root hash in veritysetup output: %s", out)
+	}
+	return v, nil
+}
@@ -0,0 +1,363 @@
+// Package fscache serves EROFS blobs to the kernel on demand, with
+// erofs-over-fscache: an EROFS filesystem mounted with "fsid=" reads its blob
+// through the cachefiles cache, which asks the daemon to fetch the ranges it
+// doesn't have yet.  The layers are mounted before they're downloaded, and
+// each blob is fetched whole on its first read, to be verified against its
+// digest before any of its data reaches the kernel.
+//
+// The filesystems mounted in the same domain share the blobs of their device
+// tables with the same tag: they're cached once, on disk and in the page
+// cache, e.g. the chunks deduplicated across images.
+//
+// It requires Linux 5.19 or later with CONFIG_EROFS_FS_ONDEMAND and
+// CONFIG_CACHEFILES_ONDEMAND, and 6.1 or later for the domains.
+package fscache
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	devicePath = "/dev/cachefiles"
+
+	// DefaultTag is the tag of the cache, distinct from the one of
+	// cachefilesd
+	DefaultTag = "erofs"
+
+	// fetchSize aligns the ranges fetched from the blobs, fewer and larger
+	// requests than the ones of the kernel
+	fetchSize = 1 << 20
+
+	// The messages of the kernel, include/uapi/linux/cachefiles.h
+	msgMaxSize      = 1024
+	opOpen          = 0
+	opClose         = 1
+	opRead          = 2
+	iocReadComplete = 0x40049801 // _IOW(0x98, 1, int)
+)
+
+// Blob is the content of an EROFS blob, fetched on demand.
+type Blob interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// registered is a blob served until its mounts are unmounted.
+type registered struct {
+	blob Blob
+	refs int
+}
+
+// object is a blob opened by the kernel.
+type object struct {
+	// fsid is the fsid of a primary blob, or the tag of a device blob
+	fsid string
+	blob Blob
+	// fd is the anonymous descriptor of the cache file, which the fetched
+	// ranges are written to
+	fd int
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Daemon is the on-demand daemon of a cachefiles cache.
+type Daemon struct {
+	dev *os.File
+	// prefetch fetches the whole blobs in the background once opened
+	prefetch bool
+
+	mu      sync.Mutex
+	blobs   map[string]*registered
+	objects map[uint32]*object
+}
+
+// Opt is an option of the daemon.
+type Opt func(*Daemon)
+
+// WithPrefetch fetches the whole blobs in the background once mounted, and
+// not only the ranges read.
+func WithPrefetch() Opt {
+	return func(d *Daemon) {
+		d.prefetch = true
+	}
+}
+
+// Open binds the cache in dir, named tag, in on-demand mode.  Only one daemon
+// can bind a cache.
+func Open(dir, tag string, opts ...Opt) (*Daemon, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	dev, err := os.OpenFile(devicePath, os.O_RDWR, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("%w: the cachefiles module isn't loaded", err)
+		}
+		return nil, err
+	}
+	for _, cmd := range []string{"dir " + dir, "tag " + tag, "bind ondemand"} {
+		if _, err := dev.WriteString(cmd); err != nil {
+			dev.Close()
+			if cmd == "bind ondemand" && errors.Is(err, unix.EOPNOTSUPP) {
+				err = fmt.Errorf("%w: the kernel lacks CONFIG_CACHEFILES_ONDEMAND: %w", err, errdefs.ErrNotImplemented)
+			}
+			return nil, fmt.Errorf("cachefiles %q: %w", cmd, err)
+		}
+	}
+	d := &Daemon{dev: dev, blobs: map[string]*registered{}, objects: map[uint32]*object{}}
+	for _, o := range opts {
+		o(d)
+	}
+	return d, nil
+}
+
+// Register serves blob as fsid, the fsid of a filesystem to mount or the tag
+// of a device blob.  The blobs shared by several filesystems are registered
+// for each of them, the first blob registered is served.
+func (d *Daemon) Register(fsid string, blob Blob) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r, ok := d.blobs[fsid]; ok {
+		r.refs++
+		return
+	}
+	d.blobs[fsid] = &registered{blob: blob, refs: 1}
+}
+
+// Unregister stops serving fsid once unregistered as many times as
+// registered, e.g. when its filesystems are unmounted.
+func (d *Daemon) Unregister(fsid string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r, ok := d.blobs[fsid]; ok {
+		if r.refs--; r.refs == 0 {
+			delete(d.blobs, fsid)
+		}
+	}
+}
+
+// Mount mounts the EROFS blob registered as fsid on target, in the shared
+// domain if not empty.  Its device blobs must be registered by their tags.
+func (d *Daemon) Mount(fsid, domain, target string) error {
+	data := "fsid=" + fsid
+	if domain != "" {
+		data += ",domain_id=" + domain
+	}
+	if err := unix.Mount("none", target, "erofs", unix.MS_RDONLY, data); err != nil {
+		return fmt.Errorf("failed to mount %s on %s: %w", fsid, target, err)
+	}
+	return nil
+}
+
+// Serve handles the requests of the kernel until ctx is done.
+func (d *Daemon) Serve(ctx context.Context) error {
+	fds := []unix.PollFd{{Fd: int32(d.dev.Fd()), Events: unix.POLLIN}}
+	buf := make([]byte, msgMaxSize)
+	for ctx.Err() == nil {
+		// Poll with a timeout to notice ctx
+		if _, err := unix.Poll(fds, 1000); err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return err
+		}
+		if fds[0].Revents&unix.POLLIN == 0 {
+			continue
+		}
+		n, err := unix.Read(int(d.dev.Fd()), buf)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) || errors.Is(err, unix.EAGAIN) {
+				continue
+			}
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		if err := d.handle(ctx, buf[:n]); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to handle a cachefiles request")
+		}
+	}
+	return nil
+}
+
+// Close unbinds the cache.  The blobs of the mounted filesystems can't be
+// fetched anymore.
+func (d *Daemon) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, o := range d.objects {
+		o.close()
+		delete(d.objects, id)
+	}
+	return d.dev.Close()
+}
+
+func (d *Daemon) handle(ctx context.Context, msg []byte) error {
+	if len(msg) < 16 {
+		return fmt.Errorf("short message of %d bytes", len(msg))
+	}
+	var (
+		id       = binary.NativeEndian.Uint32(msg[0:])
+		opcode   = binary.NativeEndian.Uint32(msg[4:])
+		objectID = binary.NativeEndian.Uint32(msg[12:])
+		data     = msg[16:]
+	)
+	switch opcode {
+	case opOpen:
+		return d.open(ctx, id, objectID, data)
+	case opClose:
+		d.mu.Lock()
+		o := d.objects[objectID]
+		delete(d.objects, objectID)
+		d.mu.Unlock()
+		if o != nil {
+			o.close()
+		}
+		return nil
+	case opRead:
+		if len(data) < 16 {
+			return fmt.Errorf("short read request of %d bytes", len(data))
+		}
+		off := binary.NativeEndian.Uint64(data[0:])
+		length := binary.NativeEndian.Uint64(data[8:])
+		d.mu.Lock()
+		o := d.objects[objectID]
+		d.mu.Unlock()
+		if o == nil {
+			return fmt.Errorf("read of unknown object %d", objectID)
+		}
+		// The kernel waits for the completion, the other requests don't
+		go o.read(ctx, id, int64(off), int64(length))
+		return nil
+	default:
+		return fmt.Errorf("unknown opcode %d", opcode)
+	}
+}
+
+// open answers the opening of a blob with its size.  The cookie key is the
+// fsid, or the tag of a device blob, and the volume key "erofs,<domain or
+// fsid>".
+func (d *Daemon) open(ctx context.Context, id, objectID uint32, data []byte) error {
+	if len(data) < 16 {
+		return fmt.Errorf("short open request of %d bytes", len(data))
+	}
+	var (
+		volumeKeySize = binary.NativeEndian.Uint32(data[0:])
+		cookieKeySize = binary.NativeEndian.Uint32(data[4:])
+		fd            = int(binary.NativeEndian.Uint32(data[8:]))
+		keys          = data[16:]
+	)
+	if uint64(volumeKeySize)+uint64(cookieKeySize) > uint64(len(keys)) {
+		unix.Close(fd)
+		return fmt.Errorf("invalid open request keys")
+	}
+	volume := string(bytes.TrimRight(keys[:volumeKeySize], "\x00"))
+	fsid := string(keys[volumeKeySize : volumeKeySize+cookieKeySize])
+	if !strings.HasPrefix(volume, "erofs,") {
+		unix.Close(fd)
+		return d.reply(fmt.Sprintf("copen %d,%d", id, -int(unix.EINVAL)))
+	}
+
+	d.mu.Lock()
+	r, ok := d.blobs[fsid]
+	var o *object
+	if ok {
+		o = &object{fsid: fsid, blob: r.blob, fd: fd}
+		d.objects[objectID] = o
+	}
+	d.mu.Unlock()
+	if !ok {
+		unix.Close(fd)
+		log.G(ctx).Warnf("unknown fscache blob %s", fsid)
+		return d.reply(fmt.Sprintf("copen %d,%d", id, -int(unix.ENOENT)))
+	}
+	if err := d.reply(fmt.Sprintf("copen %d,%d", id, r.blob.Size())); err != nil {
+		return err
+	}
+	if d.prefetch {
+		go o.fetchAll(ctx)
+	}
+	return nil
+}
+
+func (d *Daemon) reply(cmd string) error {
+	_, err := d.dev.WriteString(cmd)
+	return err
+}
+
+// read fetches the range of a read request, aligned to fetchSize, and
+// completes it.  The kernel fails the read if the range isn't written.
+func (o *object) read(ctx context.Context, id uint32, off, length int64) {
+	start := off / fetchSize * fetchSize
+	end := min((off+length+fetchSize-1)/fetchSize*fetchSize, o.blob.Size())
+	if err := o.fetch(start, end); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to fetch %d-%d of %s", start, end, o.fsid)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	if err := unix.IoctlSetInt(o.fd, iocReadComplete, int(id)); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to complete the read of %s", o.fsid)
+	}
+}
+
+// fetchAll fetches the whole blob, sequentially, until it's closed.
+func (o *object) fetchAll(ctx context.Context) {
+	size := o.blob.Size()
+	for off := int64(0); off < size; off += fetchSize {
+		if err := o.fetch(off, min(off+fetchSize, size)); err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.G(ctx).WithError(err).Warnf("failed to prefetch %s", o.fsid)
+			}
+			return
+		}
+	}
+	log.G(ctx).Debugf("prefetched %s", o.fsid)
+}
+
+// fetch writes the range [start, end) of the blob to the cache file.
+func (o *object) fetch(start, end int64) error {
+	buf := make([]byte, end-start)
+	n, err := o.blob.ReadAt(buf, start)
+	if err != nil && !(errors.Is(err, io.EOF) && int64(n) == end-start) {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return os.ErrClosed
+	}
+	for written := 0; written < len(buf); {
+		w, err := unix.Pwrite(o.fd, buf[written:], start+int64(written))
+		if err != nil {
+			return err
+		}
+		written += w
+	}
+	return nil
+}
+
+func (o *object) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.closed {
+		o.closed = true
+		unix.Close(o.fd)
+	}
+}
@@ -0,0 +1,102 @@
+package fscache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The labels of the snapshots of EROFS layers available in a registry, which
+// the snapshotter mounts with erofs-over-fscache instead of unpacking them.
+const (
+	// LabelBlobRef is the image reference of the registry serving the blob
+	LabelBlobRef = "containerd.io/snapshot/erofs.blob-ref"
+	// LabelBlobDigest and LabelBlobSize describe the EROFS blob
+	LabelBlobDigest = "containerd.io/snapshot/erofs.blob-digest"
+	LabelBlobSize   = "containerd.io/snapshot/erofs.blob-size"
+	// LabelBlobDevices are the device blobs of the layer, from
+	// AnnotationBlobDevices
+	LabelBlobDevices = "containerd.io/snapshot/erofs.blob-devices"
+
+	// AnnotationBlobDevices lists the blobs of the device table of an EROFS
+	// layer, as comma separated "<digest>:<size>", in the same repository.
+	// Their tags in the device table must be the encoded digests, so that
+	// they're shared by the layers mounted in the same domain.
+	AnnotationBlobDevices = "io.github.erofs.layer.blob-devices"
+)
+
+// AppendLabelsHandlerWrapper labels the EROFS layers of the manifests of the
+// image ref during unpack, as containerd's AppendInfoHandlerWrapper, so that
+// the snapshotter mounts them lazily, e.g. with
+// containerd.WithImageHandlerWrapper.
+func AppendLabelsHandlerWrapper(ref string) func(images.Handler) images.Handler {
+	return func(f images.Handler) images.Handler {
+		return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			children, err := f.Handle(ctx, desc)
+			if err != nil || !images.IsManifestType(desc.MediaType) {
+				return children, err
+			}
+			for i := range children {
+				c := &children[i]
+				mediaType, _, _ := strings.Cut(c.MediaType, "+")
+				if !strings.HasSuffix(mediaType, ".erofs") {
+					continue
+				}
+				if c.Annotations == nil {
+					c.Annotations = map[string]string{}
+				}
+				c.Annotations[LabelBlobRef] = ref
+				c.Annotations[LabelBlobDigest] = c.Digest.String()
+				c.Annotations[LabelBlobSize] = strconv.FormatInt(c.Size, 10)
+				if devices, ok := c.Annotations[AnnotationBlobDevices]; ok {
+					c.Annotations[LabelBlobDevices] = devices
+				}
+			}
+			return children, nil
+		})
+	}
+}
+
+// BlobFromLabels returns the reference and the descriptor of the blob of
+// labels, if any.
+func BlobFromLabels(labels map[string]string) (string, ocispec.Descriptor, bool) {
+	ref := labels[LabelBlobRef]
+	dgst, err := digest.Parse(labels[LabelBlobDigest])
+	if ref == "" || err != nil {
+		return "", ocispec.Descriptor{}, false
+	}
+	size, err := strconv.ParseInt(labels[LabelBlobSize], 10, 64)
+	if err != nil || size <= 0 {
+		return "", ocispec.Descriptor{}, false
+	}
+	return ref, ocispec.Descriptor{Digest: dgst, Size: size}, true
+}
+
+// DevicesFromLabels returns the device blobs of the blob of labels.
+func DevicesFromLabels(labels map[string]string) ([]ocispec.Descriptor, error) {
+	var devices []ocispec.Descriptor
+	for _, d := range strings.Split(labels[LabelBlobDevices], ",") {
+		if d == "" {
+			continue
+		}
+		i := strings.LastIndexByte(d, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid device blob %q", d)
+		}
+		dgst, err := digest.Parse(d[:i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid device blob %q: %w", d, err)
+		}
+		size, err := strconv.ParseInt(d[i+1:], 10, 64)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid device blob %q: bad size", d)
+		}
+		devices = append(devices, ocispec.Descriptor{Digest: dgst, Size: size})
+	}
+	return devices, nil
+}
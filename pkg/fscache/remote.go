@@ -0,0 +1,101 @@
+package fscache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// remoteBlob reads a blob from its registry.  The blob is fetched whole, once,
+// and spooled to an unlinked file while checked against its digest: the
+// ranges can't be verified alone, so none is read before the whole blob is.
+type remoteBlob struct {
+	ctx     context.Context
+	fetcher remotes.Fetcher
+	desc    ocispec.Descriptor
+	dir     string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewRemoteBlob returns the blob desc of the image ref, fetched with resolver
+// and spooled in dir.
+func NewRemoteBlob(ctx context.Context, resolver remotes.Resolver, ref string, desc ocispec.Descriptor, dir string) (Blob, error) {
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteBlob{ctx: ctx, fetcher: fetcher, desc: desc, dir: dir}, nil
+}
+
+func (b *remoteBlob) Size() int64 {
+	return b.desc.Size
+}
+
+func (b *remoteBlob) ReadAt(p []byte, off int64) (int, error) {
+	f, err := b.verified()
+	if err != nil {
+		return 0, err
+	}
+	return f.ReadAt(p, off)
+}
+
+// verified returns the spooled blob, fetching it first if it isn't yet.  A
+// failed fetch is retried by the next read.
+func (b *remoteBlob) verified() (*os.File, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.f != nil {
+		return b.f, nil
+	}
+	f, err := b.fetch()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", b.desc.Digest, err)
+	}
+	b.f = f
+	return f, nil
+}
+
+func (b *remoteBlob) fetch() (_ *os.File, retErr error) {
+	if err := b.desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(b.dir, "blob-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			f.Close()
+		}
+	}()
+	// Only the descriptor keeps it, until the blob is released
+	if err := os.Remove(f.Name()); err != nil {
+		return nil, err
+	}
+
+	rc, err := b.fetcher.Fetch(b.ctx, b.desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	verifier := b.desc.Digest.Verifier()
+	n, err := io.Copy(io.MultiWriter(f, verifier), io.LimitReader(rc, b.desc.Size+1))
+	if err != nil {
+		return nil, err
+	}
+	if n != b.desc.Size {
+		return nil, fmt.Errorf("size %d, expected %d: %w", n, b.desc.Size, errdefs.ErrFailedPrecondition)
+	}
+	if !verifier.Verified() {
+		return nil, fmt.Errorf("digest mismatch: %w", errdefs.ErrFailedPrecondition)
+	}
+	return f, nil
+}
@@ -0,0 +1,314 @@
+// Package imagemount mounts the EROFS layers of an image read-only on the
+// host, stacking them with overlayfs if there is more than one layer.  The tar
+// layers of images mixing them with EROFS layers are converted with
+// mkfs.erofs.
+//
+// Every mount is tracked by a state file so that it can be torn down
+// reliably, even after a partial failure.  The state files are kept under
+// /run, as the loop devices don't survive a reboot, and the layer blobs on
+// disk, as whole layers would fill a tmpfs.
+package imagemount
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/erofs/erofs-container-toolkit/pkg/erofs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultStateRoot is where mount states are kept.
+const DefaultStateRoot = "/run/ctr-erofs/mounts"
+
+// DefaultBlobRoot is where the layer blobs of the mounts are kept.
+const DefaultBlobRoot = "/var/lib/ctr-erofs/mounts"
+
+// Layer is a mounted EROFS layer.
+type Layer struct {
+	Digest     digest.Digest `json:"digest"`
+	Blob       string        `json:"blob"`
+	Device     string        `json:"device,omitempty"`
+	Mountpoint string        `json:"mountpoint"`
+	Mounted    bool          `json:"mounted"`
+}
+
+// State records everything set up for a mount.
+type State struct {
+	Target string `json:"target"`
+	Image  string `json:"image,omitempty"`
+	// Layers are ordered from the bottom to the top layer
+	Layers  []Layer `json:"layers"`
+	Overlay bool    `json:"overlay"`
+	// BlobDir holds the blobs of the layers
+	BlobDir string `json:"blobDir,omitempty"`
+
+	dir string
+}
+
+// IsErofsLayer checks if desc is an EROFS-native layer.
+func IsErofsLayer(desc ocispec.Descriptor) bool {
+	mediaType, _, _ := strings.Cut(desc.MediaType, "+")
+	return strings.HasSuffix(mediaType, ".erofs")
+}
+
+func stateDir(root, target string) string {
+	sum := sha256.Sum256([]byte(target))
+	return filepath.Join(root, hex.EncodeToString(sum[:]))
+}
+
+func (s *State) save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, "state.json.tmp")
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, "state.json"))
+}
+
+// Load returns the state of the mount at target.
+func Load(root, target string) (*State, error) {
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return nil, err
+	}
+	dir := stateDir(root, target)
+	b, err := os.ReadFile(filepath.Join(dir, "state.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s is not mounted by ctr-erofs: %w", target, errdefs.ErrNotFound)
+		}
+		return nil, err
+	}
+	s := &State{dir: dir}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func copyBlob(ctx context.Context, cs content.Store, desc ocispec.Descriptor, path string) error {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0400)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, content.NewReader(ra)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// convertBlob converts the tar layer desc to the EROFS image at path.
+func convertBlob(ctx context.Context, cs content.Store, desc ocispec.Descriptor, path string) error {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	r, err := compression.DecompressStream(content.NewReader(ra))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := erofs.MkfsTar(ctx, path, r); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0400)
+}
+
+// Mount mounts the EROFS layers read-only at target, converting the tar layers
+// to EROFS.  layers are ordered from the bottom to the top layer, as in image
+// manifests.  The state of the mount is kept under root, and the layer blobs
+// under blobRoot.
+func Mount(ctx context.Context, cs content.Store, image string, layers []ocispec.Descriptor, target, root, blobRoot string) (_ *State, retErr error) {
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("no layer to mount: %w", errdefs.ErrInvalidArgument)
+	}
+	for _, l := range layers {
+		if !IsErofsLayer(l) && !images.IsLayerType(l.MediaType) {
+			return nil, fmt.Errorf("layer %s is neither an EROFS nor a tar layer (%s): %w", l.Digest, l.MediaType, errdefs.ErrInvalidArgument)
+		}
+	}
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return nil, err
+	}
+	s := &State{
+		Target:  target,
+		Image:   image,
+		Overlay: len(layers) > 1,
+		BlobDir: stateDir(blobRoot, target),
+		dir:     stateDir(root, target),
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, "state.json")); err == nil {
+		return nil, fmt.Errorf("%s is already mounted: %w", target, errdefs.ErrAlreadyExists)
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			if err := s.teardown(ctx); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to clean up partial mount of %s", target)
+			}
+		}
+	}()
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.BlobDir, 0700); err != nil {
+		return nil, err
+	}
+
+	for i, l := range layers {
+		ls := Layer{
+			Digest: l.Digest,
+			Blob:   filepath.Join(s.BlobDir, fmt.Sprintf("%d.erofs", i)),
+		}
+		if s.Overlay {
+			ls.Mountpoint = filepath.Join(s.dir, fmt.Sprintf("%d", i))
+		} else {
+			ls.Mountpoint = target
+		}
+		s.Layers = append(s.Layers, ls)
+		if IsErofsLayer(l) {
+			err = copyBlob(ctx, cs, l, ls.Blob)
+		} else {
+			err = convertBlob(ctx, cs, l, ls.Blob)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy layer %s: %w", l.Digest, err)
+		}
+		if err := os.MkdirAll(ls.Mountpoint, 0755); err != nil {
+			return nil, err
+		}
+		dev, err := mount.AttachLoopDevice(ls.Blob)
+		if err != nil {
+			return nil, fmt.Errorf("failed to attach loop device for layer %s: %w", l.Digest, err)
+		}
+		s.Layers[i].Device = dev
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+		m := mount.Mount{Type: "erofs", Source: dev, Options: []string{"ro"}}
+		if err := m.Mount(ls.Mountpoint); err != nil {
+			return nil, fmt.Errorf("failed to mount layer %s: %w", l.Digest, err)
+		}
+		s.Layers[i].Mounted = true
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Overlay {
+		lowers := make([]string, 0, len(s.Layers))
+		for i := len(s.Layers) - 1; i >= 0; i-- {
+			lowers = append(lowers, s.Layers[i].Mountpoint)
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return nil, err
+		}
+		m := mount.Mount{
+			Type:    "overlay",
+			Source:  "overlay",
+			Options: []string{"ro", "lowerdir=" + strings.Join(lowers, ":")},
+		}
+		if err := m.Mount(target); err != nil {
+			return nil, fmt.Errorf("failed to mount overlay: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// Unmount tears down the mount at target: the overlay, the layer mounts and
+// the loop devices recorded in its state.  The state is kept if anything
+// fails, so that Unmount can be retried.
+func Unmount(ctx context.Context, root, target string) error {
+	s, err := Load(root, target)
+	if err != nil {
+		return err
+	}
+	return s.teardown(ctx)
+}
+
+// List returns the states of all mounts under root.
+func List(root string) ([]*State, error) {
+	matches, err := filepath.Glob(filepath.Join(root, "*", "state.json"))
+	if err != nil {
+		return nil, err
+	}
+	var states []*State
+	for _, m := range matches {
+		b, err := os.ReadFile(m)
+		if err != nil {
+			return nil, err
+		}
+		s := &State{dir: filepath.Dir(m)}
+		if err := json.Unmarshal(b, s); err != nil {
+			return nil, fmt.Errorf("invalid mount state %s: %w", m, err)
+		}
+		states = append(states, s)
+	}
+	return states, nil
+}
+
+// teardown undoes everything recorded in s, in reverse order, and keeps going
+// on errors so that as much as possible is cleaned up.
+func (s *State) teardown(ctx context.Context) error {
+	var errs []error
+	if s.Overlay {
+		if err := mount.UnmountAll(s.Target, unix.MNT_DETACH); err != nil {
+			errs = append(errs, fmt.Errorf("failed to unmount overlay %s: %w", s.Target, err))
+		}
+	}
+	for i := len(s.Layers) - 1; i >= 0; i-- {
+		l := s.Layers[i]
+		if l.Mounted {
+			if err := mount.UnmountAll(l.Mountpoint, unix.MNT_DETACH); err != nil {
+				errs = append(errs, fmt.Errorf("failed to unmount layer %s: %w", l.Digest, err))
+				continue
+			}
+		}
+		if l.Device != "" {
+			if err := mount.DetachLoopDevice(l.Device); err != nil && !errors.Is(err, unix.ENXIO) {
+				errs = append(errs, err)
+				continue
+			}
+		}
+	}
+	if len(errs) > 0 {
+		// Keep the state so that unmounting can be retried
+		return errors.Join(errs...)
+	}
+	log.G(ctx).WithField("target", s.Target).Debug("unmounted image")
+	if s.BlobDir != "" {
+		if err := os.RemoveAll(s.BlobDir); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(s.dir)
+}
@@ -0,0 +1,346 @@
+// Package layerfs reads the EROFS layers of an image in userspace, merged the
+// way overlayfs stacks them, so that files can be read without mounting
+// anything.
+package layerfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/erofs/go-erofs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	opaqueXattr = "trusted.overlay.opaque"
+	maxSymlinks = 40
+)
+
+// ErrLoop is returned when too many symlinks are met resolving a path.
+var ErrLoop = errors.New("too many levels of symbolic links")
+
+type linkFS interface {
+	Lstat(name string) (fs.FileInfo, error)
+	ReadLink(name string) (string, error)
+}
+
+// FS is the merged view of a stack of layers.  Overlay whiteouts (0/0
+// character devices) hide the entries of lower layers, and directories with
+// the opaque xattr hide the lower layer directories.
+type FS struct {
+	// layers are ordered from the bottom to the top layer
+	layers  []fs.FS
+	closers []io.Closer
+}
+
+// New returns the merged view of layers, ordered from the bottom to the top
+// layer.  Layers should implement Lstat and ReadLink for symlinks to be
+// handled.
+func New(layers ...fs.FS) *FS {
+	return &FS{layers: layers}
+}
+
+// Open returns the merged view of the EROFS layers descs, read from cs.
+func Open(ctx context.Context, cs content.Provider, descs []ocispec.Descriptor) (_ *FS, retErr error) {
+	f := &FS{}
+	defer func() {
+		if retErr != nil {
+			f.Close()
+		}
+	}()
+	for _, desc := range descs {
+		ra, err := cs.ReaderAt(ctx, desc)
+		if err != nil {
+			return nil, err
+		}
+		f.closers = append(f.closers, ra)
+		l, err := erofs.Open(ra)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open layer %s: %w", desc.Digest, err)
+		}
+		f.layers = append(f.layers, l)
+	}
+	return f, nil
+}
+
+// Close releases the layers opened by Open.
+func (f *FS) Close() error {
+	var errs []error
+	for _, c := range f.closers {
+		errs = append(errs, c.Close())
+	}
+	f.closers = nil
+	return errors.Join(errs...)
+}
+
+func lstat(l fs.FS, name string) (fs.FileInfo, error) {
+	if lfs, ok := l.(linkFS); ok {
+		return lfs.Lstat(name)
+	}
+	return fs.Stat(l, name)
+}
+
+func readLink(l fs.FS, name string) (string, error) {
+	if lfs, ok := l.(linkFS); ok {
+		return lfs.ReadLink(name)
+	}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
+
+func isWhiteout(fi fs.FileInfo) bool {
+	if fi.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+	rdev, ok := fi.(interface{ Rdev() uint64 })
+	return ok && rdev.Rdev() == 0
+}
+
+func isOpaque(fi fs.FileInfo) bool {
+	x, ok := fi.(interface {
+		GetXattr(string) (string, bool)
+	})
+	if !ok {
+		return false
+	}
+	v, _ := x.GetXattr(opaqueXattr)
+	return v == "y"
+}
+
+// layerDir checks the directory dir and its parents in the layer l: whether
+// they're all there, whether one of them is opaque, and whether one of them
+// hides dir from l and the lower layers.
+func layerDir(l fs.FS, dir string) (present, opaque, hidden bool, err error) {
+	if dir == "." {
+		return true, false, false, nil
+	}
+	parts := strings.Split(dir, "/")
+	for i := range parts {
+		fi, err := lstat(l, path.Join(parts[:i+1]...))
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, opaque, false, nil
+		} else if err != nil {
+			return false, false, false, err
+		}
+		if !fi.IsDir() {
+			return false, false, true, nil
+		}
+		opaque = opaque || isOpaque(fi)
+	}
+	return true, opaque, false, nil
+}
+
+// find returns the top-most layer with name, whose parents need to be
+// resolved directories, and its info.
+func (f *FS) find(name string) (int, fs.FileInfo, error) {
+	if name == "." {
+		if len(f.layers) == 0 {
+			return -1, nil, fs.ErrNotExist
+		}
+		fi, err := lstat(f.layers[len(f.layers)-1], name)
+		return len(f.layers) - 1, fi, err
+	}
+	for i := len(f.layers) - 1; i >= 0; i-- {
+		present, opaque, hidden, err := layerDir(f.layers[i], path.Dir(name))
+		if err != nil {
+			return -1, nil, err
+		}
+		if hidden {
+			break
+		}
+		if present {
+			fi, err := lstat(f.layers[i], name)
+			if err == nil {
+				if isWhiteout(fi) {
+					break
+				}
+				return i, fi, nil
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return -1, nil, err
+			}
+		}
+		if opaque {
+			break
+		}
+	}
+	return -1, nil, fs.ErrNotExist
+}
+
+// resolve resolves the symlinks of the parents of name, and of name itself if
+// follow is set.  It returns the resolved name, its top-most layer and info.
+func (f *FS) resolve(op, name string, follow bool) (string, int, fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return "", -1, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	orig := name
+	for links := 0; ; {
+		parts := strings.Split(name, "/")
+		dir := "."
+		for i, p := range parts {
+			cur := path.Join(dir, p)
+			idx, fi, err := f.find(cur)
+			if err != nil {
+				return "", -1, nil, &fs.PathError{Op: op, Path: orig, Err: err}
+			}
+			last := i == len(parts)-1
+			if fi.Mode()&fs.ModeSymlink != 0 && (!last || follow) {
+				if links++; links > maxSymlinks {
+					return "", -1, nil, &fs.PathError{Op: op, Path: orig, Err: ErrLoop}
+				}
+				target, err := readLink(f.layers[idx], cur)
+				if err != nil {
+					return "", -1, nil, err
+				}
+				if !path.IsAbs(target) {
+					target = path.Join(dir, target)
+				}
+				// Symlinks can't escape the root
+				name = strings.TrimPrefix(path.Clean("/"+path.Join(append([]string{target}, parts[i+1:]...)...)), "/")
+				if name == "" {
+					name = "."
+				}
+				break
+			}
+			if last {
+				return cur, idx, fi, nil
+			}
+			if !fi.IsDir() {
+				return "", -1, nil, &fs.PathError{Op: op, Path: orig, Err: syscall.ENOTDIR}
+			}
+			dir = cur
+		}
+	}
+}
+
+// Stat returns the info of name, following symlinks.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	_, _, fi, err := f.resolve("stat", name, true)
+	return fi, err
+}
+
+// Lstat returns the info of name, without following a final symlink.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	_, _, fi, err := f.resolve("lstat", name, false)
+	return fi, err
+}
+
+// LstatLayer is like Lstat, and also returns the index of the top-most layer
+// with name, from the bottom layer.
+func (f *FS) LstatLayer(name string) (fs.FileInfo, int, error) {
+	_, idx, fi, err := f.resolve("lstat", name, false)
+	return fi, idx, err
+}
+
+// ReadLink returns the target of the symlink name.
+func (f *FS) ReadLink(name string) (string, error) {
+	name, idx, _, err := f.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	return readLink(f.layers[idx], name)
+}
+
+// ReadDir returns the merged entries of the directory name, sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	name, _, fi, err := f.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	return f.readDir(name)
+}
+
+func (f *FS) readDir(name string) ([]fs.DirEntry, error) {
+	var (
+		entries []fs.DirEntry
+		seen    = map[string]struct{}{}
+	)
+	for i := len(f.layers) - 1; i >= 0; i-- {
+		present, opaque, hidden, err := layerDir(f.layers[i], name)
+		if err != nil {
+			return nil, err
+		}
+		if hidden {
+			break
+		}
+		if present {
+			des, err := fs.ReadDir(f.layers[i], name)
+			if err != nil {
+				return nil, err
+			}
+			for _, de := range des {
+				if _, ok := seen[de.Name()]; ok {
+					continue
+				}
+				seen[de.Name()] = struct{}{}
+				if de.Type()&fs.ModeCharDevice != 0 {
+					if fi, err := de.Info(); err == nil && isWhiteout(fi) {
+						continue
+					}
+				}
+				entries = append(entries, de)
+			}
+		}
+		if opaque {
+			break
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+// Open opens name, following symlinks.  Directories list their merged
+// entries.
+func (f *FS) Open(name string) (fs.File, error) {
+	name, idx, fi, err := f.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return f.layers[idx].Open(name)
+	}
+	entries, err := f.readDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return &dir{info: fi, entries: entries}, nil
+}
+
+type dir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: syscall.EISDIR}
+}
+
+func (d *dir) Close() error { return nil }
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,305 @@
+// Package loop manages a pool of read-only loop devices for EROFS blobs: the
+// attachments of a blob share its loop device, the number of devices is
+// bounded, the detached devices are reused, and the devices leaked by a
+// previous daemon can be reclaimed.
+package loop
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/containerd/errdefs"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	controlPath   = "/dev/loop-control"
+	loopDevFormat = "/dev/loop%d"
+)
+
+type device struct {
+	path string
+	refs int
+}
+
+// Pool is a pool of loop devices.
+type Pool struct {
+	max     int
+	maxFree int
+	direct  bool
+
+	mu sync.Mutex
+	// devices are the attached devices by backing file
+	devices map[string]*device
+	// free are the detached devices kept for reuse
+	free []string
+}
+
+// Opt is an option of the pool.
+type Opt func(*Pool)
+
+// WithMaxDevices bounds the number of attached devices, unbounded if 0.
+func WithMaxDevices(n int) Opt {
+	return func(p *Pool) {
+		p.max = n
+	}
+}
+
+// WithMaxFree keeps up to n detached devices for reuse, instead of removing
+// them.
+func WithMaxFree(n int) Opt {
+	return func(p *Pool) {
+		p.maxFree = n
+	}
+}
+
+// WithDirectIO reads the backing files with direct I/O, bypassing the page
+// cache of the host filesystem.
+func WithDirectIO() Opt {
+	return func(p *Pool) {
+		p.direct = true
+	}
+}
+
+// NewPool returns an empty pool.
+func NewPool(opts ...Opt) *Pool {
+	p := &Pool{devices: map[string]*device{}}
+	for _, o := range opts {
+		o(p)
+	}
+	return p
+}
+
+// Attach returns the loop device of the blob at path, attached read-only, or
+// shared with the previous attachments.  It fails with ErrResourceExhausted
+// if the pool has its maximum number of devices.
+func (p *Pool) Attach(path string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if d, ok := p.devices[path]; ok {
+		d.refs++
+		return d.path, nil
+	}
+	if p.max > 0 && len(p.devices) >= p.max {
+		return "", fmt.Errorf("%d loop devices attached: %w", len(p.devices), errdefs.ErrResourceExhausted)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// A free device can be taken by another process meanwhile, as in
+	// util-linux
+	for range 100 {
+		dev, err := p.get()
+		if err != nil {
+			return "", err
+		}
+		err = p.configure(dev, f)
+		if errors.Is(err, unix.EBUSY) {
+			continue
+		}
+		if err != nil {
+			p.put(dev)
+			return "", fmt.Errorf("failed to attach %s to %s: %w", path, dev, err)
+		}
+		p.devices[path] = &device{path: dev, refs: 1}
+		return dev, nil
+	}
+	return "", fmt.Errorf("no free loop device for %s", path)
+}
+
+// Release releases an attachment of the blob at path, and detaches its loop
+// device once released as many times as attached.  A device still in use,
+// e.g. mounted, is detached by the kernel once unused.
+func (p *Pool) Release(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, ok := p.devices[path]
+	if !ok {
+		return nil
+	}
+	if d.refs--; d.refs > 0 {
+		return nil
+	}
+	delete(p.devices, path)
+	if err := detach(d.path); err != nil {
+		return err
+	}
+	p.put(d.path)
+	return nil
+}
+
+// Reclaim detaches the loop devices of the blobs in dir not attached by the
+// pool, e.g. leaked by a previous daemon, unless keep adopts them as attached
+// once.  It returns the numbers of devices adopted and detached.
+func (p *Pool) Reclaim(dir string, keep func(path, dev string) bool) (int, int, error) {
+	backings, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return 0, 0, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	attached := map[string]bool{}
+	for _, d := range p.devices {
+		attached[d.path] = true
+	}
+	var adopted, detached int
+	for _, b := range backings {
+		data, err := os.ReadFile(b)
+		if err != nil {
+			// Detached meanwhile
+			continue
+		}
+		dev := "/dev/" + filepath.Base(filepath.Dir(filepath.Dir(b)))
+		path, deleted := strings.CutSuffix(strings.TrimSpace(string(data)), " (deleted)")
+		if attached[dev] || !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			continue
+		}
+		if _, ok := p.devices[path]; !ok && !deleted && keep(path, dev) {
+			p.devices[path] = &device{path: dev, refs: 1}
+			adopted++
+			continue
+		}
+		if err := detach(dev); err != nil {
+			return adopted, detached, err
+		}
+		detached++
+	}
+	return adopted, detached, nil
+}
+
+// Prune detaches the loop devices of the blobs in dir which were deleted,
+// attached by the pool or not, e.g. of the snapshots removed while their
+// layer was mounted.  It returns the number of devices detached.
+func (p *Pool) Prune(dir string) (int, error) {
+	backings, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	attached := map[string]string{}
+	for path, d := range p.devices {
+		attached[d.path] = path
+	}
+	var detached int
+	for _, b := range backings {
+		data, err := os.ReadFile(b)
+		if err != nil {
+			continue
+		}
+		dev := "/dev/" + filepath.Base(filepath.Dir(filepath.Dir(b)))
+		path, deleted := strings.CutSuffix(strings.TrimSpace(string(data)), " (deleted)")
+		if !deleted || !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			continue
+		}
+		if err := detach(dev); err != nil {
+			return detached, err
+		}
+		if path, ok := attached[dev]; ok {
+			delete(p.devices, path)
+			p.put(dev)
+		}
+		detached++
+	}
+	return detached, nil
+}
+
+// Stats returns the numbers of attached and free devices.
+func (p *Pool) Stats() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.devices), len(p.free)
+}
+
+// get returns a free device of the pool, or a new one.  p.mu must be held.
+func (p *Pool) get() (string, error) {
+	if n := len(p.free); n > 0 {
+		dev := p.free[n-1]
+		p.free = p.free[:n-1]
+		return dev, nil
+	}
+	ctl, err := os.OpenFile(controlPath, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer ctl.Close()
+	n, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+	if err != nil {
+		return "", fmt.Errorf("no free loop device: %w", err)
+	}
+	return fmt.Sprintf(loopDevFormat, n), nil
+}
+
+// put keeps the detached device dev for reuse, or removes it.  p.mu must be
+// held.
+func (p *Pool) put(dev string) {
+	if len(p.free) < p.maxFree {
+		p.free = append(p.free, dev)
+		return
+	}
+	var n int
+	if _, err := fmt.Sscanf(dev, loopDevFormat, &n); err != nil {
+		return
+	}
+	if ctl, err := os.OpenFile(controlPath, os.O_RDWR, 0); err == nil {
+		// Busy until detached by the kernel if still in use
+		unix.IoctlSetInt(int(ctl.Fd()), unix.LOOP_CTL_REMOVE, n)
+		ctl.Close()
+	}
+}
+
+// configure attaches the backing file f to dev, read-only.
+func (p *Pool) configure(dev string, f *os.File) error {
+	loop, err := os.OpenFile(dev, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer loop.Close()
+	config := unix.LoopConfig{Fd: uint32(f.Fd())}
+	config.Info.Flags = unix.LO_FLAGS_READ_ONLY
+	if p.direct {
+		config.Info.Flags |= unix.LO_FLAGS_DIRECT_IO
+	}
+	copy(config.Info.File_name[:len(config.Info.File_name)-1], f.Name())
+	err = unix.IoctlLoopConfigure(int(loop.Fd()), &config)
+	if !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOTTY) {
+		return err
+	}
+
+	// Before Linux 5.8
+	if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(f.Fd())); err != nil {
+		return err
+	}
+	info := config.Info
+	info.Flags &^= unix.LO_FLAGS_DIRECT_IO
+	if err := unix.IoctlLoopSetStatus64(int(loop.Fd()), &info); err != nil {
+		unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+		return err
+	}
+	if p.direct {
+		if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_DIRECT_IO, 1); err != nil {
+			unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+			return err
+		}
+	}
+	return nil
+}
+
+// detach detaches dev, or lets the kernel detach it once unused.
+func detach(dev string) error {
+	loop, err := os.OpenFile(dev, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer loop.Close()
+	if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0); err != nil && !errors.Is(err, unix.ENXIO) {
+		return fmt.Errorf("failed to detach %s: %w", dev, err)
+	}
+	return nil
+}
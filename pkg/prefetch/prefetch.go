@@ -0,0 +1,135 @@
+// Package prefetch warms the host page cache with the EROFS layers of an
+// image, so that the first containers started from it don't have to wait
+// for cold reads.
+//
+// Either the whole layer blobs are read sequentially, or only the files of a
+// prefetch list, read through the mounted image.
+package prefetch
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/log"
+	"github.com/moby/sys/symlink"
+)
+
+// Stats summarizes a prefetch.
+type Stats struct {
+	Files    int           `json:"files"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Blobs returns the EROFS layer blobs backing mounts, as returned by the
+// erofs snapshotter: the source of erofs mounts, and the layer.erofs next to
+// every overlay lower directory.
+func Blobs(mounts []mount.Mount) []string {
+	var blobs []string
+	for _, m := range mounts {
+		switch m.Type {
+		case "erofs":
+			blobs = append(blobs, m.Source)
+		case "overlay":
+			for _, o := range m.Options {
+				lowers, ok := strings.CutPrefix(o, "lowerdir=")
+				if !ok {
+					continue
+				}
+				for _, l := range strings.Split(lowers, ":") {
+					blob := filepath.Join(filepath.Dir(l), "layer.erofs")
+					if _, err := os.Stat(blob); err == nil {
+						blobs = append(blobs, blob)
+					}
+				}
+			}
+		}
+	}
+	return blobs
+}
+
+// ReadFiles reads the files at paths sequentially, one after the other.
+func ReadFiles(ctx context.Context, paths []string) (Stats, error) {
+	var (
+		st    Stats
+		start = time.Now()
+	)
+	for _, p := range paths {
+		n, err := readFile(ctx, p)
+		if err != nil {
+			return st, err
+		}
+		st.Files++
+		st.Bytes += n
+	}
+	st.Duration = time.Since(start)
+	return st, nil
+}
+
+// ReadList reads the files of list, relative to the image mounted at root.
+// Symlinks are resolved within root, and missing or non-regular files are
+// skipped.
+func ReadList(ctx context.Context, root string, list []string) (Stats, error) {
+	var (
+		st    Stats
+		start = time.Now()
+	)
+	for _, name := range list {
+		p, err := symlink.FollowSymlinkInScope(filepath.Join(root, name), root)
+		if err != nil {
+			return st, err
+		}
+		fi, err := os.Stat(p)
+		if err != nil || !fi.Mode().IsRegular() {
+			log.G(ctx).WithError(err).Debugf("skipping %s", name)
+			continue
+		}
+		n, err := readFile(ctx, p)
+		if err != nil {
+			return st, err
+		}
+		st.Files++
+		st.Bytes += n
+	}
+	st.Duration = time.Since(start)
+	return st, nil
+}
+
+// ParseList parses a prefetch list: one path per line, blank lines and lines
+// starting with '#' are ignored.
+func ParseList(r io.Reader) ([]string, error) {
+	var list []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list = append(list, line)
+	}
+	return list, s.Err()
+}
+
+func readFile(ctx context.Context, path string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := io.Copy(io.Discard, f)
+	if err != nil {
+		return n, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	log.G(ctx).Debugf("prefetched %s (%d bytes)", path, n)
+	return n, nil
+}
@@ -0,0 +1,147 @@
+// Package quota limits the size of directories with the project quotas of XFS
+// and ext4: the files created in a directory of a project are accounted to
+// it, and can't exceed its limit.
+//
+// The filesystem must be mounted with project quotas, e.g. "prjquota" for XFS,
+// or have the "project" and "quota" features with "prjquota" for ext4.
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/containerd/errdefs"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// deviceFile is the block device of the filesystem, for quotactl
+	deviceFile = "backingFsBlockDev"
+
+	// include/uapi/linux/fs.h
+	iocFsGetXattr       = 0x801c581f // _IOR('X', 31, struct fsxattr)
+	iocFsSetXattr       = 0x401c5820 // _IOW('X', 32, struct fsxattr)
+	xflagProjectInherit = 0x200
+
+	// include/uapi/linux/quota.h, QCMD(cmd, PRJQUOTA) being cmd<<8|PRJQUOTA
+	prjQuota   = 2
+	qGetInfo   = 0x800005
+	qSetQuota  = 0x800008
+	qifBLimits = 1
+	blockSize  = 1024
+)
+
+// fsxattr is struct fsxattr.
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// dqblk is struct if_dqblk.
+type dqblk struct {
+	bhardlimit uint64
+	bsoftlimit uint64
+	curspace   uint64
+	ihardlimit uint64
+	isoftlimit uint64
+	curinodes  uint64
+	btime      uint64
+	itime      uint64
+	valid      uint32
+	_          uint32
+}
+
+// dqinfo is struct if_dqinfo.
+type dqinfo struct {
+	bgrace uint64
+	igrace uint64
+	flags  uint32
+	valid  uint32
+}
+
+// Control sets the project quotas of the filesystem of a directory.
+type Control struct {
+	dev string
+}
+
+// New returns the quota control of the filesystem of dir, which must have the
+// project quotas enabled.  It creates a device node of the filesystem in dir.
+func New(dir string) (*Control, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return nil, err
+	}
+	dev := filepath.Join(dir, deviceFile)
+	os.Remove(dev)
+	if err := unix.Mknod(dev, unix.S_IFBLK|0600, int(st.Dev)); err != nil {
+		return nil, fmt.Errorf("failed to create the device node of %s: %w", dir, err)
+	}
+	c := &Control{dev: dev}
+	var info dqinfo
+	if err := c.quotactl(qGetInfo, 0, unsafe.Pointer(&info)); err != nil {
+		os.Remove(dev)
+		if errors.Is(err, unix.ESRCH) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.ENOTBLK) {
+			err = fmt.Errorf("%w: the project quotas of %s aren't enabled: %w", err, dir, errdefs.ErrNotImplemented)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetProject accounts the directory dir, and the files created in it, to the
+// project id.
+func (c *Control) SetProject(dir string, id uint32) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var attr fsxattr
+	if err := ioctl(f, iocFsGetXattr, unsafe.Pointer(&attr)); err != nil {
+		return fmt.Errorf("failed to get the project of %s: %w", dir, err)
+	}
+	attr.projid = id
+	attr.xflags |= xflagProjectInherit
+	if err := ioctl(f, iocFsSetXattr, unsafe.Pointer(&attr)); err != nil {
+		return fmt.Errorf("failed to set the project of %s: %w", dir, err)
+	}
+	return nil
+}
+
+// SetLimit limits the size of the project id to size bytes, rounded up to
+// KiB, or removes its limit if 0.
+func (c *Control) SetLimit(id uint32, size uint64) error {
+	limit := (size + blockSize - 1) / blockSize
+	q := dqblk{bhardlimit: limit, bsoftlimit: limit, valid: qifBLimits}
+	if err := c.quotactl(qSetQuota, id, unsafe.Pointer(&q)); err != nil {
+		return fmt.Errorf("failed to set the quota of project %d: %w", id, err)
+	}
+	return nil
+}
+
+func (c *Control) quotactl(cmd int, id uint32, addr unsafe.Pointer) error {
+	dev, err := unix.BytePtrFromString(c.dev)
+	if err != nil {
+		return err
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, uintptr(cmd<<8|prjQuota), uintptr(unsafe.Pointer(dev)), uintptr(id), uintptr(addr), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func ioctl(f *os.File, req uint, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), uintptr(req), uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// Package reaper removes leftovers of crashed conversions: temporary layer
+// files and abandoned content store ingests.
+package reaper
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/log"
+	"golang.org/x/sys/unix"
+
+	"github.com/erofs/erofs-container-toolkit/pkg/converter"
+	"github.com/erofs/erofs-container-toolkit/pkg/delta"
+)
+
+// DefaultMaxAge is the default age after which leftovers are considered
+// stale.
+const DefaultMaxAge = 24 * time.Hour
+
+type options struct {
+	maxAge      time.Duration
+	tempDir     string
+	refPrefixes []string
+}
+
+type Opt func(o *options)
+
+// WithMaxAge sets the age after which leftovers are considered stale.
+func WithMaxAge(d time.Duration) Opt {
+	return func(o *options) {
+		o.maxAge = d
+	}
+}
+
+// WithTempDir sets the directory to look for temporary files in, which
+// defaults to os.TempDir().
+func WithTempDir(dir string) Opt {
+	return func(o *options) {
+		o.tempDir = dir
+	}
+}
+
+func newOptions(opts []Opt) options {
+	o := options{
+		maxAge:      DefaultMaxAge,
+		tempDir:     os.TempDir(),
+		refPrefixes: []string{converter.IngestRefPrefix, delta.IngestRefPrefix},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Result reports what was reaped.
+type Result struct {
+	Files   []string
+	Ingests []string
+}
+
+// isOrphaned checks if no live process holds the lock taken by the
+// converter on its temporary files.
+func isOrphaned(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB) == nil
+}
+
+// ReapTempFiles removes stale temporary layer files.
+func ReapTempFiles(ctx context.Context, opts ...Opt) ([]string, error) {
+	o := newOptions(opts)
+	matches, err := filepath.Glob(filepath.Join(o.tempDir, converter.TempFilePrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		reaped []string
+		errs   []error
+	)
+	deadline := time.Now().Add(-o.maxAge)
+	for _, path := range matches {
+		fi, err := os.Lstat(path)
+		if err != nil || !fi.Mode().IsRegular() || fi.ModTime().After(deadline) {
+			continue
+		}
+		if !isOrphaned(path) {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+			continue
+		}
+		log.G(ctx).WithField("path", path).Info("removed stale temporary file")
+		reaped = append(reaped, path)
+	}
+	return reaped, errors.Join(errs...)
+}
+
+// ReapIngests aborts stale content store ingests started by the converter.
+func ReapIngests(ctx context.Context, cs content.Store, opts ...Opt) ([]string, error) {
+	o := newOptions(opts)
+	statuses, err := cs.ListStatuses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		reaped []string
+		errs   []error
+	)
+	deadline := time.Now().Add(-o.maxAge)
+	for _, st := range statuses {
+		if !hasAnyPrefix(st.Ref, o.refPrefixes) || st.UpdatedAt.After(deadline) {
+			continue
+		}
+		if err := cs.Abort(ctx, st.Ref); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.G(ctx).WithField("ref", st.Ref).Info("aborted stale ingest")
+		reaped = append(reaped, st.Ref)
+	}
+	return reaped, errors.Join(errs...)
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reap removes both stale temporary files and stale ingests of cs, which
+// may be nil.
+func Reap(ctx context.Context, cs content.Store, opts ...Opt) (Result, error) {
+	var (
+		res  Result
+		errs []error
+		err  error
+	)
+	res.Files, err = ReapTempFiles(ctx, opts...)
+	errs = append(errs, err)
+	if cs != nil {
+		res.Ingests, err = ReapIngests(ctx, cs, opts...)
+		errs = append(errs, err)
+	}
+	return res, errors.Join(errs...)
+}
+
+// Run calls fn every interval until ctx is done, starting immediately.
+func Run(ctx context.Context, interval time.Duration, fn func(context.Context) error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := fn(ctx); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to reap stale conversion leftovers")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
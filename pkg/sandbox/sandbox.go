@@ -0,0 +1,312 @@
+// Package sandbox runs mkfs.erofs, which parses untrusted tar streams, in a
+// sandbox: as a separate user or in a user namespace, with no new privileges,
+// a seccomp filter and resource limits.
+//
+// Install puts a mkfs.erofs shim, the current executable, first in PATH, so
+// that all the mkfs.erofs invocations of the process are sandboxed, including
+// those of libraries.  The executable must call Main first in its main.
+package sandbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	mkfsName = "mkfs.erofs"
+
+	// configEnv passes the sandbox to the shim
+	configEnv = "EROFS_SANDBOX"
+	// initEnv marks the sandboxed process, before it runs mkfs.erofs
+	initEnv = "EROFS_SANDBOX_INIT"
+
+	// shortArgOpts are the short options of mkfs.erofs which take a value.
+	shortArgOpts = "CELTUbdxz"
+)
+
+// Config is the sandbox of mkfs.erofs.
+type Config struct {
+	// User runs mkfs.erofs as this user, a name or "uid[:gid]", instead of
+	// the user of the process
+	User string `json:"user,omitempty"`
+	// UserNamespace runs mkfs.erofs as root of a new user namespace, mapped
+	// to User which is required
+	UserNamespace bool `json:"userNamespace,omitempty"`
+	NoNewPrivs    bool `json:"noNewPrivs,omitempty"`
+	// Seccomp denies the system calls mkfs.erofs doesn't need, e.g. mount,
+	// ptrace or socket.  It implies NoNewPrivs.
+	Seccomp bool `json:"seccomp,omitempty"`
+	// Rlimits are the resource limits, by name, e.g. "as", "cpu", "fsize",
+	// "nofile" or "nproc"
+	Rlimits map[string]uint64 `json:"rlimits,omitempty"`
+}
+
+var rlimits = map[string]int{
+	"as":      unix.RLIMIT_AS,
+	"core":    unix.RLIMIT_CORE,
+	"cpu":     unix.RLIMIT_CPU,
+	"data":    unix.RLIMIT_DATA,
+	"fsize":   unix.RLIMIT_FSIZE,
+	"memlock": unix.RLIMIT_MEMLOCK,
+	"nofile":  unix.RLIMIT_NOFILE,
+	"nproc":   unix.RLIMIT_NPROC,
+	"stack":   unix.RLIMIT_STACK,
+}
+
+// state is the sandbox passed to the shim.
+type state struct {
+	Config
+	// Mkfs is the path of the real mkfs.erofs
+	Mkfs string `json:"mkfs"`
+	UID  int    `json:"uid"`
+	GID  int    `json:"gid"`
+}
+
+// Install sandboxes the mkfs.erofs invocations of the process as c, by putting
+// a mkfs.erofs shim in dir first in PATH.
+func Install(dir string, c Config) error {
+	s := state{Config: c, UID: -1, GID: -1}
+	if c.User != "" {
+		var err error
+		if s.UID, s.GID, err = lookupUser(c.User); err != nil {
+			return err
+		}
+	} else if c.UserNamespace {
+		return errors.New("a user namespace requires a user to map")
+	}
+	for name := range c.Rlimits {
+		if _, ok := rlimits[name]; !ok {
+			return fmt.Errorf("unknown rlimit %q", name)
+		}
+	}
+	if c.Seccomp {
+		if _, err := seccompFilter(); err != nil {
+			return err
+		}
+	}
+
+	mkfs, err := exec.LookPath(mkfsName)
+	if err != nil {
+		return err
+	}
+	if s.Mkfs, err = filepath.Abs(mkfs); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	shim := filepath.Join(dir, mkfsName)
+	if err := os.RemoveAll(shim); err != nil {
+		return err
+	}
+	if err := os.Symlink(exe, shim); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.Setenv(configEnv, string(b)); err != nil {
+		return err
+	}
+	return os.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+}
+
+// lookupUser returns the ids of the user name or "uid[:gid]".
+func lookupUser(name string) (int, int, error) {
+	uid, gid, hasGID := strings.Cut(name, ":")
+	if u, err := strconv.Atoi(uid); err == nil {
+		g := u
+		if hasGID {
+			if g, err = strconv.Atoi(gid); err != nil {
+				return 0, 0, fmt.Errorf("invalid gid %q", gid)
+			}
+		}
+		return u, g, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	uidN, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	gidN, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uidN, gidN, nil
+}
+
+// Main runs the mkfs.erofs shim, or mkfs.erofs in the sandbox, if the process
+// is one of them, and exits.  It returns otherwise.
+func Main() {
+	if os.Getenv(initEnv) != "" {
+		runInit()
+	}
+	if filepath.Base(os.Args[0]) == mkfsName && os.Getenv(configEnv) != "" {
+		os.Exit(runShim())
+	}
+}
+
+func loadState() (*state, error) {
+	var s state
+	if err := json.Unmarshal([]byte(os.Getenv(configEnv)), &s); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", configEnv, err)
+	}
+	return &s, nil
+}
+
+// runShim runs the executable again in the sandbox, as the user or user
+// namespace of the sandbox, to run mkfs.erofs.  The output image is owned by
+// the user of the sandbox while mkfs.erofs writes it.
+func runShim() int {
+	s, err := loadState()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mkfs.erofs sandbox: %v\n", err)
+		return 1
+	}
+
+	cmd := exec.Command("/proc/self/exe", os.Args[1:]...)
+	cmd.Args[0] = mkfsName
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), initEnv+"=1")
+	// mkfs.erofs is killed with the shim, e.g. when its caller gives up
+	attr := &unix.SysProcAttr{Pdeathsig: unix.SIGKILL}
+	switch {
+	case s.UserNamespace:
+		attr.Cloneflags = unix.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: s.UID, Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: s.GID, Size: 1}}
+		// Switch to the mapped root, the ids of the shim aren't mapped
+		attr.Credential = &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: true}
+	case s.User != "":
+		attr.Credential = &syscall.Credential{Uid: uint32(s.UID), Gid: uint32(s.GID), Groups: []uint32{}}
+	}
+	cmd.SysProcAttr = attr
+
+	// mkfs.erofs writes the output image through its descriptor, as the
+	// user of the sandbox may not have access to its directory
+	if i := outputArg(cmd.Args[1:]); i >= 0 && s.User != "" {
+		f, err := os.OpenFile(cmd.Args[i+1], os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mkfs.erofs sandbox: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		if err := f.Chown(s.UID, s.GID); err != nil {
+			fmt.Fprintf(os.Stderr, "mkfs.erofs sandbox: %v\n", err)
+			return 1
+		}
+		defer f.Chown(os.Getuid(), os.Getgid())
+		cmd.ExtraFiles = []*os.File{f}
+		cmd.Args[i+1] = "/proc/self/fd/3"
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, unix.SIGTERM, unix.SIGINT)
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "mkfs.erofs sandbox: %v\n", err)
+		return 1
+	}
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return exitErr.ExitCode()
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "mkfs.erofs sandbox: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runInit restricts the process and executes mkfs.erofs.
+func runInit() {
+	s, err := loadState()
+	if err == nil {
+		// No new privileges and seccomp apply to the thread executing
+		runtime.LockOSThread()
+		err = s.restrict()
+	}
+	if err == nil {
+		var env []string
+		for _, e := range os.Environ() {
+			if !strings.HasPrefix(e, configEnv+"=") && !strings.HasPrefix(e, initEnv+"=") {
+				env = append(env, e)
+			}
+		}
+		err = unix.Exec(s.Mkfs, append([]string{mkfsName}, os.Args[1:]...), env)
+	}
+	fmt.Fprintf(os.Stderr, "mkfs.erofs sandbox: %v\n", err)
+	os.Exit(1)
+}
+
+func (s *state) restrict() error {
+	for name, limit := range s.Rlimits {
+		resource, ok := rlimits[name]
+		if !ok {
+			return fmt.Errorf("unknown rlimit %q", name)
+		}
+		if err := unix.Setrlimit(resource, &unix.Rlimit{Cur: limit, Max: limit}); err != nil {
+			return fmt.Errorf("failed to set rlimit %s: %w", name, err)
+		}
+	}
+	if s.NoNewPrivs || s.Seccomp {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to set no new privileges: %w", err)
+		}
+	}
+	if s.Seccomp {
+		return loadSeccomp()
+	}
+	return nil
+}
+
+// outputArg returns the index of the output image in the mkfs.erofs args, its
+// first operand, or -1 if none.  Long options must have their value after
+// "=".
+func outputArg(args []string) int {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "--":
+			if i+1 < len(args) {
+				return i + 1
+			}
+			return -1
+		case len(a) == 2 && a[0] == '-' && strings.IndexByte(shortArgOpts, a[1]) >= 0:
+			i++
+		case strings.HasPrefix(a, "-") && a != "-":
+		default:
+			return i
+		}
+	}
+	return -1
+}
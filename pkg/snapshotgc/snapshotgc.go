@@ -0,0 +1,227 @@
+// Package snapshotgc finds the EROFS snapshotter directories which are left
+// behind by crashes: directories unknown to the snapshotter metadata, and
+// snapshots which containerd no longer knows about, along with their
+// layer mounts.
+//
+// The snapshotter metadata is read from its database, opened read-only: it
+// can't be read while the snapshotter is running, which keeps it locked.
+package snapshotgc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/log"
+	"github.com/moby/sys/mountinfo"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultRoot is the root directory of the containerd-erofs-grpc
+	// snapshotter.
+	DefaultRoot = "/var/lib/containerd-erofs/snapshotter"
+	// DefaultMinAge is the default minimum age of orphaned directories.
+	DefaultMinAge = time.Hour
+
+	// lockTimeout is how long to wait for the snapshotter to release its
+	// database
+	lockTimeout = time.Second
+)
+
+// ErrLocked is returned by Scan if the snapshotter metadata is locked, by a
+// running snapshotter.
+var ErrLocked = errors.New("the snapshotter metadata is locked, the snapshotter may be running")
+
+// Reason tells why a snapshot directory is orphaned.
+type Reason string
+
+const (
+	// ReasonUntracked is a directory without snapshotter metadata, e.g.
+	// from a crash while creating or removing a snapshot.
+	ReasonUntracked Reason = "untracked"
+	// ReasonUnreferenced is a snapshot which containerd doesn't know about,
+	// e.g. from a crash of containerd while creating it.
+	ReasonUnreferenced Reason = "unreferenced"
+)
+
+// Orphan is an orphaned snapshot directory.
+type Orphan struct {
+	// ID is the directory name under the snapshots directory
+	ID     string `json:"id"`
+	Path   string `json:"path"`
+	Reason Reason `json:"reason"`
+	// Key is the snapshotter key of an unreferenced snapshot
+	Key string `json:"key,omitempty"`
+	// Mounts are the mountpoints in the directory
+	Mounts  []string  `json:"mounts,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// KnownFunc tells if containerd knows the snapshot with the given
+// snapshotter key.
+type KnownFunc func(key string) bool
+
+// IDsFunc returns the snapshot IDs of the snapshotter metadata mapped to
+// their keys.
+type IDsFunc func(ctx context.Context) (map[string]string, error)
+
+// Scan returns the orphaned directories under root which are older than
+// minAge.  known is checked for every snapshot of the snapshotter metadata,
+// which is read from its database.  It fails with ErrLocked if the
+// snapshotter is running.
+func Scan(ctx context.Context, root string, known KnownFunc, minAge time.Duration) ([]Orphan, error) {
+	return ScanIDs(ctx, root, func(ctx context.Context) (map[string]string, error) {
+		return readIDMap(ctx, filepath.Join(root, "metadata.db"))
+	}, known, minAge)
+}
+
+// ScanIDs is Scan with the snapshotter metadata read by ids, e.g. from the
+// metadata store of the running snapshotter, which must not create nor
+// remove snapshots meanwhile.
+func ScanIDs(ctx context.Context, root string, ids IDsFunc, known KnownFunc, minAge time.Duration) ([]Orphan, error) {
+	snapshotDir := filepath.Join(root, "snapshots")
+	// List the directories first so that snapshots created meanwhile are
+	// in the metadata read
+	entries, err := os.ReadDir(snapshotDir)
+	if err != nil {
+		return nil, err
+	}
+	idMap, err := ids(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the snapshotter metadata: %w", err)
+	}
+	mounts, err := mountinfo.GetMounts(mountinfo.PrefixFilter(snapshotDir))
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []Orphan
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		o := Orphan{ID: e.Name(), Path: filepath.Join(snapshotDir, e.Name())}
+		if key, ok := idMap[o.ID]; !ok {
+			o.Reason = ReasonUntracked
+		} else if !known(key) {
+			o.Reason, o.Key = ReasonUnreferenced, key
+		} else {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		o.ModTime = fi.ModTime()
+		if time.Since(o.ModTime) < minAge {
+			log.G(ctx).Debugf("skipping recent %s snapshot directory %s", o.Reason, o.Path)
+			continue
+		}
+		for _, m := range mounts {
+			if m.Mountpoint == o.Path || strings.HasPrefix(m.Mountpoint, o.Path+"/") {
+				o.Mounts = append(o.Mounts, m.Mountpoint)
+			}
+		}
+		o.Size = dirSize(o.Path)
+		orphans = append(orphans, o)
+	}
+	return orphans, nil
+}
+
+// Remove unmounts the mountpoints of o and removes its directory.
+func Remove(ctx context.Context, o Orphan) error {
+	for _, m := range o.Mounts {
+		if err := mount.UnmountAll(m, unix.MNT_DETACH); err != nil {
+			return fmt.Errorf("failed to unmount %s: %w", m, err)
+		}
+	}
+	// Committed layer blobs may be immutable
+	blob := filepath.Join(o.Path, "layer.erofs")
+	if _, err := os.Stat(blob); err == nil {
+		if err := clearImmutable(blob); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to clear the immutable flag of %s", blob)
+		}
+	}
+	if err := os.RemoveAll(o.Path); err != nil {
+		return err
+	}
+	log.G(ctx).WithField("path", o.Path).Debugf("removed %s snapshot directory", o.Reason)
+	return nil
+}
+
+// readIDMap returns the snapshot IDs mapped to their keys from the
+// snapshotter database, opened read-only.  It fails with ErrLocked if the
+// database is locked.
+func readIDMap(ctx context.Context, dbfile string) (map[string]string, error) {
+	ms, err := storage.NewMetaStore(dbfile, func(o *bolt.Options) error {
+		o.ReadOnly = true
+		o.Timeout = lockTimeout
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer ms.Close()
+	var ids map[string]string
+	err = ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		ids, err = storage.IDMap(ctx)
+		return err
+	})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, ErrLocked
+	}
+	return ids, err
+}
+
+func clearImmutable(path string) error {
+	const fsImmutableFl = 0x10
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	attr, err := unix.IoctlGetInt(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return err
+	}
+	if attr&fsImmutableFl == 0 {
+		return nil
+	}
+	return unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, attr&^fsImmutableFl)
+}
+
+// dirSize returns the disk usage of the files under dir, without crossing
+// mountpoints.
+func dirSize(dir string) int64 {
+	var (
+		size int64
+		dev  uint64
+	)
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		if path == dir {
+			dev = uint64(st.Dev)
+		} else if uint64(st.Dev) != dev {
+			return filepath.SkipDir
+		}
+		size += int64(st.Blocks) * 512
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,183 @@
+// Package verity computes the fs-verity digests and dm-verity root hashes of
+// EROFS blobs in userspace, so that they can be recorded at conversion time
+// and checked later without kernel support.
+//
+// Both use SHA-256 with 4096-byte blocks and no salt.  dm-verity root hashes
+// are those of the format version 1 hash tree, as set up by
+// "veritysetup format --salt=- <data> <hash>".
+package verity
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// AnnotationFsverityDigest is the fs-verity file digest of a blob, as
+	// reported by "fsverity digest" (e.g. "sha256:...").
+	AnnotationFsverityDigest = "io.github.erofs.fsverity.digest"
+	// AnnotationDmVerityRootHash is the hex dm-verity root hash of a blob.
+	AnnotationDmVerityRootHash = "io.github.erofs.dm-verity.root-hash"
+
+	// BlockSize is the data and hash block size.
+	BlockSize = 4096
+
+	hashesPerBlock = BlockSize / sha256.Size
+
+	fsverityHashAlgSHA256 = 1
+	fsverityLogBlockSize  = 12
+)
+
+var (
+	// ErrUnaligned is returned for dm-verity if the data size isn't a
+	// multiple of BlockSize.
+	ErrUnaligned = errors.New("data size is not a multiple of the block size")
+	// ErrNoAnnotation is returned by Verify if no verity annotation is
+	// recorded.
+	ErrNoAnnotation = errors.New("no verity annotation")
+)
+
+// merkleRoot returns the root hash of the Merkle tree of the data in r, and
+// the data size.  Blocks (including the last data block) are zero-padded.
+func merkleRoot(r io.Reader) ([]byte, int64, error) {
+	var (
+		level [][]byte
+		size  int64
+		buf   = make([]byte, BlockSize)
+	)
+	hashBlock := func(b []byte) []byte {
+		sum := sha256.Sum256(b)
+		return sum[:]
+	}
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			clear(buf[n:])
+			level = append(level, hashBlock(buf))
+			size += int64(n)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(level) == 0 {
+		return make([]byte, sha256.Size), 0, nil
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += hashesPerBlock {
+			clear(buf)
+			for j, h := range level[i:min(i+hashesPerBlock, len(level))] {
+				copy(buf[j*sha256.Size:], h)
+			}
+			next = append(next, hashBlock(buf))
+		}
+		level = next
+	}
+	return level[0], size, nil
+}
+
+// FsverityDigest returns the fs-verity file digest of the data in r.
+func FsverityDigest(r io.Reader) (digest.Digest, error) {
+	root, size, err := merkleRoot(r)
+	if err != nil {
+		return "", err
+	}
+	// struct fsverity_descriptor
+	var desc [256]byte
+	desc[0] = 1 // version
+	desc[1] = fsverityHashAlgSHA256
+	desc[2] = fsverityLogBlockSize
+	binary.LittleEndian.PutUint64(desc[8:], uint64(size))
+	copy(desc[16:], root)
+	sum := sha256.Sum256(desc[:])
+	return digest.NewDigestFromBytes(digest.SHA256, sum[:]), nil
+}
+
+// DmVerityRootHash returns the hex dm-verity root hash of the size bytes of
+// data in r.
+func DmVerityRootHash(r io.Reader, size int64) (string, error) {
+	if size%BlockSize != 0 {
+		return "", ErrUnaligned
+	}
+	root, n, err := merkleRoot(io.LimitReader(r, size))
+	if err != nil {
+		return "", err
+	}
+	if n != size {
+		return "", fmt.Errorf("short read: %d of %d bytes", n, size)
+	}
+	return hex.EncodeToString(root), nil
+}
+
+// Annotations computes the verity annotations of the size bytes in r.  The
+// dm-verity root hash is left out for unaligned data.
+func Annotations(r io.ReaderAt, size int64) (map[string]string, error) {
+	fsd, err := FsverityDigest(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	a := map[string]string{AnnotationFsverityDigest: fsd.String()}
+	root, err := DmVerityRootHash(io.NewSectionReader(r, 0, size), size)
+	if err == nil {
+		a[AnnotationDmVerityRootHash] = root
+	} else if !errors.Is(err, ErrUnaligned) {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Mismatch is a verity annotation which doesn't match the data.
+type Mismatch struct {
+	Annotation string `json:"annotation"`
+	Expected   string `json:"expected"`
+	Actual     string `json:"actual"`
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("%s: expected %s, got %s", m.Annotation, m.Expected, m.Actual)
+}
+
+// Verify recomputes the verity digests recorded in annotations for the size
+// bytes in r, and returns the mismatches.  It fails with ErrNoAnnotation if
+// none is recorded.
+func Verify(r io.ReaderAt, size int64, annotations map[string]string) ([]Mismatch, error) {
+	expected := map[string]string{}
+	for _, k := range []string{AnnotationFsverityDigest, AnnotationDmVerityRootHash} {
+		if v, ok := annotations[k]; ok {
+			expected[k] = v
+		}
+	}
+	if len(expected) == 0 {
+		return nil, ErrNoAnnotation
+	}
+	var mismatches []Mismatch
+	if v, ok := expected[AnnotationFsverityDigest]; ok {
+		d, err := FsverityDigest(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return nil, err
+		}
+		if d.String() != v {
+			mismatches = append(mismatches, Mismatch{AnnotationFsverityDigest, v, d.String()})
+		}
+	}
+	if v, ok := expected[AnnotationDmVerityRootHash]; ok {
+		root, err := DmVerityRootHash(io.NewSectionReader(r, 0, size), size)
+		if err != nil {
+			return nil, err
+		}
+		if root != v {
+			mismatches = append(mismatches, Mismatch{AnnotationDmVerityRootHash, v, root})
+		}
+	}
+	return mismatches, nil
+}
@@ -0,0 +1,81 @@
+package verity
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// pattern returns n bytes counting from 0 to 255 over and over.
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+// The expected root hashes of dm-verity were produced by libcryptsetup 2.6.1,
+// the library under veritysetup, as by
+//
+//	veritysetup format --no-superblock --salt=- data hash
+//
+// The digest of fs-verity of the empty file is the one of fsverity-utils.  The
+// other digests of fs-verity are the SHA-256 of the fsverity_descriptor built
+// around the root hash libcryptsetup gives for the data padded with zeroes to
+// a whole block, both trees being the same without salt.
+
+func TestFsverityDigest(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		size     int
+		expected digest.Digest
+	}{
+		{name: "empty", size: 0, expected: "sha256:3d248ca542a24fc62d1c43b916eae5016878e2533c88238480b26128a1f1af95"},
+		{name: "one block", size: BlockSize, expected: "sha256:15a0095100272ab90a2209e97f8a2c54dff6f84d2b29524f95d92fe23b6ef25b"},
+		{name: "partial last block", size: BlockSize + 904, expected: "sha256:c618e9f29a00583f67043799d7ff594d53820a4ab41e5975e9de621ad9c3bf01"},
+		{name: "two levels", size: 129 * BlockSize, expected: "sha256:c9263d6ca4271250c808937ec888e17b08546dc97634f6e98f30b3436ac2e3da"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := FsverityDigest(bytes.NewReader(pattern(tc.size)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d != tc.expected {
+				t.Fatalf("digest %s, expected %s", d, tc.expected)
+			}
+		})
+	}
+}
+
+func TestDmVerityRootHash(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		size     int
+		expected string
+	}{
+		{name: "one block", size: BlockSize, expected: "c8f5d0341d54d951a71b136e6e2afcb14d11ed8489a7ae126a8fee0df6ecf193"},
+		{name: "two levels", size: 129 * BlockSize, expected: "f75ccba5413a3a7570545509f41f3fc6e5b6292a6783ed0b698a90e28131aaec"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := DmVerityRootHash(bytes.NewReader(pattern(tc.size)), int64(tc.size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h != tc.expected {
+				t.Fatalf("root hash %s, expected %s", h, tc.expected)
+			}
+		})
+	}
+
+	// veritysetup can't format an empty device, and a partial last block
+	// can't be mapped
+	if _, err := DmVerityRootHash(bytes.NewReader(pattern(BlockSize+904)), BlockSize+904); !errors.Is(err, ErrUnaligned) {
+		t.Fatalf("expected ErrUnaligned for a partial last block, got %v", err)
+	}
+	if _, err := DmVerityRootHash(bytes.NewReader(pattern(BlockSize-1)), BlockSize); err == nil {
+		t.Fatal("expected a short read to fail")
+	}
+}